@@ -0,0 +1,344 @@
+// Dsctl inspects and edits the entities of a Cloud Datastore database, or of
+// the emulator when DATASTORE_EMULATOR_HOST is set.
+//
+// Usage:
+//
+//	dsctl [flags] <command> [arguments]
+//
+// The commands are:
+//
+//	kinds                         list the kinds of the namespace
+//	query [query flags] KIND      print the entities of a kind
+//	count [query flags] KIND      count the entities of a kind
+//	get KEY...                    print entities by key
+//	put KEY JSON                  store an entity given as a JSON object
+//	delete KEY...                 delete entities by key
+//
+// Keys are key paths as printed by the driver, such as 'Zoo:"north"/Animal:42'
+// where names are quoted and IDs are not, or encoded keys. The query flags
+// are -filter, repeated and combined with AND, as in -filter 'Legs>=4' or
+// -filter 'Name in ["cat","dog"]'; -order, repeated, a minus sign sorting
+// in descending order; -limit; and -ancestor.
+//
+// The project is taken from -project, then DATASTORE_PROJECT_ID, then the
+// credentials. To inspect the emulator of datastore-emulator/docker-compose.yml:
+//
+//	DATASTORE_EMULATOR_HOST=localhost:8081 dsctl -project my-project kinds
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+	ds "github.com/marjau/cloud/gcp/datastore"
+)
+
+const usage = `usage: dsctl [flags] <command> [arguments]
+
+Commands:
+  kinds                         list the kinds of the namespace
+  query [query flags] KIND      print the entities of a kind
+  count [query flags] KIND      count the entities of a kind
+  get KEY...                    print entities by key
+  put KEY JSON                  store an entity given as a JSON object
+  delete KEY...                 delete entities by key
+
+Flags:
+`
+
+// errUsage reports invalid arguments, once the usage was printed.
+var errUsage = errors.New("invalid arguments")
+
+func main() {
+	err := run(context.Background(), os.Args[1:], os.Stdout, os.Stderr)
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+	case errors.Is(err, errUsage):
+		os.Exit(2)
+	default:
+		fmt.Fprintln(os.Stderr, "dsctl:", err)
+		os.Exit(1)
+	}
+}
+
+// command is a parsed command line.
+type command struct {
+	driver ds.Driver
+	out    output
+	args   []string
+	stderr io.Writer
+}
+
+var commands = map[string]func(ctx context.Context, c *command) error{
+	"kinds":  kinds,
+	"query":  query,
+	"count":  count,
+	"get":    get,
+	"put":    put,
+	"delete": del,
+}
+
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("dsctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	project := fs.String("project", os.Getenv("DATASTORE_PROJECT_ID"), "project `ID`")
+	database := fs.String("database", "", "database `ID`, the default database when empty")
+	namespace := fs.String("namespace", "", "`namespace` of the keys and queries")
+	format := fs.String("output", "table", "output `format`: table, json or ndjson")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+	name := fs.Arg(0)
+	f, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "dsctl: unknown command %q\n", name)
+		fs.Usage()
+		return errUsage
+	}
+	out, err := newOutput(*format, stdout)
+	if err != nil {
+		fmt.Fprintln(stderr, "dsctl:", err)
+		fs.Usage()
+		return errUsage
+	}
+
+	if *project == "" {
+		*project = datastore.DetectProjectID
+	}
+	d, err := ds.NewDriver(ctx, *project, ds.WithDatabase(*database))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if *namespace != "" {
+		d = ds.NewNamespaceDriver(d, *namespace)
+	}
+	return f(ctx, &command{driver: d, out: out, args: fs.Args()[1:], stderr: stderr})
+}
+
+// parse parses the flags of a command, which may come before or after its
+// arguments, and returns the arguments.
+func (c *command) parse(fs *flag.FlagSet, usage string, min, max int) ([]string, error) {
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(c.stderr, "usage: dsctl %s %s\n", fs.Name(), usage)
+		fs.PrintDefaults()
+	}
+	var args []string
+	rest := c.args
+	for {
+		if err := fs.Parse(rest); err != nil {
+			return nil, errUsage
+		}
+		rest = fs.Args()
+		if len(rest) == 0 {
+			break
+		}
+		args, rest = append(args, rest[0]), rest[1:]
+	}
+	if len(args) < min || max >= 0 && len(args) > max {
+		fs.Usage()
+		return nil, errUsage
+	}
+	return args, nil
+}
+
+func kinds(ctx context.Context, c *command) error {
+	if _, err := c.parse(flag.NewFlagSet("kinds", flag.ContinueOnError), "", 0, 0); err != nil {
+		return err
+	}
+	kinds, err := ds.Kinds(ctx, c.driver, "")
+	if err != nil {
+		return err
+	}
+	return c.out.strings(kinds)
+}
+
+// queryFlags are the flags of the commands running a query.
+type queryFlags struct {
+	filters  stringsFlag
+	orders   stringsFlag
+	limit    int
+	ancestor string
+}
+
+func (qf *queryFlags) register(fs *flag.FlagSet, ordered bool) {
+	fs.Var(&qf.filters, "filter", "`filter` such as 'Legs>=4', repeated filters are combined with AND")
+	fs.StringVar(&qf.ancestor, "ancestor", "", "only the entities under the ancestor `key`")
+	if ordered {
+		fs.Var(&qf.orders, "order", "sort `property`, descending when prefixed with a minus sign")
+		fs.IntVar(&qf.limit, "limit", 0, "maximum `number` of entities, unlimited when zero")
+	}
+}
+
+func (qf *queryFlags) query(kind string) (*ds.Query, error) {
+	q := ds.NewQuery(kind)
+	for _, f := range qf.filters {
+		filter, err := parseFilter(f)
+		if err != nil {
+			return nil, err
+		}
+		q = q.Filter(filter)
+	}
+	if len(qf.orders) > 0 {
+		q = q.Order(qf.orders...)
+	}
+	if qf.limit > 0 {
+		q = q.Limit(qf.limit)
+	}
+	if qf.ancestor != "" {
+		ancestor, err := ds.ParseKey(qf.ancestor)
+		if err != nil {
+			return nil, err
+		}
+		q = q.Ancestor(ancestor)
+	}
+	return q, q.Validate()
+}
+
+func query(ctx context.Context, c *command) error {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	var qf queryFlags
+	qf.register(fs, true)
+	args, err := c.parse(fs, "[-filter FILTER]... [-order PROPERTY]... [-limit N] [-ancestor KEY] KIND", 1, 1)
+	if err != nil {
+		return err
+	}
+	q, err := qf.query(args[0])
+	if err != nil {
+		return err
+	}
+	it, err := c.driver.Find(ctx, q)
+	if err != nil {
+		return err
+	}
+	keys, entities, err := readAll(it)
+	if err != nil {
+		return err
+	}
+	return c.out.entities(keys, entities)
+}
+
+func count(ctx context.Context, c *command) error {
+	fs := flag.NewFlagSet("count", flag.ContinueOnError)
+	var qf queryFlags
+	qf.register(fs, false)
+	args, err := c.parse(fs, "[-filter FILTER]... [-ancestor KEY] KIND", 1, 1)
+	if err != nil {
+		return err
+	}
+	q, err := qf.query(args[0])
+	if err != nil {
+		return err
+	}
+	n, err := c.driver.Count(ctx, q)
+	if err != nil {
+		return err
+	}
+	return c.out.count(n)
+}
+
+func parseKeys(args []string) ([]*datastore.Key, error) {
+	keys := make([]*datastore.Key, len(args))
+	for i, arg := range args {
+		var err error
+		if keys[i], err = ds.ParseKey(arg); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// get prints the entities found, then reports those that are missing.
+func get(ctx context.Context, c *command) error {
+	args, err := c.parse(flag.NewFlagSet("get", flag.ContinueOnError), "KEY...", 1, -1)
+	if err != nil {
+		return err
+	}
+	keys, err := parseKeys(args)
+	if err != nil {
+		return err
+	}
+	entities := make([]datastore.PropertyList, len(keys))
+	err = c.driver.GetMulti(ctx, keys, entities)
+	var me datastore.MultiError
+	if err != nil && !errors.As(err, &me) {
+		return err
+	}
+	var foundKeys []*datastore.Key
+	var found []datastore.PropertyList
+	var missing []string
+	for i, k := range keys {
+		if me != nil && me[i] != nil {
+			missing = append(missing, fmt.Sprintf("%s: %v", ds.FormatKey(k), me[i]))
+			continue
+		}
+		foundKeys = append(foundKeys, k)
+		found = append(found, entities[i])
+	}
+	if err := c.out.entities(foundKeys, found); err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return errors.New(strings.Join(missing, "; "))
+	}
+	return nil
+}
+
+func put(ctx context.Context, c *command) error {
+	args, err := c.parse(flag.NewFlagSet("put", flag.ContinueOnError), `KEY '{"Property": value, ...}'`, 2, 2)
+	if err != nil {
+		return err
+	}
+	key, err := ds.ParseKey(args[0])
+	if err != nil {
+		return err
+	}
+	props, err := parseEntity(args[1])
+	if err != nil {
+		return err
+	}
+	key, err = c.driver.Put(ctx, key, &props)
+	if err != nil {
+		return err
+	}
+	return c.out.strings([]string{ds.FormatKey(key)})
+}
+
+func del(ctx context.Context, c *command) error {
+	args, err := c.parse(flag.NewFlagSet("delete", flag.ContinueOnError), "KEY...", 1, -1)
+	if err != nil {
+		return err
+	}
+	keys, err := parseKeys(args)
+	if err != nil {
+		return err
+	}
+	return c.driver.DeleteMulti(ctx, keys)
+}
+
+// stringsFlag is a flag that may be repeated.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/marjau/cloud/gcp/datastore/dstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type DsctlTestSuite struct {
+	suite.Suite
+	srv *dstest.Server
+}
+
+func TestDsctlTestSuite(t *testing.T) {
+	suite.Run(t, new(DsctlTestSuite))
+}
+
+func (s *DsctlTestSuite) SetupTest() {
+	var err error
+	s.srv, err = dstest.NewServer()
+	s.Require().NoError(err)
+	s.T().Setenv("DATASTORE_EMULATOR_HOST", s.srv.Addr)
+	s.T().Setenv("DATASTORE_PROJECT_ID", "klaboratory")
+
+	s.dsctl("put", `Zoo:"north"`, `{"City": "Berlin"}`)
+	s.dsctl("put", `Zoo:"north"/Animal:"cat"`, `{"Name": "cat", "Legs": 4, "Weight": 4.5, "Tags": ["small", "furry"]}`)
+	s.dsctl("put", `Animal:"dog"`, `{"Name": "dog", "Legs": 4, "Diet": {"Food": "meat"}}`)
+	s.dsctl("put", `Animal:"bird"`, `{"Name": "bird", "Legs": 2}`)
+}
+
+func (s *DsctlTestSuite) TearDownTest() {
+	s.srv.Close()
+}
+
+// dsctl runs the command and returns its output, failing on errors.
+func (s *DsctlTestSuite) dsctl(args ...string) string {
+	s.T().Helper()
+	out, err := s.run(args...)
+	s.Require().NoError(err, strings.Join(args, " "))
+	return out
+}
+
+func (s *DsctlTestSuite) run(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	err := run(context.Background(), args, &stdout, &stderr)
+	return stdout.String(), err
+}
+
+func (s *DsctlTestSuite) TestKinds() {
+	assert.Equal(s.T(), "Animal\nZoo\n", s.dsctl("kinds"))
+	assert.Equal(s.T(), "[\n  \"Animal\",\n  \"Zoo\"\n]\n", s.dsctl("-output", "json", "kinds"))
+	assert.Empty(s.T(), s.dsctl("-namespace", "tenant", "kinds"))
+}
+
+func (s *DsctlTestSuite) TestQuery() {
+	out := s.dsctl("query", "-filter", "Legs=4", "-order", "-Name", "Animal")
+	assert.Equal(s.T(), strings.Join([]string{
+		`KEY                       Diet             Legs  Name  Tags               Weight`,
+		`Animal:"dog"              {"Food":"meat"}  4     dog                      `,
+		`Zoo:"north"/Animal:"cat"                   4     cat   ["small","furry"]  4.5`,
+		``,
+	}, "\n"), out)
+
+	out = s.dsctl("-output", "ndjson", "query", "Animal", "-order", "Legs", "-limit", "1")
+	assert.Equal(s.T(), `{"key":"Animal:\"bird\"","properties":{"Legs":2,"Name":"bird"}}`+"\n", out)
+
+	out = s.dsctl("-output", "ndjson", "query", "-ancestor", `Zoo:"north"`, "-filter", `Name in ["cat","dog"]`, "Animal")
+	assert.Equal(s.T(), `{"key":"Zoo:\"north\"/Animal:\"cat\"","properties":{"Legs":4,"Name":"cat","Tags":["small","furry"],"Weight":4.5}}`+"\n", out)
+
+	_, err := s.run("query", "-filter", "Legs", "Animal")
+	assert.ErrorContains(s.T(), err, "expected PROPERTY OPERATOR VALUE")
+}
+
+func (s *DsctlTestSuite) TestCount() {
+	assert.Equal(s.T(), "3\n", s.dsctl("count", "Animal"))
+	assert.Equal(s.T(), "1\n", s.dsctl("count", "-filter", "Legs<4", "Animal"))
+	assert.Equal(s.T(), `{"count":1}`+"\n", s.dsctl("-output", "json", "count", "-ancestor", `Zoo:"north"`, "Animal"))
+}
+
+func (s *DsctlTestSuite) TestGetPutDelete() {
+	var entities []jsonEntity
+	out := s.dsctl("-output", "json", "get", `Animal:"dog"`, `Animal:"bird"`)
+	s.Require().NoError(json.Unmarshal([]byte(out), &entities))
+	s.Require().Len(entities, 2)
+	assert.Equal(s.T(), `Animal:"dog"`, entities[0].Key)
+	assert.Equal(s.T(), map[string]interface{}{"Food": "meat"}, entities[0].Properties["Diet"])
+	assert.Equal(s.T(), "bird", entities[1].Properties["Name"])
+
+	out, err := s.run("-output", "ndjson", "get", `Animal:"dog"`, `Animal:"cow"`)
+	assert.ErrorContains(s.T(), err, `Animal:"cow": datastore: no such entity`)
+	assert.Contains(s.T(), out, `"dog"`, "the entities found are printed")
+
+	s.dsctl("delete", `Animal:"dog"`, `Animal:"bird"`)
+	assert.Equal(s.T(), "1\n", s.dsctl("count", "Animal"))
+
+	assert.Equal(s.T(), "@tenant/Animal:\"cow\"\n", s.dsctl("-namespace", "tenant", "put", `Animal:"cow"`, `{"Legs": 4}`))
+	assert.Equal(s.T(), "Animal\n", s.dsctl("-namespace", "tenant", "kinds"))
+	out = s.dsctl("-namespace", "tenant", "put", "Animal", `{"Legs": 4}`)
+	assert.Regexp(s.T(), `^@tenant/Animal:\d+\n$`, out, "incomplete keys are allocated")
+}
+
+func (s *DsctlTestSuite) TestUsage() {
+	for _, args := range [][]string{
+		nil,
+		{"unknown"},
+		{"-output", "xml", "kinds"},
+		{"kinds", "extra"},
+		{"query"},
+		{"put", `Animal:"cow"`},
+		{"get", "-bogus", `Animal:"cow"`},
+	} {
+		_, err := s.run(args...)
+		assert.ErrorIs(s.T(), err, errUsage, args)
+	}
+}
+
+func TestParseValue(t *testing.T) {
+	cases := map[string]interface{}{
+		`4`:                    int64(4),
+		`-4.5`:                 -4.5,
+		`true`:                 true,
+		`null`:                 nil,
+		`"4"`:                  "4",
+		`cat`:                  "cat",
+		`two words`:            "two words",
+		`2020-01-02T03:04:05Z`: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		`{"a": 1}`:             `{"a": 1}`,
+	}
+	for s, want := range cases {
+		got, err := parseValue("Field", s)
+		assert.NoError(t, err, s)
+		if wt, ok := want.(time.Time); ok {
+			assert.True(t, wt.Equal(got.(time.Time)), s)
+			continue
+		}
+		assert.Equal(t, want, got, s)
+	}
+
+	k, err := parseValue("__key__", `Zoo:"north"/Animal:42`)
+	require.NoError(t, err)
+	assert.Equal(t, datastore.IDKey("Animal", 42, datastore.NameKey("Zoo", "north", nil)), k)
+	_, err = parseValue("__key__", "Animal:x")
+	assert.Error(t, err)
+}
+
+func TestParseFilter(t *testing.T) {
+	for _, s := range []string{"Legs>=4", "Legs >= 4", "Name = cat", "Name==cat", "Legs!=4", "Legs<4", "Legs<=4", "Legs>4",
+		`Name in ["cat", "dog"]`, `Name not-in ["cat"]`, `__key__ in ["Animal:1"]`} {
+		_, err := parseFilter(s)
+		assert.NoError(t, err, s)
+	}
+	for _, s := range []string{"Legs", "Legs ~ 4", `Name in cat`, `__key__ = Animal:x`} {
+		_, err := parseFilter(s)
+		assert.Error(t, err, s)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	ds "github.com/marjau/cloud/gcp/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// output prints the results of the commands in one format.
+type output interface {
+	entities(keys []*datastore.Key, entities []datastore.PropertyList) error
+	strings(values []string) error
+	count(n int64) error
+}
+
+func newOutput(format string, w io.Writer) (output, error) {
+	switch format {
+	case "table":
+		return tableOutput{w}, nil
+	case "json":
+		return jsonOutput{w: w}, nil
+	case "ndjson":
+		return jsonOutput{w: w, lines: true}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q", format)
+}
+
+// readAll reads the entities of it.
+func readAll(it ds.Iterator) ([]*datastore.Key, []datastore.PropertyList, error) {
+	var keys []*datastore.Key
+	var entities []datastore.PropertyList
+	for {
+		var props datastore.PropertyList
+		k, err := it.Next(&props)
+		if err == iterator.Done {
+			return keys, entities, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, k)
+		entities = append(entities, props)
+	}
+}
+
+// tableOutput prints entities as a table with a column per property.
+type tableOutput struct {
+	w io.Writer
+}
+
+func (t tableOutput) entities(keys []*datastore.Key, entities []datastore.PropertyList) error {
+	seen := map[string]bool{}
+	var columns []string
+	for _, props := range entities {
+		for _, p := range props {
+			if !seen[p.Name] {
+				seen[p.Name] = true
+				columns = append(columns, p.Name)
+			}
+		}
+	}
+	sort.Strings(columns)
+
+	tw := tabwriter.NewWriter(t.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(append([]string{"KEY"}, columns...), "\t"))
+	for i, props := range entities {
+		values := map[string]interface{}{}
+		for _, p := range props {
+			values[p.Name] = p.Value
+		}
+		row := []string{ds.FormatKey(keys[i])}
+		for _, c := range columns {
+			row = append(row, cell(values[c]))
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+func (t tableOutput) strings(values []string) error {
+	for _, v := range values {
+		if _, err := fmt.Fprintln(t.w, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t tableOutput) count(n int64) error {
+	_, err := fmt.Fprintln(t.w, n)
+	return err
+}
+
+var cellReplacer = strings.NewReplacer("\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+// cell formats a value for a table: strings, times and keys as they read,
+// blobs in base64 and anything else as JSON.
+func cell(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return cellReplacer.Replace(x)
+	case time.Time, *datastore.Key:
+		return plain(x).(string)
+	case []byte:
+		return base64.StdEncoding.EncodeToString(x)
+	}
+	b, err := json.Marshal(plain(v))
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// jsonOutput prints entities as JSON objects, in an array or one per line.
+type jsonOutput struct {
+	w     io.Writer
+	lines bool
+}
+
+type jsonEntity struct {
+	Key        string                 `json:"key"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+func (j jsonOutput) entities(keys []*datastore.Key, entities []datastore.PropertyList) error {
+	values := make([]interface{}, len(entities))
+	for i, props := range entities {
+		values[i] = jsonEntity{Key: ds.FormatKey(keys[i]), Properties: plainProperties(props)}
+	}
+	return j.write(values)
+}
+
+func (j jsonOutput) strings(values []string) error {
+	vs := make([]interface{}, len(values))
+	for i := range values {
+		vs[i] = values[i]
+	}
+	return j.write(vs)
+}
+
+func (j jsonOutput) count(n int64) error {
+	enc := json.NewEncoder(j.w)
+	return enc.Encode(map[string]int64{"count": n})
+}
+
+func (j jsonOutput) write(values []interface{}) error {
+	enc := json.NewEncoder(j.w)
+	enc.SetEscapeHTML(false)
+	if !j.lines {
+		enc.SetIndent("", "  ")
+		return enc.Encode(values)
+	}
+	for _, v := range values {
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func plainProperties(props []datastore.Property) map[string]interface{} {
+	m := make(map[string]interface{}, len(props))
+	for _, p := range props {
+		m[p.Name] = plain(p.Value)
+	}
+	return m
+}
+
+// plain converts a property value to a value encoding/json prints as it
+// reads: times in RFC 3339, keys as key paths, geopoints as objects with
+// lat and lng, and nested entities as objects of their properties.
+func plain(v interface{}) interface{} {
+	switch x := v.(type) {
+	case time.Time:
+		return x.UTC().Format(time.RFC3339Nano)
+	case *datastore.Key:
+		if x == nil {
+			return nil
+		}
+		return ds.FormatKey(x)
+	case float64:
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return strconv.FormatFloat(x, 'g', -1, 64)
+		}
+	case datastore.GeoPoint:
+		return map[string]float64{"lat": x.Lat, "lng": x.Lng}
+	case *datastore.Entity:
+		if x == nil {
+			return nil
+		}
+		return plainProperties(x.Properties)
+	case []interface{}:
+		values := make([]interface{}, len(x))
+		for i := range x {
+			values[i] = plain(x[i])
+		}
+		return values
+	}
+	return v
+}
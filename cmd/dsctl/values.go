@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	ds "github.com/marjau/cloud/gcp/datastore"
+)
+
+var (
+	comparison = regexp.MustCompile(`^\s*([^\s!=<>]+)\s*(!=|<=|>=|==|=|<|>)\s*(.*?)\s*$`)
+	membership = regexp.MustCompile(`^\s*(\S+)\s+(in|not-in)\s+(.*?)\s*$`)
+)
+
+// parseFilter parses a filter such as 'Legs>=4' or 'Name in ["cat","dog"]'.
+// Values are read by parseValue.
+func parseFilter(s string) (ds.Filter, error) {
+	if m := membership.FindStringSubmatch(s); m != nil {
+		field := m[1]
+		var raw []json.RawMessage
+		if err := json.Unmarshal([]byte(m[3]), &raw); err != nil {
+			return nil, fmt.Errorf("filter %q: %s expects a JSON array", s, m[2])
+		}
+		values := make([]interface{}, len(raw))
+		for i := range raw {
+			var err error
+			if values[i], err = parseValue(field, string(raw[i])); err != nil {
+				return nil, fmt.Errorf("filter %q: %w", s, err)
+			}
+		}
+		if m[2] == "in" {
+			return ds.In(field, values...), nil
+		}
+		return ds.NotIn(field, values...), nil
+	}
+
+	m := comparison.FindStringSubmatch(s)
+	if m == nil {
+		return nil, fmt.Errorf("filter %q: expected PROPERTY OPERATOR VALUE", s)
+	}
+	field := m[1]
+	v, err := parseValue(field, m[3])
+	if err != nil {
+		return nil, fmt.Errorf("filter %q: %w", s, err)
+	}
+	switch m[2] {
+	case "=", "==":
+		return ds.Eq(field, v), nil
+	case "!=":
+		return ds.NotEqual(field, v), nil
+	case "<":
+		return ds.Lt(field, v), nil
+	case "<=":
+		return ds.Lte(field, v), nil
+	case ">":
+		return ds.Gt(field, v), nil
+	}
+	return ds.Gte(field, v), nil
+}
+
+// parseValue parses the value of a filter on field. Values of __key__ are
+// keys. Others are read as JSON, integers being int64, and otherwise as an
+// RFC 3339 time or a bare string: 4, 4.5, true, null, "4",
+// 2020-01-02T03:04:05Z and cat are all values.
+func parseValue(field, s string) (interface{}, error) {
+	if field == "__key__" {
+		var quoted string
+		if json.Unmarshal([]byte(s), &quoted) == nil {
+			s = quoted
+		}
+		return ds.ParseKey(s)
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err == nil && !dec.More() {
+		if _, ok := v.(map[string]interface{}); !ok {
+			return jsonValue(v)
+		}
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return s, nil
+}
+
+// parseEntity parses a JSON object into properties, see jsonValue.
+func parseEntity(s string) (datastore.PropertyList, error) {
+	dec := json.NewDecoder(bytes.NewReader([]byte(s)))
+	dec.UseNumber()
+	var object map[string]interface{}
+	if err := dec.Decode(&object); err != nil {
+		return nil, fmt.Errorf("entity: expected a JSON object: %w", err)
+	}
+	e, err := jsonValue(object)
+	if err != nil {
+		return nil, err
+	}
+	return e.(*datastore.Entity).Properties, nil
+}
+
+// jsonValue converts a decoded JSON value to a property value: numbers are
+// int64 when they are integers and float64 otherwise, arrays are arrays and
+// objects nested entities.
+func jsonValue(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i, nil
+		}
+		return x.Float64()
+	case []interface{}:
+		values := make([]interface{}, len(x))
+		for i := range x {
+			var err error
+			if values[i], err = jsonValue(x[i]); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	case map[string]interface{}:
+		names := make([]string, 0, len(x))
+		for name := range x {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		e := &datastore.Entity{}
+		for _, name := range names {
+			value, err := jsonValue(x[name])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			e.Properties = append(e.Properties, datastore.Property{Name: name, Value: value})
+		}
+		return e, nil
+	}
+	return v, nil
+}
@@ -0,0 +1,241 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+
+	"cloud.google.com/go/datastore"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// maxAggregations is the number of aggregations a query accepts.
+const maxAggregations = 5
+
+// countAlias is the alias of the aggregation run by Driver.Count.
+const countAlias = "count"
+
+// Aggregation is one aggregate computed by Driver.Aggregate and reported
+// under its alias.
+type Aggregation struct {
+	alias string
+	op    string
+	field string
+}
+
+// Count counts the results of the query.
+func Count(alias string) Aggregation {
+	return Aggregation{alias: alias, op: "count"}
+}
+
+// Sum adds up the numeric values of field. The sum is an int64 when every
+// value is an integer and a float64 otherwise.
+func Sum(alias, field string) Aggregation {
+	return Aggregation{alias: alias, op: "sum", field: field}
+}
+
+// Avg averages the numeric values of field as a float64, nil when there is
+// none.
+func Avg(alias, field string) Aggregation {
+	return Aggregation{alias: alias, op: "avg", field: field}
+}
+
+// AggregationResult holds the aggregates of a query by alias.
+type AggregationResult map[string]interface{}
+
+// Int returns the aggregate under alias as an integer. A float aggregate is
+// truncated.
+func (r AggregationResult) Int(alias string) (int64, error) {
+	switch v := r[alias].(type) {
+	case int64:
+		return v, nil
+	case float64:
+		return int64(v), nil
+	}
+	return 0, fmt.Errorf("aggregate %q is %v, not a number", alias, r[alias])
+}
+
+// Float returns the aggregate under alias as a float.
+func (r AggregationResult) Float(alias string) (float64, error) {
+	switch v := r[alias].(type) {
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	}
+	return 0, fmt.Errorf("aggregate %q is %v, not a number", alias, r[alias])
+}
+
+// validateAggregations reports invalid aggregations and queries the
+// backend cannot aggregate.
+func validateAggregations(q *Query, aggs []Aggregation) error {
+	if err := q.Validate(); err != nil {
+		return err
+	}
+	if len(q.projection) > 0 {
+		return invalidArgument(errors.New("invalid aggregation: projection queries cannot be aggregated"))
+	}
+	if len(aggs) == 0 {
+		return invalidArgument(errors.New("invalid aggregation: no aggregation"))
+	}
+	if len(aggs) > maxAggregations {
+		return invalidArgument(fmt.Errorf("invalid aggregation: %d aggregations, at most %d are allowed", len(aggs), maxAggregations))
+	}
+	aliases := map[string]bool{}
+	for _, a := range aggs {
+		switch {
+		case a.alias == "":
+			return invalidArgument(errors.New("invalid aggregation: empty alias"))
+		case aliases[a.alias]:
+			return invalidArgument(fmt.Errorf("invalid aggregation: duplicate alias %q", a.alias))
+		case a.op != "count" && a.field == "":
+			return invalidArgument(fmt.Errorf("invalid aggregation: %s %q has no field", a.op, a.alias))
+		}
+		aliases[a.alias] = true
+	}
+	return nil
+}
+
+// Aggregate computes aggs over the results of q in one request, without
+// reading the entities.
+func (d *driver) Aggregate(ctx context.Context, query *Query, aggs ...Aggregation) (AggregationResult, error) {
+	if err := validateAggregations(query, aggs); err != nil {
+		return nil, err
+	}
+	q, err := query.build()
+	if err != nil {
+		return nil, err
+	}
+
+	aq := q.NewAggregationQuery()
+	for _, a := range aggs {
+		switch a.op {
+		case "count":
+			aq = aq.WithCount(a.alias)
+		case "sum":
+			aq = aq.WithSum(a.field, a.alias)
+		case "avg":
+			aq = aq.WithAvg(a.field, a.alias)
+		}
+	}
+
+	var res datastore.AggregationResult
+	err = d.do(ctx, "Aggregate", true, func(ctx context.Context) error {
+		res, err = d.client.RunAggregationQuery(ctx, aq)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := AggregationResult{}
+	for alias, v := range res {
+		pv, ok := v.(*pb.Value)
+		if !ok {
+			return nil, &Error{Kind: ErrInternal, Err: fmt.Errorf("aggregate %q has unexpected type %T", alias, v)}
+		}
+		switch x := pv.GetValueType().(type) {
+		case *pb.Value_IntegerValue:
+			result[alias] = x.IntegerValue
+		case *pb.Value_DoubleValue:
+			result[alias] = x.DoubleValue
+		default:
+			result[alias] = nil
+		}
+	}
+	return result, nil
+}
+
+// Count returns the number of results of q.
+func (d *driver) Count(ctx context.Context, q *Query) (int64, error) {
+	return count(d.Aggregate(ctx, q, Count(countAlias)))
+}
+
+func count(res AggregationResult, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	return res.Int(countAlias)
+}
+
+// aggregate computes aggs over n results, value returning the indexed value
+// of a field of result i.
+func aggregate(aggs []Aggregation, n int, value func(i int, field string) (interface{}, bool)) AggregationResult {
+	a := newAggregator(aggs)
+	for i := 0; i < n; i++ {
+		a.add(func(field string) (interface{}, bool) {
+			return value(i, field)
+		})
+	}
+	return a.result()
+}
+
+// aggregator computes aggregations one result at a time. It mirrors the
+// backend: non-numeric values are ignored, and integer sums overflowing
+// int64 turn into floats.
+type aggregator struct {
+	aggs   []Aggregation
+	n      int64
+	isum   []int64
+	fsum   []float64
+	floats []bool
+	values []int
+}
+
+func newAggregator(aggs []Aggregation) *aggregator {
+	return &aggregator{
+		aggs:   aggs,
+		isum:   make([]int64, len(aggs)),
+		fsum:   make([]float64, len(aggs)),
+		floats: make([]bool, len(aggs)),
+		values: make([]int, len(aggs)),
+	}
+}
+
+// add aggregates one result, value returning the indexed value of a field.
+func (a *aggregator) add(value func(field string) (interface{}, bool)) {
+	a.n++
+	for i, agg := range a.aggs {
+		if agg.op == "count" {
+			continue
+		}
+		v, ok := value(agg.field)
+		if !ok {
+			continue
+		}
+		switch x := normalizeValue(v).(type) {
+		case int64:
+			if !a.floats[i] && (x > 0 && a.isum[i] > math.MaxInt64-x || x < 0 && a.isum[i] < math.MinInt64-x) {
+				a.floats[i] = true
+			}
+			a.isum[i] += x
+			a.fsum[i] += float64(x)
+		case float64:
+			a.floats[i] = true
+			a.fsum[i] += x
+		default:
+			continue
+		}
+		a.values[i]++
+	}
+}
+
+// result returns the aggregates of the results added so far.
+func (a *aggregator) result() AggregationResult {
+	result := AggregationResult{}
+	for i, agg := range a.aggs {
+		switch {
+		case agg.op == "count":
+			result[agg.alias] = a.n
+		case agg.op == "avg" && a.values[i] == 0:
+			result[agg.alias] = nil
+		case agg.op == "avg":
+			result[agg.alias] = a.fsum[i] / float64(a.values[i])
+		case a.floats[i]:
+			result[agg.alias] = a.fsum[i]
+		default:
+			result[agg.alias] = a.isum[i]
+		}
+	}
+	return result
+}
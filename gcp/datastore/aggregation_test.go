@@ -0,0 +1,109 @@
+package datastore
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type AggregationTestSuite struct {
+	suite.Suite
+	newDriver func(t *testing.T) Driver
+	d         Driver
+	ctx       context.Context
+}
+
+func TestAggregationTestSuite(t *testing.T) {
+	forEachDriver(t, func(newDriver func(*testing.T) Driver) suite.TestingSuite {
+		return &AggregationTestSuite{newDriver: newDriver}
+	})
+}
+
+func (s *AggregationTestSuite) SetupTest() {
+	s.d = s.newDriver(s.T())
+	s.ctx = context.Background()
+
+	animals := []Animal{
+		{Name: "cat", Legs: 4},
+		{Name: "dog", Legs: 4},
+		{Name: "bird", Legs: 2},
+		{Name: "snake", Legs: 0},
+	}
+	keys := make([]*datastore.Key, len(animals))
+	for i, a := range animals {
+		keys[i] = datastore.NameKey("Animal", a.Name, nil)
+	}
+	s.Require().NoError(s.d.UpdateMulti(s.ctx, keys, animals))
+
+	for i, w := range []interface{}{1.5, int64(2), "heavy"} {
+		k := datastore.IDKey("Parcel", int64(i+1), nil)
+		s.Require().NoError(s.d.Update(s.ctx, k, &datastore.PropertyList{{Name: "Weight", Value: w}}))
+	}
+}
+
+func (s *AggregationTestSuite) TestCount() {
+	n, err := s.d.Count(s.ctx, NewQuery("Animal"))
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(4), n)
+
+	n, err = s.d.Count(s.ctx, NewQuery("Animal").Filter(Eq("Legs", 4)))
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(2), n)
+
+	n, err = s.d.Count(s.ctx, NewQuery("Animal").Limit(3))
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(3), n)
+}
+
+func (s *AggregationTestSuite) TestAggregate() {
+	res, err := s.d.Aggregate(s.ctx, NewQuery("Animal").Filter(Gt("Legs", 0)),
+		Count("n"), Sum("total", "Legs"), Avg("mean", "Legs"))
+	s.Require().NoError(err)
+	assert.Equal(s.T(), AggregationResult{"n": int64(3), "total": int64(10), "mean": 10.0 / 3}, res)
+
+	mean, err := res.Float("mean")
+	assert.NoError(s.T(), err)
+	assert.InDelta(s.T(), 3.33, mean, 0.01)
+	total, err := res.Int("total")
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(10), total)
+}
+
+func (s *AggregationTestSuite) TestMixedValues() {
+	res, err := s.d.Aggregate(s.ctx, NewQuery("Parcel"), Sum("total", "Weight"), Avg("mean", "Weight"))
+	s.Require().NoError(err)
+	assert.Equal(s.T(), AggregationResult{"total": 3.5, "mean": 1.75}, res, "non-numeric values are ignored")
+
+	res, err = s.d.Aggregate(s.ctx, NewQuery("Animal"), Sum("total", "Missing"), Avg("mean", "Missing"))
+	s.Require().NoError(err)
+	assert.Equal(s.T(), AggregationResult{"total": int64(0), "mean": nil}, res)
+	_, err = res.Float("mean")
+	assert.Error(s.T(), err)
+}
+
+func (s *AggregationTestSuite) TestInvalid() {
+	cases := map[string][]Aggregation{
+		"none":            nil,
+		"empty alias":     {Count("")},
+		"duplicate alias": {Count("n"), Sum("n", "Legs")},
+		"no field":        {Sum("total", "")},
+		"too many":        {Count("a"), Count("b"), Count("c"), Count("d"), Count("e"), Count("f")},
+	}
+	for name, aggs := range cases {
+		_, err := s.d.Aggregate(s.ctx, NewQuery("Animal"), aggs...)
+		assert.Error(s.T(), err, name)
+	}
+
+	_, err := s.d.Count(s.ctx, NewQuery("Animal").Project("Legs"))
+	assert.Error(s.T(), err)
+}
+
+func (s *AggregationTestSuite) TestNamespace() {
+	tenant := NewNamespaceDriver(s.d, "tenant")
+	n, err := tenant.Count(s.ctx, NewQuery("Animal"))
+	assert.NoError(s.T(), err)
+	assert.Zero(s.T(), n)
+}
@@ -0,0 +1,639 @@
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// AuditKind is the kind of the entities an AuditDriver stores its records
+// in, in the namespace of the audited entities.
+const AuditKind = "AuditRecord"
+
+// The operations of an AuditRecord.
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// AuditRecord tells who wrote or deleted an entity, when, and what changed.
+type AuditRecord struct {
+	// Actor is the actor of the context of the write, set with
+	// ContextWithActor, or empty.
+	Actor string
+	// Operation is AuditCreate when the entity did not exist before the
+	// write, AuditUpdate when it did, and AuditDelete.
+	Operation string
+	Key       *datastore.Key
+	Time      time.Time
+	// Changes lists the properties that differ, sorted by name.
+	Changes []AuditChange
+}
+
+// AuditChange is a property changed by a write. Before is nil when the
+// property was missing or null before the write, and After when it is
+// after.
+type AuditChange struct {
+	Property string
+	Before   interface{}
+	After    interface{}
+}
+
+// AuditSink receives the records of an AuditDriver instead of Datastore,
+// for instance to send them to a log. It must be safe for concurrent use.
+type AuditSink interface {
+	Write(ctx context.Context, records []AuditRecord) error
+}
+
+type actorKey struct{}
+
+// ContextWithActor returns a copy of ctx whose writes through an
+// AuditDriver are recorded as done by actor.
+func ContextWithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor of ctx, or an empty string.
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// AuditOption configures NewAuditDriver.
+type AuditOption func(*AuditDriver)
+
+// AuditTo sends the records to sink once their writes committed, instead
+// of storing them with the writes.
+func AuditTo(sink AuditSink) AuditOption {
+	return func(a *AuditDriver) {
+		a.sink = sink
+	}
+}
+
+var _ Driver = (*AuditDriver)(nil)
+
+// AuditDriver is a Driver recording its writes and deletes, in and out of
+// transactions, as AuditRecords. Each write runs in a transaction reading
+// the entity before it, so its record holds the changed properties. By
+// default the record is stored in that transaction as an entity of
+// AuditKind, which History reads back. With AuditTo the records go to a
+// sink after the commit instead.
+//
+// The record of a write with an incomplete key has the key the entity is
+// stored under. Deleting a missing entity is not recorded. A transaction
+// writing an entity again records the changes from its previous write.
+// Batches write a transaction per chunk, so a chunk and its records are
+// written as a whole or not at all.
+type AuditDriver struct {
+	d    Driver
+	sink AuditSink
+}
+
+// NewAuditDriver returns d recording its writes. Closing it closes d.
+func NewAuditDriver(d Driver, opts ...AuditOption) *AuditDriver {
+	a := &AuditDriver{d: d}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// historyQuery returns the query of the records stored for key.
+func historyQuery(key *datastore.Key) *Query {
+	return NewQuery(AuditKind).Namespace(key.Namespace).Filter(Eq("Key", key))
+}
+
+// History returns the records stored for key, oldest first. Records sent
+// to a sink are not stored, so History does not return them.
+func (a *AuditDriver) History(ctx context.Context, key *datastore.Key) ([]AuditRecord, error) {
+	if !validKey(key) || key.Incomplete() {
+		return nil, errInvalidKey
+	}
+	it, err := a.d.Find(ctx, historyQuery(key))
+	if err != nil {
+		return nil, err
+	}
+	var records []AuditRecord
+	for {
+		var e auditEntity
+		if _, err := it.Next(&e); err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		r, err := e.record()
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	// Sorted here rather than by the query, which would need a composite
+	// index.
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	return records, nil
+}
+
+// HistoryPage returns a page of at most pageSize records stored for key,
+// oldest first, and the token of the next page, empty after the last one.
+// Unlike History, it sorts the records by the query, which needs a
+// composite index on the Key and Time properties of AuditKind.
+func (a *AuditDriver) HistoryPage(ctx context.Context, key *datastore.Key, pageSize int, pageToken string) ([]AuditRecord, string, error) {
+	if !validKey(key) || key.Incomplete() {
+		return nil, "", errInvalidKey
+	}
+	var entities []auditEntity
+	page, err := a.d.FindPage(ctx, historyQuery(key).Order("Time"), pageSize, pageToken, &entities)
+	if err != nil {
+		return nil, "", err
+	}
+	records := make([]AuditRecord, len(entities))
+	for i := range entities {
+		if records[i], err = entities[i].record(); err != nil {
+			return nil, "", err
+		}
+	}
+	return records, page.NextPageToken, nil
+}
+
+// auditEntity is a stored AuditRecord.
+type auditEntity struct {
+	Actor     string
+	Operation string
+	Key       *datastore.Key
+	Time      time.Time
+	Changes   string `datastore:",noindex"`
+}
+
+// auditedChange is an AuditChange encoded in auditEntity.Changes. Missing
+// values are omitted.
+type auditedChange struct {
+	Property string         `json:"property"`
+	Before   *exportedValue `json:"before,omitempty"`
+	After    *exportedValue `json:"after,omitempty"`
+}
+
+func newAuditEntity(r AuditRecord) (*auditEntity, error) {
+	changes := make([]auditedChange, len(r.Changes))
+	for i, c := range r.Changes {
+		changes[i].Property = c.Property
+		var err error
+		if changes[i].Before, err = auditedValue(c.Before); err != nil {
+			return nil, fmt.Errorf("audit: property %s: %w", c.Property, err)
+		}
+		if changes[i].After, err = auditedValue(c.After); err != nil {
+			return nil, fmt.Errorf("audit: property %s: %w", c.Property, err)
+		}
+	}
+	raw, err := json.Marshal(changes)
+	if err != nil {
+		return nil, err
+	}
+	return &auditEntity{Actor: r.Actor, Operation: r.Operation, Key: r.Key, Time: r.Time, Changes: string(raw)}, nil
+}
+
+func auditedValue(v interface{}) (*exportedValue, error) {
+	if v == nil {
+		return nil, nil
+	}
+	e, err := exportValue(v)
+	return &e, err
+}
+
+func (e *auditEntity) record() (AuditRecord, error) {
+	r := AuditRecord{Actor: e.Actor, Operation: e.Operation, Key: e.Key, Time: e.Time}
+	var changes []auditedChange
+	if err := json.Unmarshal([]byte(e.Changes), &changes); err != nil {
+		return AuditRecord{}, fmt.Errorf("audit record of %s: %w", FormatKey(e.Key), err)
+	}
+	for _, c := range changes {
+		change := AuditChange{Property: c.Property}
+		var err error
+		if c.Before != nil {
+			change.Before, err = importValue(*c.Before)
+		}
+		if err == nil && c.After != nil {
+			change.After, err = importValue(*c.After)
+		}
+		if err != nil {
+			return AuditRecord{}, fmt.Errorf("audit record of %s: property %s: %w", FormatKey(e.Key), c.Property, err)
+		}
+		r.Changes = append(r.Changes, change)
+	}
+	return r, nil
+}
+
+// auditChanges returns the properties whose values differ between before
+// and after, sorted by name.
+func auditChanges(before, after []datastore.Property) []AuditChange {
+	b, a := auditedValues(before), auditedValues(after)
+	names := make([]string, 0, len(b)+len(a))
+	for name := range b {
+		names = append(names, name)
+	}
+	for name := range a {
+		if _, ok := b[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var changes []AuditChange
+	for _, name := range names {
+		if !reflect.DeepEqual(b[name], a[name]) {
+			changes = append(changes, AuditChange{Property: name, Before: b[name], After: a[name]})
+		}
+	}
+	return changes
+}
+
+// auditedValues returns the values of props by name, as Datastore stores
+// them. Repeated properties are merged into an array.
+func auditedValues(props []datastore.Property) map[string]interface{} {
+	values := make(map[string]interface{}, len(props))
+	repeated := map[string]bool{}
+	for _, p := range props {
+		v := storedAuditValue(p.Value)
+		prev, ok := values[p.Name]
+		switch {
+		case !ok:
+			values[p.Name] = v
+		case repeated[p.Name]:
+			values[p.Name] = append(prev.([]interface{}), v)
+		default:
+			values[p.Name] = []interface{}{prev, v}
+			repeated[p.Name] = true
+		}
+	}
+	return values
+}
+
+// storedAuditValue returns v as it reads back from Datastore, so values
+// written and values read compare equal.
+func storedAuditValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case time.Time:
+		return x.UTC().Truncate(time.Microsecond)
+	case []interface{}:
+		values := make([]interface{}, len(x))
+		for i := range x {
+			values[i] = storedAuditValue(x[i])
+		}
+		return values
+	case *datastore.Entity:
+		if x == nil {
+			return nil
+		}
+		e := &datastore.Entity{Key: x.Key, Properties: make([]datastore.Property, len(x.Properties))}
+		for i, p := range x.Properties {
+			e.Properties[i] = datastore.Property{Name: p.Name, Value: storedAuditValue(p.Value), NoIndex: p.NoIndex}
+		}
+		return e
+	case *datastore.Key:
+		if x == nil {
+			return nil
+		}
+	}
+	return v
+}
+
+// batchLimit returns the size of the chunks of the batches, whose entities
+// each take a second mutation when their records are stored.
+func (a *AuditDriver) batchLimit() int {
+	if a.sink != nil {
+		return maxBatchMutations
+	}
+	return maxBatchMutations / 2
+}
+
+// audit runs f in a transaction of the driver and, with a sink, sends the
+// records of the attempt that committed.
+func (a *AuditDriver) audit(ctx context.Context, f func(t *auditTx) error, opts ...TxOption) error {
+	var records []AuditRecord
+	err := a.d.RunInTransaction(ctx, func(tx Tx) error {
+		t := &auditTx{ctx: ctx, a: a, tx: tx, staged: map[string][]datastore.Property{}}
+		err := f(t)
+		records = t.records
+		return err
+	}, opts...)
+	if err != nil {
+		return err
+	}
+	if a.sink == nil || len(records) == 0 {
+		return nil
+	}
+	if err := a.sink.Write(ctx, records); err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+	return nil
+}
+
+// completeKeys returns keys with IDs allocated to the incomplete ones.
+func (a *AuditDriver) completeKeys(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	var incomplete []*datastore.Key
+	var at []int
+	for i, k := range keys {
+		if k.Incomplete() {
+			incomplete = append(incomplete, k)
+			at = append(at, i)
+		}
+	}
+	complete := append([]*datastore.Key(nil), keys...)
+	if len(incomplete) == 0 {
+		return complete, nil
+	}
+	allocated, err := a.d.AllocateIDs(ctx, incomplete)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range at {
+		complete[i] = allocated[j]
+	}
+	return complete, nil
+}
+
+func (a *AuditDriver) Find(ctx context.Context, q *Query) (Iterator, error) {
+	return a.d.Find(ctx, q)
+}
+
+func (a *AuditDriver) FindIds(ctx context.Context, q *Query) ([]string, error) {
+	return a.d.FindIds(ctx, q)
+}
+
+func (a *AuditDriver) FindKeys(ctx context.Context, q *Query) ([]*datastore.Key, error) {
+	return a.d.FindKeys(ctx, q)
+}
+
+func (a *AuditDriver) FindPage(ctx context.Context, q *Query, pageSize int, pageToken string, dst interface{}) (*Page, error) {
+	return a.d.FindPage(ctx, q, pageSize, pageToken, dst)
+}
+
+func (a *AuditDriver) FindIdsPage(ctx context.Context, q *Query, pageSize int, pageToken string) ([]string, string, error) {
+	return a.d.FindIdsPage(ctx, q, pageSize, pageToken)
+}
+
+func (a *AuditDriver) Aggregate(ctx context.Context, q *Query, aggs ...Aggregation) (AggregationResult, error) {
+	return a.d.Aggregate(ctx, q, aggs...)
+}
+
+func (a *AuditDriver) Count(ctx context.Context, q *Query) (int64, error) {
+	return a.d.Count(ctx, q)
+}
+
+func (a *AuditDriver) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	return a.d.Get(ctx, key, dst)
+}
+
+func (a *AuditDriver) Create(ctx context.Context, key *datastore.Key, object interface{}) (string, error) {
+	k, err := a.Put(ctx, key, object)
+	if err != nil {
+		return "", err
+	}
+	return k.Encode(), nil
+}
+
+func (a *AuditDriver) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	var newKey *datastore.Key
+	err := a.audit(ctx, func(t *auditTx) error {
+		var err error
+		newKey, err = t.Put(key, src)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newKey, nil
+}
+
+func (a *AuditDriver) Delete(ctx context.Context, key *datastore.Key) error {
+	return a.audit(ctx, func(t *auditTx) error {
+		return t.Delete(key)
+	})
+}
+
+func (a *AuditDriver) Update(ctx context.Context, key *datastore.Key, data interface{}) error {
+	return a.audit(ctx, func(t *auditTx) error {
+		_, err := t.Put(key, data)
+		return err
+	})
+}
+
+// UpdateVersioned records the update in its transaction.
+func (a *AuditDriver) UpdateVersioned(ctx context.Context, key *datastore.Key, data Versioned) error {
+	return updateVersioned(ctx, a, key, data)
+}
+
+func (a *AuditDriver) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}, opts ...BatchOption) error {
+	return a.d.GetMulti(ctx, keys, dst, opts...)
+}
+
+func (a *AuditDriver) CreateMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) ([]string, error) {
+	return encodeMulti(a.PutMulti(ctx, keys, src, opts...))
+}
+
+// PutMulti writes the entities of keys and their records in a transaction
+// per chunk. The key of an item that failed is nil.
+func (a *AuditDriver) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) ([]*datastore.Key, error) {
+	v, err := batchValues(keys, src)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBatchKeys(keys, true); err != nil {
+		return nil, err
+	}
+	complete, err := a.completeKeys(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	err = a.putMulti(ctx, complete, v, opts)
+	if me, ok := err.(datastore.MultiError); ok {
+		for i := range complete {
+			if me[i] != nil {
+				complete[i] = nil
+			}
+		}
+	}
+	return complete, err
+}
+
+func (a *AuditDriver) putMulti(ctx context.Context, keys []*datastore.Key, v reflect.Value, opts []BatchOption) error {
+	return runBatch(ctx, len(keys), newBatchOptions(a.batchLimit(), opts), true, func(ctx context.Context, lo, hi int) error {
+		return a.audit(ctx, func(t *auditTx) error {
+			for i := lo; i < hi; i++ {
+				if _, err := t.Put(keys[i], batchElem(v, i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// UpdateMulti writes the entities of keys and their records in a
+// transaction per chunk.
+func (a *AuditDriver) UpdateMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) error {
+	v, err := batchValues(keys, src)
+	if err != nil {
+		return err
+	}
+	if err := checkBatchKeys(keys, false); err != nil {
+		return err
+	}
+	return a.putMulti(ctx, keys, v, opts)
+}
+
+// DeleteMulti deletes the entities of keys and stores their records in a
+// transaction per chunk.
+func (a *AuditDriver) DeleteMulti(ctx context.Context, keys []*datastore.Key, opts ...BatchOption) error {
+	if err := checkBatchKeys(keys, false); err != nil {
+		return err
+	}
+	return runBatch(ctx, len(keys), newBatchOptions(a.batchLimit(), opts), true, func(ctx context.Context, lo, hi int) error {
+		return a.audit(ctx, func(t *auditTx) error {
+			for _, k := range keys[lo:hi] {
+				if err := t.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+func (a *AuditDriver) AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	return a.d.AllocateIDs(ctx, keys)
+}
+
+func (a *AuditDriver) ReserveIDs(ctx context.Context, keys []*datastore.Key) error {
+	return a.d.ReserveIDs(ctx, keys)
+}
+
+// RunInTransaction records the writes of f with them. With a sink, only
+// the records of the attempt that committed are sent.
+func (a *AuditDriver) RunInTransaction(ctx context.Context, f func(tx Tx) error, opts ...TxOption) error {
+	return a.audit(ctx, func(t *auditTx) error {
+		return f(t)
+	}, opts...)
+}
+
+func (a *AuditDriver) Close() error {
+	return a.d.Close()
+}
+
+// auditTx records the writes of a transaction.
+type auditTx struct {
+	ctx     context.Context
+	a       *AuditDriver
+	tx      Tx
+	records []AuditRecord
+	// staged holds the properties of the entities the transaction wrote,
+	// nil for those it deleted, by memoryKey.
+	staged map[string][]datastore.Property
+}
+
+func (t *auditTx) Get(key *datastore.Key, dst interface{}) error {
+	return t.tx.Get(key, dst)
+}
+
+func (t *auditTx) Put(key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	if !validKey(key) {
+		return nil, errInvalidKey
+	}
+	after, err := saveEntity(src)
+	if err != nil {
+		return nil, err
+	}
+	if after == nil {
+		after = []datastore.Property{}
+	}
+	// An incomplete key gets a new ID, so it has no entity before.
+	var before []datastore.Property
+	if !key.Incomplete() {
+		if before, err = t.current(key); err != nil {
+			return nil, err
+		}
+	}
+	key, err = t.tx.Put(key, src)
+	if err != nil {
+		return nil, err
+	}
+	t.staged[memoryKey(key)] = after
+	op := AuditUpdate
+	if before == nil {
+		op = AuditCreate
+	}
+	return key, t.record(key, op, before, after)
+}
+
+func (t *auditTx) Delete(key *datastore.Key) error {
+	if !validKey(key) || key.Incomplete() {
+		return errInvalidKey
+	}
+	before, err := t.current(key)
+	if err != nil {
+		return err
+	}
+	if err := t.tx.Delete(key); err != nil {
+		return err
+	}
+	t.staged[memoryKey(key)] = nil
+	if before == nil {
+		return nil
+	}
+	return t.record(key, AuditDelete, before, nil)
+}
+
+// current returns the properties of the entity of key as the transaction
+// left it, nil when it is missing. The reads of a transaction see the
+// entities as they were before it, so those it wrote are taken from its
+// last write.
+func (t *auditTx) current(key *datastore.Key) ([]datastore.Property, error) {
+	if props, ok := t.staged[memoryKey(key)]; ok {
+		return props, nil
+	}
+	var props datastore.PropertyList
+	switch err := t.tx.Get(key, &props); {
+	case errors.Is(err, ErrNotFound):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	if props == nil {
+		props = datastore.PropertyList{}
+	}
+	return props, nil
+}
+
+// record records the write of key, storing the record in the transaction
+// unless it goes to a sink.
+func (t *auditTx) record(key *datastore.Key, op string, before, after []datastore.Property) error {
+	r := AuditRecord{
+		Actor:     ActorFromContext(t.ctx),
+		Operation: op,
+		Key:       key,
+		Time:      now(),
+		Changes:   auditChanges(before, after),
+	}
+	if t.a.sink == nil {
+		e, err := newAuditEntity(r)
+		if err != nil {
+			return err
+		}
+		rk := datastore.IncompleteKey(AuditKind, nil)
+		rk.Namespace = key.Namespace
+		if _, err := t.tx.Put(rk, e); err != nil {
+			return err
+		}
+	}
+	t.records = append(t.records, r)
+	return nil
+}
@@ -0,0 +1,279 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+// recordingSink keeps the records it receives.
+type recordingSink struct {
+	mu      sync.Mutex
+	records []AuditRecord
+	err     error
+}
+
+func (s *recordingSink) Write(ctx context.Context, records []AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, records...)
+	return s.err
+}
+
+type AuditTestSuite struct {
+	suite.Suite
+	newDriver func(t *testing.T) Driver
+	raw       Driver
+	d         *AuditDriver
+	ctx       context.Context
+	cat       *datastore.Key
+}
+
+func TestAuditTestSuite(t *testing.T) {
+	forEachDriver(t, func(newDriver func(*testing.T) Driver) suite.TestingSuite {
+		return &AuditTestSuite{newDriver: newDriver}
+	})
+}
+
+func (s *AuditTestSuite) SetupTest() {
+	s.raw = s.newDriver(s.T())
+	s.d = NewAuditDriver(s.raw)
+	s.ctx = ContextWithActor(context.Background(), "alice")
+	s.cat = datastore.NameKey("Animal", "cat", nil)
+}
+
+// operations returns the operations of records.
+func operations(records []AuditRecord) []string {
+	ops := make([]string, len(records))
+	for i, r := range records {
+		ops[i] = r.Operation
+	}
+	return ops
+}
+
+func (s *AuditTestSuite) TestHistory() {
+	_, err := s.d.Put(s.ctx, s.cat, &Animal{Name: "cat", Legs: 4})
+	s.Require().NoError(err)
+	s.Require().NoError(s.d.Update(ContextWithActor(s.ctx, "bob"), s.cat, &Animal{Name: "cat", Legs: 3}))
+	s.Require().NoError(s.d.Delete(s.ctx, s.cat))
+	s.Require().NoError(s.d.Delete(s.ctx, s.cat), "deleting a missing entity")
+
+	records, err := s.d.History(s.ctx, s.cat)
+	s.Require().NoError(err)
+	s.Require().Len(records, 3)
+	assert.Equal(s.T(), []string{AuditCreate, AuditUpdate, AuditDelete}, operations(records))
+	assert.Equal(s.T(), []string{"alice", "bob", "alice"}, []string{records[0].Actor, records[1].Actor, records[2].Actor})
+	assert.Equal(s.T(), s.cat, records[1].Key)
+	assert.False(s.T(), records[1].Time.Before(records[0].Time))
+	assert.Equal(s.T(), []AuditChange{
+		{Property: "FoodType", After: ""},
+		{Property: "Legs", After: int64(4)},
+		{Property: "Name", After: "cat"},
+		{Property: "Sound", After: ""},
+	}, records[0].Changes)
+	assert.Equal(s.T(), []AuditChange{{Property: "Legs", Before: int64(4), After: int64(3)}}, records[1].Changes)
+	assert.Equal(s.T(), []AuditChange{
+		{Property: "FoodType", Before: ""},
+		{Property: "Legs", Before: int64(3)},
+		{Property: "Name", Before: "cat"},
+		{Property: "Sound", Before: ""},
+	}, records[2].Changes)
+
+	records, err = s.d.History(s.ctx, datastore.NameKey("Animal", "dog", nil))
+	s.Require().NoError(err)
+	assert.Empty(s.T(), records)
+	_, err = s.d.History(s.ctx, datastore.IncompleteKey("Animal", nil))
+	assert.ErrorIs(s.T(), err, ErrInvalidArgument)
+}
+
+func (s *AuditTestSuite) TestHistoryPage() {
+	for legs := 1; legs <= 3; legs++ {
+		s.Require().NoError(s.d.Update(s.ctx, s.cat, &Animal{Name: "cat", Legs: legs}))
+	}
+
+	records, next, err := s.d.HistoryPage(s.ctx, s.cat, 2, "")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []string{AuditCreate, AuditUpdate}, operations(records))
+	s.Require().NotEmpty(next)
+	records, next, err = s.d.HistoryPage(s.ctx, s.cat, 2, next)
+	s.Require().NoError(err)
+	s.Require().Equal([]string{AuditUpdate}, operations(records))
+	assert.Equal(s.T(), []AuditChange{{Property: "Legs", Before: int64(2), After: int64(3)}}, records[0].Changes)
+	assert.Empty(s.T(), next)
+
+	_, _, err = s.d.HistoryPage(s.ctx, datastore.IncompleteKey("Animal", nil), 2, "")
+	assert.ErrorIs(s.T(), err, ErrInvalidArgument)
+}
+
+func (s *AuditTestSuite) TestIncompleteKeys() {
+	k, err := s.d.Put(s.ctx, datastore.IncompleteKey("Animal", nil), &Animal{Name: "bird"})
+	s.Require().NoError(err)
+	s.Require().False(k.Incomplete())
+	records, err := s.d.History(s.ctx, k)
+	s.Require().NoError(err)
+	s.Require().Len(records, 1)
+	assert.Equal(s.T(), AuditCreate, records[0].Operation)
+
+	keys, err := s.d.PutMulti(s.ctx, []*datastore.Key{datastore.IncompleteKey("Animal", nil), s.cat},
+		[]Animal{{Name: "fish"}, {Name: "cat"}})
+	s.Require().NoError(err)
+	var a Animal
+	s.Require().NoError(s.d.Get(s.ctx, keys[0], &a))
+	assert.Equal(s.T(), "fish", a.Name)
+	records, err = s.d.History(s.ctx, keys[0])
+	s.Require().NoError(err)
+	assert.Len(s.T(), records, 1)
+}
+
+func (s *AuditTestSuite) TestMulti() {
+	dog := datastore.NameKey("Animal", "dog", nil)
+	keys := []*datastore.Key{s.cat, dog}
+	_, err := s.d.CreateMulti(s.ctx, keys, []Animal{{Name: "cat"}, {Name: "dog"}}, BatchSize(1))
+	s.Require().NoError(err)
+	s.Require().NoError(s.d.UpdateMulti(s.ctx, keys, []Animal{{Name: "cat", Legs: 4}, {Name: "dog"}}))
+	s.Require().NoError(s.d.DeleteMulti(s.ctx, keys))
+
+	records, err := s.d.History(s.ctx, s.cat)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []string{AuditCreate, AuditUpdate, AuditDelete}, operations(records))
+	records, err = s.d.History(s.ctx, dog)
+	s.Require().NoError(err)
+	s.Require().Equal([]string{AuditCreate, AuditUpdate, AuditDelete}, operations(records))
+	assert.Empty(s.T(), records[1].Changes, "writing the same entity changes nothing")
+
+	_, err = s.d.PutMulti(s.ctx, []*datastore.Key{dog, nil}, []Animal{{Name: "dog"}, {Name: "ghost"}})
+	assert.Error(s.T(), err)
+	n, err := s.d.Count(s.ctx, NewQuery(AuditKind))
+	s.Require().NoError(err)
+	assert.Equal(s.T(), int64(6), n, "nothing recorded for a rejected batch")
+}
+
+func (s *AuditTestSuite) TestTransaction() {
+	dog := datastore.NameKey("Animal", "dog", nil)
+	_, err := s.d.Put(s.ctx, s.cat, &Animal{Name: "cat"})
+	s.Require().NoError(err)
+	err = s.d.RunInTransaction(ContextWithActor(s.ctx, "bob"), func(tx Tx) error {
+		var a Animal
+		if err := tx.Get(s.cat, &a); err != nil {
+			return err
+		}
+		a.Legs = 4
+		if _, err := tx.Put(s.cat, &a); err != nil {
+			return err
+		}
+		_, err := tx.Put(dog, &Animal{Name: "dog"})
+		return err
+	})
+	s.Require().NoError(err)
+	records, err := s.d.History(s.ctx, s.cat)
+	s.Require().NoError(err)
+	s.Require().Equal([]string{AuditCreate, AuditUpdate}, operations(records))
+	assert.Equal(s.T(), "bob", records[1].Actor)
+	assert.Equal(s.T(), []AuditChange{{Property: "Legs", Before: int64(0), After: int64(4)}}, records[1].Changes)
+
+	errAbort := errors.New("abort")
+	err = s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		if err := tx.Delete(dog); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	assert.ErrorIs(s.T(), err, errAbort)
+	records, err = s.d.History(s.ctx, dog)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []string{AuditCreate}, operations(records), "records roll back with their writes")
+
+	doc := datastore.NameKey("Document", "readme", nil)
+	s.Require().NoError(s.d.UpdateVersioned(s.ctx, doc, &Document{Title: "draft"}))
+	records, err = s.d.History(s.ctx, doc)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []string{AuditCreate}, operations(records))
+}
+
+// TestStagedWrites writes an entity twice in a transaction, which only the
+// memory driver allows.
+func TestStagedWrites(t *testing.T) {
+	d := NewAuditDriver(NewMemoryDriver())
+	ctx := context.Background()
+	cat := datastore.NameKey("Animal", "cat", nil)
+	_, err := d.Put(ctx, cat, &Animal{Name: "cat", Legs: 4})
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = d.RunInTransaction(ctx, func(tx Tx) error {
+		if _, err := tx.Put(cat, &Animal{Name: "cat", Legs: 3}); err != nil {
+			return err
+		}
+		if _, err := tx.Put(cat, &Animal{Name: "cat", Legs: 2}); err != nil {
+			return err
+		}
+		return tx.Delete(cat)
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	records, err := d.History(ctx, cat)
+	if !assert.NoError(t, err) || !assert.Len(t, records, 4) {
+		return
+	}
+	var changes [][]AuditChange
+	for _, r := range records[1:] {
+		if r.Operation != AuditDelete {
+			changes = append(changes, r.Changes)
+		}
+	}
+	assert.ElementsMatch(t, [][]AuditChange{
+		{{Property: "Legs", Before: int64(4), After: int64(3)}},
+		{{Property: "Legs", Before: int64(3), After: int64(2)}},
+	}, changes, "each write is diffed against the one staged before it")
+	for _, r := range records[1:] {
+		if r.Operation == AuditDelete {
+			assert.Contains(t, r.Changes, AuditChange{Property: "Legs", Before: int64(2)})
+		}
+	}
+}
+
+func (s *AuditTestSuite) TestValues() {
+	_, err := s.d.Put(s.ctx, s.cat, &datastore.PropertyList{
+		{Name: "Tags", Value: []interface{}{"small", "furry"}},
+		{Name: "Owner", Value: datastore.NameKey("Person", "alice", nil)},
+		{Name: "Note", Value: nil},
+	})
+	s.Require().NoError(err)
+	records, err := s.d.History(s.ctx, s.cat)
+	s.Require().NoError(err)
+	s.Require().Len(records, 1)
+	assert.Equal(s.T(), []AuditChange{
+		{Property: "Owner", After: datastore.NameKey("Person", "alice", nil)},
+		{Property: "Tags", After: []interface{}{"small", "furry"}},
+	}, records[0].Changes, "null properties are not changes")
+}
+
+func (s *AuditTestSuite) TestSink() {
+	sink := &recordingSink{}
+	d := NewAuditDriver(s.raw, AuditTo(sink))
+	_, err := d.Put(s.ctx, s.cat, &Animal{Name: "cat"})
+	s.Require().NoError(err)
+	s.Require().NoError(d.RunInTransaction(s.ctx, func(tx Tx) error {
+		return tx.Delete(s.cat)
+	}))
+	s.Require().Len(sink.records, 2)
+	assert.Equal(s.T(), []string{AuditCreate, AuditDelete}, operations(sink.records))
+	assert.Equal(s.T(), "alice", sink.records[1].Actor)
+
+	n, err := s.d.Count(s.ctx, NewQuery(AuditKind))
+	s.Require().NoError(err)
+	assert.Zero(s.T(), n, "the records are not stored")
+
+	sink.err = errors.New("sink down")
+	_, err = d.Put(s.ctx, s.cat, &Animal{Name: "cat"})
+	assert.ErrorIs(s.T(), err, sink.err)
+	var a Animal
+	assert.NoError(s.T(), d.Get(s.ctx, s.cat, &a), "the write committed")
+}
@@ -0,0 +1,287 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+)
+
+const (
+	// maxBatchMutations is the number of mutations a commit accepts.
+	maxBatchMutations = 500
+	// maxBatchLookups is the number of keys a lookup accepts.
+	maxBatchLookups = 1000
+)
+
+// ErrBatchSkipped marks the items of a batch that were not applied because
+// another item of the same chunk failed. Chunks commit atomically, so these
+// items can be retried as they are.
+var ErrBatchSkipped = errors.New("skipped: another item of its batch chunk failed")
+
+// BatchOption configures the multi-entity operations of a Driver.
+type BatchOption func(*batchOptions)
+
+type batchOptions struct {
+	size        int
+	parallelism int
+}
+
+func newBatchOptions(limit int, opts []BatchOption) batchOptions {
+	o := batchOptions{size: limit, parallelism: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.size > limit {
+		o.size = limit
+	}
+	return o
+}
+
+// BatchSize sets the number of entities sent per request. It is capped at
+// the backend limit, which is also the default. Values below one are
+// ignored.
+func BatchSize(size int) BatchOption {
+	return func(o *batchOptions) {
+		if size > 0 {
+			o.size = size
+		}
+	}
+}
+
+// BatchParallelism sets how many chunks run concurrently. The default runs
+// them one after another. Values below one are ignored.
+func BatchParallelism(n int) BatchOption {
+	return func(o *batchOptions) {
+		if n > 0 {
+			o.parallelism = n
+		}
+	}
+}
+
+// batchValues checks that src is a slice holding one entity per key.
+func batchValues(keys []*datastore.Key, src interface{}) (reflect.Value, error) {
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice {
+		return reflect.Value{}, invalidArgument(fmt.Errorf("%w: expected a slice, got %T", datastore.ErrInvalidEntityType, src))
+	}
+	if v.Len() != len(keys) {
+		return reflect.Value{}, invalidArgument(fmt.Errorf("%w: %d keys, %d entities", datastore.ErrDifferentKeyAndDstLength, len(keys), v.Len()))
+	}
+	return v, nil
+}
+
+// batchElem returns element i of the slice v in the form Get and Put take:
+// a struct pointer or a PropertyLoadSaver. Nil struct pointers are
+// allocated.
+func batchElem(v reflect.Value, i int) interface{} {
+	e := v.Index(i)
+	switch e.Kind() {
+	case reflect.Ptr:
+		if e.IsNil() {
+			e.Set(reflect.New(e.Type().Elem()))
+		}
+		return e.Interface()
+	case reflect.Interface:
+		return e.Interface()
+	}
+	return e.Addr().Interface()
+}
+
+// checkBatchKeys validates every key before anything is sent. When one is
+// invalid the whole batch is rejected with a MultiError marking the invalid
+// keys, the others being skipped.
+func checkBatchKeys(keys []*datastore.Key, allowIncomplete bool) error {
+	var errs datastore.MultiError
+	for i, k := range keys {
+		if validKey(k) && (allowIncomplete || !k.Incomplete()) {
+			continue
+		}
+		if errs == nil {
+			errs = make(datastore.MultiError, len(keys))
+		}
+		errs[i] = errInvalidKey
+	}
+	if errs == nil {
+		return nil
+	}
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = ErrBatchSkipped
+		}
+	}
+	return errs
+}
+
+// runBatch splits n items into chunks of the configured size and calls fn
+// with the bounds of each. fn returns nil, a MultiError covering its chunk,
+// or an error that applies to the whole chunk. The results are merged into
+// one MultiError indexed like the items, nil when every item succeeded.
+//
+// When atomic is set a chunk is all or nothing: items reported as nil in a
+// failed chunk are marked ErrBatchSkipped.
+func runBatch(ctx context.Context, n int, o batchOptions, atomic bool, fn func(ctx context.Context, lo, hi int) error) error {
+	errs := make(datastore.MultiError, n)
+	failed := false
+	var mu sync.Mutex
+	record := func(lo, hi int, err error) {
+		if err == nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		failed = true
+		var me datastore.MultiError
+		if errors.As(err, &me) && len(me) == hi-lo {
+			for i, e := range me {
+				if e == nil && atomic {
+					e = ErrBatchSkipped
+				}
+				errs[lo+i] = e
+			}
+			return
+		}
+		for i := lo; i < hi; i++ {
+			errs[i] = err
+		}
+	}
+
+	sem := make(chan struct{}, o.parallelism)
+	var wg sync.WaitGroup
+	for lo := 0; lo < n; lo += o.size {
+		hi := lo + o.size
+		if hi > n {
+			hi = n
+		}
+		sem <- struct{}{}
+		if err := ctx.Err(); err != nil {
+			<-sem
+			record(lo, hi, err)
+			continue
+		}
+		wg.Add(1)
+		go func(lo, hi int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			record(lo, hi, fn(ctx, lo, hi))
+		}(lo, hi)
+	}
+	wg.Wait()
+
+	if !failed {
+		return nil
+	}
+	return errs
+}
+
+// GetMulti loads the entities of keys into dst, a slice of the same length
+// holding structs, struct pointers or PropertyLoadSavers. Missing entities
+// are reported as ErrNotFound in the returned MultiError.
+func (d *driver) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}, opts ...BatchOption) error {
+	v, err := batchValues(keys, dst)
+	if err != nil {
+		return err
+	}
+	if err := checkBatchKeys(keys, false); err != nil {
+		return err
+	}
+
+	return runBatch(ctx, len(keys), newBatchOptions(maxBatchLookups, opts), false, func(ctx context.Context, lo, hi int) error {
+		return d.do(ctx, "GetMulti", true, func(ctx context.Context) error {
+			return d.client.GetMulti(ctx, keys[lo:hi], v.Slice(lo, hi).Interface())
+		})
+	})
+}
+
+// CreateMulti stores src, a slice holding one entity per key, and returns
+// the encoded complete keys. The key of an item that failed is empty.
+func (d *driver) CreateMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) ([]string, error) {
+	return encodeMulti(d.PutMulti(ctx, keys, src, opts...))
+}
+
+// PutMulti stores src, a slice holding one entity per key, and returns the
+// complete keys. The key of an item that failed is nil. Chunks holding an
+// incomplete key are not retried.
+func (d *driver) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) ([]*datastore.Key, error) {
+	v, err := batchValues(keys, src)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBatchKeys(keys, true); err != nil {
+		return nil, err
+	}
+
+	complete := make([]*datastore.Key, len(keys))
+	err = runBatch(ctx, len(keys), newBatchOptions(maxBatchMutations, opts), true, func(ctx context.Context, lo, hi int) error {
+		return d.do(ctx, "PutMulti", completeKeys(keys[lo:hi]), func(ctx context.Context) error {
+			newKeys, err := d.client.PutMulti(ctx, keys[lo:hi], v.Slice(lo, hi).Interface())
+			if err != nil {
+				return err
+			}
+			copy(complete[lo:], newKeys)
+			return nil
+		})
+	})
+	return complete, err
+}
+
+// completeKeys reports whether none of keys is incomplete.
+func completeKeys(keys []*datastore.Key) bool {
+	for _, k := range keys {
+		if k.Incomplete() {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeMulti encodes the keys returned by PutMulti, keeping its error.
+func encodeMulti(keys []*datastore.Key, err error) ([]string, error) {
+	if keys == nil {
+		return nil, err
+	}
+	ids := make([]string, len(keys))
+	for i, k := range keys {
+		if k != nil {
+			ids[i] = k.Encode()
+		}
+	}
+	return ids, err
+}
+
+// UpdateMulti stores src, a slice holding one entity per key, over the
+// existing entities.
+func (d *driver) UpdateMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) error {
+	v, err := batchValues(keys, src)
+	if err != nil {
+		return err
+	}
+	if err := checkBatchKeys(keys, false); err != nil {
+		return err
+	}
+
+	return runBatch(ctx, len(keys), newBatchOptions(maxBatchMutations, opts), true, func(ctx context.Context, lo, hi int) error {
+		return d.do(ctx, "UpdateMulti", true, func(ctx context.Context) error {
+			_, err := d.client.PutMulti(ctx, keys[lo:hi], v.Slice(lo, hi).Interface())
+			return err
+		})
+	})
+}
+
+// DeleteMulti deletes the entities of keys.
+func (d *driver) DeleteMulti(ctx context.Context, keys []*datastore.Key, opts ...BatchOption) error {
+	if err := checkBatchKeys(keys, false); err != nil {
+		return err
+	}
+
+	return runBatch(ctx, len(keys), newBatchOptions(maxBatchMutations, opts), true, func(ctx context.Context, lo, hi int) error {
+		return d.do(ctx, "DeleteMulti", true, func(ctx context.Context) error {
+			return d.client.DeleteMulti(ctx, keys[lo:hi])
+		})
+	})
+}
@@ -0,0 +1,149 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+// unsaveable fails to save, as an entity with an unsupported field would.
+type unsaveable struct{}
+
+var errUnsaveable = errors.New("unsaveable")
+
+func (unsaveable) Load([]datastore.Property) error     { return nil }
+func (unsaveable) Save() ([]datastore.Property, error) { return nil, errUnsaveable }
+
+type BatchTestSuite struct {
+	suite.Suite
+	newDriver func(t *testing.T) Driver
+	d         Driver
+	ctx       context.Context
+}
+
+func TestBatchTestSuite(t *testing.T) {
+	forEachDriver(t, func(newDriver func(*testing.T) Driver) suite.TestingSuite {
+		return &BatchTestSuite{newDriver: newDriver}
+	})
+}
+
+func (s *BatchTestSuite) SetupTest() {
+	s.d = s.newDriver(s.T())
+	s.ctx = context.Background()
+}
+
+func (s *BatchTestSuite) animals(n int) ([]*datastore.Key, []Animal) {
+	keys := make([]*datastore.Key, n)
+	animals := make([]Animal, n)
+	for i := range keys {
+		name := fmt.Sprintf("animal-%d", i)
+		keys[i] = datastore.NameKey("Animal", name, nil)
+		animals[i] = Animal{Name: name, Legs: i}
+	}
+	return keys, animals
+}
+
+func (s *BatchTestSuite) TestCreateGetDelete() {
+	keys := make([]*datastore.Key, 7)
+	animals := make([]Animal, len(keys))
+	for i := range keys {
+		keys[i] = datastore.IncompleteKey("Animal", nil)
+		animals[i] = Animal{Name: fmt.Sprintf("animal-%d", i), Legs: i}
+	}
+	ids, err := s.d.CreateMulti(s.ctx, keys, animals, BatchSize(3), BatchParallelism(2))
+	s.Require().NoError(err)
+	s.Require().Len(ids, len(keys))
+
+	created := make([]*datastore.Key, len(ids))
+	for i, id := range ids {
+		created[i], err = datastore.DecodeKey(id)
+		s.Require().NoError(err)
+		assert.False(s.T(), created[i].Incomplete())
+	}
+
+	got := make([]Animal, len(created))
+	assert.NoError(s.T(), s.d.GetMulti(s.ctx, created, got, BatchSize(2), BatchParallelism(3)))
+	assert.Equal(s.T(), animals, got)
+
+	assert.NoError(s.T(), s.d.DeleteMulti(s.ctx, created, BatchSize(3)))
+	err = s.d.GetMulti(s.ctx, created, make([]Animal, len(created)))
+	var me datastore.MultiError
+	s.Require().True(errors.As(err, &me))
+	for _, e := range me {
+		assert.ErrorIs(s.T(), e, ErrNotFound)
+	}
+}
+
+func (s *BatchTestSuite) TestUpdateMulti() {
+	keys, animals := s.animals(5)
+	s.Require().NoError(s.d.UpdateMulti(s.ctx, keys, animals, BatchSize(2)))
+
+	got := make([]*Animal, len(keys))
+	assert.NoError(s.T(), s.d.GetMulti(s.ctx, keys, got))
+	for i, a := range got {
+		assert.Equal(s.T(), animals[i], *a)
+	}
+}
+
+func (s *BatchTestSuite) TestGetMultiMissing() {
+	keys, animals := s.animals(4)
+	s.Require().NoError(s.d.UpdateMulti(s.ctx, keys[:3], animals[:3]))
+
+	got := make([]Animal, len(keys))
+	err := s.d.GetMulti(s.ctx, keys, got, BatchSize(3))
+	assert.Equal(s.T(), datastore.MultiError{nil, nil, nil, errNoSuchEntity}, err)
+	assert.Equal(s.T(), animals[:3], got[:3])
+}
+
+func (s *BatchTestSuite) TestPartialFailure() {
+	keys, animals := s.animals(5)
+	src := make([]interface{}, len(keys))
+	for i := range animals {
+		src[i] = &animals[i]
+	}
+	src[3] = unsaveable{}
+
+	err := s.d.UpdateMulti(s.ctx, keys, src, BatchSize(2), BatchParallelism(2))
+	var me datastore.MultiError
+	s.Require().True(errors.As(err, &me))
+	s.Require().Len(me, len(keys))
+	assert.NoError(s.T(), me[0])
+	assert.NoError(s.T(), me[1])
+	assert.Equal(s.T(), ErrBatchSkipped, me[2], "the chunk of a failed item is not applied")
+	assert.ErrorIs(s.T(), me[3], errUnsaveable)
+	assert.NoError(s.T(), me[4])
+
+	err = s.d.GetMulti(s.ctx, keys, make([]Animal, len(keys)))
+	assert.Equal(s.T(), datastore.MultiError{nil, nil, errNoSuchEntity, errNoSuchEntity, nil}, err)
+
+	// The skipped item can be retried on its own.
+	assert.NoError(s.T(), s.d.UpdateMulti(s.ctx, keys[2:3], animals[2:3]))
+}
+
+func (s *BatchTestSuite) TestInvalidArguments() {
+	keys, animals := s.animals(3)
+	keys[1] = datastore.IncompleteKey("Animal", nil)
+
+	err := s.d.UpdateMulti(s.ctx, keys, animals)
+	assert.Equal(s.T(), datastore.MultiError{ErrBatchSkipped, errInvalidKey, ErrBatchSkipped}, err)
+
+	_, err = s.d.CreateMulti(s.ctx, keys, animals[:2])
+	assert.ErrorIs(s.T(), err, datastore.ErrDifferentKeyAndDstLength)
+
+	err = s.d.GetMulti(s.ctx, keys, Animal{})
+	assert.ErrorIs(s.T(), err, datastore.ErrInvalidEntityType)
+}
+
+func (s *BatchTestSuite) TestCanceled() {
+	keys, _ := s.animals(3)
+	ctx, cancel := context.WithCancel(s.ctx)
+	cancel()
+
+	err := s.d.DeleteMulti(ctx, keys, BatchSize(1))
+	assert.Equal(s.T(), datastore.MultiError{context.Canceled, context.Canceled, context.Canceled}, err)
+}
@@ -0,0 +1,557 @@
+package datastore
+
+import (
+	"container/list"
+	"context"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+const (
+	// defaultCacheTTL is how long entities stay cached by default.
+	defaultCacheTTL = time.Minute
+	// defaultCacheSize is the number of entities the default backend holds.
+	defaultCacheSize = 10000
+	// cacheGenerations is the number of generation counters of a Cache,
+	// each shared by the keys hashing to it.
+	cacheGenerations = 256
+)
+
+// CacheBackend stores the entities of a Cache under opaque keys. It must be
+// safe for concurrent use. Entries may be dropped at any time, for instance
+// to bound the memory they take.
+type CacheBackend interface {
+	// Get returns the properties stored under key, unless they expired.
+	Get(key string) ([]datastore.Property, bool)
+	// Set stores props under key for ttl.
+	Set(key string, props []datastore.Property, ttl time.Duration)
+	// Delete drops the entry of key, if any.
+	Delete(key string)
+}
+
+// CacheStats reports how the lookups of a Cache were served.
+type CacheStats struct {
+	Hits   int64
+	Misses int64
+}
+
+// CacheOption configures NewCache.
+type CacheOption func(*Cache)
+
+// CacheTTL sets how long entities stay cached, one minute by default. It
+// bounds how long writes made around the cache, by other processes or
+// without the cached driver, may go unnoticed. Values below one are ignored.
+func CacheTTL(ttl time.Duration) CacheOption {
+	return func(c *Cache) {
+		if ttl > 0 {
+			c.ttl = ttl
+		}
+	}
+}
+
+// CacheUsing sets the backend of the cache, by default an in-memory backend
+// holding up to 10000 entities, see NewMemoryCache.
+func CacheUsing(b CacheBackend) CacheOption {
+	return func(c *Cache) {
+		c.backend = b
+	}
+}
+
+// Cache holds entities read by key, for the drivers returned by
+// NewCachedDriver. Entities are cached under the namespace their keys
+// resolve to, so the namespace views of a database can share a Cache, see
+// NewCachedDriver. Keys of other projects or databases are not told apart,
+// so a Cache must only be shared by drivers of one database. It is safe for
+// concurrent use.
+type Cache struct {
+	backend CacheBackend
+	ttl     time.Duration
+
+	hits   int64
+	misses int64
+
+	// generations are bumped by Invalidate, so fills read before an
+	// invalidation are not cached after it.
+	generations [cacheGenerations]cacheGeneration
+}
+
+type cacheGeneration struct {
+	mu sync.Mutex
+	n  uint64
+}
+
+// NewCache returns an empty cache.
+func NewCache(opts ...CacheOption) *Cache {
+	c := &Cache{ttl: defaultCacheTTL}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.backend == nil {
+		c.backend = NewMemoryCache(defaultCacheSize)
+	}
+	return c
+}
+
+// Stats returns the number of lookups served from the cache and from the
+// driver since the cache was created.
+func (c *Cache) Stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadInt64(&c.hits),
+		Misses: atomic.LoadInt64(&c.misses),
+	}
+}
+
+// Invalidate drops the entities of keys, typically written around the
+// cache. Invalid and incomplete keys are ignored.
+func (c *Cache) Invalidate(keys ...*datastore.Key) {
+	for _, k := range keys {
+		if !cacheable(k) {
+			continue
+		}
+		mk := memoryKey(k)
+		g := c.generationOf(mk)
+		g.mu.Lock()
+		g.n++
+		c.backend.Delete(mk)
+		g.mu.Unlock()
+	}
+}
+
+func (c *Cache) generationOf(mk string) *cacheGeneration {
+	h := fnv.New32a()
+	h.Write([]byte(mk))
+	return &c.generations[h.Sum32()%cacheGenerations]
+}
+
+// generation returns the generation of key, to be given to set along with
+// the properties read afterwards.
+func (c *Cache) generation(key *datastore.Key) uint64 {
+	g := c.generationOf(memoryKey(key))
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.n
+}
+
+// get returns a copy of the cached properties of key, counting the hit or
+// the miss.
+func (c *Cache) get(key *datastore.Key) ([]datastore.Property, bool) {
+	props, ok := c.backend.Get(memoryKey(key))
+	if ok {
+		atomic.AddInt64(&c.hits, 1)
+	} else {
+		atomic.AddInt64(&c.misses, 1)
+	}
+	return cloneProperties(props), ok
+}
+
+// set caches a copy of props, read from the driver at generation gen,
+// unless key was invalidated since.
+func (c *Cache) set(key *datastore.Key, props []datastore.Property, gen uint64) {
+	mk := memoryKey(key)
+	g := c.generationOf(mk)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.n == gen {
+		c.backend.Set(mk, cloneProperties(props), c.ttl)
+	}
+}
+
+// cloneProperties copies props deeply, so that changing the values loaded
+// from the cache, such as blobs or arrays, leaves the cache as it is.
+func cloneProperties(props []datastore.Property) []datastore.Property {
+	if props == nil {
+		return nil
+	}
+	c := make([]datastore.Property, len(props))
+	for i, p := range props {
+		c[i] = datastore.Property{Name: p.Name, Value: clonePropertyValue(p.Value), NoIndex: p.NoIndex}
+	}
+	return c
+}
+
+func clonePropertyValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case []byte:
+		return append([]byte(nil), x...)
+	case []interface{}:
+		values := make([]interface{}, len(x))
+		for i := range x {
+			values[i] = clonePropertyValue(x[i])
+		}
+		return values
+	case *datastore.Entity:
+		if x == nil {
+			return x
+		}
+		return &datastore.Entity{Key: cloneKey(x.Key), Properties: cloneProperties(x.Properties)}
+	case *datastore.Key:
+		return cloneKey(x)
+	}
+	return v
+}
+
+// cacheable reports whether k addresses an entity that can be cached.
+func cacheable(k *datastore.Key) bool {
+	return validKey(k) && !k.Incomplete()
+}
+
+// memoryCache is an in-memory CacheBackend evicting the least recently used
+// entries.
+type memoryCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List // of *memoryCacheEntry, the most recently used first
+	now     func() time.Time
+}
+
+type memoryCacheEntry struct {
+	key     string
+	props   []datastore.Property
+	expires time.Time
+}
+
+// NewMemoryCache returns an in-memory CacheBackend holding up to size
+// entities, evicting the least recently used ones. A size below one is
+// unbounded.
+func NewMemoryCache(size int) CacheBackend {
+	return &memoryCache{
+		size:    size,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+func (m *memoryCache) Get(key string) ([]datastore.Property, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*memoryCacheEntry)
+	if !m.now().Before(e.expires) {
+		m.remove(el)
+		return nil, false
+	}
+	m.lru.MoveToFront(el)
+	return e.props, true
+}
+
+func (m *memoryCache) Set(key string, props []datastore.Property, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := &memoryCacheEntry{key: key, props: props, expires: m.now().Add(ttl)}
+	if el, ok := m.entries[key]; ok {
+		el.Value = e
+		m.lru.MoveToFront(el)
+		return
+	}
+	m.entries[key] = m.lru.PushFront(e)
+	for m.size > 0 && m.lru.Len() > m.size {
+		m.remove(m.lru.Back())
+	}
+}
+
+func (m *memoryCache) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.entries[key]; ok {
+		m.remove(el)
+	}
+}
+
+func (m *memoryCache) remove(el *list.Element) {
+	m.lru.Remove(el)
+	delete(m.entries, el.Value.(*memoryCacheEntry).key)
+}
+
+var _ Driver = (*cachedDriver)(nil)
+
+// cachedDriver serves the lookups of a Driver from a Cache. Queries and the
+// reads of transactions always go to the driver.
+type cachedDriver struct {
+	d     Driver
+	cache *Cache
+	// view is the namespace view d reads through, if any.
+	view *namespaceDriver
+}
+
+// NewCachedDriver returns d reading entities through cache: Get and GetMulti
+// are served from the cache when they can, and fill it otherwise. Every
+// write and delete made through the returned driver, transactions included,
+// invalidates the entities it touched once it returned. Closing it closes d
+// and leaves the cache as it is.
+//
+// When d is a view returned by NewNamespaceDriver, possibly wrapped by the
+// other drivers of this package, keys are cached in the namespace of the
+// view, so views of several namespaces may share a cache.
+func NewCachedDriver(d Driver, cache *Cache) Driver {
+	return &cachedDriver{d: d, cache: cache, view: namespaceView(d)}
+}
+
+// namespaceView returns the namespace view d reads through, looking through
+// the wrappers of this package, or nil when there is none.
+func namespaceView(d Driver) *namespaceDriver {
+	for {
+		switch x := d.(type) {
+		case *namespaceDriver:
+			return x
+		case *interceptedDriver:
+			d = x.d
+		case *cachedDriver:
+			d = x.d
+		case *lifecycleDriver:
+			d = x.d
+		case *SoftDeleteDriver:
+			d = x.d
+		case *AuditDriver:
+			d = x.d
+		case *registryDriver:
+			d = x.Driver
+		default:
+			return nil
+		}
+	}
+}
+
+// cacheKey returns the key k is cached under, the one of the namespace it
+// resolves to, and false when it cannot be cached.
+func (c *cachedDriver) cacheKey(k *datastore.Key) (*datastore.Key, bool) {
+	if !cacheable(k) {
+		return nil, false
+	}
+	if c.view == nil {
+		return k, true
+	}
+	scoped, err := c.view.scopeKey(k)
+	return scoped, err == nil
+}
+
+// invalidate drops the cached entities of keys.
+func (c *cachedDriver) invalidate(keys ...*datastore.Key) {
+	scoped := make([]*datastore.Key, 0, len(keys))
+	for _, k := range keys {
+		if ck, ok := c.cacheKey(k); ok {
+			scoped = append(scoped, ck)
+		}
+	}
+	c.cache.Invalidate(scoped...)
+}
+
+func (c *cachedDriver) Find(ctx context.Context, q *Query) (Iterator, error) {
+	return c.d.Find(ctx, q)
+}
+
+func (c *cachedDriver) FindIds(ctx context.Context, q *Query) ([]string, error) {
+	return c.d.FindIds(ctx, q)
+}
+
+func (c *cachedDriver) FindKeys(ctx context.Context, q *Query) ([]*datastore.Key, error) {
+	return c.d.FindKeys(ctx, q)
+}
+
+func (c *cachedDriver) FindPage(ctx context.Context, q *Query, pageSize int, pageToken string, dst interface{}) (*Page, error) {
+	return c.d.FindPage(ctx, q, pageSize, pageToken, dst)
+}
+
+func (c *cachedDriver) FindIdsPage(ctx context.Context, q *Query, pageSize int, pageToken string) ([]string, string, error) {
+	return c.d.FindIdsPage(ctx, q, pageSize, pageToken)
+}
+
+func (c *cachedDriver) Aggregate(ctx context.Context, q *Query, aggs ...Aggregation) (AggregationResult, error) {
+	return c.d.Aggregate(ctx, q, aggs...)
+}
+
+func (c *cachedDriver) Count(ctx context.Context, q *Query) (int64, error) {
+	return c.d.Count(ctx, q)
+}
+
+func (c *cachedDriver) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	ck, ok := c.cacheKey(key)
+	if !ok {
+		return c.d.Get(ctx, key, dst)
+	}
+	if props, ok := c.cache.get(ck); ok {
+		return loadEntity(dst, ck, props)
+	}
+	gen := c.cache.generation(ck)
+	var props datastore.PropertyList
+	if err := c.d.Get(ctx, key, &props); err != nil {
+		return err
+	}
+	c.cache.set(ck, props, gen)
+	return loadEntity(dst, ck, props)
+}
+
+func (c *cachedDriver) Create(ctx context.Context, key *datastore.Key, object interface{}) (string, error) {
+	defer c.invalidate(key)
+	return c.d.Create(ctx, key, object)
+}
+
+func (c *cachedDriver) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	defer c.invalidate(key)
+	return c.d.Put(ctx, key, src)
+}
+
+func (c *cachedDriver) Delete(ctx context.Context, key *datastore.Key) error {
+	defer c.invalidate(key)
+	return c.d.Delete(ctx, key)
+}
+
+func (c *cachedDriver) Update(ctx context.Context, key *datastore.Key, data interface{}) error {
+	defer c.invalidate(key)
+	return c.d.Update(ctx, key, data)
+}
+
+func (c *cachedDriver) UpdateVersioned(ctx context.Context, key *datastore.Key, data Versioned) error {
+	defer c.invalidate(key)
+	return c.d.UpdateVersioned(ctx, key, data)
+}
+
+// GetMulti serves the keys it can from the cache and looks the others up in
+// one GetMulti of the driver.
+func (c *cachedDriver) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}, opts ...BatchOption) error {
+	v, err := batchValues(keys, dst)
+	if err != nil {
+		return err
+	}
+	if err := checkBatchKeys(keys, false); err != nil {
+		return err
+	}
+
+	errs := make(datastore.MultiError, len(keys))
+	cacheKeys := make([]*datastore.Key, len(keys))
+	var missed []int
+	for i, k := range keys {
+		ck, ok := c.cacheKey(k)
+		if !ok {
+			missed = append(missed, i)
+			continue
+		}
+		cacheKeys[i] = ck
+		if props, ok := c.cache.get(ck); ok {
+			errs[i] = loadEntity(batchElem(v, i), ck, props)
+		} else {
+			missed = append(missed, i)
+		}
+	}
+
+	if len(missed) > 0 {
+		missedKeys := make([]*datastore.Key, len(missed))
+		gens := make([]uint64, len(missed))
+		for j, i := range missed {
+			missedKeys[j] = keys[i]
+			if cacheKeys[i] != nil {
+				gens[j] = c.cache.generation(cacheKeys[i])
+			}
+		}
+		loaded := make([]datastore.PropertyList, len(missed))
+		err := c.d.GetMulti(ctx, missedKeys, loaded, opts...)
+		me, ok := err.(datastore.MultiError)
+		if err != nil && !ok {
+			return err
+		}
+		for j, i := range missed {
+			if ok && me[j] != nil {
+				errs[i] = me[j]
+				continue
+			}
+			key := keys[i]
+			if cacheKeys[i] != nil {
+				key = cacheKeys[i]
+				c.cache.set(key, loaded[j], gens[j])
+			}
+			errs[i] = loadEntity(batchElem(v, i), key, loaded[j])
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return errs
+		}
+	}
+	return nil
+}
+
+func (c *cachedDriver) CreateMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) ([]string, error) {
+	defer c.invalidate(keys...)
+	return c.d.CreateMulti(ctx, keys, src, opts...)
+}
+
+func (c *cachedDriver) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) ([]*datastore.Key, error) {
+	defer c.invalidate(keys...)
+	return c.d.PutMulti(ctx, keys, src, opts...)
+}
+
+func (c *cachedDriver) UpdateMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) error {
+	defer c.invalidate(keys...)
+	return c.d.UpdateMulti(ctx, keys, src, opts...)
+}
+
+func (c *cachedDriver) DeleteMulti(ctx context.Context, keys []*datastore.Key, opts ...BatchOption) error {
+	defer c.invalidate(keys...)
+	return c.d.DeleteMulti(ctx, keys, opts...)
+}
+
+func (c *cachedDriver) AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	return c.d.AllocateIDs(ctx, keys)
+}
+
+func (c *cachedDriver) ReserveIDs(ctx context.Context, keys []*datastore.Key) error {
+	return c.d.ReserveIDs(ctx, keys)
+}
+
+// RunInTransaction invalidates the keys written by every attempt of f once
+// the transaction returned, whether it committed or not.
+func (c *cachedDriver) RunInTransaction(ctx context.Context, f func(tx Tx) error, opts ...TxOption) error {
+	written := &writtenKeys{}
+	defer func() {
+		c.invalidate(written.keys...)
+	}()
+	return c.d.RunInTransaction(ctx, func(tx Tx) error {
+		return f(&cachedTx{tx: tx, written: written})
+	}, opts...)
+}
+
+func (c *cachedDriver) Close() error {
+	return c.d.Close()
+}
+
+// writtenKeys collects the keys written by the attempts of a transaction.
+type writtenKeys struct {
+	mu   sync.Mutex
+	keys []*datastore.Key
+}
+
+func (w *writtenKeys) add(key *datastore.Key) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.keys = append(w.keys, key)
+}
+
+// cachedTx records the keys a transaction writes. Its reads are not cached,
+// as they must see the snapshot of the transaction.
+type cachedTx struct {
+	tx      Tx
+	written *writtenKeys
+}
+
+func (t *cachedTx) Get(key *datastore.Key, dst interface{}) error {
+	return t.tx.Get(key, dst)
+}
+
+func (t *cachedTx) Put(key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	t.written.add(key)
+	return t.tx.Put(key, src)
+}
+
+func (t *cachedTx) Delete(key *datastore.Key) error {
+	t.written.add(key)
+	return t.tx.Delete(key)
+}
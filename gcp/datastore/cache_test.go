@@ -0,0 +1,314 @@
+package datastore
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type CacheTestSuite struct {
+	suite.Suite
+	newDriver func(t *testing.T) Driver
+	inner     Driver
+	cache     *Cache
+	d         Driver
+	ctx       context.Context
+}
+
+func TestCacheTestSuite(t *testing.T) {
+	forEachDriver(t, func(newDriver func(*testing.T) Driver) suite.TestingSuite {
+		return &CacheTestSuite{newDriver: newDriver}
+	})
+}
+
+func (s *CacheTestSuite) SetupTest() {
+	s.ctx = context.Background()
+	s.inner = s.newDriver(s.T())
+	s.cache = NewCache()
+	s.d = NewCachedDriver(s.inner, s.cache)
+	s.Require().NoError(s.inner.Update(s.ctx, datastore.NameKey("Animal", "cat", nil), &Animal{Name: "cat", Legs: 4}))
+}
+
+func (s *CacheTestSuite) TestReadThrough() {
+	k := datastore.NameKey("Animal", "cat", nil)
+	for i := 0; i < 3; i++ {
+		var a Animal
+		s.Require().NoError(s.d.Get(s.ctx, k, &a))
+		assert.Equal(s.T(), Animal{Name: "cat", Legs: 4}, a)
+	}
+	assert.Equal(s.T(), CacheStats{Hits: 2, Misses: 1}, s.cache.Stats())
+
+	err := s.d.Get(s.ctx, datastore.NameKey("Animal", "cow", nil), &Animal{})
+	assert.ErrorIs(s.T(), err, ErrNotFound)
+	err = s.d.Get(s.ctx, datastore.IncompleteKey("Animal", nil), &Animal{})
+	assert.ErrorIs(s.T(), err, ErrInvalidArgument)
+	assert.Equal(s.T(), CacheStats{Hits: 2, Misses: 2}, s.cache.Stats(), "invalid keys are not looked up")
+
+	var legless struct{ Name, Sound, FoodType string }
+	err = s.d.Get(s.ctx, k, &legless)
+	assert.ErrorIs(s.T(), err, ErrFieldMismatch, "cached entities load like stored ones")
+	assert.Equal(s.T(), "cat", legless.Name)
+}
+
+func (s *CacheTestSuite) TestInvalidation() {
+	k := datastore.NameKey("Animal", "cat", nil)
+	get := func() (Animal, error) {
+		var a Animal
+		err := s.d.Get(s.ctx, k, &a)
+		return a, err
+	}
+
+	_, err := get()
+	s.Require().NoError(err)
+	s.Require().NoError(s.d.Update(s.ctx, k, &Animal{Name: "cat", Legs: 3}))
+	a, err := get()
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 3, a.Legs)
+
+	s.Require().NoError(s.d.UpdateMulti(s.ctx, []*datastore.Key{k}, []Animal{{Name: "cat", Legs: 2}}))
+	a, err = get()
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 2, a.Legs)
+
+	err = s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		_, err := tx.Put(k, &Animal{Name: "cat", Legs: 1})
+		return err
+	})
+	s.Require().NoError(err)
+	a, err = get()
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 1, a.Legs)
+
+	s.Require().NoError(s.d.Delete(s.ctx, k))
+	_, err = get()
+	assert.ErrorIs(s.T(), err, ErrNotFound)
+	assert.Equal(s.T(), CacheStats{Hits: 0, Misses: 5}, s.cache.Stats())
+}
+
+func (s *CacheTestSuite) TestWritesAround() {
+	k := datastore.NameKey("Animal", "cat", nil)
+	s.Require().NoError(s.d.Get(s.ctx, k, &Animal{}))
+	s.Require().NoError(s.inner.Update(s.ctx, k, &Animal{Name: "cat", Legs: 3}))
+
+	var a Animal
+	s.Require().NoError(s.d.Get(s.ctx, k, &a))
+	assert.Equal(s.T(), 4, a.Legs, "writes around the cache go unnoticed")
+
+	s.cache.Invalidate(k)
+	s.Require().NoError(s.d.Get(s.ctx, k, &a))
+	assert.Equal(s.T(), 3, a.Legs)
+}
+
+func (s *CacheTestSuite) TestNamespaces() {
+	tenants := map[string]Driver{}
+	for _, ns := range []string{"a", "b"} {
+		tenants[ns] = NewCachedDriver(NewInterceptedDriver(NewNamespaceDriver(s.inner, ns)), s.cache)
+	}
+	k := datastore.NameKey("Animal", "dog", nil)
+	s.Require().NoError(tenants["a"].Update(s.ctx, k, &Animal{Name: "rex"}))
+	s.Require().NoError(tenants["b"].Update(s.ctx, k, &Animal{Name: "fido"}))
+
+	for i := 0; i < 2; i++ {
+		for ns, name := range map[string]string{"a": "rex", "b": "fido"} {
+			var a Animal
+			s.Require().NoError(tenants[ns].Get(s.ctx, k, &a))
+			assert.Equal(s.T(), name, a.Name, "tenants do not share cached entities")
+			dogs := make([]Animal, 1)
+			s.Require().NoError(tenants[ns].GetMulti(s.ctx, []*datastore.Key{k}, dogs))
+			assert.Equal(s.T(), name, dogs[0].Name)
+		}
+	}
+	assert.Equal(s.T(), CacheStats{Hits: 6, Misses: 2}, s.cache.Stats())
+
+	scoped := datastore.NameKey("Animal", "dog", nil)
+	scoped.Namespace = "a"
+	s.Require().NoError(s.inner.Update(s.ctx, scoped, &Animal{Name: "max"}))
+	s.cache.Invalidate(scoped)
+	var a Animal
+	s.Require().NoError(tenants["a"].Get(s.ctx, k, &a))
+	assert.Equal(s.T(), "max", a.Name, "entities are invalidated by the key of their namespace")
+}
+
+func (s *CacheTestSuite) TestGetMulti() {
+	keys := []*datastore.Key{
+		datastore.NameKey("Animal", "cat", nil),
+		datastore.NameKey("Animal", "dog", nil),
+		datastore.NameKey("Animal", "cow", nil),
+	}
+	s.Require().NoError(s.inner.Update(s.ctx, keys[1], &Animal{Name: "dog", Legs: 4}))
+	s.Require().NoError(s.d.Get(s.ctx, keys[0], &Animal{}))
+
+	dst := make([]*Animal, 3)
+	err := s.d.GetMulti(s.ctx, keys, dst)
+	var me datastore.MultiError
+	s.Require().ErrorAs(err, &me)
+	s.Require().Len(me, 3)
+	assert.NoError(s.T(), me[0])
+	assert.NoError(s.T(), me[1])
+	assert.ErrorIs(s.T(), me[2], ErrNotFound)
+	assert.Equal(s.T(), "cat", dst[0].Name)
+	assert.Equal(s.T(), "dog", dst[1].Name)
+	assert.Equal(s.T(), CacheStats{Hits: 1, Misses: 3}, s.cache.Stats())
+
+	dst = make([]*Animal, 2)
+	s.Require().NoError(s.d.GetMulti(s.ctx, keys[:2], dst))
+	assert.Equal(s.T(), "dog", dst[1].Name)
+	assert.Equal(s.T(), CacheStats{Hits: 3, Misses: 3}, s.cache.Stats())
+
+	err = s.d.GetMulti(s.ctx, []*datastore.Key{keys[0], nil}, make([]Animal, 2))
+	s.Require().ErrorAs(err, &me)
+	assert.ErrorIs(s.T(), me[0], ErrBatchSkipped)
+	assert.ErrorIs(s.T(), me[1], ErrInvalidArgument)
+}
+
+// pausedDriver holds the lookups of the driver it wraps once they read
+// their entities, until resume is closed.
+type pausedDriver struct {
+	Driver
+	read   chan struct{}
+	resume chan struct{}
+}
+
+func (p *pausedDriver) pause() {
+	select {
+	case p.read <- struct{}{}:
+	default:
+	}
+	<-p.resume
+}
+
+func (p *pausedDriver) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	defer p.pause()
+	return p.Driver.Get(ctx, key, dst)
+}
+
+func (p *pausedDriver) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}, opts ...BatchOption) error {
+	defer p.pause()
+	return p.Driver.GetMulti(ctx, keys, dst, opts...)
+}
+
+func (s *CacheTestSuite) TestStaleFill() {
+	k := datastore.NameKey("Animal", "cat", nil)
+	for legs, lookup := range map[int]func(d Driver) error{
+		3: func(d Driver) error { return d.Get(s.ctx, k, &Animal{}) },
+		2: func(d Driver) error { return d.GetMulti(s.ctx, []*datastore.Key{k}, make([]Animal, 1)) },
+	} {
+		s.cache.Invalidate(k)
+		paused := &pausedDriver{Driver: s.inner, read: make(chan struct{}, 1), resume: make(chan struct{})}
+		done := make(chan error, 1)
+		go func() {
+			done <- lookup(NewCachedDriver(paused, s.cache))
+		}()
+		<-paused.read
+		s.Require().NoError(s.d.Update(s.ctx, k, &Animal{Name: "cat", Legs: legs}))
+		close(paused.resume)
+		s.Require().NoError(<-done)
+
+		var a Animal
+		s.Require().NoError(s.d.Get(s.ctx, k, &a))
+		assert.Equal(s.T(), legs, a.Legs, "the entity read before the update is not cached")
+	}
+}
+
+func (s *CacheTestSuite) TestLoadedCopies() {
+	k := datastore.NameKey("Animal", "cat", nil)
+	s.Require().NoError(s.inner.Update(s.ctx, k, &datastore.PropertyList{
+		{Name: "Blob", Value: []byte("abc"), NoIndex: true},
+		{Name: "Tags", Value: []interface{}{"small"}},
+	}))
+	for i := 0; i < 3; i++ {
+		var props datastore.PropertyList
+		s.Require().NoError(s.d.Get(s.ctx, k, &props))
+		blob, tags := props[propertyIndex(props, "Blob")].Value, props[propertyIndex(props, "Tags")].Value
+		assert.Equal(s.T(), []byte("abc"), blob)
+		assert.Equal(s.T(), []interface{}{"small"}, tags)
+		blob.([]byte)[0] = 'x'
+		tags.([]interface{})[0] = "big"
+	}
+	assert.Equal(s.T(), CacheStats{Hits: 2, Misses: 1}, s.cache.Stats())
+}
+
+func TestMemoryCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := NewMemoryCache(2).(*memoryCache)
+	c.now = func() time.Time { return now }
+	props := []datastore.Property{{Name: "Name", Value: "cat"}}
+
+	c.Set("a", props, time.Minute)
+	c.Set("b", props, time.Minute)
+	_, ok := c.Get("a")
+	assert.True(t, ok)
+	c.Set("c", props, time.Minute)
+	_, ok = c.Get("b")
+	assert.False(t, ok, "the least recently used entry is evicted")
+	got, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, props, got)
+
+	now = now.Add(time.Minute)
+	_, ok = c.Get("a")
+	assert.False(t, ok, "the entry expired")
+	assert.Equal(t, 1, c.lru.Len(), "expired entries are dropped")
+
+	c.Delete("c")
+	_, ok = c.Get("c")
+	assert.False(t, ok)
+	assert.Empty(t, c.entries)
+}
+
+// mapCache is a CacheBackend ignoring TTLs.
+type mapCache struct {
+	mu      sync.Mutex
+	entries map[string][]datastore.Property
+	ttl     time.Duration
+}
+
+func (m *mapCache) Get(key string) ([]datastore.Property, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	props, ok := m.entries[key]
+	return props, ok
+}
+
+func (m *mapCache) Set(key string, props []datastore.Property, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[key], m.ttl = props, ttl
+}
+
+func (m *mapCache) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+}
+
+func TestCacheBackend(t *testing.T) {
+	backend := &mapCache{entries: map[string][]datastore.Property{}}
+	cache := NewCache(CacheUsing(backend), CacheTTL(time.Hour))
+	d := NewCachedDriver(NewMemoryDriver(), cache)
+	ctx := context.Background()
+	zoo := datastore.NameKey("Zoo", "north", nil)
+	zoo.Namespace = "tenant"
+	k := datastore.NameKey("Animal", "cat", zoo)
+	k.Namespace = "tenant"
+
+	if !assert.NoError(t, d.Update(ctx, k, &Animal{Name: "cat"})) {
+		return
+	}
+	assert.NoError(t, d.Get(ctx, k, &Animal{}))
+	assert.Len(t, backend.entries, 1)
+	assert.Equal(t, time.Hour, backend.ttl)
+
+	var a Animal
+	backend.entries[memoryKey(k)] = []datastore.Property{{Name: "Name", Value: "tiger"}}
+	assert.NoError(t, d.Get(ctx, k, &a))
+	assert.Equal(t, "tiger", a.Name, "the entity is read from the backend")
+
+	assert.NoError(t, d.Delete(ctx, k))
+	assert.Empty(t, backend.entries)
+}
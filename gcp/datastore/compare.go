@@ -0,0 +1,216 @@
+package datastore
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Value ranks follow the cross-type sort order of Datastore: values of
+// different types never compare equal and sort by type first.
+const (
+	rankNull = iota
+	rankBool
+	rankNumber
+	rankTime
+	rankString
+	rankBytes
+	rankKey
+	rankGeoPoint
+	rankEntity
+	rankOther
+)
+
+// normalizeValue converts a Go value to the representation the client saves
+// it with: signed 64-bit integers, 64-bit floats and untyped slices.
+func normalizeValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case nil, bool, int64, float64, string, []byte, time.Time, *datastore.Key, datastore.GeoPoint, *datastore.Entity:
+		return v
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, e := range x {
+			out[i] = normalizeValue(e)
+		}
+		return out
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return rv.Bytes()
+		}
+		out := make([]interface{}, rv.Len())
+		for i := range out {
+			out[i] = normalizeValue(rv.Index(i).Interface())
+		}
+		return out
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return nil
+		}
+		return normalizeValue(rv.Elem().Interface())
+	}
+	return v
+}
+
+// valueElems returns the elements of a multi-valued property, or the value
+// itself.
+func valueElems(v interface{}) []interface{} {
+	if vs, ok := v.([]interface{}); ok {
+		return vs
+	}
+	return []interface{}{v}
+}
+
+func valueRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return rankNull
+	case bool:
+		return rankBool
+	case int64, float64:
+		return rankNumber
+	case time.Time:
+		return rankTime
+	case string:
+		return rankString
+	case []byte:
+		return rankBytes
+	case *datastore.Key:
+		return rankKey
+	case datastore.GeoPoint:
+		return rankGeoPoint
+	case *datastore.Entity:
+		return rankEntity
+	}
+	return rankOther
+}
+
+// compareValues orders two normalized values the way the backend does.
+func compareValues(a, b interface{}) int {
+	ra, rb := valueRank(a), valueRank(b)
+	if ra != rb {
+		return compareInts(int64(ra), int64(rb))
+	}
+
+	switch x := a.(type) {
+	case bool:
+		y := b.(bool)
+		switch {
+		case x == y:
+			return 0
+		case !x:
+			return -1
+		}
+		return 1
+	case int64:
+		if y, ok := b.(int64); ok {
+			return compareInts(x, y)
+		}
+		return compareFloats(float64(x), b.(float64))
+	case float64:
+		if y, ok := b.(int64); ok {
+			return compareFloats(x, float64(y))
+		}
+		return compareFloats(x, b.(float64))
+	case time.Time:
+		return compareInts(x.UnixMicro(), b.(time.Time).UnixMicro())
+	case string:
+		return strings.Compare(x, b.(string))
+	case []byte:
+		return bytes.Compare(x, b.([]byte))
+	case *datastore.Key:
+		return compareKeys(x, b.(*datastore.Key))
+	case datastore.GeoPoint:
+		y := b.(datastore.GeoPoint)
+		if c := compareFloats(x.Lat, y.Lat); c != 0 {
+			return c
+		}
+		return compareFloats(x.Lng, y.Lng)
+	}
+	return 0
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// keyPath returns the elements of k from the root down.
+func keyPath(k *datastore.Key) []*datastore.Key {
+	var path []*datastore.Key
+	for ; k != nil; k = k.Parent {
+		path = append([]*datastore.Key{k}, path...)
+	}
+	return path
+}
+
+// compareKeys orders keys by namespace, then path element by path element:
+// kind first, numeric IDs before names, ancestors before descendants.
+func compareKeys(a, b *datastore.Key) int {
+	if c := strings.Compare(a.Namespace, b.Namespace); c != 0 {
+		return c
+	}
+	pa, pb := keyPath(a), keyPath(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		x, y := pa[i], pb[i]
+		if c := strings.Compare(x.Kind, y.Kind); c != 0 {
+			return c
+		}
+		switch {
+		case x.Name == "" && y.Name != "":
+			return -1
+		case x.Name != "" && y.Name == "":
+			return 1
+		case x.Name != "":
+			if c := strings.Compare(x.Name, y.Name); c != 0 {
+				return c
+			}
+		default:
+			if c := compareInts(x.ID, y.ID); c != 0 {
+				return c
+			}
+		}
+	}
+	return compareInts(int64(len(pa)), int64(len(pb)))
+}
+
+// hasAncestor reports whether ancestor is k or one of its parents.
+func hasAncestor(k, ancestor *datastore.Key) bool {
+	for ; k != nil; k = k.Parent {
+		if k.Equal(ancestor) {
+			return true
+		}
+	}
+	return false
+}
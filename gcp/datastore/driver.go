@@ -3,104 +3,211 @@ package datastore
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/datastore"
+	"google.golang.org/api/option"
 )
 
-var instance *driver
-
 type Driver interface {
-	Find(ancestorId *datastore.Key, objectType string, filter *DataFilter, sort string) *datastore.Iterator
-	FindIds(ancestorId *datastore.Key, objectType string, filter *DataFilter, sort string) ([]string, error)
-	Create(key *datastore.Key, object interface{}) (string, error)
-	Delete(key *datastore.Key) error
-	Update(key *datastore.Key, data interface{}) error
-	close()
+	Find(ctx context.Context, q *Query) (Iterator, error)
+	FindIds(ctx context.Context, q *Query) ([]string, error)
+	FindKeys(ctx context.Context, q *Query) ([]*datastore.Key, error)
+	FindPage(ctx context.Context, q *Query, pageSize int, pageToken string, dst interface{}) (*Page, error)
+	FindIdsPage(ctx context.Context, q *Query, pageSize int, pageToken string) ([]string, string, error)
+	Aggregate(ctx context.Context, q *Query, aggs ...Aggregation) (AggregationResult, error)
+	Count(ctx context.Context, q *Query) (int64, error)
+	Get(ctx context.Context, key *datastore.Key, dst interface{}) error
+	Create(ctx context.Context, key *datastore.Key, object interface{}) (string, error)
+	Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error)
+	Delete(ctx context.Context, key *datastore.Key) error
+	Update(ctx context.Context, key *datastore.Key, data interface{}) error
+	UpdateVersioned(ctx context.Context, key *datastore.Key, data Versioned) error
+	GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}, opts ...BatchOption) error
+	CreateMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) ([]string, error)
+	PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) ([]*datastore.Key, error)
+	UpdateMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) error
+	DeleteMulti(ctx context.Context, keys []*datastore.Key, opts ...BatchOption) error
+	AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error)
+	ReserveIDs(ctx context.Context, keys []*datastore.Key) error
+	RunInTransaction(ctx context.Context, f func(tx Tx) error, opts ...TxOption) error
+	// Close releases the resources of the driver. It must not be used
+	// afterwards.
+	Close() error
 }
 
-type driver struct {
-	client *datastore.Client
+// Option configures the driver returned by NewDriver.
+type Option func(*driver)
+
+// WithTimeout sets the default timeout applied to operations whose context
+// carries no deadline. A zero or negative value disables the default.
+func WithTimeout(timeout time.Duration) Option {
+	return func(d *driver) {
+		d.timeout = timeout
+	}
 }
 
-func newDriver(projectId string) (Driver, error) {
-	if instance == nil {
-		instance = new(driver)
-		c, err := datastore.NewClient(context.Background(), projectId)
-		if err != nil {
-			return nil, err
-		}
-		instance.client = c
+// WithDatabase selects a named database of the project instead of the
+// default one.
+func WithDatabase(databaseID string) Option {
+	return func(d *driver) {
+		d.database = databaseID
 	}
-	return instance, nil
 }
 
-func (d *driver) close() {
-	err := d.client.Close()
-	if err != nil {
-		fmt.Printf("ERROR: datastore client close failure: %v\n", err)
-		// logger.Log().Err(err).Msg("datastore client close failure")
+// WithClientOptions passes options, such as credentials or an endpoint, to
+// the underlying client.
+func WithClientOptions(opts ...option.ClientOption) Option {
+	return func(d *driver) {
+		d.clientOpts = append(d.clientOpts, opts...)
 	}
 }
 
-func (d *driver) FindIds(ancestor *datastore.Key, objectType string, filter *DataFilter, sort string) (keys []string, err error) {
-	q := datastore.NewQuery(objectType)
+type driver struct {
+	client     *datastore.Client
+	timeout    time.Duration
+	database   string
+	clientOpts []option.ClientOption
+	retry      RetryPolicy
+
+	interceptors []Interceptor
+
+	closeOnce sync.Once
+	closeErr  error
+}
 
-	if ancestor != nil {
-		q = q.Ancestor(ancestor)
+// NewDriver returns a Driver backed by a new client for projectId. Every
+// call creates its own client, so a process can talk to several projects
+// and databases; the caller owns the driver and must Close it.
+func NewDriver(ctx context.Context, projectId string, opts ...Option) (Driver, error) {
+	d, err := newDriver(ctx, projectId, opts...)
+	if err != nil {
+		return nil, err
 	}
+	return d.intercepted(), nil
+}
 
-	if filter != nil {
-		f := *filter
-		q = q.FilterField(f.GetField(), f.GetCondition(), f.GetValue())
+func newDriver(ctx context.Context, projectId string, opts ...Option) (*driver, error) {
+	d := &driver{timeout: ctxTimeOut, retry: DefaultRetryPolicy}
+	for _, opt := range opts {
+		opt(d)
 	}
+	c, err := datastore.NewClientWithDatabase(ctx, projectId, d.database, d.clientOpts...)
+	if err != nil {
+		return nil, err
+	}
+	d.client = c
+	return d, nil
+}
 
-	if sort != "" {
-		q = q.Order(sort)
+// intercepted wraps d with its interceptors, if any.
+func (d *driver) intercepted() Driver {
+	if len(d.interceptors) == 0 {
+		return d
 	}
+	return NewInterceptedDriver(d, d.interceptors...)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// Close closes the client of the driver. Later calls return the result of
+// the first one.
+func (d *driver) Close() error {
+	d.closeOnce.Do(func() {
+		d.closeErr = d.client.Close()
+	})
+	return d.closeErr
+}
 
-	resultKeys, err := d.client.GetAll(ctx, q, nil)
-	if err != nil {
-		return nil, fmt.Errorf("driver.Find can't GetAll: %v", err)
+// withTimeout derives the context of a single operation. The caller's
+// deadline wins; the driver default only applies when ctx has none.
+func (d *driver) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || d.timeout <= 0 {
+		return context.WithCancel(ctx)
 	}
+	return context.WithTimeout(ctx, d.timeout)
+}
 
-	for _, key := range resultKeys {
-		keys = append(keys, key.Encode())
+func (d *driver) FindIds(ctx context.Context, query *Query) ([]string, error) {
+	keys, err := d.FindKeys(ctx, query)
+	if err != nil {
+		return nil, err
 	}
-	return
+	return EncodeKeys(keys), nil
 }
 
-func (d *driver) Find(ancestor *datastore.Key, objectType string, filter *DataFilter, sort string) *datastore.Iterator {
-	q := datastore.NewQuery(objectType)
+// FindKeys returns the keys of the results of the query.
+func (d *driver) FindKeys(ctx context.Context, query *Query) ([]*datastore.Key, error) {
+	q, err := query.KeysOnly().build()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*datastore.Key
+	err = d.do(ctx, "FindKeys", true, func(ctx context.Context) error {
+		keys, err = d.client.GetAll(ctx, q, nil)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("driver.FindKeys can't GetAll: %w", err)
+	}
+	return keys, nil
+}
 
-	if ancestor != nil {
-		q = q.Ancestor(ancestor)
+// Find runs the query and returns an iterator over its results. The
+// iterator is bound to ctx, so the default timeout is not applied here:
+// the caller owns the lifetime of the iteration.
+func (d *driver) Find(ctx context.Context, query *Query) (Iterator, error) {
+	q, err := query.build()
+	if err != nil {
+		return nil, err
 	}
 
-	if sort != "" {
-		q = q.Order(sort)
+	return errorIterator{d.client.Run(ctx, q)}, nil
+}
+
+// FindPage reads one page of at most pageSize results starting at
+// pageToken, an empty token being the first page. Entities are appended to
+// dst, a pointer to a slice, unless it is nil.
+func (d *driver) FindPage(ctx context.Context, query *Query, pageSize int, pageToken string, dst interface{}) (*Page, error) {
+	query, cursor, err := pageRequest(query, pageSize, pageToken)
+	if err != nil {
+		return nil, err
 	}
 
-	if filter != nil {
-		f := *filter
-		//logger.Debug(fmt.Sprintf("Find(%v.%v %v %v)", objectType, f.GetField(), f.GetCondition(), f.GetValue()))
-		q = q.FilterField(f.GetField(), f.GetCondition(), f.GetValue())
+	q, err := query.build()
+	if err != nil {
+		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	_ = cancel
+	var page *Page
+	err = d.do(ctx, "FindPage", true, func(ctx context.Context) error {
+		page, err = readPage(d.client.Run(ctx, q.Start(cursor)), pageSize, dst)
+		return err
+	})
+	return page, err
+}
 
-	return d.client.Run(ctx, q)
+// FindIdsPage reads one page of encoded keys and returns the token of the
+// next page, empty once the results are exhausted.
+func (d *driver) FindIdsPage(ctx context.Context, query *Query, pageSize int, pageToken string) ([]string, string, error) {
+	page, err := d.FindPage(ctx, query.KeysOnly(), pageSize, pageToken, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return page.Ids(), page.NextPageToken, nil
 }
 
-func (d *driver) Create(key *datastore.Key, object interface{}) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+func (d *driver) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	if !validKey(key) || key.Incomplete() {
+		return errInvalidKey
+	}
+	return d.do(ctx, "Get", true, func(ctx context.Context) error {
+		return d.client.Get(ctx, key, dst)
+	})
+}
 
-	newKey, err := d.client.Put(ctx, key, object)
+func (d *driver) Create(ctx context.Context, key *datastore.Key, object interface{}) (string, error) {
+	newKey, err := d.Put(ctx, key, object)
 	if err != nil {
 		return "", err
 	}
@@ -108,11 +215,21 @@ func (d *driver) Create(key *datastore.Key, object interface{}) (string, error)
 	return newKey.Encode(), nil
 }
 
-func (d *driver) Delete(key *datastore.Key) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// Put stores src under key and returns its complete key. A Put of an
+// incomplete key is not retried, as each attempt would store a new entity.
+func (d *driver) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	var newKey *datastore.Key
+	err := d.do(ctx, "Put", key != nil && !key.Incomplete(), func(ctx context.Context) (err error) {
+		newKey, err = d.client.Put(ctx, key, src)
+		return err
+	})
+	return newKey, err
+}
 
-	err := d.client.Delete(ctx, key)
+func (d *driver) Delete(ctx context.Context, key *datastore.Key) error {
+	err := d.do(ctx, "Delete", true, func(ctx context.Context) error {
+		return d.client.Delete(ctx, key)
+	})
 	if err != nil {
 		return err
 	}
@@ -120,14 +237,34 @@ func (d *driver) Delete(key *datastore.Key) error {
 	return nil
 }
 
-func (d *driver) Update(key *datastore.Key, data interface{}) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	_, err := d.client.Put(ctx, key, data)
+// Update stores data under key. Like Put, it is not retried when the key is
+// incomplete.
+func (d *driver) Update(ctx context.Context, key *datastore.Key, data interface{}) error {
+	err := d.do(ctx, "Update", key != nil && !key.Incomplete(), func(ctx context.Context) error {
+		_, err := d.client.Put(ctx, key, data)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// AllocateIDs allocates IDs for incomplete keys without storing entities,
+// and returns the completed keys.
+func (d *driver) AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	var complete []*datastore.Key
+	err := d.do(ctx, "AllocateIDs", true, func(ctx context.Context) (err error) {
+		complete, err = d.client.AllocateIDs(ctx, keys)
+		return err
+	})
+	return complete, err
+}
+
+// ReserveIDs prevents the IDs of complete keys from being allocated.
+func (d *driver) ReserveIDs(ctx context.Context, keys []*datastore.Key) error {
+	return d.do(ctx, "ReserveIDs", true, func(ctx context.Context) error {
+		return d.client.ReserveIDs(ctx, keys)
+	})
+}
@@ -10,8 +10,6 @@ import (
 
 const ctxTimeOut = 10 * time.Second
 
-var dbInstance *driverBasic
-
 var _ DriverBasic = driverBasic{}
 
 type DriverBasic interface {
@@ -21,16 +19,14 @@ type DriverBasic interface {
 	Close()
 }
 
+// NewDriverBasic returns a DriverBasic with its own client for projectId.
+// The caller must Close it.
 func NewDriverBasic(projectId string) (DriverBasic, error) {
-	if dbInstance == nil {
-		dbInstance = new(driverBasic)
-		c, err := datastore.NewClient(context.Background(), projectId)
-		if err != nil {
-			return nil, err
-		}
-		dbInstance.client = c
+	c, err := datastore.NewClient(context.Background(), projectId)
+	if err != nil {
+		return nil, err
 	}
-	return dbInstance, nil
+	return driverBasic{client: c}, nil
 }
 
 type Animal struct {
@@ -1,8 +1,11 @@
 package datastore
 
 import (
+	"context"
 	"testing"
 
+	"cloud.google.com/go/datastore"
+	"github.com/marjau/cloud/gcp/datastore/dstest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
@@ -11,7 +14,8 @@ const kLabProjectIDTest = "klaboratory"
 
 type DriverBasicTestSuite struct {
 	suite.Suite
-	d DriverBasic
+	srv *dstest.Server
+	d   DriverBasic
 }
 
 func TestDriverBasicTestSuite(t *testing.T) {
@@ -19,6 +23,7 @@ func TestDriverBasicTestSuite(t *testing.T) {
 }
 
 func (s *DriverBasicTestSuite) SetupSuite() {
+	s.srv = startTestServer(s.T())
 	dsDriver, err := NewDriverBasic(kLabProjectIDTest)
 	assert.Nil(s.T(), err)
 	assert.NotNil(s.T(), dsDriver)
@@ -26,17 +31,24 @@ func (s *DriverBasicTestSuite) SetupSuite() {
 	s.T().Logf("Datastore driver loaded")
 }
 
-func (s *DriverBasicTestSuite) TearDownTest() {
-	//s.d.Close()
+func (s *DriverBasicTestSuite) TearDownSuite() {
+	s.d.Close()
+	s.srv.Close()
 }
 
 func (s *DriverBasicTestSuite) TestGet() {
-	a, err := s.d.Get()
-	s.T().Logf("ERROR: %v", err)
-	s.T().Logf("Animal: %#v", a)
+	ctx := context.Background()
+	c, err := datastore.NewClient(ctx, kLabProjectIDTest)
+	s.Require().NoError(err)
+	defer c.Close()
+
+	want := &Animal{Name: "cat", Legs: 4, Sound: "meow", FoodType: "meat"}
+	_, err = c.Put(ctx, datastore.NameKey("Animal", "5634161670881280", nil), want)
+	s.Require().NoError(err)
 
-	//assert.Nil(s.T(), err)
-	//assert.NotNil(s.T(), a)
+	a, err := s.d.Get()
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), want, a)
 }
 func (s *DriverBasicTestSuite) TestGetAll() {}
 func (s *DriverBasicTestSuite) TestPut() {
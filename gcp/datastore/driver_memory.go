@@ -0,0 +1,952 @@
+package datastore
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+var _ Driver = (*memoryDriver)(nil)
+
+// memoryDriver is an in-memory Driver. It keeps the query semantics of the
+// backend (kinds, ancestors, filters, sort orders, projections and encoded
+// keys) so services can inject it in unit tests instead of Datastore.
+type memoryDriver struct {
+	mu       sync.RWMutex
+	entities map[string]*memoryEntity
+	versions map[string]int64
+	version  int64
+	lastID   int64
+}
+
+type memoryEntity struct {
+	key   *datastore.Key
+	props []datastore.Property
+}
+
+// NewMemoryDriver returns an empty in-memory Driver.
+func NewMemoryDriver() Driver {
+	return &memoryDriver{
+		entities: map[string]*memoryEntity{},
+		versions: map[string]int64{},
+	}
+}
+
+// Close is a no-op: the memory driver holds no resources.
+func (m *memoryDriver) Close() error { return nil }
+
+// validKey reports whether k can address a stored entity: every element has
+// a kind, at most one of ID and name, a complete parent and one namespace.
+func validKey(k *datastore.Key) bool {
+	if k == nil {
+		return false
+	}
+	for ; k != nil; k = k.Parent {
+		if k.Kind == "" || (k.Name != "" && k.ID != 0) {
+			return false
+		}
+		if k.Parent != nil && (k.Parent.Incomplete() || k.Parent.Namespace != k.Namespace) {
+			return false
+		}
+	}
+	return true
+}
+
+// cloneKey copies every element of k so callers cannot alias stored keys.
+func cloneKey(k *datastore.Key) *datastore.Key {
+	if k == nil {
+		return nil
+	}
+	c := *k
+	c.Parent = cloneKey(k.Parent)
+	return &c
+}
+
+// saveEntity converts src, a struct pointer or PropertyLoadSaver, to the
+// properties the backend would store.
+func saveEntity(src interface{}) ([]datastore.Property, error) {
+	var props []datastore.Property
+	var err error
+	if pls, ok := src.(datastore.PropertyLoadSaver); ok {
+		props, err = pls.Save()
+	} else {
+		props, err = datastore.SaveStruct(src)
+	}
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	for i := range props {
+		props[i].Value = storedValue(props[i].Value)
+	}
+	return props, nil
+}
+
+// storedValue applies the precision the backend keeps for a saved value.
+func storedValue(v interface{}) interface{} {
+	switch x := normalizeValue(v).(type) {
+	case time.Time:
+		return x.Truncate(time.Microsecond)
+	case []interface{}:
+		for i := range x {
+			x[i] = storedValue(x[i])
+		}
+		return x
+	case *datastore.Entity:
+		e := &datastore.Entity{Key: x.Key, Properties: make([]datastore.Property, len(x.Properties))}
+		copy(e.Properties, x.Properties)
+		for i := range e.Properties {
+			e.Properties[i].Value = storedValue(e.Properties[i].Value)
+		}
+		return e
+	default:
+		return x
+	}
+}
+
+// loadEntity loads props into dst, a struct pointer or PropertyLoadSaver,
+// with the same semantics as the client.
+func loadEntity(dst interface{}, key *datastore.Key, props []datastore.Property) error {
+	props = append([]datastore.Property(nil), props...)
+	if kl, ok := dst.(datastore.KeyLoader); ok {
+		if err := kl.LoadKey(key); err != nil {
+			return err
+		}
+	}
+	if pls, ok := dst.(datastore.PropertyLoadSaver); ok {
+		return wrapError(pls.Load(props))
+	}
+	return wrapError(datastore.LoadStruct(dst, props))
+}
+
+// memoryKey is the map key an entity is stored under.
+func memoryKey(k *datastore.Key) string {
+	var b strings.Builder
+	b.WriteString(strconv.Quote(k.Namespace))
+	for _, e := range keyPath(k) {
+		b.WriteString("/" + strconv.Quote(e.Kind) + ",")
+		if e.Name != "" {
+			b.WriteString(strconv.Quote(e.Name))
+		} else {
+			b.WriteString(strconv.FormatInt(e.ID, 10))
+		}
+	}
+	return b.String()
+}
+
+func (m *memoryDriver) get(key *datastore.Key, dst interface{}) error {
+	if !validKey(key) || key.Incomplete() {
+		return errInvalidKey
+	}
+	m.mu.RLock()
+	e, ok := m.entities[memoryKey(key)]
+	m.mu.RUnlock()
+	if !ok {
+		return errNoSuchEntity
+	}
+	return loadEntity(dst, cloneKey(e.key), e.props)
+}
+
+// memoryMutation is a write staged for storing. A nil props deletes.
+type memoryMutation struct {
+	key   *datastore.Key
+	props []datastore.Property
+}
+
+func newPutMutation(key *datastore.Key, src interface{}) (memoryMutation, error) {
+	if !validKey(key) {
+		return memoryMutation{}, errInvalidKey
+	}
+	props, err := saveEntity(src)
+	if err != nil {
+		return memoryMutation{}, err
+	}
+	if props == nil {
+		props = []datastore.Property{}
+	}
+	return memoryMutation{key: cloneKey(key), props: props}, nil
+}
+
+func newDeleteMutation(key *datastore.Key) (memoryMutation, error) {
+	if !validKey(key) || key.Incomplete() {
+		return memoryMutation{}, errInvalidKey
+	}
+	return memoryMutation{key: cloneKey(key)}, nil
+}
+
+// apply stores the mutations as one write and returns their complete keys.
+// The caller must hold the write lock.
+func (m *memoryDriver) apply(mutations []memoryMutation) []*datastore.Key {
+	m.version++
+	keys := make([]*datastore.Key, len(mutations))
+	for i, mut := range mutations {
+		key := cloneKey(mut.key)
+		if key.Incomplete() {
+			m.lastID++
+			key.ID = m.lastID
+		}
+		mk := memoryKey(key)
+		if mut.props == nil {
+			delete(m.entities, mk)
+		} else {
+			m.entities[mk] = &memoryEntity{key: key, props: mut.props}
+		}
+		m.versions[mk] = m.version
+		keys[i] = cloneKey(key)
+	}
+	return keys
+}
+
+func (m *memoryDriver) put(key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	mut, err := newPutMutation(key, src)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.apply([]memoryMutation{mut})[0], nil
+}
+
+func (m *memoryDriver) delete(key *datastore.Key) error {
+	mut, err := newDeleteMutation(key)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apply([]memoryMutation{mut})
+	return nil
+}
+
+func (m *memoryDriver) Find(ctx context.Context, q *Query) (Iterator, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	start, err := decodeMemoryCursor(q.start)
+	if err != nil {
+		return nil, err
+	}
+	results, err := m.run(q, start)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryIterator{results: results, keysOnly: q.keysOnly, start: start + q.offset}, nil
+}
+
+func (m *memoryDriver) FindIds(ctx context.Context, q *Query) ([]string, error) {
+	keys, err := m.FindKeys(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeKeys(keys), nil
+}
+
+func (m *memoryDriver) FindKeys(ctx context.Context, q *Query) ([]*datastore.Key, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	start, err := decodeMemoryCursor(q.start)
+	if err != nil {
+		return nil, err
+	}
+	results, err := m.run(q.KeysOnly(), start)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*datastore.Key, len(results))
+	for i, r := range results {
+		keys[i] = r.key
+	}
+	return keys, nil
+}
+
+func (m *memoryDriver) FindPage(ctx context.Context, q *Query, pageSize int, pageToken string, dst interface{}) (*Page, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	q, cursor, err := pageRequest(q, pageSize, pageToken)
+	if err != nil {
+		return nil, err
+	}
+	start, err := decodeMemoryCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	results, err := m.run(q, start)
+	if err != nil {
+		return nil, err
+	}
+	it := &memoryIterator{results: results, keysOnly: q.keysOnly, start: start + q.offset}
+	return readPage(it, pageSize, dst)
+}
+
+func (m *memoryDriver) FindIdsPage(ctx context.Context, q *Query, pageSize int, pageToken string) ([]string, string, error) {
+	page, err := m.FindPage(ctx, q.KeysOnly(), pageSize, pageToken, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return page.Ids(), page.NextPageToken, nil
+}
+
+func (m *memoryDriver) Aggregate(ctx context.Context, q *Query, aggs ...Aggregation) (AggregationResult, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	if err := validateAggregations(q, aggs); err != nil {
+		return nil, err
+	}
+	results, err := m.run(q, 0)
+	if err != nil {
+		return nil, err
+	}
+	return aggregate(aggs, len(results), func(i int, field string) (interface{}, bool) {
+		return indexedValue(results[i].key, results[i].props, field)
+	}), nil
+}
+
+func (m *memoryDriver) Count(ctx context.Context, q *Query) (int64, error) {
+	return count(m.Aggregate(ctx, q, Count(countAlias)))
+}
+
+func (m *memoryDriver) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+	return m.get(key, dst)
+}
+
+func (m *memoryDriver) Create(ctx context.Context, key *datastore.Key, object interface{}) (string, error) {
+	newKey, err := m.Put(ctx, key, object)
+	if err != nil {
+		return "", err
+	}
+	return newKey.Encode(), nil
+}
+
+func (m *memoryDriver) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	return m.put(key, src)
+}
+
+func (m *memoryDriver) Delete(ctx context.Context, key *datastore.Key) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+	return m.delete(key)
+}
+
+func (m *memoryDriver) Update(ctx context.Context, key *datastore.Key, data interface{}) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+	_, err := m.put(key, data)
+	return err
+}
+
+func (m *memoryDriver) UpdateVersioned(ctx context.Context, key *datastore.Key, data Versioned) error {
+	return updateVersioned(ctx, m, key, data)
+}
+
+func (m *memoryDriver) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}, opts ...BatchOption) error {
+	v, err := batchValues(keys, dst)
+	if err != nil {
+		return err
+	}
+	if err := checkBatchKeys(keys, false); err != nil {
+		return err
+	}
+	return runBatch(ctx, len(keys), newBatchOptions(maxBatchLookups, opts), false, func(_ context.Context, lo, hi int) error {
+		errs := make(datastore.MultiError, hi-lo)
+		failed := false
+		for i := lo; i < hi; i++ {
+			if err := m.get(keys[i], batchElem(v, i)); err != nil {
+				errs[i-lo] = err
+				failed = true
+			}
+		}
+		if failed {
+			return errs
+		}
+		return nil
+	})
+}
+
+func (m *memoryDriver) CreateMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) ([]string, error) {
+	return encodeMulti(m.PutMulti(ctx, keys, src, opts...))
+}
+
+func (m *memoryDriver) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) ([]*datastore.Key, error) {
+	v, err := batchValues(keys, src)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBatchKeys(keys, true); err != nil {
+		return nil, err
+	}
+	complete := make([]*datastore.Key, len(keys))
+	err = runBatch(ctx, len(keys), newBatchOptions(maxBatchMutations, opts), true, func(_ context.Context, lo, hi int) error {
+		newKeys, err := m.putMulti(keys[lo:hi], v.Slice(lo, hi))
+		if err != nil {
+			return err
+		}
+		copy(complete[lo:], newKeys)
+		return nil
+	})
+	return complete, err
+}
+
+func (m *memoryDriver) UpdateMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) error {
+	v, err := batchValues(keys, src)
+	if err != nil {
+		return err
+	}
+	if err := checkBatchKeys(keys, false); err != nil {
+		return err
+	}
+	return runBatch(ctx, len(keys), newBatchOptions(maxBatchMutations, opts), true, func(_ context.Context, lo, hi int) error {
+		_, err := m.putMulti(keys[lo:hi], v.Slice(lo, hi))
+		return err
+	})
+}
+
+func (m *memoryDriver) DeleteMulti(ctx context.Context, keys []*datastore.Key, opts ...BatchOption) error {
+	if err := checkBatchKeys(keys, false); err != nil {
+		return err
+	}
+	return runBatch(ctx, len(keys), newBatchOptions(maxBatchMutations, opts), true, func(_ context.Context, lo, hi int) error {
+		mutations := make([]memoryMutation, 0, hi-lo)
+		for _, k := range keys[lo:hi] {
+			mut, err := newDeleteMutation(k)
+			if err != nil {
+				return err
+			}
+			mutations = append(mutations, mut)
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.apply(mutations)
+		return nil
+	})
+}
+
+// putMulti stores the entities of v under keys as one write. When an
+// entity cannot be saved nothing is stored and the MultiError reports it.
+func (m *memoryDriver) putMulti(keys []*datastore.Key, v reflect.Value) ([]*datastore.Key, error) {
+	mutations := make([]memoryMutation, len(keys))
+	errs := make(datastore.MultiError, len(keys))
+	failed := false
+	for i, k := range keys {
+		if e := v.Index(i); e.Kind() == reflect.Ptr && e.IsNil() {
+			errs[i] = errInvalidEntityType
+			failed = true
+			continue
+		}
+		mut, err := newPutMutation(k, batchElem(v, i))
+		if err != nil {
+			errs[i] = err
+			failed = true
+		}
+		mutations[i] = mut
+	}
+	if failed {
+		return nil, errs
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.apply(mutations), nil
+}
+
+func (m *memoryDriver) AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if !validKey(k) || !k.Incomplete() {
+			return nil, errInvalidKey
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	allocated := make([]*datastore.Key, len(keys))
+	for i, k := range keys {
+		m.lastID++
+		allocated[i] = cloneKey(k)
+		allocated[i].ID = m.lastID
+	}
+	return allocated, nil
+}
+
+// ReserveIDs keeps the allocator of the driver above the IDs of keys.
+func (m *memoryDriver) ReserveIDs(ctx context.Context, keys []*datastore.Key) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if !validKey(k) || k.Incomplete() {
+			return errInvalidKey
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, k := range keys {
+		if k.ID > m.lastID {
+			m.lastID = k.ID
+		}
+	}
+	return nil
+}
+
+func (m *memoryDriver) RunInTransaction(ctx context.Context, f func(tx Tx) error, opts ...TxOption) error {
+	o := newTxOptions(opts)
+	ids := &txIDs{allocate: func(key *datastore.Key) (*datastore.Key, error) {
+		keys, err := m.AllocateIDs(ctx, []*datastore.Key{key})
+		if err != nil {
+			return nil, err
+		}
+		return keys[0], nil
+	}}
+	for attempt := 0; attempt < o.attempts; attempt++ {
+		if err := ctxErr(ctx); err != nil {
+			return err
+		}
+		ids.next = 0
+		tx := &memoryTx{m: m, readOnly: o.readOnly, ids: ids, reads: map[string]int64{}}
+		if err := f(tx); err != nil {
+			return err
+		}
+		if m.commit(tx) {
+			return nil
+		}
+	}
+	return wrapError(datastore.ErrConcurrentTransaction)
+}
+
+// commit applies the staged writes of tx unless an entity it read changed
+// since, in which case it reports contention.
+func (m *memoryDriver) commit(tx *memoryTx) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for mk, v := range tx.reads {
+		if m.versions[mk] != v {
+			return false
+		}
+	}
+	if len(tx.writes) > 0 {
+		m.apply(tx.writes)
+	}
+	return true
+}
+
+// memoryTx is an optimistic transaction: it records the version of every
+// entity it reads and stages its writes until commit.
+type memoryTx struct {
+	m        *memoryDriver
+	readOnly bool
+	ids      *txIDs
+	reads    map[string]int64
+	writes   []memoryMutation
+}
+
+func (tx *memoryTx) Get(key *datastore.Key, dst interface{}) error {
+	if !validKey(key) || key.Incomplete() {
+		return errInvalidKey
+	}
+	mk := memoryKey(key)
+	tx.m.mu.RLock()
+	e, ok := tx.m.entities[mk]
+	if _, seen := tx.reads[mk]; !seen {
+		tx.reads[mk] = tx.m.versions[mk]
+	}
+	tx.m.mu.RUnlock()
+	if !ok {
+		return errNoSuchEntity
+	}
+	return loadEntity(dst, cloneKey(e.key), e.props)
+}
+
+func (tx *memoryTx) Put(key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	if tx.readOnly {
+		return nil, ErrReadOnlyTransaction
+	}
+	mut, err := newPutMutation(key, src)
+	if err != nil {
+		return nil, err
+	}
+	if mut.key, err = tx.ids.complete(mut.key); err != nil {
+		return nil, err
+	}
+	tx.writes = append(tx.writes, mut)
+	return cloneKey(mut.key), nil
+}
+
+func (tx *memoryTx) Delete(key *datastore.Key) error {
+	if tx.readOnly {
+		return ErrReadOnlyTransaction
+	}
+	mut, err := newDeleteMutation(key)
+	if err != nil {
+		return err
+	}
+	tx.writes = append(tx.writes, mut)
+	return nil
+}
+
+// memoryResult is one row of a query result.
+type memoryResult struct {
+	key   *datastore.Key
+	props []datastore.Property
+}
+
+// run evaluates q against a snapshot of the store. Results before position
+// start are skipped as a cursor would, and the query offset after them.
+func (m *memoryDriver) run(q *Query, start int) ([]memoryResult, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	var filters []datastore.EntityFilter
+	for _, f := range q.filters {
+		filters = append(filters, normalizeFilter(f.EntityFilter()))
+	}
+
+	orders := q.orders
+	if len(orders) == 0 {
+		// The backend sorts by the inequality property when no order is set.
+		if field := inequalityField(filters); field != "" {
+			orders = []order{{field: field}}
+		}
+	}
+
+	m.mu.RLock()
+	entities := m.entities
+	if q.kind == kindKind {
+		entities = m.kindEntities()
+	}
+	var results []memoryResult
+	for _, e := range entities {
+		if !m.matches(q, filters, orders, e) {
+			continue
+		}
+		results = append(results, memoryResult{key: cloneKey(e.key), props: e.props})
+	}
+	m.mu.RUnlock()
+
+	sortResults(results, orders)
+
+	if len(q.projection) > 0 {
+		results = project(results, q.projection, q.distinctOn)
+	}
+
+	skip := q.offset + start
+	if skip > len(results) {
+		skip = len(results)
+	}
+	results = results[skip:]
+	if q.limit >= 0 && q.limit < len(results) {
+		results = results[:q.limit]
+	}
+	return results, nil
+}
+
+// kindEntities returns the entities of the kind metadata kind: one per kind
+// and namespace holding entities, named after the kind.
+func (m *memoryDriver) kindEntities() map[string]*memoryEntity {
+	kinds := map[string]*memoryEntity{}
+	for _, e := range m.entities {
+		k := &datastore.Key{Kind: kindKind, Name: e.key.Kind, Namespace: e.key.Namespace}
+		kinds[memoryKey(k)] = &memoryEntity{key: k}
+	}
+	return kinds
+}
+
+func (m *memoryDriver) matches(q *Query, filters []datastore.EntityFilter, orders []order, e *memoryEntity) bool {
+	if q.kind != "" && e.key.Kind != q.kind {
+		return false
+	}
+	if q.ancestor != nil && !hasAncestor(e.key, q.ancestor) {
+		return false
+	}
+	if e.key.Namespace != q.namespace {
+		return false
+	}
+	for _, f := range filters {
+		if !matchFilter(e.key, e.props, f) {
+			return false
+		}
+	}
+	// Entities without an indexed value for a sort order are not returned.
+	for _, o := range orders {
+		if _, ok := indexedValue(e.key, e.props, o.field); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeFilter normalizes the values of every property filter in ef.
+func normalizeFilter(ef datastore.EntityFilter) datastore.EntityFilter {
+	switch f := ef.(type) {
+	case datastore.PropertyFilter:
+		f.Operator = strings.TrimSpace(f.Operator)
+		f.Value = normalizeValue(f.Value)
+		return f
+	case datastore.AndFilter:
+		and := datastore.AndFilter{}
+		for _, m := range f.Filters {
+			and.Filters = append(and.Filters, normalizeFilter(m))
+		}
+		return and
+	case datastore.OrFilter:
+		or := datastore.OrFilter{}
+		for _, m := range f.Filters {
+			or.Filters = append(or.Filters, normalizeFilter(m))
+		}
+		return or
+	}
+	return ef
+}
+
+// inequalityField returns the property of the inequality filters, if any.
+func inequalityField(filters []datastore.EntityFilter) string {
+	field := ""
+	for _, f := range filters {
+		_ = walkFilter(f, func(pf datastore.PropertyFilter) error {
+			if inequalityConditions[pf.Operator] {
+				field = pf.FieldName
+			}
+			return nil
+		})
+	}
+	return field
+}
+
+// indexedValue returns the value of the named property as the index sees
+// it. Unindexed properties are invisible to filters and sort orders, and a
+// dotted name reaches into nested entities.
+func indexedValue(key *datastore.Key, props []datastore.Property, name string) (interface{}, bool) {
+	if name == "__key__" {
+		return key, true
+	}
+	for _, p := range props {
+		if p.Name == name {
+			if p.NoIndex {
+				return nil, false
+			}
+			return p.Value, true
+		}
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		for _, p := range props {
+			if e, ok := p.Value.(*datastore.Entity); ok && p.Name == name[:i] && !p.NoIndex {
+				return indexedValue(e.Key, e.Properties, name[i+1:])
+			}
+		}
+	}
+	return nil, false
+}
+
+func matchFilter(key *datastore.Key, props []datastore.Property, ef datastore.EntityFilter) bool {
+	switch f := ef.(type) {
+	case datastore.AndFilter:
+		for _, m := range f.Filters {
+			if !matchFilter(key, props, m) {
+				return false
+			}
+		}
+		return true
+	case datastore.OrFilter:
+		for _, m := range f.Filters {
+			if matchFilter(key, props, m) {
+				return true
+			}
+		}
+		return false
+	case datastore.PropertyFilter:
+		v, ok := indexedValue(key, props, f.FieldName)
+		if !ok {
+			return false
+		}
+		// A multi-valued property matches when any of its values does.
+		for _, e := range valueElems(v) {
+			if matchValue(e, f.Operator, f.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchValue(v interface{}, op string, operand interface{}) bool {
+	switch op {
+	case "=":
+		return compareValues(v, operand) == 0
+	case "!=":
+		return compareValues(v, operand) != 0
+	case "<":
+		return compareValues(v, operand) < 0
+	case "<=":
+		return compareValues(v, operand) <= 0
+	case ">":
+		return compareValues(v, operand) > 0
+	case ">=":
+		return compareValues(v, operand) >= 0
+	case "in", "not-in":
+		found := false
+		for _, o := range valueElems(operand) {
+			if compareValues(v, o) == 0 {
+				found = true
+				break
+			}
+		}
+		return found == (op == "in")
+	}
+	return false
+}
+
+// sortValue picks the value a multi-valued property sorts by: its smallest
+// value ascending, its largest descending.
+func sortValue(v interface{}, desc bool) interface{} {
+	elems := valueElems(v)
+	if len(elems) == 0 {
+		return nil
+	}
+	best := elems[0]
+	for _, e := range elems[1:] {
+		c := compareValues(e, best)
+		if (desc && c > 0) || (!desc && c < 0) {
+			best = e
+		}
+	}
+	return best
+}
+
+// sortResults sorts by the given orders, then by key as the backend does.
+func sortResults(results []memoryResult, orders []order) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		for _, o := range orders {
+			va, _ := indexedValue(a.key, a.props, o.field)
+			vb, _ := indexedValue(b.key, b.props, o.field)
+			c := compareValues(sortValue(va, o.desc), sortValue(vb, o.desc))
+			if o.desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return compareKeys(a.key, b.key) < 0
+	})
+}
+
+// project keeps the projected properties of each result. A multi-valued
+// property yields one result per value, and entities missing a projected
+// property are dropped. Results are then de-duplicated on distinctOn.
+func project(results []memoryResult, projection, distinctOn []string) []memoryResult {
+	var projected []memoryResult
+	for _, r := range results {
+		rows := [][]datastore.Property{nil}
+		for _, name := range projection {
+			v, ok := indexedValue(r.key, r.props, name)
+			if !ok {
+				rows = nil
+				break
+			}
+			var next [][]datastore.Property
+			for _, row := range rows {
+				for _, e := range valueElems(v) {
+					p := append(append([]datastore.Property(nil), row...), datastore.Property{Name: name, Value: e})
+					next = append(next, p)
+				}
+			}
+			rows = next
+		}
+		for _, row := range rows {
+			projected = append(projected, memoryResult{key: r.key, props: row})
+		}
+	}
+
+	if len(distinctOn) == 0 {
+		return projected
+	}
+	var distinct []memoryResult
+	for _, r := range projected {
+		dup := false
+		for _, d := range distinct {
+			same := true
+			for _, name := range distinctOn {
+				va, _ := indexedValue(r.key, r.props, name)
+				vb, _ := indexedValue(d.key, d.props, name)
+				if compareValues(va, vb) != 0 {
+					same = false
+					break
+				}
+			}
+			if same {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			distinct = append(distinct, r)
+		}
+	}
+	return distinct
+}
+
+// memoryIterator walks a query result snapshot. Its cursors encode the
+// position in the result, counted from the start of the query, offset
+// included, so that a query resumed at a cursor does not skip its offset
+// again.
+type memoryIterator struct {
+	results  []memoryResult
+	keysOnly bool
+	start    int
+	pos      int
+}
+
+func (it *memoryIterator) Next(dst interface{}) (*datastore.Key, error) {
+	if it.pos >= len(it.results) {
+		return nil, iterator.Done
+	}
+	r := it.results[it.pos]
+	it.pos++
+	if dst != nil && !it.keysOnly {
+		if err := loadEntity(dst, r.key, r.props); err != nil {
+			return r.key, err
+		}
+	}
+	return r.key, nil
+}
+
+func (it *memoryIterator) Cursor() (datastore.Cursor, error) {
+	token := base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(it.start + it.pos)))
+	return datastore.DecodeCursor(token)
+}
+
+// decodeMemoryCursor returns the result position encoded in c.
+func decodeMemoryCursor(c datastore.Cursor) (int, error) {
+	if c.String() == "" {
+		return 0, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(c.String())
+	if err != nil {
+		return 0, invalidArgument(fmt.Errorf("invalid page token: %w", err))
+	}
+	pos, err := strconv.Atoi(string(b))
+	if err != nil || pos < 0 {
+		return 0, invalidArgument(errors.New("invalid page token: not a memory driver cursor"))
+	}
+	return pos, nil
+}
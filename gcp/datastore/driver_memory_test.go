@@ -0,0 +1,230 @@
+package datastore
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/api/iterator"
+)
+
+type Pet struct {
+	Name  string
+	Legs  int
+	Tags  []string
+	Notes string `datastore:",noindex"`
+}
+
+type MemoryDriverTestSuite struct {
+	suite.Suite
+	ctx  context.Context
+	d    Driver
+	zoo  *datastore.Key
+	keys map[string]*datastore.Key
+}
+
+func TestMemoryDriverTestSuite(t *testing.T) {
+	suite.Run(t, new(MemoryDriverTestSuite))
+}
+
+func (s *MemoryDriverTestSuite) SetupTest() {
+	s.ctx = context.Background()
+	s.d = NewMemoryDriver()
+	s.zoo = datastore.NameKey("Zoo", "north", nil)
+	s.keys = map[string]*datastore.Key{}
+
+	pets := []Pet{
+		{Name: "cat", Legs: 4, Tags: []string{"small", "furry"}, Notes: "x"},
+		{Name: "dog", Legs: 4, Tags: []string{"furry"}},
+		{Name: "bird", Legs: 2, Tags: []string{"small", "loud"}},
+		{Name: "snake", Legs: 0},
+	}
+	for i, p := range pets {
+		parent := s.zoo
+		if i == 3 {
+			parent = nil
+		}
+		p := p
+		encoded, err := s.d.Create(s.ctx, datastore.IncompleteKey("Pet", parent), &p)
+		assert.NoError(s.T(), err)
+		k, err := datastore.DecodeKey(encoded)
+		assert.NoError(s.T(), err)
+		assert.False(s.T(), k.Incomplete())
+		s.keys[p.Name] = k
+	}
+	_, err := s.d.Create(s.ctx, datastore.NameKey("Plant", "fern", s.zoo), &Pet{Name: "fern"})
+	assert.NoError(s.T(), err)
+}
+
+func (s *MemoryDriverTestSuite) names(q *Query) []string {
+	it, err := s.d.Find(s.ctx, q)
+	assert.NoError(s.T(), err)
+	var names []string
+	for {
+		var p Pet
+		_, err := it.Next(&p)
+		if err == iterator.Done {
+			return names
+		}
+		assert.NoError(s.T(), err)
+		names = append(names, p.Name)
+	}
+}
+
+func (s *MemoryDriverTestSuite) TestCRUD() {
+	k := datastore.NameKey("Pet", "rex", nil)
+	_, err := s.d.Create(s.ctx, k, &Pet{Name: "rex", Legs: 4})
+	assert.NoError(s.T(), err)
+
+	var p Pet
+	assert.NoError(s.T(), s.d.Get(s.ctx, k, &p))
+	assert.Equal(s.T(), Pet{Name: "rex", Legs: 4}, p)
+
+	assert.NoError(s.T(), s.d.Update(s.ctx, k, &Pet{Name: "rex", Legs: 3}))
+	assert.NoError(s.T(), s.d.Get(s.ctx, k, &p))
+	assert.Equal(s.T(), 3, p.Legs)
+
+	assert.NoError(s.T(), s.d.Delete(s.ctx, k))
+	assert.ErrorIs(s.T(), s.d.Get(s.ctx, k, &p), datastore.ErrNoSuchEntity)
+
+	assert.ErrorIs(s.T(), s.d.Get(s.ctx, datastore.IncompleteKey("Pet", nil), &p), datastore.ErrInvalidKey)
+	_, err = s.d.Create(s.ctx, datastore.NameKey("", "x", nil), &p)
+	assert.ErrorIs(s.T(), err, datastore.ErrInvalidKey)
+}
+
+func (s *MemoryDriverTestSuite) TestPropertyList() {
+	var pl datastore.PropertyList
+	assert.NoError(s.T(), s.d.Get(s.ctx, s.keys["cat"], &pl))
+	assert.Len(s.T(), pl, 4)
+	assert.Equal(s.T(), int64(4), pl[1].Value)
+}
+
+func (s *MemoryDriverTestSuite) TestKindsAndAncestors() {
+	assert.ElementsMatch(s.T(), []string{"cat", "dog", "bird", "snake"}, s.names(NewQuery("Pet")))
+	assert.ElementsMatch(s.T(), []string{"cat", "dog", "bird"}, s.names(NewQuery("Pet").Ancestor(s.zoo)))
+	assert.ElementsMatch(s.T(), []string{"fern"}, s.names(NewQuery("Plant")))
+	assert.ElementsMatch(s.T(), []string{"cat", "dog", "bird", "fern"}, s.names(NewQuery("").Ancestor(s.zoo)))
+}
+
+func (s *MemoryDriverTestSuite) TestFilters() {
+	assert.ElementsMatch(s.T(), []string{"cat", "dog"}, s.names(NewQuery("Pet").Filter(Eq("Legs", 4))))
+	assert.ElementsMatch(s.T(), []string{"cat", "bird"}, s.names(NewQuery("Pet").Filter(Eq("Tags", "small"))))
+	assert.ElementsMatch(s.T(), []string{"bird", "snake"}, s.names(NewQuery("Pet").Filter(Lt("Legs", 3.5))))
+	assert.ElementsMatch(s.T(), []string{"cat", "snake"}, s.names(NewQuery("Pet").Filter(In("Name", "cat", "snake"))))
+	assert.ElementsMatch(s.T(), []string{"dog", "bird"}, s.names(NewQuery("Pet").Filter(NotIn("Name", "cat", "snake"))))
+	assert.ElementsMatch(s.T(), []string{"cat", "bird", "snake"}, s.names(NewQuery("Pet").
+		Filter(Or(Eq("Tags", "small"), Eq("Legs", 0)))))
+	assert.ElementsMatch(s.T(), []string{"cat"}, s.names(NewQuery("Pet").
+		Filter(And(Eq("Tags", "small"), Gte("Legs", 4)))))
+	assert.ElementsMatch(s.T(), []string{"cat"}, s.names(NewQuery("Pet").Filter(Eq("__key__", s.keys["cat"]))))
+	assert.Empty(s.T(), s.names(NewQuery("Pet").Filter(Eq("Notes", "x"))), "unindexed properties cannot be filtered")
+
+	_, err := s.d.Find(s.ctx, NewQuery("Pet").Filter(Gt("Legs", 1)).Order("Name"))
+	assert.Error(s.T(), err)
+}
+
+func (s *MemoryDriverTestSuite) TestOrders() {
+	assert.Equal(s.T(), []string{"bird", "cat", "dog", "snake"}, s.names(NewQuery("Pet").Order("Name")))
+	assert.Equal(s.T(), []string{"cat", "dog", "bird", "snake"}, s.names(NewQuery("Pet").Order("-Legs", "Name")))
+	assert.Equal(s.T(), []string{"snake", "bird"}, s.names(NewQuery("Pet").Filter(Lt("Legs", 3))))
+	// Entities missing the sort property are excluded, multi-valued ones
+	// sort by their smallest value.
+	assert.Equal(s.T(), []string{"cat", "dog", "bird"}, s.names(NewQuery("Pet").Order("Tags", "Name")))
+	assert.Equal(s.T(), []string{"dog", "snake"}, s.names(NewQuery("Pet").Order("Name").Offset(2).Limit(2)))
+}
+
+func (s *MemoryDriverTestSuite) TestProjection() {
+	it, err := s.d.Find(s.ctx, NewQuery("Pet").Project("Legs").DistinctOn("Legs").Order("Legs"))
+	assert.NoError(s.T(), err)
+	var legs []int
+	for {
+		var p Pet
+		if _, err := it.Next(&p); err == iterator.Done {
+			break
+		}
+		assert.Empty(s.T(), p.Name)
+		legs = append(legs, p.Legs)
+	}
+	assert.Equal(s.T(), []int{0, 2, 4}, legs)
+}
+
+func (s *MemoryDriverTestSuite) TestFindIds() {
+	ids, err := s.d.FindIds(s.ctx, NewQuery("Pet").Order("Name").Limit(1))
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), []string{s.keys["bird"].Encode()}, ids)
+
+	k, err := datastore.DecodeKey(ids[0])
+	assert.NoError(s.T(), err)
+	assert.True(s.T(), k.Equal(s.keys["bird"]))
+}
+
+func (s *MemoryDriverTestSuite) TestPagination() {
+	var all []string
+	token := ""
+	for {
+		var pets []Pet
+		page, err := s.d.FindPage(s.ctx, NewQuery("Pet").Order("Name"), 3, token, &pets)
+		assert.NoError(s.T(), err)
+		assert.Len(s.T(), page.Keys, len(pets))
+		for _, p := range pets {
+			all = append(all, p.Name)
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		token = page.NextPageToken
+	}
+	assert.Equal(s.T(), []string{"bird", "cat", "dog", "snake"}, all)
+
+	ids, next, err := s.d.FindIdsPage(s.ctx, NewQuery("Pet").Order("Name"), 4, "")
+	assert.NoError(s.T(), err)
+	assert.Len(s.T(), ids, 4)
+	assert.Empty(s.T(), next)
+
+	_, _, err = s.d.FindIdsPage(s.ctx, NewQuery("Pet"), 4, "bm90LWEtbnVtYmVy")
+	assert.Error(s.T(), err)
+
+	var pages [][]string
+	token = ""
+	for {
+		ids, next, err := s.d.FindIdsPage(s.ctx, NewQuery("Pet").Order("Name").Offset(1), 2, token)
+		s.Require().NoError(err)
+		pages = append(pages, ids)
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	assert.Equal(s.T(), [][]string{
+		{s.keys["cat"].Encode(), s.keys["dog"].Encode()},
+		{s.keys["snake"].Encode()},
+	}, pages, "the offset applies to the first page only")
+}
+
+func (s *MemoryDriverTestSuite) TestRepository() {
+	r := NewRepository[Pet](s.d, "Pet")
+
+	k, err := r.Save(s.ctx, r.NameKey("rex", nil), Pet{Name: "rex", Legs: 4})
+	assert.NoError(s.T(), err)
+
+	e, err := r.Get(s.ctx, k)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), "rex", e.Value.Name)
+
+	list, err := r.List(s.ctx, r.Query().Filter(Eq("Legs", 4)).Order("Name"))
+	assert.NoError(s.T(), err)
+	assert.Len(s.T(), list, 3)
+	assert.Equal(s.T(), "rex", list[2].Value.Name)
+	assert.True(s.T(), list[2].Key.Equal(k))
+
+	page, next, err := r.ListPage(s.ctx, nil, 2, "")
+	assert.NoError(s.T(), err)
+	assert.Len(s.T(), page, 2)
+	assert.NotEmpty(s.T(), next)
+
+	assert.NoError(s.T(), r.Delete(s.ctx, k))
+	_, err = r.Get(s.ctx, k)
+	assert.ErrorIs(s.T(), err, ErrNotFound)
+}
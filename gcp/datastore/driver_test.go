@@ -1,17 +1,58 @@
 package datastore
 
 import (
+	"context"
 	"testing"
+	"time"
 
+	"cloud.google.com/go/datastore"
+	"github.com/marjau/cloud/gcp/datastore/dstest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/api/iterator"
 )
 
 const testProjectID = "klaboratory"
 
+// startTestServer starts a fake Datastore server and points the clients
+// created by the test at it.
+func startTestServer(t *testing.T) *dstest.Server {
+	srv, err := dstest.NewServer()
+	require.NoError(t, err)
+	t.Setenv("DATASTORE_EMULATOR_HOST", srv.Addr)
+	return srv
+}
+
+// newServerDriver returns a driver talking to a fresh fake server.
+func newServerDriver(t *testing.T) Driver {
+	srv := startTestServer(t)
+	d, err := NewDriver(context.Background(), testProjectID)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		d.Close()
+		srv.Close()
+	})
+	return d
+}
+
+// forEachDriver runs the suite built by newSuite once against the memory
+// driver and once against a fake server, as the subtests memory and server.
+// newDriver returns a fresh driver for the test it is given.
+func forEachDriver(t *testing.T, newSuite func(newDriver func(t *testing.T) Driver) suite.TestingSuite) {
+	t.Run("memory", func(t *testing.T) {
+		suite.Run(t, newSuite(func(*testing.T) Driver { return NewMemoryDriver() }))
+	})
+	t.Run("server", func(t *testing.T) {
+		suite.Run(t, newSuite(newServerDriver))
+	})
+}
+
 type DriverTestSuite struct {
 	suite.Suite
-	d Driver
+	srv *dstest.Server
+	d   Driver
+	ctx context.Context
 }
 
 func TestDriverTestSuite(t *testing.T) {
@@ -19,37 +60,137 @@ func TestDriverTestSuite(t *testing.T) {
 }
 
 func (s *DriverTestSuite) SetupSuite() {
-	dsDriver, err := newDriver(testProjectID)
+	s.srv = startTestServer(s.T())
+	dsDriver, err := NewDriver(context.Background(), testProjectID)
 	assert.Nil(s.T(), err)
 	assert.NotNil(s.T(), dsDriver)
 	s.d = dsDriver
+	s.ctx = context.Background()
 }
 
-func (s *DriverTestSuite) TearDownTest() {
-	//s.T().Logf("--> Closing client connection...")
-	//s.d.close()
+func (s *DriverTestSuite) TearDownSuite() {
+	s.NoError(s.d.Close())
+	s.srv.Close()
+}
+
+func (s *DriverTestSuite) SetupTest() {
+	s.srv.Reset()
+	for _, a := range []Animal{
+		{Name: "cat", Legs: 4, Sound: "meow", FoodType: "meat"},
+		{Name: "dog", Legs: 4, Sound: "woof", FoodType: "meat"},
+		{Name: "bird", Legs: 2, Sound: "tweet", FoodType: "seeds"},
+	} {
+		a := a
+		_, err := s.d.Create(s.ctx, datastore.NameKey("Animal", a.Name, nil), &a)
+		s.Require().NoError(err)
+	}
 }
 
 func (s *DriverTestSuite) TestFind() {
 	objectType := "Animal"
-	i := s.d.Find(nil, objectType, nil, "")
-	var entity Animal
-	s.T().Logf("Starting interations...")
+	i, err := s.d.Find(s.ctx, NewQuery(objectType).Filter(Eq("Legs", 4)).Order("-Name"))
+	assert.Nil(s.T(), err)
+	var names []string
 	for {
+		var entity Animal
 		key, err := i.Next(&entity)
-		if err != nil {
+		if err == iterator.Done {
+			break
+		}
+		assert.Nil(s.T(), err)
+		assert.Equal(s.T(), entity.Name, key.Name)
+		names = append(names, entity.Name)
+	}
+	assert.Equal(s.T(), []string{"dog", "cat"}, names)
+}
+
+func (s *DriverTestSuite) TestFindIds() {
+	ids, err := s.d.FindIds(s.ctx, NewQuery("Animal").Filter(Or(Eq("Sound", "tweet"), Eq("Sound", "meow"))))
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), []string{
+		datastore.NameKey("Animal", "bird", nil).Encode(),
+		datastore.NameKey("Animal", "cat", nil).Encode(),
+	}, ids)
+}
+
+func (s *DriverTestSuite) TestFindPage() {
+	var names []string
+	token := ""
+	for {
+		var animals []*Animal
+		page, err := s.d.FindPage(s.ctx, NewQuery("Animal").Order("Name"), 2, token, &animals)
+		s.Require().NoError(err)
+		for _, a := range animals {
+			names = append(names, a.Name)
+		}
+		if page.NextPageToken == "" {
 			break
 		}
-		s.T().Logf("K: %v", key)
-		s.T().Logf("%#v", entity)
+		token = page.NextPageToken
 	}
+	assert.Equal(s.T(), []string{"bird", "cat", "dog"}, names)
 }
 
-//func (s *DriverTestSuite) TestUpdate() {
-//	k64, _ := strconv.ParseInt("5634161670881280", 10, 64)
-//	k := &datastore.Key{
-//		Kind: "Animal",
-//		ID:   k64,
-//	}
-//	s.d.Update(k)
-//}
+func (s *DriverTestSuite) TestFindPageOffset() {
+	var names []string
+	token := ""
+	for {
+		var animals []*Animal
+		page, err := s.d.FindPage(s.ctx, NewQuery("Animal").Order("Name").Offset(1), 1, token, &animals)
+		s.Require().NoError(err)
+		for _, a := range animals {
+			names = append(names, a.Name)
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		token = page.NextPageToken
+	}
+	assert.Equal(s.T(), []string{"cat", "dog"}, names)
+}
+
+func (s *DriverTestSuite) TestUpdate() {
+	k := datastore.NameKey("Animal", "cat", nil)
+	assert.Nil(s.T(), s.d.Update(s.ctx, k, &Animal{Name: "cat", Legs: 3, Sound: "meow"}))
+
+	var a Animal
+	assert.Nil(s.T(), s.d.Get(s.ctx, k, &a))
+	assert.Equal(s.T(), 3, a.Legs)
+}
+
+func (s *DriverTestSuite) TestCreateAndDelete() {
+	encoded, err := s.d.Create(s.ctx, datastore.IncompleteKey("Animal", nil), &Animal{Name: "snake"})
+	assert.Nil(s.T(), err)
+	k, err := datastore.DecodeKey(encoded)
+	assert.Nil(s.T(), err)
+	assert.NotZero(s.T(), k.ID)
+
+	assert.Nil(s.T(), s.d.Delete(s.ctx, k))
+	assert.ErrorIs(s.T(), s.d.Get(s.ctx, k, &Animal{}), datastore.ErrNoSuchEntity)
+}
+
+func TestDriverWithTimeout(t *testing.T) {
+	d := &driver{timeout: ctxTimeOut}
+	WithTimeout(time.Second)(d)
+	assert.Equal(t, time.Second, d.timeout)
+
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Second), deadline, 100*time.Millisecond)
+
+	parent, parentCancel := context.WithTimeout(context.Background(), time.Hour)
+	defer parentCancel()
+	ctx, cancel = d.withTimeout(parent)
+	defer cancel()
+	deadline, _ = ctx.Deadline()
+	want, _ := parent.Deadline()
+	assert.Equal(t, want, deadline)
+
+	WithTimeout(0)(d)
+	ctx, cancel = d.withTimeout(context.Background())
+	defer cancel()
+	_, ok = ctx.Deadline()
+	assert.False(t, ok)
+}
@@ -0,0 +1,96 @@
+package dstest
+
+import (
+	"context"
+	"math"
+
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *Server) RunAggregationQuery(_ context.Context, req *pb.RunAggregationQueryRequest) (*pb.RunAggregationQueryResponse, error) {
+	aq := req.GetAggregationQuery()
+	q := aq.GetNestedQuery()
+	if q == nil {
+		return nil, status.Error(codes.Unimplemented, "GQL queries are not supported")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.readTransaction(req.GetReadOptions()); err != nil {
+		return nil, err
+	}
+
+	batch, err := s.runQuery(req.GetPartitionId().GetNamespaceId(), q)
+	if err != nil {
+		return nil, err
+	}
+
+	props := map[string]*pb.Value{}
+	for _, a := range aq.GetAggregations() {
+		switch op := a.GetOperator().(type) {
+		case *pb.AggregationQuery_Aggregation_Count_:
+			n := int64(len(batch.GetEntityResults()))
+			if upTo := op.Count.GetUpTo(); upTo != nil && upTo.GetValue() < n {
+				n = upTo.GetValue()
+			}
+			props[a.GetAlias()] = &pb.Value{ValueType: &pb.Value_IntegerValue{IntegerValue: n}}
+		case *pb.AggregationQuery_Aggregation_Sum_:
+			props[a.GetAlias()] = sum(batch.GetEntityResults(), op.Sum.GetProperty().GetName(), false)
+		case *pb.AggregationQuery_Aggregation_Avg_:
+			props[a.GetAlias()] = sum(batch.GetEntityResults(), op.Avg.GetProperty().GetName(), true)
+		default:
+			return nil, status.Error(codes.InvalidArgument, "unknown aggregation")
+		}
+	}
+
+	return &pb.RunAggregationQueryResponse{
+		Batch: &pb.AggregationResultBatch{
+			AggregationResults: []*pb.AggregationResult{{AggregateProperties: props}},
+			MoreResults:        pb.QueryResultBatch_NO_MORE_RESULTS,
+		},
+		Query: aq,
+	}, nil
+}
+
+// sum adds up the numeric values of the named property, or averages them.
+// Other values are ignored. An integer sum stays an integer unless it
+// overflows; an average of no values is null.
+func sum(results []*pb.EntityResult, name string, avg bool) *pb.Value {
+	var isum int64
+	var fsum float64
+	floats, values := false, 0
+	for _, r := range results {
+		v, ok := indexedValue(r.GetEntity(), name)
+		if !ok {
+			continue
+		}
+		switch x := v.GetValueType().(type) {
+		case *pb.Value_IntegerValue:
+			i := x.IntegerValue
+			if i > 0 && isum > math.MaxInt64-i || i < 0 && isum < math.MinInt64-i {
+				floats = true
+			}
+			isum += i
+			fsum += float64(i)
+		case *pb.Value_DoubleValue:
+			floats = true
+			fsum += x.DoubleValue
+		default:
+			continue
+		}
+		values++
+	}
+
+	switch {
+	case avg && values == 0:
+		return &pb.Value{ValueType: &pb.Value_NullValue{}}
+	case avg:
+		return &pb.Value{ValueType: &pb.Value_DoubleValue{DoubleValue: fsum / float64(values)}}
+	case floats:
+		return &pb.Value{ValueType: &pb.Value_DoubleValue{DoubleValue: fsum}}
+	}
+	return &pb.Value{ValueType: &pb.Value_IntegerValue{IntegerValue: isum}}
+}
@@ -0,0 +1,400 @@
+package dstest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"strings"
+
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	keyProperty = "__key__"
+	// kindKind is the metadata kind listing the kinds of a namespace.
+	kindKind = "__kind__"
+)
+
+// kindEntities returns the entities of the kind metadata kind: one per kind
+// and namespace holding entities, named after the kind.
+func (s *Server) kindEntities() map[string]*pb.Entity {
+	kinds := map[string]*pb.Entity{}
+	for _, e := range s.entities {
+		path := e.GetKey().GetPath()
+		k := &pb.Key{
+			PartitionId: e.GetKey().GetPartitionId(),
+			Path: []*pb.Key_PathElement{{
+				Kind:   kindKind,
+				IdType: &pb.Key_PathElement_Name{Name: path[len(path)-1].GetKind()},
+			}},
+		}
+		kinds[keyString(k)] = &pb.Entity{Key: k}
+	}
+	return kinds
+}
+
+// runQuery evaluates q over the entities of namespace and returns a single
+// batch holding every result. Cursors encode positions in the result.
+func (s *Server) runQuery(namespace string, q *pb.Query) (*pb.QueryResultBatch, error) {
+	if len(q.GetKind()) > 1 {
+		return nil, status.Error(codes.InvalidArgument, "only one kind per query is supported")
+	}
+	kind := ""
+	if len(q.GetKind()) == 1 {
+		kind = q.GetKind()[0].GetName()
+	}
+
+	orders := q.GetOrder()
+	if len(orders) == 0 {
+		// The backend sorts by the inequality property when no order is set.
+		if p := inequalityProperty(q.GetFilter()); p != "" {
+			orders = []*pb.PropertyOrder{{Property: &pb.PropertyReference{Name: p}}}
+		}
+	}
+
+	entities := s.entities
+	if kind == kindKind {
+		entities = s.kindEntities()
+	}
+	var results []*pb.Entity
+	for _, e := range entities {
+		if e.GetKey().GetPartitionId().GetNamespaceId() != namespace {
+			continue
+		}
+		path := e.GetKey().GetPath()
+		if kind != "" && path[len(path)-1].GetKind() != kind {
+			continue
+		}
+		if q.GetFilter() != nil && !matchFilter(e, q.GetFilter()) {
+			continue
+		}
+		if !hasOrderValues(e, orders) {
+			continue
+		}
+		results = append(results, e)
+	}
+	sortEntities(results, orders)
+
+	resultType := pb.EntityResult_FULL
+	projection := projectionNames(q)
+	switch {
+	case len(projection) == 1 && projection[0] == keyProperty:
+		resultType = pb.EntityResult_KEY_ONLY
+	case len(projection) > 0:
+		resultType = pb.EntityResult_PROJECTION
+		results = project(results, projection, q.GetDistinctOn())
+	}
+
+	start, err := decodeCursor(q.GetStartCursor())
+	if err != nil {
+		return nil, err
+	}
+	end := len(results)
+	if c := q.GetEndCursor(); c != nil {
+		if end, err = decodeCursor(c); err != nil {
+			return nil, err
+		}
+	}
+	if end > len(results) {
+		end = len(results)
+	}
+	if start > end {
+		start = end
+	}
+	results = results[start:end]
+
+	skipped := int(q.GetOffset())
+	if skipped > len(results) {
+		skipped = len(results)
+	}
+	results = results[skipped:]
+
+	more := pb.QueryResultBatch_NO_MORE_RESULTS
+	if l := q.GetLimit(); l != nil && int(l.GetValue()) < len(results) {
+		results = results[:l.GetValue()]
+		more = pb.QueryResultBatch_MORE_RESULTS_AFTER_LIMIT
+	}
+
+	pos := start + skipped
+	batch := &pb.QueryResultBatch{
+		SkippedResults:   int32(skipped),
+		EntityResultType: resultType,
+		MoreResults:      more,
+		SnapshotVersion:  s.version,
+	}
+	if skipped > 0 {
+		batch.SkippedCursor = encodeCursor(pos)
+	}
+	for _, e := range results {
+		pos++
+		e = proto.Clone(e).(*pb.Entity)
+		if resultType == pb.EntityResult_KEY_ONLY {
+			e.Properties = nil
+		}
+		batch.EntityResults = append(batch.EntityResults, &pb.EntityResult{
+			Entity:  e,
+			Version: s.versions[keyString(e.GetKey())],
+			Cursor:  encodeCursor(pos),
+		})
+	}
+	batch.EndCursor = encodeCursor(pos)
+	return batch, nil
+}
+
+func encodeCursor(pos int) []byte {
+	return binary.AppendUvarint(nil, uint64(pos))
+}
+
+func decodeCursor(c []byte) (int, error) {
+	if len(c) == 0 {
+		return 0, nil
+	}
+	pos, n := binary.Uvarint(c)
+	if n != len(c) {
+		return 0, status.Error(codes.InvalidArgument, "invalid query cursor")
+	}
+	return int(pos), nil
+}
+
+func projectionNames(q *pb.Query) []string {
+	var names []string
+	for _, p := range q.GetProjection() {
+		names = append(names, p.GetProperty().GetName())
+	}
+	return names
+}
+
+var inequalityOperators = map[pb.PropertyFilter_Operator]bool{
+	pb.PropertyFilter_LESS_THAN:             true,
+	pb.PropertyFilter_LESS_THAN_OR_EQUAL:    true,
+	pb.PropertyFilter_GREATER_THAN:          true,
+	pb.PropertyFilter_GREATER_THAN_OR_EQUAL: true,
+	pb.PropertyFilter_NOT_EQUAL:             true,
+	pb.PropertyFilter_NOT_IN:                true,
+}
+
+// inequalityProperty returns the property of the inequality filters in f.
+func inequalityProperty(f *pb.Filter) string {
+	if pf := f.GetPropertyFilter(); pf != nil {
+		if inequalityOperators[pf.GetOp()] {
+			return pf.GetProperty().GetName()
+		}
+		return ""
+	}
+	for _, m := range f.GetCompositeFilter().GetFilters() {
+		if p := inequalityProperty(m); p != "" {
+			return p
+		}
+	}
+	return ""
+}
+
+// indexedValue returns the value of the named property as the index sees
+// it. Unindexed values are invisible to filters and sort orders, and a
+// dotted name reaches into entity values.
+func indexedValue(e *pb.Entity, name string) (*pb.Value, bool) {
+	if name == keyProperty {
+		return &pb.Value{ValueType: &pb.Value_KeyValue{KeyValue: e.GetKey()}}, true
+	}
+	if v, ok := e.GetProperties()[name]; ok {
+		if v.GetExcludeFromIndexes() {
+			return nil, false
+		}
+		return v, true
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if v, ok := e.GetProperties()[name[:i]]; ok && v.GetEntityValue() != nil && !v.GetExcludeFromIndexes() {
+			return indexedValue(v.GetEntityValue(), name[i+1:])
+		}
+	}
+	return nil, false
+}
+
+// elems returns the values of an array, or the value itself. Unindexed
+// array elements are skipped.
+func elems(v *pb.Value) []*pb.Value {
+	a := v.GetArrayValue()
+	if a == nil {
+		return []*pb.Value{v}
+	}
+	var out []*pb.Value
+	for _, e := range a.GetValues() {
+		if !e.GetExcludeFromIndexes() {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func matchFilter(e *pb.Entity, f *pb.Filter) bool {
+	if cf := f.GetCompositeFilter(); cf != nil {
+		or := cf.GetOp() == pb.CompositeFilter_OR
+		for _, m := range cf.GetFilters() {
+			if matchFilter(e, m) == or {
+				return or
+			}
+		}
+		return !or
+	}
+
+	pf := f.GetPropertyFilter()
+	if pf.GetOp() == pb.PropertyFilter_HAS_ANCESTOR {
+		return hasAncestor(e.GetKey(), pf.GetValue().GetKeyValue())
+	}
+	v, ok := indexedValue(e, pf.GetProperty().GetName())
+	if !ok {
+		return false
+	}
+	// A multi-valued property matches when any of its values does.
+	for _, x := range elems(v) {
+		if matchValue(x, pf.GetOp(), pf.GetValue()) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchValue(v *pb.Value, op pb.PropertyFilter_Operator, operand *pb.Value) bool {
+	switch op {
+	case pb.PropertyFilter_EQUAL:
+		return compareValues(v, operand) == 0
+	case pb.PropertyFilter_NOT_EQUAL:
+		return compareValues(v, operand) != 0
+	case pb.PropertyFilter_LESS_THAN:
+		return compareValues(v, operand) < 0
+	case pb.PropertyFilter_LESS_THAN_OR_EQUAL:
+		return compareValues(v, operand) <= 0
+	case pb.PropertyFilter_GREATER_THAN:
+		return compareValues(v, operand) > 0
+	case pb.PropertyFilter_GREATER_THAN_OR_EQUAL:
+		return compareValues(v, operand) >= 0
+	case pb.PropertyFilter_IN, pb.PropertyFilter_NOT_IN:
+		found := false
+		for _, o := range operand.GetArrayValue().GetValues() {
+			if compareValues(v, o) == 0 {
+				found = true
+				break
+			}
+		}
+		return found == (op == pb.PropertyFilter_IN)
+	}
+	return false
+}
+
+// hasAncestor reports whether ancestor is k or one of its parents.
+func hasAncestor(k, ancestor *pb.Key) bool {
+	if k.GetPartitionId().GetNamespaceId() != ancestor.GetPartitionId().GetNamespaceId() {
+		return false
+	}
+	path, prefix := k.GetPath(), ancestor.GetPath()
+	if len(prefix) == 0 || len(prefix) > len(path) {
+		return false
+	}
+	for i, e := range prefix {
+		if comparePathElements(e, path[i]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func hasOrderValues(e *pb.Entity, orders []*pb.PropertyOrder) bool {
+	for _, o := range orders {
+		v, ok := indexedValue(e, o.GetProperty().GetName())
+		if !ok || len(elems(v)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sortValue picks the value a multi-valued property sorts by: its smallest
+// value ascending, its largest descending.
+func sortValue(v *pb.Value, desc bool) *pb.Value {
+	values := elems(v)
+	if len(values) == 0 {
+		return nil
+	}
+	best := values[0]
+	for _, x := range values[1:] {
+		c := compareValues(x, best)
+		if (desc && c > 0) || (!desc && c < 0) {
+			best = x
+		}
+	}
+	return best
+}
+
+// sortEntities sorts by the given orders, then by key as the backend does.
+func sortEntities(entities []*pb.Entity, orders []*pb.PropertyOrder) {
+	sort.SliceStable(entities, func(i, j int) bool {
+		a, b := entities[i], entities[j]
+		for _, o := range orders {
+			desc := o.GetDirection() == pb.PropertyOrder_DESCENDING
+			va, _ := indexedValue(a, o.GetProperty().GetName())
+			vb, _ := indexedValue(b, o.GetProperty().GetName())
+			c := compareValues(sortValue(va, desc), sortValue(vb, desc))
+			if desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return compareKeys(a.GetKey(), b.GetKey()) < 0
+	})
+}
+
+// project keeps the projected properties of each entity. An array property
+// yields one result per value, and entities missing a projected property
+// are dropped. Results are then de-duplicated on distinctOn.
+func project(entities []*pb.Entity, projection []string, distinctOn []*pb.PropertyReference) []*pb.Entity {
+	var projected []*pb.Entity
+	for _, e := range entities {
+		rows := []map[string]*pb.Value{{}}
+		for _, name := range projection {
+			v, ok := indexedValue(e, name)
+			if !ok {
+				rows = nil
+				break
+			}
+			var next []map[string]*pb.Value
+			for _, row := range rows {
+				for _, x := range elems(v) {
+					r := map[string]*pb.Value{name: x}
+					for k, v := range row {
+						r[k] = v
+					}
+					next = append(next, r)
+				}
+			}
+			rows = next
+		}
+		for _, row := range rows {
+			projected = append(projected, &pb.Entity{Key: e.GetKey(), Properties: row})
+		}
+	}
+
+	if len(distinctOn) == 0 {
+		return projected
+	}
+	var distinct []*pb.Entity
+	seen := map[string]bool{}
+	for _, e := range projected {
+		var id bytes.Buffer
+		for _, p := range distinctOn {
+			v, _ := indexedValue(e, p.GetName())
+			b, _ := proto.MarshalOptions{Deterministic: true}.Marshal(v)
+			id.Write(b)
+			id.WriteByte(0)
+		}
+		if !seen[id.String()] {
+			seen[id.String()] = true
+			distinct = append(distinct, e)
+		}
+	}
+	return distinct
+}
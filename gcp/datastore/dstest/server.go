@@ -0,0 +1,384 @@
+// Package dstest provides an in-process fake of the Datastore v1 gRPC API.
+//
+// The fake implements Lookup, RunQuery, RunAggregationQuery, Commit,
+// BeginTransaction, Rollback, AllocateIds and ReserveIds on top of an
+// in-memory store, so tests can point the real cloud.google.com/go/datastore
+// client at it through DATASTORE_EMULATOR_HOST without Java, gcloud or
+// network access:
+//
+//	srv, err := dstest.NewServer()
+//	...
+//	defer srv.Close()
+//	t.Setenv("DATASTORE_EMULATOR_HOST", srv.Addr)
+//
+// Server.Fail injects error statuses, to exercise how callers handle
+// transient failures.
+package dstest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Server is a fake Datastore v1 gRPC server listening on a local port.
+type Server struct {
+	pb.UnimplementedDatastoreServer
+
+	// Addr is the host:port the server listens on.
+	Addr string
+
+	srv *grpc.Server
+
+	mu       sync.Mutex
+	entities map[string]*pb.Entity
+	versions map[string]int64
+	version  int64
+	lastID   int64
+	lastTx   int64
+	txs      map[string]*transaction
+	faults   map[string][]codes.Code
+}
+
+// transaction records the entity versions read by a transaction, so its
+// commit can detect contention with writes that happened in between.
+type transaction struct {
+	readOnly bool
+	reads    map[string]int64
+}
+
+// NewServer starts a fake server on a free local port.
+func NewServer() (*Server, error) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Addr: lis.Addr().String(),
+	}
+	s.srv = grpc.NewServer(grpc.UnaryInterceptor(s.intercept))
+	s.Reset()
+	pb.RegisterDatastoreServer(s.srv, s)
+	go func() {
+		_ = s.srv.Serve(lis)
+	}()
+	return s, nil
+}
+
+// Close stops the server and closes its connections.
+func (s *Server) Close() {
+	s.srv.Stop()
+}
+
+// Reset drops every entity, open transaction and pending fault.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entities = map[string]*pb.Entity{}
+	s.versions = map[string]int64{}
+	s.txs = map[string]*transaction{}
+	s.faults = map[string][]codes.Code{}
+}
+
+// Fail makes the next times calls of method, such as "Lookup" or "Commit",
+// fail with code before reaching the store. Faults queue up behind those
+// already set for the method.
+func (s *Server) Fail(method string, code codes.Code, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < times; i++ {
+		s.faults[method] = append(s.faults[method], code)
+	}
+}
+
+// intercept fails the call with the next fault set for its method, if any.
+func (s *Server) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+	s.mu.Lock()
+	faults := s.faults[method]
+	if len(faults) > 0 {
+		s.faults[method] = faults[1:]
+	}
+	s.mu.Unlock()
+
+	if len(faults) > 0 {
+		return nil, status.Errorf(faults[0], "injected %s failure", method)
+	}
+	return handler(ctx, req)
+}
+
+// keyString identifies an entity by namespace and path.
+func keyString(k *pb.Key) string {
+	var b strings.Builder
+	b.WriteString(strconv.Quote(k.GetPartitionId().GetNamespaceId()))
+	for _, e := range k.GetPath() {
+		b.WriteString("/" + strconv.Quote(e.GetKind()) + ",")
+		if e.GetName() != "" {
+			b.WriteString(strconv.Quote(e.GetName()))
+		} else {
+			b.WriteString(strconv.FormatInt(e.GetId(), 10))
+		}
+	}
+	return b.String()
+}
+
+// incomplete reports whether the last element of k lacks an ID and a name.
+func incomplete(k *pb.Key) bool {
+	path := k.GetPath()
+	return len(path) > 0 && path[len(path)-1].GetIdType() == nil
+}
+
+func checkKey(k *pb.Key, allowIncomplete bool) error {
+	path := k.GetPath()
+	if len(path) == 0 {
+		return status.Error(codes.InvalidArgument, "key path is empty")
+	}
+	for i, e := range path {
+		if e.GetKind() == "" {
+			return status.Error(codes.InvalidArgument, "key path element has no kind")
+		}
+		last := i == len(path)-1
+		if e.GetIdType() == nil && (!last || !allowIncomplete) {
+			return status.Errorf(codes.InvalidArgument, "key path element %q is incomplete", e.GetKind())
+		}
+	}
+	return nil
+}
+
+// transaction returns the open transaction with the given ID.
+func (s *Server) transaction(id []byte) (*transaction, error) {
+	tx, ok := s.txs[string(id)]
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "unknown transaction")
+	}
+	return tx, nil
+}
+
+// readTransaction returns the transaction selected by opts, if any.
+func (s *Server) readTransaction(opts *pb.ReadOptions) (*transaction, error) {
+	if id := opts.GetTransaction(); id != nil {
+		return s.transaction(id)
+	}
+	return nil, nil
+}
+
+func (s *Server) Lookup(_ context.Context, req *pb.LookupRequest) (*pb.LookupResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.readTransaction(req.GetReadOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pb.LookupResponse{}
+	for _, k := range req.GetKeys() {
+		if err := checkKey(k, false); err != nil {
+			return nil, err
+		}
+		ks := keyString(k)
+		if tx != nil {
+			tx.reads[ks] = s.versions[ks]
+		}
+		if e, ok := s.entities[ks]; ok {
+			resp.Found = append(resp.Found, &pb.EntityResult{
+				Entity:  proto.Clone(e).(*pb.Entity),
+				Version: s.versions[ks],
+			})
+			continue
+		}
+		resp.Missing = append(resp.Missing, &pb.EntityResult{
+			Entity:  &pb.Entity{Key: k},
+			Version: s.version,
+		})
+	}
+	return resp, nil
+}
+
+func (s *Server) RunQuery(_ context.Context, req *pb.RunQueryRequest) (*pb.RunQueryResponse, error) {
+	q := req.GetQuery()
+	if q == nil {
+		return nil, status.Error(codes.Unimplemented, "GQL queries are not supported")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.readTransaction(req.GetReadOptions()); err != nil {
+		return nil, err
+	}
+
+	batch, err := s.runQuery(req.GetPartitionId().GetNamespaceId(), q)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.RunQueryResponse{Batch: batch, Query: q}, nil
+}
+
+func (s *Server) BeginTransaction(_ context.Context, req *pb.BeginTransactionRequest) (*pb.BeginTransactionResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastTx++
+	id := fmt.Sprintf("tx-%d", s.lastTx)
+	s.txs[id] = &transaction{
+		readOnly: req.GetTransactionOptions().GetReadOnly() != nil,
+		reads:    map[string]int64{},
+	}
+	return &pb.BeginTransactionResponse{Transaction: []byte(id)}, nil
+}
+
+func (s *Server) Rollback(_ context.Context, req *pb.RollbackRequest) (*pb.RollbackResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.transaction(req.GetTransaction()); err != nil {
+		return nil, err
+	}
+	delete(s.txs, string(req.GetTransaction()))
+	return &pb.RollbackResponse{}, nil
+}
+
+func (s *Server) Commit(_ context.Context, req *pb.CommitRequest) (*pb.CommitResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id := req.GetTransaction(); id != nil {
+		tx, err := s.transaction(id)
+		if err != nil {
+			return nil, err
+		}
+		delete(s.txs, string(id))
+		if tx.readOnly && len(req.GetMutations()) > 0 {
+			return nil, status.Error(codes.FailedPrecondition, "read-only transaction cannot write")
+		}
+		for ks, v := range tx.reads {
+			if s.versions[ks] != v {
+				return nil, status.Error(codes.Aborted, "too much contention on these datastore entities")
+			}
+		}
+	}
+
+	// Validate every mutation before applying any, so a commit is atomic.
+	seen := map[string]bool{}
+	for _, m := range req.GetMutations() {
+		k, allowIncomplete := mutationKey(m)
+		if err := checkKey(k, allowIncomplete); err != nil {
+			return nil, err
+		}
+		if incomplete(k) {
+			continue
+		}
+		ks := keyString(k)
+		if seen[ks] {
+			return nil, status.Error(codes.InvalidArgument, "a commit cannot contain multiple mutations of the same entity")
+		}
+		seen[ks] = true
+		_, exists := s.entities[ks]
+		switch m.GetOperation().(type) {
+		case *pb.Mutation_Insert:
+			if exists {
+				return nil, status.Error(codes.AlreadyExists, "entity already exists")
+			}
+		case *pb.Mutation_Update:
+			if !exists {
+				return nil, status.Error(codes.NotFound, "no entity to update")
+			}
+		}
+	}
+
+	s.version++
+	resp := &pb.CommitResponse{}
+	for _, m := range req.GetMutations() {
+		result := &pb.MutationResult{Version: s.version}
+		switch op := m.GetOperation().(type) {
+		case *pb.Mutation_Delete:
+			ks := keyString(op.Delete)
+			delete(s.entities, ks)
+			s.versions[ks] = s.version
+		default:
+			e := proto.Clone(mutationEntity(m)).(*pb.Entity)
+			if incomplete(e.Key) {
+				s.lastID++
+				e.Key.Path[len(e.Key.Path)-1].IdType = &pb.Key_PathElement_Id{Id: s.lastID}
+				result.Key = e.Key
+			}
+			ks := keyString(e.Key)
+			s.entities[ks] = e
+			s.versions[ks] = s.version
+		}
+		resp.MutationResults = append(resp.MutationResults, result)
+	}
+	return resp, nil
+}
+
+func mutationEntity(m *pb.Mutation) *pb.Entity {
+	switch op := m.GetOperation().(type) {
+	case *pb.Mutation_Insert:
+		return op.Insert
+	case *pb.Mutation_Update:
+		return op.Update
+	case *pb.Mutation_Upsert:
+		return op.Upsert
+	}
+	return nil
+}
+
+// mutationKey returns the key a mutation touches and whether it may be
+// incomplete.
+func mutationKey(m *pb.Mutation) (*pb.Key, bool) {
+	switch op := m.GetOperation().(type) {
+	case *pb.Mutation_Delete:
+		return op.Delete, false
+	case *pb.Mutation_Update:
+		return op.Update.GetKey(), false
+	default:
+		return mutationEntity(m).GetKey(), true
+	}
+}
+
+func (s *Server) AllocateIds(_ context.Context, req *pb.AllocateIdsRequest) (*pb.AllocateIdsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := &pb.AllocateIdsResponse{}
+	for _, k := range req.GetKeys() {
+		if err := checkKey(k, true); err != nil {
+			return nil, err
+		}
+		if !incomplete(k) {
+			return nil, status.Error(codes.InvalidArgument, "cannot allocate an ID for a complete key")
+		}
+		k = proto.Clone(k).(*pb.Key)
+		s.lastID++
+		k.Path[len(k.Path)-1].IdType = &pb.Key_PathElement_Id{Id: s.lastID}
+		resp.Keys = append(resp.Keys, k)
+	}
+	return resp, nil
+}
+
+func (s *Server) ReserveIds(_ context.Context, req *pb.ReserveIdsRequest) (*pb.ReserveIdsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, k := range req.GetKeys() {
+		if err := checkKey(k, false); err != nil {
+			return nil, err
+		}
+		// Reserved IDs are never handed out by the allocator.
+		if id := k.Path[len(k.Path)-1].GetId(); id > s.lastID {
+			s.lastID = id
+		}
+	}
+	return &pb.ReserveIdsResponse{}, nil
+}
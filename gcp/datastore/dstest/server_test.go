@@ -0,0 +1,202 @@
+package dstest
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type item struct {
+	Name  string
+	Count int
+	Tags  []string
+}
+
+type ServerTestSuite struct {
+	suite.Suite
+	srv *Server
+	c   *datastore.Client
+	ctx context.Context
+}
+
+func TestServerTestSuite(t *testing.T) {
+	suite.Run(t, new(ServerTestSuite))
+}
+
+func (s *ServerTestSuite) SetupSuite() {
+	srv, err := NewServer()
+	require.NoError(s.T(), err)
+	s.srv = srv
+	s.T().Setenv("DATASTORE_EMULATOR_HOST", srv.Addr)
+
+	s.ctx = context.Background()
+	s.c, err = datastore.NewClient(s.ctx, "test-project")
+	require.NoError(s.T(), err)
+}
+
+func (s *ServerTestSuite) TearDownSuite() {
+	s.c.Close()
+	s.srv.Close()
+}
+
+func (s *ServerTestSuite) SetupTest() {
+	s.srv.Reset()
+}
+
+func (s *ServerTestSuite) TestPutGetDelete() {
+	parent := datastore.NameKey("Box", "a", nil)
+	k, err := s.c.Put(s.ctx, datastore.IncompleteKey("Item", parent), &item{Name: "x", Count: 1})
+	s.Require().NoError(err)
+	assert.NotZero(s.T(), k.ID)
+	assert.True(s.T(), k.Parent.Equal(parent))
+
+	var got item
+	assert.NoError(s.T(), s.c.Get(s.ctx, k, &got))
+	assert.Equal(s.T(), item{Name: "x", Count: 1}, got)
+
+	assert.NoError(s.T(), s.c.Delete(s.ctx, k))
+	assert.Equal(s.T(), datastore.ErrNoSuchEntity, s.c.Get(s.ctx, k, &got))
+
+	ns := datastore.NameKey("Item", "y", nil)
+	ns.Namespace = "tenant"
+	_, err = s.c.Put(s.ctx, ns, &item{Name: "y"})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), datastore.ErrNoSuchEntity, s.c.Get(s.ctx, datastore.NameKey("Item", "y", nil), &got))
+}
+
+func (s *ServerTestSuite) TestQuery() {
+	parent := datastore.NameKey("Box", "a", nil)
+	items := []*item{
+		{Name: "a", Count: 3, Tags: []string{"red"}},
+		{Name: "b", Count: 1, Tags: []string{"blue", "red"}},
+		{Name: "c", Count: 2},
+	}
+	keys := []*datastore.Key{
+		datastore.NameKey("Item", "a", parent),
+		datastore.NameKey("Item", "b", parent),
+		datastore.NameKey("Item", "c", nil),
+	}
+	_, err := s.c.PutMulti(s.ctx, keys, items)
+	s.Require().NoError(err)
+
+	var got []item
+	_, err = s.c.GetAll(s.ctx, datastore.NewQuery("Item").Order("-Count"), &got)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), "a", got[0].Name)
+	assert.Equal(s.T(), "c", got[1].Name)
+
+	n, err := s.c.Count(s.ctx, datastore.NewQuery("Item").Ancestor(parent))
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 2, n)
+
+	ks, err := s.c.GetAll(s.ctx, datastore.NewQuery("Item").FilterField("Tags", "=", "red").KeysOnly(), nil)
+	s.Require().NoError(err)
+	assert.Len(s.T(), ks, 2)
+
+	it := s.c.Run(s.ctx, datastore.NewQuery("Item").Order("Name").Limit(1))
+	_, err = it.Next(&item{})
+	s.Require().NoError(err)
+	cursor, err := it.Cursor()
+	s.Require().NoError(err)
+
+	got = nil
+	_, err = s.c.GetAll(s.ctx, datastore.NewQuery("Item").Order("Name").Start(cursor), &got)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []string{"b", "c"}, []string{got[0].Name, got[1].Name})
+}
+
+func (s *ServerTestSuite) TestTransactionContention() {
+	k := datastore.NameKey("Item", "counter", nil)
+	_, err := s.c.Put(s.ctx, k, &item{Count: 1})
+	s.Require().NoError(err)
+
+	tx, err := s.c.NewTransaction(s.ctx)
+	s.Require().NoError(err)
+	var got item
+	s.Require().NoError(tx.Get(k, &got))
+
+	_, err = s.c.Put(s.ctx, k, &item{Count: 5})
+	s.Require().NoError(err)
+
+	_, err = tx.Put(k, &item{Count: got.Count + 1})
+	s.Require().NoError(err)
+	_, err = tx.Commit()
+	assert.Equal(s.T(), datastore.ErrConcurrentTransaction, err)
+
+	_, err = s.c.RunInTransaction(s.ctx, func(tx *datastore.Transaction) error {
+		if err := tx.Get(k, &got); err != nil {
+			return err
+		}
+		got.Count++
+		_, err := tx.Put(k, &got)
+		return err
+	})
+	s.Require().NoError(err)
+	s.Require().NoError(s.c.Get(s.ctx, k, &got))
+	assert.Equal(s.T(), 6, got.Count)
+}
+
+func (s *ServerTestSuite) TestMutations() {
+	k := datastore.NameKey("Item", "x", nil)
+	_, err := s.c.Mutate(s.ctx, datastore.NewUpdate(k, &item{}))
+	assert.Equal(s.T(), codes.NotFound, status.Code(err))
+
+	_, err = s.c.Mutate(s.ctx, datastore.NewInsert(k, &item{}))
+	s.Require().NoError(err)
+	_, err = s.c.Mutate(s.ctx, datastore.NewInsert(k, &item{}))
+	assert.Equal(s.T(), codes.AlreadyExists, status.Code(err))
+}
+
+func (s *ServerTestSuite) TestAllocateIDs() {
+	keys, err := s.c.AllocateIDs(s.ctx, []*datastore.Key{
+		datastore.IncompleteKey("Item", nil),
+		datastore.IncompleteKey("Item", nil),
+	})
+	s.Require().NoError(err)
+	assert.NotZero(s.T(), keys[0].ID)
+	assert.NotEqual(s.T(), keys[0].ID, keys[1].ID)
+}
+
+func (s *ServerTestSuite) TestAggregation() {
+	for i, n := range []int{1, 2, 3, 6} {
+		_, err := s.c.Put(s.ctx, datastore.IDKey("Item", int64(i+1), nil), &item{Name: "x", Count: n})
+		s.Require().NoError(err)
+	}
+
+	res, err := s.c.RunAggregationQuery(s.ctx, datastore.NewQuery("Item").
+		FilterField("Count", ">", 1).
+		NewAggregationQuery().
+		WithCount("n").
+		WithSum("Count", "total").
+		WithAvg("Count", "mean"))
+	s.Require().NoError(err)
+	assert.Equal(s.T(), int64(3), res["n"].(*pb.Value).GetIntegerValue())
+	assert.Equal(s.T(), int64(11), res["total"].(*pb.Value).GetIntegerValue())
+	assert.InDelta(s.T(), 11.0/3, res["mean"].(*pb.Value).GetDoubleValue(), 1e-9)
+}
+
+func (s *ServerTestSuite) TestFail() {
+	k := datastore.NameKey("Item", "a", nil)
+	_, err := s.c.Put(s.ctx, k, &item{Name: "a"})
+	s.Require().NoError(err)
+
+	s.srv.Fail("Lookup", codes.Aborted, 2)
+	var got item
+	for i := 0; i < 2; i++ {
+		err = s.c.Get(s.ctx, k, &got)
+		assert.Equal(s.T(), codes.Aborted, status.Code(err))
+	}
+	assert.NoError(s.T(), s.c.Get(s.ctx, k, &got))
+
+	s.srv.Fail("Commit", codes.Internal, 1)
+	s.srv.Reset()
+	_, err = s.c.Put(s.ctx, k, &item{Name: "a"})
+	assert.NoError(s.T(), err, "Reset drops pending faults")
+}
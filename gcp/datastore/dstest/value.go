@@ -0,0 +1,163 @@
+package dstest
+
+import (
+	"bytes"
+	"strings"
+
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// Value ranks follow the cross-type sort order of Datastore: values of
+// different types never compare equal and sort by type first.
+const (
+	rankNull = iota
+	rankBool
+	rankNumber
+	rankTime
+	rankString
+	rankBytes
+	rankKey
+	rankGeoPoint
+	rankArray
+	rankEntity
+)
+
+func valueRank(v *pb.Value) int {
+	switch v.GetValueType().(type) {
+	case *pb.Value_BooleanValue:
+		return rankBool
+	case *pb.Value_IntegerValue, *pb.Value_DoubleValue:
+		return rankNumber
+	case *pb.Value_TimestampValue:
+		return rankTime
+	case *pb.Value_StringValue:
+		return rankString
+	case *pb.Value_BlobValue:
+		return rankBytes
+	case *pb.Value_KeyValue:
+		return rankKey
+	case *pb.Value_GeoPointValue:
+		return rankGeoPoint
+	case *pb.Value_ArrayValue:
+		return rankArray
+	case *pb.Value_EntityValue:
+		return rankEntity
+	}
+	return rankNull
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareValues orders two values the way the backend does. Integers and
+// doubles compare numerically with each other.
+func compareValues(a, b *pb.Value) int {
+	ra, rb := valueRank(a), valueRank(b)
+	if ra != rb {
+		return compareInts(int64(ra), int64(rb))
+	}
+
+	switch ra {
+	case rankBool:
+		x, y := a.GetBooleanValue(), b.GetBooleanValue()
+		switch {
+		case x == y:
+			return 0
+		case !x:
+			return -1
+		}
+		return 1
+	case rankNumber:
+		_, ai := a.GetValueType().(*pb.Value_IntegerValue)
+		_, bi := b.GetValueType().(*pb.Value_IntegerValue)
+		if ai && bi {
+			return compareInts(a.GetIntegerValue(), b.GetIntegerValue())
+		}
+		return compareFloats(number(a), number(b))
+	case rankTime:
+		x, y := a.GetTimestampValue(), b.GetTimestampValue()
+		if c := compareInts(x.GetSeconds(), y.GetSeconds()); c != 0 {
+			return c
+		}
+		return compareInts(int64(x.GetNanos()), int64(y.GetNanos()))
+	case rankString:
+		return strings.Compare(a.GetStringValue(), b.GetStringValue())
+	case rankBytes:
+		return bytes.Compare(a.GetBlobValue(), b.GetBlobValue())
+	case rankKey:
+		return compareKeys(a.GetKeyValue(), b.GetKeyValue())
+	case rankGeoPoint:
+		x, y := a.GetGeoPointValue(), b.GetGeoPointValue()
+		if c := compareFloats(x.GetLatitude(), y.GetLatitude()); c != 0 {
+			return c
+		}
+		return compareFloats(x.GetLongitude(), y.GetLongitude())
+	case rankArray:
+		x, y := a.GetArrayValue().GetValues(), b.GetArrayValue().GetValues()
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := compareValues(x[i], y[i]); c != 0 {
+				return c
+			}
+		}
+		return compareInts(int64(len(x)), int64(len(y)))
+	}
+	return 0
+}
+
+func number(v *pb.Value) float64 {
+	if i, ok := v.GetValueType().(*pb.Value_IntegerValue); ok {
+		return float64(i.IntegerValue)
+	}
+	return v.GetDoubleValue()
+}
+
+// comparePathElements orders path elements by kind, then numeric IDs before
+// names.
+func comparePathElements(a, b *pb.Key_PathElement) int {
+	if c := strings.Compare(a.GetKind(), b.GetKind()); c != 0 {
+		return c
+	}
+	_, an := a.GetIdType().(*pb.Key_PathElement_Name)
+	_, bn := b.GetIdType().(*pb.Key_PathElement_Name)
+	switch {
+	case !an && bn:
+		return -1
+	case an && !bn:
+		return 1
+	case an:
+		return strings.Compare(a.GetName(), b.GetName())
+	}
+	return compareInts(a.GetId(), b.GetId())
+}
+
+// compareKeys orders keys by namespace, then path element by path element,
+// ancestors before descendants.
+func compareKeys(a, b *pb.Key) int {
+	if c := strings.Compare(a.GetPartitionId().GetNamespaceId(), b.GetPartitionId().GetNamespaceId()); c != 0 {
+		return c
+	}
+	pathA, pathB := a.GetPath(), b.GetPath()
+	for i := 0; i < len(pathA) && i < len(pathB); i++ {
+		if c := comparePathElements(pathA[i], pathB[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInts(int64(len(pathA)), int64(len(pathB)))
+}
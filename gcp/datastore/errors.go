@@ -0,0 +1,158 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The kinds of errors returned by the drivers. Every error the drivers
+// classify satisfies errors.Is with exactly one of them, and still wraps the
+// original error of the client or the backend:
+//
+//	if errors.Is(err, datastore.ErrNotFound) {
+//		w.WriteHeader(http.StatusNotFound)
+//	}
+var (
+	// ErrNotFound reports a missing entity.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict reports a write that lost against a concurrent one.
+	ErrConflict = errors.New("conflict")
+	// ErrInvalidArgument reports an invalid key, entity, query or option.
+	ErrInvalidArgument = errors.New("invalid argument")
+	// ErrUnavailable reports a backend that is down or overloaded.
+	ErrUnavailable = errors.New("unavailable")
+	// ErrFieldMismatch reports a stored property the destination has no
+	// field for. The other fields are loaded.
+	ErrFieldMismatch = errors.New("field mismatch")
+	// ErrTimeout reports an operation that ran out of time.
+	ErrTimeout = errors.New("timeout")
+	// ErrInternal reports a backend failure or a response the package cannot
+	// read.
+	ErrInternal = errors.New("internal")
+)
+
+// Error is an error classified under one of the error kinds. Its message is
+// the one of the error it wraps.
+type Error struct {
+	// Kind is one of ErrNotFound, ErrConflict, ErrInvalidArgument,
+	// ErrUnavailable, ErrFieldMismatch, ErrTimeout and ErrInternal.
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the kind of the error.
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// invalidArgument classifies err as an invalid argument, unless it is nil or
+// already classified.
+func invalidArgument(err error) error {
+	var classified *Error
+	if err == nil || errors.As(err, &classified) {
+		return err
+	}
+	return &Error{Kind: ErrInvalidArgument, Err: err}
+}
+
+var (
+	errNoSuchEntity      = wrapError(datastore.ErrNoSuchEntity)
+	errInvalidKey        = wrapError(datastore.ErrInvalidKey)
+	errInvalidEntityType = wrapError(datastore.ErrInvalidEntityType)
+)
+
+// errorKind returns the kind of err, nil when it has none.
+func errorKind(err error) error {
+	var mismatch *datastore.ErrFieldMismatch
+	switch {
+	case errors.Is(err, datastore.ErrNoSuchEntity):
+		return ErrNotFound
+	case errors.As(err, &mismatch):
+		return ErrFieldMismatch
+	case errors.Is(err, datastore.ErrConcurrentTransaction):
+		return ErrConflict
+	case errors.Is(err, datastore.ErrInvalidKey),
+		errors.Is(err, datastore.ErrInvalidEntityType),
+		errors.Is(err, datastore.ErrDifferentKeyAndDstLength):
+		return ErrInvalidArgument
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrTimeout
+	}
+
+	var se interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &se) {
+		return nil
+	}
+	switch se.GRPCStatus().Code() {
+	case codes.NotFound:
+		return ErrNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return ErrConflict
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return ErrInvalidArgument
+	case codes.Unavailable, codes.ResourceExhausted:
+		return ErrUnavailable
+	case codes.DeadlineExceeded:
+		return ErrTimeout
+	case codes.Internal, codes.DataLoss:
+		return ErrInternal
+	}
+	return nil
+}
+
+// wrapError classifies err under its kind, keeping it wrapped. Errors that
+// are already classified or have no kind are returned as they are, and the
+// items of a MultiError are classified one by one.
+func wrapError(err error) error {
+	if me, ok := err.(datastore.MultiError); ok {
+		errs := make(datastore.MultiError, len(me))
+		for i, e := range me {
+			errs[i] = wrapError(e)
+		}
+		return errs
+	}
+	var classified *Error
+	if err == nil || errors.As(err, &classified) {
+		return err
+	}
+	if kind := errorKind(err); kind != nil {
+		return &Error{Kind: kind, Err: err}
+	}
+	return err
+}
+
+// ctxErr returns the classified error of a done context.
+func ctxErr(ctx context.Context) error {
+	return wrapError(ctx.Err())
+}
+
+// errorIterator classifies the errors of the iterator it wraps.
+type errorIterator struct {
+	it Iterator
+}
+
+func (i errorIterator) Next(dst interface{}) (*datastore.Key, error) {
+	k, err := i.it.Next(dst)
+	if err != nil && err != iterator.Done {
+		err = wrapError(err)
+	}
+	return k, err
+}
+
+func (i errorIterator) Cursor() (datastore.Cursor, error) {
+	c, err := i.it.Cursor()
+	return c, wrapError(err)
+}
@@ -0,0 +1,193 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errorKinds = []error{ErrNotFound, ErrConflict, ErrInvalidArgument, ErrUnavailable, ErrFieldMismatch, ErrTimeout, ErrInternal}
+
+// assertKind checks that err is of kind and of no other kind.
+func assertKind(t *testing.T, err, kind error, msgAndArgs ...interface{}) {
+	t.Helper()
+	for _, k := range errorKinds {
+		assert.Equal(t, k == kind, errors.Is(err, k), append([]interface{}{"%v is %v", err, k}, msgAndArgs...)...)
+	}
+}
+
+func TestWrapError(t *testing.T) {
+	cases := map[error]error{
+		datastore.ErrNoSuchEntity:                      ErrNotFound,
+		datastore.ErrConcurrentTransaction:             ErrConflict,
+		fmt.Errorf("x: %w", datastore.ErrInvalidKey):   ErrInvalidArgument,
+		&datastore.ErrFieldMismatch{FieldName: "Legs"}: ErrFieldMismatch,
+		context.DeadlineExceeded:                       ErrTimeout,
+		status.Error(codes.NotFound, ""):               ErrNotFound,
+		status.Error(codes.AlreadyExists, ""):          ErrConflict,
+		status.Error(codes.Aborted, ""):                ErrConflict,
+		status.Error(codes.InvalidArgument, ""):        ErrInvalidArgument,
+		status.Error(codes.FailedPrecondition, ""):     ErrInvalidArgument,
+		status.Error(codes.Unavailable, ""):            ErrUnavailable,
+		status.Error(codes.ResourceExhausted, ""):      ErrUnavailable,
+		status.Error(codes.DeadlineExceeded, ""):       ErrTimeout,
+		status.Error(codes.Internal, ""):               ErrInternal,
+		status.Error(codes.DataLoss, ""):               ErrInternal,
+		status.Error(codes.Unknown, ""):                nil,
+		context.Canceled:                               nil,
+		ErrVersionConflict:                             ErrConflict,
+		ErrForeignNamespace:                            ErrInvalidArgument,
+		ErrReadOnlyTransaction:                         ErrInvalidArgument,
+	}
+	for err, kind := range cases {
+		wrapped := wrapError(err)
+		assertKind(t, wrapped, kind)
+		assert.ErrorIs(t, wrapped, err, "the original error stays wrapped")
+		assert.Equal(t, err.Error(), wrapped.Error())
+	}
+
+	var mismatch *datastore.ErrFieldMismatch
+	assert.ErrorAs(t, wrapError(&datastore.ErrFieldMismatch{FieldName: "Legs"}), &mismatch)
+	assert.Nil(t, wrapError(nil))
+
+	err := wrapError(datastore.MultiError{nil, datastore.ErrNoSuchEntity})
+	var me datastore.MultiError
+	if assert.ErrorAs(t, err, &me) {
+		assert.NoError(t, me[0])
+		assertKind(t, me[1], ErrNotFound)
+	}
+
+	once := wrapError(datastore.ErrNoSuchEntity)
+	assert.Same(t, once, wrapError(once), "classified errors are kept as they are")
+}
+
+type ErrorsTestSuite struct {
+	suite.Suite
+	newDriver func(t *testing.T) Driver
+	d         Driver
+	ctx       context.Context
+}
+
+func TestErrorsTestSuite(t *testing.T) {
+	forEachDriver(t, func(newDriver func(*testing.T) Driver) suite.TestingSuite {
+		return &ErrorsTestSuite{newDriver: newDriver}
+	})
+}
+
+func (s *ErrorsTestSuite) SetupTest() {
+	s.d = s.newDriver(s.T())
+	s.ctx = context.Background()
+	s.Require().NoError(s.d.Update(s.ctx, datastore.NameKey("Animal", "cat", nil), &Animal{Name: "cat", Legs: 4}))
+}
+
+func (s *ErrorsTestSuite) TestNotFound() {
+	err := s.d.Get(s.ctx, datastore.NameKey("Animal", "cow", nil), &Animal{})
+	assertKind(s.T(), err, ErrNotFound)
+	assert.ErrorIs(s.T(), err, datastore.ErrNoSuchEntity)
+
+	err = s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		return tx.Get(datastore.NameKey("Animal", "cow", nil), &Animal{})
+	})
+	assertKind(s.T(), err, ErrNotFound)
+}
+
+func (s *ErrorsTestSuite) TestFieldMismatch() {
+	var legless struct{ Name, Sound, FoodType string }
+	err := s.d.Get(s.ctx, datastore.NameKey("Animal", "cat", nil), &legless)
+	assertKind(s.T(), err, ErrFieldMismatch)
+	var mismatch *datastore.ErrFieldMismatch
+	s.Require().ErrorAs(err, &mismatch)
+	assert.Equal(s.T(), "Legs", mismatch.FieldName)
+	assert.Equal(s.T(), "cat", legless.Name, "the other fields are loaded")
+}
+
+func (s *ErrorsTestSuite) TestInvalidArgument() {
+	err := s.d.Get(s.ctx, datastore.IncompleteKey("Animal", nil), &Animal{})
+	assertKind(s.T(), err, ErrInvalidArgument)
+
+	_, err = s.d.FindKeys(s.ctx, NewQuery("Animal").Offset(-1))
+	assertKind(s.T(), err, ErrInvalidArgument)
+
+	_, err = s.d.FindPage(s.ctx, NewQuery("Animal"), 0, "", nil)
+	assertKind(s.T(), err, ErrInvalidArgument)
+
+	_, err = s.d.Count(s.ctx, NewQuery("Animal").Project("Legs"))
+	assertKind(s.T(), err, ErrInvalidArgument)
+
+	_, err = s.d.PutMulti(s.ctx, []*datastore.Key{datastore.NameKey("Animal", "cow", nil)}, []Animal{})
+	assertKind(s.T(), err, ErrInvalidArgument)
+
+	err = s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		_, err := tx.Put(datastore.NameKey("Animal", "cow", nil), &Animal{})
+		return err
+	}, TxReadOnly())
+	assertKind(s.T(), err, ErrInvalidArgument)
+	assert.ErrorIs(s.T(), err, ErrReadOnlyTransaction)
+}
+
+func (s *ErrorsTestSuite) TestConflict() {
+	k := datastore.NameKey("Animal", "cat", nil)
+	err := s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		var a Animal
+		if err := tx.Get(k, &a); err != nil {
+			return err
+		}
+		if err := s.d.Update(s.ctx, k, &a); err != nil {
+			return err
+		}
+		_, err := tx.Put(k, &a)
+		return err
+	}, TxMaxAttempts(1))
+	assertKind(s.T(), err, ErrConflict)
+}
+
+func (s *ErrorsTestSuite) TestTimeout() {
+	ctx, cancel := context.WithTimeout(s.ctx, time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	err := s.d.Get(ctx, datastore.NameKey("Animal", "cat", nil), &Animal{})
+	assertKind(s.T(), err, ErrTimeout)
+}
+
+func TestServerErrors(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+	d, err := NewDriver(context.Background(), testProjectID, WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer d.Close()
+	ctx := context.Background()
+
+	failures := map[codes.Code]error{
+		codes.ResourceExhausted:  ErrUnavailable,
+		codes.Aborted:            ErrConflict,
+		codes.FailedPrecondition: ErrInvalidArgument,
+		codes.DeadlineExceeded:   ErrTimeout,
+	}
+	for code, kind := range failures {
+		srv.Fail("Lookup", code, 1)
+		err := d.Get(ctx, datastore.NameKey("Animal", "cat", nil), &Animal{})
+		assertKind(t, err, kind, code)
+		assert.Equal(t, code, status.Code(err), "the status stays wrapped")
+	}
+
+	srv.Fail("RunQuery", codes.FailedPrecondition, 1)
+	it, err := d.Find(ctx, NewQuery("Animal"))
+	if assert.NoError(t, err) {
+		_, err = it.Next(&Animal{})
+		assertKind(t, err, ErrInvalidArgument)
+	}
+
+	srv.Fail("RunQuery", codes.ResourceExhausted, 1)
+	_, err = d.FindKeys(ctx, NewQuery("Animal"))
+	assertKind(t, err, ErrUnavailable)
+}
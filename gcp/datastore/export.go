@@ -0,0 +1,363 @@
+package datastore
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// The types of the exported property values.
+const (
+	nullType     = "null"
+	intType      = "int"
+	floatType    = "float"
+	boolType     = "bool"
+	stringType   = "string"
+	timeType     = "time"
+	geoPointType = "geopoint"
+	keyType      = "key"
+	blobType     = "blob"
+	entityType   = "entity"
+	arrayType    = "array"
+)
+
+// exportedEntity is one line of an export, or a nested entity. Keys are
+// printed by FormatKey.
+type exportedEntity struct {
+	Key        string             `json:"key,omitempty"`
+	Properties []exportedProperty `json:"properties"`
+}
+
+type exportedProperty struct {
+	Name string `json:"name"`
+	exportedValue
+	NoIndex bool `json:"noindex,omitempty"`
+}
+
+// exportedValue is a property value along with its type, so that values
+// JSON cannot tell apart, such as times and strings, are restored as they
+// were.
+type exportedValue struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type exportedGeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+type exportOptions struct {
+	namespace string
+	ancestor  *datastore.Key
+}
+
+// ExportOption configures Export.
+type ExportOption func(*exportOptions)
+
+// ExportNamespace exports the kinds of namespace instead of the default
+// namespace.
+func ExportNamespace(namespace string) ExportOption {
+	return func(o *exportOptions) {
+		o.namespace = namespace
+	}
+}
+
+// ExportAncestor only exports the entities under ancestor, in its
+// namespace.
+func ExportAncestor(ancestor *datastore.Key) ExportOption {
+	return func(o *exportOptions) {
+		o.ancestor = ancestor
+		if ancestor != nil {
+			o.namespace = ancestor.Namespace
+		}
+	}
+}
+
+// Export writes the entities of kinds read from d to w as newline-delimited
+// JSON, one entity per line, and returns how many it wrote:
+//
+//	{"key":"Zoo:\"north\"/Animal:42","properties":[{"name":"Born","type":"time","value":"2020-01-02T03:04:05Z"}]}
+//
+// Keys keep their full path and namespace, in the form FormatKey prints, and
+// every value is written along with its type: null, int, float, bool,
+// string, time, geopoint, key, blob, entity or array. Import reads it back.
+func Export(ctx context.Context, d Driver, w io.Writer, kinds []string, opts ...ExportOption) (int, error) {
+	if len(kinds) == 0 {
+		return 0, invalidArgument(errors.New("export: no kinds"))
+	}
+	var o exportOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	n := 0
+	for _, kind := range kinds {
+		q := NewQuery(kind).Namespace(o.namespace)
+		if o.ancestor != nil {
+			q = q.Ancestor(o.ancestor)
+		}
+		it, err := d.Find(ctx, q)
+		if err != nil {
+			return n, err
+		}
+		for {
+			var props datastore.PropertyList
+			key, err := it.Next(&props)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return n, err
+			}
+			e, err := exportEntity(key, props)
+			if err != nil {
+				return n, fmt.Errorf("export %v: %w", key, err)
+			}
+			if err := enc.Encode(e); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, bw.Flush()
+}
+
+// exportEntity exports the properties of an entity sorted by name, so that
+// exports of the same entities are identical.
+func exportEntity(key *datastore.Key, props []datastore.Property) (exportedEntity, error) {
+	props = append([]datastore.Property(nil), props...)
+	sort.SliceStable(props, func(i, j int) bool { return props[i].Name < props[j].Name })
+	e := exportedEntity{Key: FormatKey(key), Properties: make([]exportedProperty, len(props))}
+	for i, p := range props {
+		v, err := exportValue(p.Value)
+		if err != nil {
+			return e, fmt.Errorf("property %s: %w", p.Name, err)
+		}
+		e.Properties[i] = exportedProperty{Name: p.Name, exportedValue: v, NoIndex: p.NoIndex}
+	}
+	return e, nil
+}
+
+func exportValue(v interface{}) (exportedValue, error) {
+	var typ string
+	var value interface{}
+	switch x := v.(type) {
+	case nil:
+		return exportedValue{Type: nullType}, nil
+	case int64:
+		typ, value = intType, x
+	case float64:
+		typ, value = floatType, x
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			// JSON has no numbers for these.
+			value = strconv.FormatFloat(x, 'g', -1, 64)
+		}
+	case bool:
+		typ, value = boolType, x
+	case string:
+		typ, value = stringType, x
+	case time.Time:
+		typ, value = timeType, x.UTC().Format(time.RFC3339Nano)
+	case datastore.GeoPoint:
+		typ, value = geoPointType, exportedGeoPoint{Lat: x.Lat, Lng: x.Lng}
+	case *datastore.Key:
+		if x == nil {
+			return exportedValue{Type: nullType}, nil
+		}
+		typ, value = keyType, FormatKey(x)
+	case []byte:
+		typ, value = blobType, x
+	case *datastore.Entity:
+		if x == nil {
+			return exportedValue{Type: nullType}, nil
+		}
+		e, err := exportEntity(x.Key, x.Properties)
+		if err != nil {
+			return exportedValue{}, err
+		}
+		typ, value = entityType, e
+	case []interface{}:
+		values := make([]exportedValue, len(x))
+		for i := range x {
+			var err error
+			if values[i], err = exportValue(x[i]); err != nil {
+				return exportedValue{}, err
+			}
+		}
+		typ, value = arrayType, values
+	default:
+		return exportedValue{}, invalidArgument(fmt.Errorf("%w: unsupported value type %T", datastore.ErrInvalidEntityType, v))
+	}
+	raw, err := json.Marshal(value)
+	return exportedValue{Type: typ, Value: raw}, err
+}
+
+// Import stores the entities of an export read from r into d under their
+// original keys, overwriting those that exist, and returns how many it
+// stored. Entities are stored in batches with PutMulti, to which opts are
+// passed; on error, the entities of the batches before the failing one are
+// stored. The IDs of the keys of each batch are reserved first, so that
+// they are not allocated to new entities afterwards.
+func Import(ctx context.Context, d Driver, r io.Reader, opts ...BatchOption) (int, error) {
+	dec := json.NewDecoder(r)
+	keys := make([]*datastore.Key, 0, maxBatchMutations)
+	entities := make([]datastore.PropertyList, 0, maxBatchMutations)
+	n := 0
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		var ids []*datastore.Key
+		for _, k := range keys {
+			if k.ID != 0 {
+				ids = append(ids, k)
+			}
+		}
+		if len(ids) > 0 {
+			if err := d.ReserveIDs(ctx, ids); err != nil {
+				return err
+			}
+		}
+		if _, err := d.PutMulti(ctx, keys, entities, opts...); err != nil {
+			return err
+		}
+		n += len(keys)
+		keys, entities = keys[:0], entities[:0]
+		return nil
+	}
+
+	for i := 1; ; i++ {
+		var e exportedEntity
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return n, invalidArgument(fmt.Errorf("import: entity %d: %w", i, err))
+		}
+		key, props, err := importEntity(e)
+		if err == nil && (key == nil || key.Incomplete()) {
+			err = invalidKeyf("%q is not a complete key", e.Key)
+		}
+		if err != nil {
+			return n, invalidArgument(fmt.Errorf("import: entity %d: %w", i, err))
+		}
+		keys = append(keys, key)
+		entities = append(entities, props)
+		if len(keys) == cap(keys) {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, flush()
+}
+
+func importEntity(e exportedEntity) (*datastore.Key, datastore.PropertyList, error) {
+	var key *datastore.Key
+	if e.Key != "" {
+		var err error
+		if key, err = ParseKey(e.Key); err != nil {
+			return nil, nil, err
+		}
+	}
+	props := make(datastore.PropertyList, len(e.Properties))
+	for i, p := range e.Properties {
+		v, err := importValue(p.exportedValue)
+		if err != nil {
+			return nil, nil, fmt.Errorf("property %s: %w", p.Name, err)
+		}
+		props[i] = datastore.Property{Name: p.Name, Value: v, NoIndex: p.NoIndex}
+	}
+	return key, props, nil
+}
+
+func importValue(v exportedValue) (interface{}, error) {
+	if v.Type == nullType {
+		return nil, nil
+	}
+	if len(v.Value) == 0 {
+		return nil, fmt.Errorf("%s value missing", v.Type)
+	}
+	switch v.Type {
+	case intType:
+		var i int64
+		err := json.Unmarshal(v.Value, &i)
+		return i, err
+	case floatType:
+		var f float64
+		if v.Value[0] != '"' {
+			err := json.Unmarshal(v.Value, &f)
+			return f, err
+		}
+		var s string
+		if err := json.Unmarshal(v.Value, &s); err != nil {
+			return nil, err
+		}
+		return strconv.ParseFloat(s, 64)
+	case boolType:
+		var b bool
+		err := json.Unmarshal(v.Value, &b)
+		return b, err
+	case stringType:
+		var s string
+		err := json.Unmarshal(v.Value, &s)
+		return s, err
+	case timeType:
+		var s string
+		if err := json.Unmarshal(v.Value, &s); err != nil {
+			return nil, err
+		}
+		return time.Parse(time.RFC3339Nano, s)
+	case geoPointType:
+		var g exportedGeoPoint
+		err := json.Unmarshal(v.Value, &g)
+		return datastore.GeoPoint{Lat: g.Lat, Lng: g.Lng}, err
+	case keyType:
+		var s string
+		if err := json.Unmarshal(v.Value, &s); err != nil {
+			return nil, err
+		}
+		return ParseKey(s)
+	case blobType:
+		var b []byte
+		err := json.Unmarshal(v.Value, &b)
+		return b, err
+	case entityType:
+		var e exportedEntity
+		if err := json.Unmarshal(v.Value, &e); err != nil {
+			return nil, err
+		}
+		key, props, err := importEntity(e)
+		if err != nil {
+			return nil, err
+		}
+		return &datastore.Entity{Key: key, Properties: props}, nil
+	case arrayType:
+		var values []exportedValue
+		if err := json.Unmarshal(v.Value, &values); err != nil {
+			return nil, err
+		}
+		array := make([]interface{}, len(values))
+		for i := range values {
+			var err error
+			if array[i], err = importValue(values[i]); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	}
+	return nil, fmt.Errorf("unknown value type %q", v.Type)
+}
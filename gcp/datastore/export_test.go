@@ -0,0 +1,210 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ExportTestSuite struct {
+	suite.Suite
+	newDriver func(t *testing.T) Driver
+	d         Driver
+	ctx       context.Context
+	zoo       *datastore.Key
+	cat       *datastore.Key
+}
+
+func TestExportTestSuite(t *testing.T) {
+	forEachDriver(t, func(newDriver func(*testing.T) Driver) suite.TestingSuite {
+		return &ExportTestSuite{newDriver: newDriver}
+	})
+}
+
+func (s *ExportTestSuite) SetupTest() {
+	s.d = s.newDriver(s.T())
+	s.ctx = context.Background()
+	s.zoo = datastore.NameKey("Zoo", "north", nil)
+	s.cat = datastore.IDKey("Animal", 42, s.zoo)
+
+	born := time.Date(2020, 1, 2, 3, 4, 5, 678000, time.UTC)
+	cat := datastore.PropertyList{
+		{Name: "Name", Value: "cat"},
+		{Name: "Legs", Value: int64(4)},
+		{Name: "Weight", Value: 4.5},
+		{Name: "Tame", Value: true},
+		{Name: "Born", Value: born},
+		{Name: "Home", Value: datastore.GeoPoint{Lat: 52.5, Lng: 13.4}},
+		{Name: "Zoo", Value: s.zoo},
+		{Name: "Photo", Value: []byte{0, 1, 2, 255}, NoIndex: true},
+		{Name: "Owner", Value: nil},
+		{Name: "Tags", Value: []interface{}{"small", "furry"}},
+		{Name: "Diet", Value: &datastore.Entity{Properties: []datastore.Property{
+			{Name: "Food", Value: "fish"},
+			{Name: "Meals", Value: int64(3)},
+		}}},
+	}
+	_, err := s.d.PutMulti(s.ctx,
+		[]*datastore.Key{s.zoo, s.cat, datastore.NameKey("Animal", "dog", nil)},
+		[]datastore.PropertyList{{{Name: "City", Value: "Berlin"}}, cat, {{Name: "Name", Value: "dog"}}})
+	s.Require().NoError(err)
+}
+
+func (s *ExportTestSuite) TestRoundTrip() {
+	var buf bytes.Buffer
+	n, err := Export(s.ctx, s.d, &buf, []string{"Zoo", "Animal"})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 3, n)
+	export := buf.String()
+	assert.Len(s.T(), strings.Split(strings.TrimSuffix(export, "\n"), "\n"), 3, "one entity per line")
+	assert.Contains(s.T(), export, `"key":"Zoo:\"north\"/Animal:42"`)
+	assert.Contains(s.T(), export, `{"name":"Born","type":"time","value":"2020-01-02T03:04:05.000678Z"}`)
+
+	restored := NewMemoryDriver()
+	n, err = Import(s.ctx, restored, strings.NewReader(export))
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 3, n)
+
+	var again bytes.Buffer
+	_, err = Export(s.ctx, restored, &again, []string{"Zoo", "Animal"})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), export, again.String())
+
+	var cat datastore.PropertyList
+	s.Require().NoError(restored.Get(s.ctx, s.cat, &cat))
+	values := map[string]interface{}{}
+	for _, p := range cat {
+		values[p.Name] = p.Value
+		assert.Equal(s.T(), p.Name == "Photo", p.NoIndex, p.Name)
+	}
+	assert.Equal(s.T(), int64(4), values["Legs"])
+	assert.Equal(s.T(), 4.5, values["Weight"])
+	assert.True(s.T(), time.Date(2020, 1, 2, 3, 4, 5, 678000, time.UTC).Equal(values["Born"].(time.Time)))
+	assert.Equal(s.T(), datastore.GeoPoint{Lat: 52.5, Lng: 13.4}, values["Home"])
+	assert.True(s.T(), s.zoo.Equal(values["Zoo"].(*datastore.Key)))
+	assert.Equal(s.T(), []byte{0, 1, 2, 255}, values["Photo"])
+	assert.Nil(s.T(), values["Owner"])
+	assert.Equal(s.T(), []interface{}{"small", "furry"}, values["Tags"])
+	if diet, ok := values["Diet"].(*datastore.Entity); assert.True(s.T(), ok) {
+		assert.Equal(s.T(), []datastore.Property{{Name: "Food", Value: "fish"}, {Name: "Meals", Value: int64(3)}}, diet.Properties)
+	}
+}
+
+func (s *ExportTestSuite) TestAncestor() {
+	var buf bytes.Buffer
+	n, err := Export(s.ctx, s.d, &buf, []string{"Animal"}, ExportAncestor(s.zoo))
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 1, n)
+	assert.NotContains(s.T(), buf.String(), `"dog"`)
+
+	n, err = Export(s.ctx, s.d, &buf, []string{"Animal"}, ExportNamespace("tenant"))
+	s.Require().NoError(err)
+	assert.Zero(s.T(), n)
+
+	_, err = Export(s.ctx, s.d, &buf, nil)
+	assert.ErrorIs(s.T(), err, ErrInvalidArgument)
+}
+
+func (s *ExportTestSuite) TestImportOverwrites() {
+	line := `{"key":"Animal:\"dog\"","properties":[{"name":"Name","type":"string","value":"wolf"}]}` + "\n"
+	n, err := Import(s.ctx, s.d, strings.NewReader(line))
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 1, n)
+
+	var dog Animal
+	s.Require().NoError(s.d.Get(s.ctx, datastore.NameKey("Animal", "dog", nil), &dog))
+	assert.Equal(s.T(), "wolf", dog.Name)
+}
+
+func (s *ExportTestSuite) TestImportReservesIDs() {
+	var buf strings.Builder
+	for i := 1; i <= 3; i++ {
+		fmt.Fprintf(&buf, `{"key":"Animal:%d","properties":[{"name":"Name","type":"string","value":"imported %d"}]}`+"\n", i, i)
+	}
+	_, err := Import(s.ctx, s.d, strings.NewReader(buf.String()))
+	s.Require().NoError(err)
+
+	for i := 0; i < 3; i++ {
+		id, err := s.d.Create(s.ctx, datastore.IncompleteKey("Animal", nil), &Animal{Name: "created"})
+		s.Require().NoError(err)
+		k, err := datastore.DecodeKey(id)
+		s.Require().NoError(err)
+		assert.Greater(s.T(), k.ID, int64(3), "imported IDs are not allocated again")
+	}
+	for i := int64(1); i <= 3; i++ {
+		var a Animal
+		s.Require().NoError(s.d.Get(s.ctx, datastore.IDKey("Animal", i, nil), &a))
+		assert.Equal(s.T(), fmt.Sprintf("imported %d", i), a.Name)
+	}
+}
+
+func TestImportBatches(t *testing.T) {
+	var buf strings.Builder
+	for i := 1; i <= 1200; i++ {
+		fmt.Fprintf(&buf, `{"key":"@tenant/Animal:%d","properties":[{"name":"Legs","type":"int","value":%d}]}`+"\n", i, i%5)
+	}
+	d := NewMemoryDriver()
+	ctx := context.Background()
+	n, err := Import(ctx, d, strings.NewReader(buf.String()))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 1200, n)
+	count, err := d.Count(ctx, NewQuery("Animal").Namespace("tenant"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1200), count)
+}
+
+func TestImportErrors(t *testing.T) {
+	valid := `{"key":"Animal:1","properties":[]}` + "\n"
+	cases := map[string]string{
+		"syntax":     `{"key":`,
+		"incomplete": `{"key":"Animal","properties":[]}`,
+		"no key":     `{"properties":[]}`,
+		"bad key":    `{"key":"Animal:x","properties":[]}`,
+		"type":       `{"key":"Animal:2","properties":[{"name":"Legs","type":"complex","value":1}]}`,
+		"value":      `{"key":"Animal:2","properties":[{"name":"Legs","type":"int","value":"four"}]}`,
+		"missing":    `{"key":"Animal:2","properties":[{"name":"Legs","type":"int"}]}`,
+	}
+	for name, line := range cases {
+		n, err := Import(context.Background(), NewMemoryDriver(), strings.NewReader(valid+line))
+		assert.ErrorIs(t, err, ErrInvalidArgument, name)
+		assert.Contains(t, fmt.Sprint(err), "entity 2", name)
+		assert.Zero(t, n, "%s: nothing is stored before the batch is full", name)
+	}
+}
+
+func TestExportValues(t *testing.T) {
+	values := []interface{}{
+		nil, int64(math.MinInt64), math.Inf(-1), math.Inf(1), 0.1, "<tag>", []byte{},
+		time.Date(1900, 1, 1, 0, 0, 0, 1000, time.UTC), []interface{}{int64(1), "two", nil},
+		datastore.NameKey("Animal", "cat / \"dog\"", datastore.IDKey("Zoo", 7, nil)),
+	}
+	for _, v := range values {
+		exported, err := exportValue(v)
+		if !assert.NoError(t, err, v) {
+			continue
+		}
+		imported, err := importValue(exported)
+		assert.NoError(t, err, v)
+		assert.Equal(t, v, imported)
+	}
+
+	nan, err := exportValue(math.NaN())
+	if assert.NoError(t, err) {
+		v, err := importValue(nan)
+		assert.NoError(t, err)
+		assert.True(t, math.IsNaN(v.(float64)))
+	}
+
+	_, err = exportValue(int32(1))
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
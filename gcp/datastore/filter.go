@@ -0,0 +1,103 @@
+package datastore
+
+import "cloud.google.com/go/datastore"
+
+// PropertyFilter compares a single property against a value. It satisfies
+// both DataFilter and Filter.
+type PropertyFilter struct {
+	Field     string
+	Condition string
+	Value     interface{}
+}
+
+var _ DataFilter = PropertyFilter{}
+var _ Filter = PropertyFilter{}
+
+func (f PropertyFilter) GetField() string      { return f.Field }
+func (f PropertyFilter) GetCondition() string  { return f.Condition }
+func (f PropertyFilter) GetValue() interface{} { return f.Value }
+
+// EntityFilter maps the filter onto the client's PropertyFilter.
+func (f PropertyFilter) EntityFilter() datastore.EntityFilter {
+	return datastore.PropertyFilter{FieldName: f.Field, Operator: f.Condition, Value: f.Value}
+}
+
+// Where adapts any DataFilter implementation into a Filter.
+func Where(f DataFilter) Filter {
+	if f == nil {
+		return nil
+	}
+	return PropertyFilter{Field: f.GetField(), Condition: f.GetCondition(), Value: f.GetValue()}
+}
+
+// Eq matches entities whose property equals value.
+func Eq(field string, value interface{}) PropertyFilter {
+	return PropertyFilter{Field: field, Condition: "=", Value: value}
+}
+
+// Lt matches entities whose property is less than value.
+func Lt(field string, value interface{}) PropertyFilter {
+	return PropertyFilter{Field: field, Condition: "<", Value: value}
+}
+
+// Lte matches entities whose property is less than or equal to value.
+func Lte(field string, value interface{}) PropertyFilter {
+	return PropertyFilter{Field: field, Condition: "<=", Value: value}
+}
+
+// Gt matches entities whose property is greater than value.
+func Gt(field string, value interface{}) PropertyFilter {
+	return PropertyFilter{Field: field, Condition: ">", Value: value}
+}
+
+// Gte matches entities whose property is greater than or equal to value.
+func Gte(field string, value interface{}) PropertyFilter {
+	return PropertyFilter{Field: field, Condition: ">=", Value: value}
+}
+
+// NotEqual matches entities whose property differs from value.
+func NotEqual(field string, value interface{}) PropertyFilter {
+	return PropertyFilter{Field: field, Condition: "!=", Value: value}
+}
+
+// In matches entities whose property equals any of values.
+func In(field string, values ...interface{}) PropertyFilter {
+	return PropertyFilter{Field: field, Condition: "in", Value: values}
+}
+
+// NotIn matches entities whose property equals none of values.
+func NotIn(field string, values ...interface{}) PropertyFilter {
+	return PropertyFilter{Field: field, Condition: "not-in", Value: values}
+}
+
+// compositeFilter joins filters with AND or OR.
+type compositeFilter struct {
+	or      bool
+	filters []Filter
+}
+
+// And matches entities that satisfy every filter.
+func And(filters ...Filter) Filter {
+	return compositeFilter{filters: filters}
+}
+
+// Or matches entities that satisfy at least one filter.
+func Or(filters ...Filter) Filter {
+	return compositeFilter{or: true, filters: filters}
+}
+
+// EntityFilter maps the composite onto the client's AndFilter or OrFilter.
+func (c compositeFilter) EntityFilter() datastore.EntityFilter {
+	var efs []datastore.EntityFilter
+	for _, f := range c.filters {
+		if f == nil {
+			efs = append(efs, nil)
+			continue
+		}
+		efs = append(efs, f.EntityFilter())
+	}
+	if c.or {
+		return datastore.OrFilter{Filters: efs}
+	}
+	return datastore.AndFilter{Filters: efs}
+}
@@ -0,0 +1,73 @@
+package datastore
+
+import (
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type testFilter struct {
+	field     string
+	condition string
+	value     interface{}
+}
+
+func (f testFilter) GetField() string      { return f.field }
+func (f testFilter) GetCondition() string  { return f.condition }
+func (f testFilter) GetValue() interface{} { return f.value }
+
+type FilterTestSuite struct {
+	suite.Suite
+}
+
+func TestFilterTestSuite(t *testing.T) {
+	suite.Run(t, new(FilterTestSuite))
+}
+
+func (s *FilterTestSuite) TestConstructors() {
+	cases := []struct {
+		filter    PropertyFilter
+		condition string
+	}{
+		{Eq("Legs", 4), "="},
+		{Lt("Legs", 4), "<"},
+		{Lte("Legs", 4), "<="},
+		{Gt("Legs", 4), ">"},
+		{Gte("Legs", 4), ">="},
+		{NotEqual("Legs", 4), "!="},
+	}
+	for _, c := range cases {
+		assert.Equal(s.T(), "Legs", c.filter.GetField())
+		assert.Equal(s.T(), c.condition, c.filter.GetCondition())
+		assert.Equal(s.T(), 4, c.filter.GetValue())
+		assert.Equal(s.T(), datastore.PropertyFilter{FieldName: "Legs", Operator: c.condition, Value: 4}, c.filter.EntityFilter())
+	}
+
+	in := In("Name", "cat", "dog")
+	assert.Equal(s.T(), "in", in.GetCondition())
+	assert.Equal(s.T(), []interface{}{"cat", "dog"}, in.GetValue())
+	assert.Equal(s.T(), "not-in", NotIn("Name", "cat").GetCondition())
+}
+
+func (s *FilterTestSuite) TestWhere() {
+	f := Where(testFilter{"Sound", "=", "meow"})
+	assert.Equal(s.T(), Eq("Sound", "meow"), f)
+	assert.Nil(s.T(), Where(nil))
+}
+
+func (s *FilterTestSuite) TestComposite() {
+	f := Or(Eq("Name", "cat"), And(Gt("Legs", 2), Lt("Legs", 8)))
+	assert.Equal(s.T(), datastore.OrFilter{Filters: []datastore.EntityFilter{
+		datastore.PropertyFilter{FieldName: "Name", Operator: "=", Value: "cat"},
+		datastore.AndFilter{Filters: []datastore.EntityFilter{
+			datastore.PropertyFilter{FieldName: "Legs", Operator: ">", Value: 2},
+			datastore.PropertyFilter{FieldName: "Legs", Operator: "<", Value: 8},
+		}},
+	}}, f.EntityFilter())
+
+	q, err := NewQuery("Animal").Filter(f).build()
+	assert.NoError(s.T(), err)
+	assert.NotNil(s.T(), q)
+}
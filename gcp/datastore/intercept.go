@@ -0,0 +1,494 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Operation describes a Driver call to interceptors.
+type Operation struct {
+	// Name is the Driver method, such as "Get" or "PutMulti", or for the
+	// operations of a transaction the Tx method behind "Tx.", as in
+	// "Tx.Put".
+	Name string
+	// Kind and Namespace are those of the keys or the query of the
+	// operation. Kind is empty when the keys are of several kinds.
+	Kind      string
+	Namespace string
+	// Keys are the keys the operation reads or writes. Once it returned,
+	// the keys it completed are replaced by the complete ones, and those of
+	// RunInTransaction are set to the keys its transaction wrote or deleted
+	// when it committed.
+	Keys []*datastore.Key
+	// Query is the query of the Find operations, Aggregate and Count.
+	Query *Query
+	// Results is the number of entities or keys a read returned, once it
+	// returned. Those of Find are read from its iterator later and counted
+	// as they are, see IteratorInterceptor. It stays zero for aggregations.
+	Results int
+	// Duration and Err are set once the operation returned. The duration of
+	// Find does not include the iteration of its results.
+	Duration time.Duration
+	Err      error
+}
+
+// Interceptor observes, and may alter, the operations of a driver. Logging,
+// metrics, auditing or fault injection can be stacked this way without
+// touching the driver.
+type Interceptor interface {
+	// Before is called before the operation runs and returns the context
+	// to run it with. An error skips the operation and the interceptors
+	// after this one, and is returned instead.
+	Before(ctx context.Context, op *Operation) (context.Context, error)
+	// After is called once the operation returned, with the context its
+	// Before returned, by every interceptor whose Before succeeded, the
+	// last one first. It may replace op.Err, which is what the caller gets.
+	After(ctx context.Context, op *Operation)
+}
+
+// IteratorInterceptor is an Interceptor that also observes the results of
+// Find, which are read from its iterator after the operation returned.
+type IteratorInterceptor interface {
+	Interceptor
+	// AfterNext is called after every call to Next on the iterator of op,
+	// with the context After got, as long as the iterator has not stopped.
+	// op.Results counts the results returned so far. err is the error of
+	// the call, iterator.Done once there are no more results; the iterator
+	// has stopped once err is not nil.
+	AfterNext(ctx context.Context, op *Operation, err error)
+}
+
+// Hooks is an Interceptor made of functions, either of which may be nil.
+type Hooks struct {
+	BeforeFunc func(ctx context.Context, op *Operation) (context.Context, error)
+	AfterFunc  func(ctx context.Context, op *Operation)
+}
+
+func (h Hooks) Before(ctx context.Context, op *Operation) (context.Context, error) {
+	if h.BeforeFunc == nil {
+		return ctx, nil
+	}
+	return h.BeforeFunc(ctx, op)
+}
+
+func (h Hooks) After(ctx context.Context, op *Operation) {
+	if h.AfterFunc != nil {
+		h.AfterFunc(ctx, op)
+	}
+}
+
+// WithInterceptors wraps the operations of the driver with interceptors,
+// the first one being the outermost. See NewInterceptedDriver.
+func WithInterceptors(interceptors ...Interceptor) Option {
+	return func(d *driver) {
+		d.interceptors = append(d.interceptors, interceptors...)
+	}
+}
+
+var _ Driver = (*interceptedDriver)(nil)
+
+// interceptedDriver runs the operations of a Driver through a chain of
+// interceptors.
+type interceptedDriver struct {
+	d            Driver
+	interceptors []Interceptor
+}
+
+// NewInterceptedDriver returns d with its operations, and those of its
+// transactions, wrapped by interceptors, the first one being the outermost.
+// Close is not intercepted; closing the returned driver closes d.
+func NewInterceptedDriver(d Driver, interceptors ...Interceptor) Driver {
+	return &interceptedDriver{d: d, interceptors: interceptors}
+}
+
+// keyOperation describes an operation on keys.
+func keyOperation(name string, keys ...*datastore.Key) *Operation {
+	op := &Operation{Name: name, Keys: keys}
+	seen := false
+	for _, k := range keys {
+		switch {
+		case k == nil:
+		case !seen:
+			op.Kind, op.Namespace = k.Kind, k.Namespace
+			seen = true
+		case k.Kind != op.Kind:
+			op.Kind = ""
+		}
+	}
+	return op
+}
+
+// queryOperation describes an operation running q.
+func queryOperation(name string, q *Query) *Operation {
+	op := &Operation{Name: name, Query: q}
+	if q != nil {
+		op.Kind, op.Namespace = q.kind, q.namespace
+	}
+	return op
+}
+
+// multiOperation describes an operation on a batch of keys, copying them
+// so completing them leaves the slice of the caller untouched.
+func multiOperation(name string, keys []*datastore.Key) *Operation {
+	return keyOperation(name, append([]*datastore.Key(nil), keys...)...)
+}
+
+// complete replaces the keys of op by the non-nil complete keys.
+func (op *Operation) complete(keys []*datastore.Key) {
+	for i, k := range keys {
+		if k != nil && i < len(op.Keys) {
+			op.Keys[i] = k
+		}
+	}
+}
+
+// run calls f within the interceptors.
+func (i *interceptedDriver) run(ctx context.Context, op *Operation, f func(ctx context.Context) error) error {
+	_, err := i.call(ctx, op, f)
+	return err
+}
+
+// call calls f within the interceptors and returns the contexts the
+// interceptors whose Before succeeded got in After.
+func (i *interceptedDriver) call(ctx context.Context, op *Operation, f func(ctx context.Context) error) ([]context.Context, error) {
+	ctxs := make([]context.Context, 0, len(i.interceptors))
+	var err error
+	for _, ic := range i.interceptors {
+		var next context.Context
+		if next, err = ic.Before(ctx, op); err != nil {
+			break
+		}
+		if next != nil {
+			ctx = next
+		}
+		ctxs = append(ctxs, ctx)
+	}
+
+	start := time.Now()
+	if err == nil {
+		err = f(ctx)
+	}
+	op.Duration, op.Err = time.Since(start), err
+
+	for j := len(ctxs) - 1; j >= 0; j-- {
+		i.interceptors[j].After(ctxs[j], op)
+	}
+	return ctxs, op.Err
+}
+
+func (i *interceptedDriver) Find(ctx context.Context, q *Query) (Iterator, error) {
+	op := queryOperation("Find", q)
+	var it Iterator
+	ctxs, err := i.call(ctx, op, func(ctx context.Context) error {
+		var err error
+		it, err = i.d.Find(ctx, q)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &interceptedIterator{it: it, i: i, op: op, ctxs: ctxs}, nil
+}
+
+// interceptedIterator counts the results of a Find in its operation and
+// reports them to the interceptors implementing IteratorInterceptor.
+type interceptedIterator struct {
+	it      Iterator
+	i       *interceptedDriver
+	op      *Operation
+	ctxs    []context.Context
+	stopped bool
+}
+
+func (it *interceptedIterator) Next(dst interface{}) (*datastore.Key, error) {
+	key, err := it.it.Next(dst)
+	if it.stopped {
+		return key, err
+	}
+	if err == nil || errors.Is(err, ErrFieldMismatch) {
+		it.op.Results++
+	}
+	it.stopped = err != nil && !errors.Is(err, ErrFieldMismatch)
+	for j := len(it.ctxs) - 1; j >= 0; j-- {
+		if ic, ok := it.i.interceptors[j].(IteratorInterceptor); ok {
+			ic.AfterNext(it.ctxs[j], it.op, err)
+		}
+	}
+	return key, err
+}
+
+func (it *interceptedIterator) Cursor() (datastore.Cursor, error) {
+	return it.it.Cursor()
+}
+
+func (i *interceptedDriver) FindIds(ctx context.Context, q *Query) (ids []string, err error) {
+	op := queryOperation("FindIds", q)
+	err = i.run(ctx, op, func(ctx context.Context) error {
+		ids, err = i.d.FindIds(ctx, q)
+		op.Results = len(ids)
+		return err
+	})
+	return ids, err
+}
+
+func (i *interceptedDriver) FindKeys(ctx context.Context, q *Query) (keys []*datastore.Key, err error) {
+	op := queryOperation("FindKeys", q)
+	err = i.run(ctx, op, func(ctx context.Context) error {
+		keys, err = i.d.FindKeys(ctx, q)
+		op.Results = len(keys)
+		return err
+	})
+	return keys, err
+}
+
+func (i *interceptedDriver) FindPage(ctx context.Context, q *Query, pageSize int, pageToken string, dst interface{}) (page *Page, err error) {
+	op := queryOperation("FindPage", q)
+	err = i.run(ctx, op, func(ctx context.Context) error {
+		page, err = i.d.FindPage(ctx, q, pageSize, pageToken, dst)
+		if page != nil {
+			op.Results = len(page.Keys)
+		}
+		return err
+	})
+	return page, err
+}
+
+func (i *interceptedDriver) FindIdsPage(ctx context.Context, q *Query, pageSize int, pageToken string) (ids []string, next string, err error) {
+	op := queryOperation("FindIdsPage", q)
+	err = i.run(ctx, op, func(ctx context.Context) error {
+		ids, next, err = i.d.FindIdsPage(ctx, q, pageSize, pageToken)
+		op.Results = len(ids)
+		return err
+	})
+	return ids, next, err
+}
+
+func (i *interceptedDriver) Aggregate(ctx context.Context, q *Query, aggs ...Aggregation) (res AggregationResult, err error) {
+	err = i.run(ctx, queryOperation("Aggregate", q), func(ctx context.Context) error {
+		res, err = i.d.Aggregate(ctx, q, aggs...)
+		return err
+	})
+	return res, err
+}
+
+func (i *interceptedDriver) Count(ctx context.Context, q *Query) (n int64, err error) {
+	err = i.run(ctx, queryOperation("Count", q), func(ctx context.Context) error {
+		n, err = i.d.Count(ctx, q)
+		return err
+	})
+	return n, err
+}
+
+func (i *interceptedDriver) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	op := keyOperation("Get", key)
+	return i.run(ctx, op, func(ctx context.Context) error {
+		err := i.d.Get(ctx, key, dst)
+		op.Results = loaded(1, err)
+		return err
+	})
+}
+
+func (i *interceptedDriver) Create(ctx context.Context, key *datastore.Key, object interface{}) (id string, err error) {
+	op := keyOperation("Create", key)
+	err = i.run(ctx, op, func(ctx context.Context) error {
+		if id, err = i.d.Create(ctx, key, object); err == nil {
+			op.complete(decodeCreated([]string{id}))
+		}
+		return err
+	})
+	return id, err
+}
+
+func (i *interceptedDriver) Put(ctx context.Context, key *datastore.Key, src interface{}) (newKey *datastore.Key, err error) {
+	op := keyOperation("Put", key)
+	err = i.run(ctx, op, func(ctx context.Context) error {
+		newKey, err = i.d.Put(ctx, key, src)
+		op.complete([]*datastore.Key{newKey})
+		return err
+	})
+	return newKey, err
+}
+
+func (i *interceptedDriver) Delete(ctx context.Context, key *datastore.Key) error {
+	return i.run(ctx, keyOperation("Delete", key), func(ctx context.Context) error {
+		return i.d.Delete(ctx, key)
+	})
+}
+
+func (i *interceptedDriver) Update(ctx context.Context, key *datastore.Key, data interface{}) error {
+	return i.run(ctx, keyOperation("Update", key), func(ctx context.Context) error {
+		return i.d.Update(ctx, key, data)
+	})
+}
+
+func (i *interceptedDriver) UpdateVersioned(ctx context.Context, key *datastore.Key, data Versioned) error {
+	return i.run(ctx, keyOperation("UpdateVersioned", key), func(ctx context.Context) error {
+		return i.d.UpdateVersioned(ctx, key, data)
+	})
+}
+
+func (i *interceptedDriver) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}, opts ...BatchOption) error {
+	op := multiOperation("GetMulti", keys)
+	return i.run(ctx, op, func(ctx context.Context) error {
+		err := i.d.GetMulti(ctx, keys, dst, opts...)
+		op.Results = loaded(len(keys), err)
+		return err
+	})
+}
+
+func (i *interceptedDriver) CreateMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) (ids []string, err error) {
+	op := multiOperation("CreateMulti", keys)
+	err = i.run(ctx, op, func(ctx context.Context) error {
+		ids, err = i.d.CreateMulti(ctx, keys, src, opts...)
+		op.complete(decodeCreated(ids))
+		return err
+	})
+	return ids, err
+}
+
+func (i *interceptedDriver) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) (complete []*datastore.Key, err error) {
+	op := multiOperation("PutMulti", keys)
+	err = i.run(ctx, op, func(ctx context.Context) error {
+		complete, err = i.d.PutMulti(ctx, keys, src, opts...)
+		op.complete(complete)
+		return err
+	})
+	return complete, err
+}
+
+func (i *interceptedDriver) UpdateMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) error {
+	return i.run(ctx, multiOperation("UpdateMulti", keys), func(ctx context.Context) error {
+		return i.d.UpdateMulti(ctx, keys, src, opts...)
+	})
+}
+
+func (i *interceptedDriver) DeleteMulti(ctx context.Context, keys []*datastore.Key, opts ...BatchOption) error {
+	return i.run(ctx, multiOperation("DeleteMulti", keys), func(ctx context.Context) error {
+		return i.d.DeleteMulti(ctx, keys, opts...)
+	})
+}
+
+func (i *interceptedDriver) AllocateIDs(ctx context.Context, keys []*datastore.Key) (allocated []*datastore.Key, err error) {
+	op := multiOperation("AllocateIDs", keys)
+	err = i.run(ctx, op, func(ctx context.Context) error {
+		allocated, err = i.d.AllocateIDs(ctx, keys)
+		op.complete(allocated)
+		return err
+	})
+	return allocated, err
+}
+
+func (i *interceptedDriver) ReserveIDs(ctx context.Context, keys []*datastore.Key) error {
+	return i.run(ctx, multiOperation("ReserveIDs", keys), func(ctx context.Context) error {
+		return i.d.ReserveIDs(ctx, keys)
+	})
+}
+
+func (i *interceptedDriver) RunInTransaction(ctx context.Context, f func(tx Tx) error, opts ...TxOption) error {
+	op := &Operation{Name: "RunInTransaction"}
+	return i.run(ctx, op, func(ctx context.Context) error {
+		var t *interceptedTx
+		err := i.d.RunInTransaction(ctx, func(tx Tx) error {
+			t = &interceptedTx{tx: tx, i: i, ctx: ctx, written: map[string]*datastore.Key{}}
+			return f(t)
+		}, opts...)
+		if err == nil && t != nil {
+			// The writes of the attempt that committed.
+			keys := make([]*datastore.Key, 0, len(t.written))
+			for _, k := range t.written {
+				keys = append(keys, k)
+			}
+			written := keyOperation(op.Name, keys...)
+			op.Keys, op.Kind, op.Namespace = written.Keys, written.Kind, written.Namespace
+		}
+		return err
+	})
+}
+
+func (i *interceptedDriver) Close() error {
+	return i.d.Close()
+}
+
+// loaded returns how many of n entities a lookup that returned err loaded.
+// A field mismatch still loads the entity.
+func loaded(n int, err error) int {
+	if me, ok := err.(datastore.MultiError); ok {
+		n = 0
+		for _, e := range me {
+			if e == nil || errors.Is(e, ErrFieldMismatch) {
+				n++
+			}
+		}
+		return n
+	}
+	if err == nil || errors.Is(err, ErrFieldMismatch) {
+		return n
+	}
+	return 0
+}
+
+// decodeCreated decodes the keys returned by Create and CreateMulti, those
+// of failed items being nil.
+func decodeCreated(ids []string) []*datastore.Key {
+	keys := make([]*datastore.Key, len(ids))
+	for j, id := range ids {
+		if id != "" {
+			keys[j], _ = datastore.DecodeKey(id)
+		}
+	}
+	return keys
+}
+
+// interceptedTx runs the operations of a transaction through the
+// interceptors of its driver, with the context of the transaction. It keeps
+// the keys it wrote or deleted, by memoryKey.
+type interceptedTx struct {
+	tx  Tx
+	i   *interceptedDriver
+	ctx context.Context
+
+	mu      sync.Mutex
+	written map[string]*datastore.Key
+}
+
+// wrote records a write or a deletion of key.
+func (t *interceptedTx) wrote(key *datastore.Key) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.written[memoryKey(key)] = key
+}
+
+func (t *interceptedTx) Get(key *datastore.Key, dst interface{}) error {
+	op := keyOperation("Tx.Get", key)
+	return t.i.run(t.ctx, op, func(context.Context) error {
+		err := t.tx.Get(key, dst)
+		op.Results = loaded(1, err)
+		return err
+	})
+}
+
+func (t *interceptedTx) Put(key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	var newKey *datastore.Key
+	err := t.i.run(t.ctx, keyOperation("Tx.Put", key), func(context.Context) error {
+		var err error
+		if newKey, err = t.tx.Put(key, src); err == nil {
+			t.wrote(newKey)
+		}
+		return err
+	})
+	return newKey, err
+}
+
+func (t *interceptedTx) Delete(key *datastore.Key) error {
+	return t.i.run(t.ctx, keyOperation("Tx.Delete", key), func(context.Context) error {
+		err := t.tx.Delete(key)
+		if err == nil {
+			t.wrote(key)
+		}
+		return err
+	})
+}
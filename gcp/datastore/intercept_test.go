@@ -0,0 +1,182 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type traceKey struct{}
+
+// recorder records the operations it sees, prefixed with its name.
+type recorder struct {
+	name string
+	log  *[]string
+	ops  []Operation
+}
+
+func (r *recorder) Before(ctx context.Context, op *Operation) (context.Context, error) {
+	*r.log = append(*r.log, r.name+" before "+op.Name)
+	trace, _ := ctx.Value(traceKey{}).(string)
+	return context.WithValue(ctx, traceKey{}, trace+r.name), nil
+}
+
+func (r *recorder) After(ctx context.Context, op *Operation) {
+	*r.log = append(*r.log, fmt.Sprintf("%s after %s %v", r.name, op.Name, ctx.Value(traceKey{})))
+	r.ops = append(r.ops, *op)
+}
+
+type InterceptTestSuite struct {
+	suite.Suite
+	newDriver func(t *testing.T) Driver
+	d         Driver
+	log       []string
+	outer     *recorder
+	inner     *recorder
+	ctx       context.Context
+}
+
+func TestInterceptTestSuite(t *testing.T) {
+	forEachDriver(t, func(newDriver func(*testing.T) Driver) suite.TestingSuite {
+		return &InterceptTestSuite{newDriver: newDriver}
+	})
+}
+
+func (s *InterceptTestSuite) SetupTest() {
+	s.log = nil
+	s.outer = &recorder{name: "outer", log: &s.log}
+	s.inner = &recorder{name: "inner", log: &s.log}
+	s.d = NewInterceptedDriver(s.newDriver(s.T()), s.outer, s.inner)
+	s.ctx = context.Background()
+}
+
+func (s *InterceptTestSuite) TestChain() {
+	k := datastore.NameKey("Animal", "cat", nil)
+	s.Require().NoError(s.d.Update(s.ctx, k, &Animal{Name: "cat"}))
+	assert.Equal(s.T(), []string{
+		"outer before Update",
+		"inner before Update",
+		"inner after Update outerinner",
+		"outer after Update outer",
+	}, s.log)
+
+	s.Require().Len(s.inner.ops, 1)
+	op := s.inner.ops[0]
+	assert.Equal(s.T(), "Animal", op.Kind)
+	assert.Equal(s.T(), []*datastore.Key{k}, op.Keys)
+	assert.Positive(s.T(), op.Duration)
+	assert.NoError(s.T(), op.Err)
+}
+
+func (s *InterceptTestSuite) TestOperations() {
+	zoo := datastore.NameKey("Zoo", "north", nil)
+	k, err := s.d.Put(s.ctx, datastore.IncompleteKey("Animal", zoo), &Animal{Name: "cat"})
+	s.Require().NoError(err)
+	keys := IncompleteKeys("Animal", zoo, 2)
+	_, err = s.d.CreateMulti(s.ctx, keys, []Animal{{Name: "dog"}, {Name: "bird"}})
+	s.Require().NoError(err)
+	assert.True(s.T(), keys[0].Incomplete(), "the keys of the caller are left untouched")
+
+	err = s.d.Get(s.ctx, datastore.NameKey("Animal", "cow", nil), &Animal{})
+	assert.ErrorIs(s.T(), err, ErrNotFound)
+	_, err = s.d.Count(s.ctx, NewQuery("Animal").Namespace("tenant"))
+	s.Require().NoError(err)
+	err = s.d.GetMulti(s.ctx, []*datastore.Key{k, zoo}, make([]Animal, 2))
+	assert.Error(s.T(), err, "the zoo is not stored")
+
+	ops := s.inner.ops
+	s.Require().Len(ops, 5)
+	assert.Equal(s.T(), "Put", ops[0].Name)
+	assert.Equal(s.T(), []*datastore.Key{k}, ops[0].Keys, "After sees the complete key")
+	assert.Equal(s.T(), "CreateMulti", ops[1].Name)
+	assert.False(s.T(), ops[1].Keys[0].Incomplete())
+	assert.False(s.T(), ops[1].Keys[1].Incomplete())
+	assert.Equal(s.T(), "Get", ops[2].Name)
+	assert.ErrorIs(s.T(), ops[2].Err, ErrNotFound)
+	assert.Equal(s.T(), "Count", ops[3].Name)
+	assert.Equal(s.T(), "Animal", ops[3].Kind)
+	assert.Equal(s.T(), "tenant", ops[3].Namespace)
+	assert.NotNil(s.T(), ops[3].Query)
+	assert.Equal(s.T(), "GetMulti", ops[4].Name)
+	assert.Empty(s.T(), ops[4].Kind, "the keys are of several kinds")
+}
+
+func (s *InterceptTestSuite) TestTransaction() {
+	k := datastore.NameKey("Animal", "cat", nil)
+	err := s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		if err := tx.Get(k, &Animal{}); !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		_, err := tx.Put(k, &Animal{Name: "cat"})
+		return err
+	})
+	s.Require().NoError(err)
+
+	var names []string
+	for _, op := range s.inner.ops {
+		names = append(names, op.Name)
+	}
+	assert.Equal(s.T(), []string{"Tx.Get", "Tx.Put", "RunInTransaction"}, names)
+	run := s.inner.ops[2]
+	assert.Equal(s.T(), []*datastore.Key{k}, run.Keys, "After sees the keys the transaction wrote")
+	assert.Equal(s.T(), "Animal", run.Kind)
+	assert.Contains(s.T(), s.log, "inner after Tx.Put outerinnerouterinner", "transaction operations run with its context")
+}
+
+func (s *InterceptTestSuite) TestFaultInjection() {
+	injected := errors.New("injected")
+	d := NewInterceptedDriver(s.d, Hooks{BeforeFunc: func(ctx context.Context, op *Operation) (context.Context, error) {
+		if strings.HasPrefix(op.Name, "Update") {
+			return nil, injected
+		}
+		return ctx, nil
+	}}, s.outer)
+
+	k := datastore.NameKey("Animal", "cat", nil)
+	assert.Equal(s.T(), injected, d.Update(s.ctx, k, &Animal{Name: "cat"}))
+	assert.Empty(s.T(), s.log, "the operation and the next interceptors are skipped")
+	assert.ErrorIs(s.T(), s.d.Get(s.ctx, k, &Animal{}), ErrNotFound)
+}
+
+func (s *InterceptTestSuite) TestReplaceError() {
+	d := NewInterceptedDriver(s.d, Hooks{AfterFunc: func(ctx context.Context, op *Operation) {
+		if errors.Is(op.Err, ErrNotFound) {
+			op.Err = nil
+		}
+	}})
+	assert.NoError(s.T(), d.Get(s.ctx, datastore.NameKey("Animal", "cow", nil), &Animal{}))
+	s.Require().Len(s.outer.ops, 1)
+	assert.ErrorIs(s.T(), s.outer.ops[0].Err, ErrNotFound)
+}
+
+func TestWithInterceptors(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	var names []string
+	hooks := Hooks{AfterFunc: func(ctx context.Context, op *Operation) {
+		names = append(names, op.Name+" "+op.Namespace)
+	}}
+	ctx := context.Background()
+	d, err := NewDriver(ctx, testProjectID, WithInterceptors(hooks))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer d.Close()
+	assert.NoError(t, d.Update(ctx, datastore.NameKey("Animal", "cat", nil), &Animal{Name: "cat"}))
+
+	r := NewRegistry(WithInterceptors(hooks))
+	defer r.Close()
+	tenant, err := r.Driver(ctx, RegistryKey{ProjectID: testProjectID, Namespace: "tenant"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, tenant.Update(ctx, datastore.NameKey("Animal", "cat", nil), &Animal{Name: "cat"}))
+	assert.Equal(t, []string{"Update ", "Update tenant"}, names)
+}
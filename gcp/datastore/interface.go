@@ -1,7 +1,25 @@
 package datastore
 
+import "cloud.google.com/go/datastore"
+
 type DataFilter interface {
 	GetField() string
 	GetCondition() string
 	GetValue() interface{}
 }
+
+// Filter is a query condition. It is implemented by the property filters
+// built with Eq, Lt, Lte, Gt, Gte, NotEqual, In and NotIn, and by the
+// composites built with And and Or.
+type Filter interface {
+	EntityFilter() datastore.EntityFilter
+}
+
+// Iterator walks the results of a query. *datastore.Iterator satisfies it.
+type Iterator interface {
+	// Next loads the next result into dst, unless it is nil, and returns its
+	// key. It returns iterator.Done when there are no more results.
+	Next(dst interface{}) (*datastore.Key, error)
+	// Cursor returns the position after the last result returned by Next.
+	Cursor() (datastore.Cursor, error)
+}
@@ -0,0 +1,236 @@
+package datastore
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// PathElement is one element of a key path: a kind with either a name or a
+// numeric ID. An element with neither is incomplete, which only the last
+// element of a path may be.
+type PathElement struct {
+	Kind string
+	Name string
+	ID   int64
+}
+
+// NameElement returns a path element identified by name.
+func NameElement(kind, name string) PathElement {
+	return PathElement{Kind: kind, Name: name}
+}
+
+// IDElement returns a path element identified by a numeric ID.
+func IDElement(kind string, id int64) PathElement {
+	return PathElement{Kind: kind, ID: id}
+}
+
+// IncompleteElement returns a path element whose ID is allocated when the
+// entity is stored.
+func IncompleteElement(kind string) PathElement {
+	return PathElement{Kind: kind}
+}
+
+// BuildKey builds the key of path, given root first, in namespace.
+func BuildKey(namespace string, path ...PathElement) (*datastore.Key, error) {
+	if len(path) == 0 {
+		return nil, invalidKeyf("empty key path")
+	}
+	var k *datastore.Key
+	for i, e := range path {
+		switch {
+		case e.Kind == "":
+			return nil, invalidKeyf("path element %d has no kind", i)
+		case e.Name != "" && e.ID != 0:
+			return nil, invalidKeyf("path element %s has both a name and an ID", e.Kind)
+		case e.ID < 0:
+			return nil, invalidKeyf("path element %s has a negative ID", e.Kind)
+		case e.Name == "" && e.ID == 0 && i < len(path)-1:
+			return nil, invalidKeyf("ancestor %s is incomplete", e.Kind)
+		}
+		k = &datastore.Key{Kind: e.Kind, Name: e.Name, ID: e.ID, Parent: k, Namespace: namespace}
+	}
+	return k, nil
+}
+
+// KeyPath returns the path of k, root first.
+func KeyPath(k *datastore.Key) []PathElement {
+	var path []PathElement
+	for _, e := range keyPath(k) {
+		path = append(path, PathElement{Kind: e.Kind, Name: e.Name, ID: e.ID})
+	}
+	return path
+}
+
+// FormatKey prints the path of k in a readable form ParseKey accepts:
+//
+//	@tenant/Zoo:"north"/Animal:42
+//
+// The namespace, when there is one, comes first behind an at sign. Names are
+// quoted, IDs are not, and an incomplete last element is its bare kind.
+// Kinds and namespaces are quoted when they hold other characters than
+// letters, digits, '_', '-' and '.'.
+func FormatKey(k *datastore.Key) string {
+	if k == nil {
+		return ""
+	}
+	var b strings.Builder
+	if k.Namespace != "" {
+		b.WriteString("@" + formatToken(k.Namespace))
+	}
+	for _, e := range keyPath(k) {
+		if b.Len() > 0 {
+			b.WriteByte('/')
+		}
+		b.WriteString(formatToken(e.Kind))
+		switch {
+		case e.Name != "":
+			b.WriteString(":" + strconv.Quote(e.Name))
+		case e.ID != 0:
+			b.WriteString(":" + strconv.FormatInt(e.ID, 10))
+		}
+	}
+	return b.String()
+}
+
+func isTokenChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.'
+}
+
+func formatToken(s string) string {
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			return strconv.Quote(s)
+		}
+	}
+	if s == "" {
+		return `""`
+	}
+	return s
+}
+
+// parseToken reads a bare or quoted token at the start of s.
+func parseToken(s string) (string, string, error) {
+	if strings.HasPrefix(s, `"`) {
+		quoted, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return "", "", err
+		}
+		token, err := strconv.Unquote(quoted)
+		return token, s[len(quoted):], err
+	}
+	i := 0
+	for i < len(s) && isTokenChar(s[i]) {
+		i++
+	}
+	if i == 0 {
+		return "", "", fmt.Errorf("expected a name at %q", s)
+	}
+	return s[:i], s[i:], nil
+}
+
+// ParseKey parses a key printed by FormatKey or encoded by Key.Encode.
+func ParseKey(s string) (*datastore.Key, error) {
+	if !strings.ContainsAny(s, `@/:"`) {
+		if k, err := datastore.DecodeKey(s); err == nil {
+			return k, nil
+		}
+	}
+	k, err := parseKeyPath(s)
+	if err != nil {
+		return nil, invalidKeyf("parse %q: %v", s, err)
+	}
+	return k, nil
+}
+
+func parseKeyPath(s string) (*datastore.Key, error) {
+	namespace, rest := "", s
+	if strings.HasPrefix(rest, "@") {
+		var err error
+		if namespace, rest, err = parseToken(rest[1:]); err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(rest, "/") {
+			return nil, fmt.Errorf("expected a path after namespace %q", namespace)
+		}
+		rest = rest[1:]
+	}
+
+	var path []PathElement
+	for {
+		kind, r, err := parseToken(rest)
+		if err != nil {
+			return nil, err
+		}
+		e := PathElement{Kind: kind}
+		rest = r
+		if strings.HasPrefix(rest, ":") {
+			rest = rest[1:]
+			if strings.HasPrefix(rest, `"`) {
+				if e.Name, rest, err = parseToken(rest); err != nil {
+					return nil, err
+				}
+			} else {
+				end := strings.IndexByte(rest, '/')
+				if end < 0 {
+					end = len(rest)
+				}
+				if e.ID, err = strconv.ParseInt(rest[:end], 10, 64); err != nil {
+					return nil, fmt.Errorf("invalid ID %q of %s", rest[:end], kind)
+				}
+				rest = rest[end:]
+			}
+		}
+		path = append(path, e)
+
+		if rest == "" {
+			return BuildKey(namespace, path...)
+		}
+		if rest[0] != '/' {
+			return nil, fmt.Errorf("unexpected %q after %s", rest, kind)
+		}
+		rest = rest[1:]
+	}
+}
+
+// invalidKeyf returns an invalid argument wrapping datastore.ErrInvalidKey.
+func invalidKeyf(format string, args ...interface{}) error {
+	return invalidArgument(fmt.Errorf("%w: "+format, append([]interface{}{datastore.ErrInvalidKey}, args...)...))
+}
+
+// EncodeKeys encodes keys with Key.Encode.
+func EncodeKeys(keys []*datastore.Key) []string {
+	encoded := make([]string, len(keys))
+	for i, k := range keys {
+		encoded[i] = k.Encode()
+	}
+	return encoded
+}
+
+// DecodeKeys decodes keys encoded with Key.Encode.
+func DecodeKeys(encoded []string) ([]*datastore.Key, error) {
+	keys := make([]*datastore.Key, len(encoded))
+	for i, s := range encoded {
+		k, err := datastore.DecodeKey(s)
+		if err != nil {
+			return nil, invalidArgument(fmt.Errorf("decode key %d: %w", i, err))
+		}
+		keys[i] = k
+	}
+	return keys, nil
+}
+
+// IncompleteKeys returns n incomplete keys of kind under parent, ready for
+// AllocateIDs or CreateMulti.
+func IncompleteKeys(kind string, parent *datastore.Key, n int) []*datastore.Key {
+	keys := make([]*datastore.Key, n)
+	for i := range keys {
+		keys[i] = datastore.IncompleteKey(kind, parent)
+		if parent != nil {
+			keys[i].Namespace = parent.Namespace
+		}
+	}
+	return keys
+}
@@ -0,0 +1,137 @@
+package datastore
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type KeysTestSuite struct {
+	suite.Suite
+}
+
+func TestKeysTestSuite(t *testing.T) {
+	suite.Run(t, new(KeysTestSuite))
+}
+
+func (s *KeysTestSuite) TestBuildKey() {
+	k, err := BuildKey("tenant", NameElement("Zoo", "north"), IDElement("Animal", 42))
+	s.Require().NoError(err)
+	want := datastore.IDKey("Animal", 42, datastore.NameKey("Zoo", "north", nil))
+	want.Namespace, want.Parent.Namespace = "tenant", "tenant"
+	assert.True(s.T(), want.Equal(k))
+	assert.Equal(s.T(), []PathElement{{Kind: "Zoo", Name: "north"}, {Kind: "Animal", ID: 42}}, KeyPath(k))
+
+	k, err = BuildKey("", NameElement("Zoo", "north"), IncompleteElement("Animal"))
+	assert.NoError(s.T(), err)
+	assert.True(s.T(), k.Incomplete())
+
+	invalid := [][]PathElement{
+		nil,
+		{IDElement("", 1)},
+		{{Kind: "Animal", Name: "cat", ID: 1}},
+		{IDElement("Animal", -1)},
+		{IncompleteElement("Zoo"), IDElement("Animal", 1)},
+	}
+	for _, path := range invalid {
+		_, err := BuildKey("", path...)
+		assert.ErrorIs(s.T(), err, datastore.ErrInvalidKey, "%v", path)
+	}
+}
+
+func (s *KeysTestSuite) TestFormatAndParse() {
+	cases := map[string]*datastore.Key{
+		`Zoo:"north"/Animal:42`:      datastore.IDKey("Animal", 42, datastore.NameKey("Zoo", "north", nil)),
+		`@tenant/Animal:"a/b:\"c\""`: {Kind: "Animal", Name: `a/b:"c"`, Namespace: "tenant"},
+		`"Odd Kind":"1"`:             datastore.NameKey("Odd Kind", "1", nil),
+		`Zoo:"north"/Animal`:         datastore.IncompleteKey("Animal", datastore.NameKey("Zoo", "north", nil)),
+	}
+	for text, k := range cases {
+		assert.Equal(s.T(), text, FormatKey(k))
+		parsed, err := ParseKey(text)
+		if assert.NoError(s.T(), err, text) {
+			assert.True(s.T(), k.Equal(parsed), text)
+		}
+	}
+
+	k := datastore.IDKey("Animal", 42, datastore.NameKey("Zoo", "north", nil))
+	parsed, err := ParseKey(k.Encode())
+	assert.NoError(s.T(), err)
+	assert.True(s.T(), k.Equal(parsed))
+
+	for _, text := range []string{"", "Animal:", "Animal:x", `Animal:"cat"/`, "@tenant", `Animal:"cat"Zoo`, "/Animal:1"} {
+		_, err := ParseKey(text)
+		assert.ErrorIs(s.T(), err, datastore.ErrInvalidKey, text)
+	}
+}
+
+func (s *KeysTestSuite) TestEncodeKeys() {
+	keys := []*datastore.Key{datastore.NameKey("Animal", "cat", nil), datastore.IDKey("Animal", 7, nil)}
+	decoded, err := DecodeKeys(EncodeKeys(keys))
+	s.Require().NoError(err)
+	for i := range keys {
+		assert.True(s.T(), keys[i].Equal(decoded[i]))
+	}
+
+	_, err = DecodeKeys([]string{"not a key"})
+	assert.Error(s.T(), err)
+}
+
+type TypedKeysTestSuite struct {
+	suite.Suite
+	newDriver func(t *testing.T) Driver
+	d         Driver
+	ctx       context.Context
+}
+
+func TestTypedKeysTestSuite(t *testing.T) {
+	forEachDriver(t, func(newDriver func(*testing.T) Driver) suite.TestingSuite {
+		return &TypedKeysTestSuite{newDriver: newDriver}
+	})
+}
+
+func (s *TypedKeysTestSuite) SetupTest() {
+	s.d = s.newDriver(s.T())
+	s.ctx = context.Background()
+}
+
+func (s *TypedKeysTestSuite) TestPutAndFindKeys() {
+	zoo := datastore.NameKey("Zoo", "north", nil)
+	k, err := s.d.Put(s.ctx, datastore.IncompleteKey("Animal", zoo), &Animal{Name: "cat"})
+	s.Require().NoError(err)
+	assert.False(s.T(), k.Incomplete())
+	assert.True(s.T(), zoo.Equal(k.Parent))
+
+	keys, err := s.d.PutMulti(s.ctx, IncompleteKeys("Animal", zoo, 2), []Animal{{Name: "dog"}, {Name: "bird"}})
+	s.Require().NoError(err)
+	s.Require().Len(keys, 2)
+
+	found, err := s.d.FindKeys(s.ctx, NewQuery("Animal").Ancestor(zoo))
+	s.Require().NoError(err)
+	assert.Len(s.T(), found, 3)
+	assert.ElementsMatch(s.T(), EncodeKeys(append(keys, k)), EncodeKeys(found))
+}
+
+func (s *TypedKeysTestSuite) TestAllocateAndReserveIDs() {
+	keys, err := s.d.AllocateIDs(s.ctx, IncompleteKeys("Animal", nil, 3))
+	s.Require().NoError(err)
+	s.Require().Len(keys, 3)
+	seen := map[int64]bool{}
+	for _, k := range keys {
+		assert.NotZero(s.T(), k.ID)
+		assert.False(s.T(), seen[k.ID])
+		seen[k.ID] = true
+	}
+
+	// Allocated keys are not stored.
+	n, err := s.d.Count(s.ctx, NewQuery("Animal"))
+	assert.NoError(s.T(), err)
+	assert.Zero(s.T(), n)
+
+	assert.NoError(s.T(), s.d.ReserveIDs(s.ctx, []*datastore.Key{datastore.IDKey("Animal", 1000, nil)}))
+	_, err = s.d.AllocateIDs(s.ctx, []*datastore.Key{datastore.IDKey("Animal", 1, nil)})
+	assert.Error(s.T(), err, "complete keys cannot be allocated")
+}
@@ -0,0 +1,489 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// BeforeSaver is implemented by entities preparing themselves to be
+// written, for instance to set defaults or timestamps. It runs before the
+// entity is validated. The key may be incomplete. An error cancels the
+// write.
+type BeforeSaver interface {
+	BeforeSave(ctx context.Context, key *datastore.Key) error
+}
+
+// AfterSaver is implemented by entities reacting to being written. It runs
+// once the write succeeded, with the complete key; its error is returned
+// although the entity was written.
+type AfterSaver interface {
+	AfterSave(ctx context.Context, key *datastore.Key) error
+}
+
+// AfterLoader is implemented by entities fixing themselves up once loaded,
+// by a lookup or a query. It also runs when properties of the entity had no
+// field, the load then failing with ErrFieldMismatch.
+type AfterLoader interface {
+	AfterLoad(ctx context.Context, key *datastore.Key) error
+}
+
+// BeforeDeleter is implemented by entities vetting their deletion. As a
+// delete only has a key, it runs for the kinds registered with
+// LifecycleKind, on the stored entity. An error cancels the delete.
+type BeforeDeleter interface {
+	BeforeDelete(ctx context.Context, key *datastore.Key) error
+}
+
+var beforeDeleterType = reflect.TypeOf((*BeforeDeleter)(nil)).Elem()
+
+// LifecycleOption configures NewLifecycleDriver.
+type LifecycleOption func(*lifecycleDriver)
+
+// LifecycleKind registers the type of the entities of kind, given by an
+// example value, so deletes of these entities run its BeforeDelete hook.
+func LifecycleKind(kind string, example interface{}) LifecycleOption {
+	return func(l *lifecycleDriver) {
+		t := reflect.TypeOf(example)
+		for t != nil && t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t != nil && reflect.PtrTo(t).Implements(beforeDeleterType) {
+			l.kinds[kind] = t
+		}
+	}
+}
+
+var _ Driver = (*lifecycleDriver)(nil)
+
+// lifecycleDriver runs the hooks of the entities of a Driver and validates
+// them before they are written.
+type lifecycleDriver struct {
+	d     Driver
+	kinds map[string]reflect.Type
+}
+
+// NewLifecycleDriver returns d running the hooks of the entities it reads
+// and writes, in and out of transactions: BeforeSave then ValidateEntity
+// before every write, AfterSave after it, AfterLoad after every load and
+// BeforeDelete before the deletes of the kinds registered with
+// LifecycleKind. The hooks of a transaction see its context, and its
+// AfterSave hooks run once it committed.
+//
+// Batches run the hooks of every entity first, and are rejected as a whole
+// when one fails, the failures reported in a MultiError. Their AfterSave
+// hooks only run when the whole batch was written.
+//
+// The hooks run on the values given by the caller, so the lifecycle driver
+// goes around the other wrappers, such as NewCachedDriver. Closing it closes
+// d.
+func NewLifecycleDriver(d Driver, opts ...LifecycleOption) Driver {
+	l := &lifecycleDriver{d: d, kinds: map[string]reflect.Type{}}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// beforeSave runs the BeforeSave hook of src, then validates it.
+func beforeSave(ctx context.Context, key *datastore.Key, src interface{}) error {
+	if h, ok := src.(BeforeSaver); ok {
+		if err := h.BeforeSave(ctx, key); err != nil {
+			return err
+		}
+	}
+	return ValidateEntity(src)
+}
+
+func afterSave(ctx context.Context, key *datastore.Key, src interface{}) error {
+	if h, ok := src.(AfterSaver); ok {
+		return h.AfterSave(ctx, key)
+	}
+	return nil
+}
+
+// afterLoad runs the AfterLoad hook of dst, unless loading it failed with
+// err other than a field mismatch, and returns the error of the hook, or
+// else err.
+func afterLoad(ctx context.Context, key *datastore.Key, dst interface{}, err error) error {
+	h, ok := dst.(AfterLoader)
+	if !ok || err != nil && !errors.Is(err, ErrFieldMismatch) {
+		return err
+	}
+	if hookErr := h.AfterLoad(ctx, key); hookErr != nil {
+		return hookErr
+	}
+	return err
+}
+
+// beforeSaveMulti runs beforeSave on the elements of v, the entities of
+// keys. When some fail, it returns a MultiError marking the others
+// ErrBatchSkipped.
+func beforeSaveMulti(ctx context.Context, keys []*datastore.Key, v reflect.Value) error {
+	var errs datastore.MultiError
+	for i, k := range keys {
+		if err := beforeSave(ctx, k, batchElem(v, i)); err != nil {
+			if errs == nil {
+				errs = make(datastore.MultiError, len(keys))
+			}
+			errs[i] = err
+		}
+	}
+	return skipOthers(errs)
+}
+
+// skipOthers marks ErrBatchSkipped the items of errs that did not fail, and
+// returns nil when none did.
+func skipOthers(errs datastore.MultiError) error {
+	if errs == nil {
+		return nil
+	}
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = ErrBatchSkipped
+		}
+	}
+	return errs
+}
+
+// afterSaveMulti runs the AfterSave hooks of the elements of v, the
+// entities of keys.
+func afterSaveMulti(ctx context.Context, keys []*datastore.Key, v reflect.Value) error {
+	var errs datastore.MultiError
+	for i, k := range keys {
+		if err := afterSave(ctx, k, batchElem(v, i)); err != nil {
+			if errs == nil {
+				errs = make(datastore.MultiError, len(keys))
+			}
+			errs[i] = err
+		}
+	}
+	if errs == nil {
+		return nil
+	}
+	return errs
+}
+
+// beforeDelete runs the BeforeDelete hook of the stored entity of key, if
+// its kind is registered. Missing entities have none to run.
+func (l *lifecycleDriver) beforeDelete(ctx context.Context, key *datastore.Key, props datastore.PropertyList) error {
+	v := reflect.New(l.kinds[key.Kind]).Interface()
+	if err := loadEntity(v, key, props); err != nil && !errors.Is(err, ErrFieldMismatch) {
+		return err
+	}
+	return v.(BeforeDeleter).BeforeDelete(ctx, key)
+}
+
+// hooked reports whether deleting key runs a BeforeDelete hook.
+func (l *lifecycleDriver) hooked(key *datastore.Key) bool {
+	return key != nil && l.kinds[key.Kind] != nil
+}
+
+func (l *lifecycleDriver) Find(ctx context.Context, q *Query) (Iterator, error) {
+	it, err := l.d.Find(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return &lifecycleIterator{ctx: ctx, it: it}, nil
+}
+
+// lifecycleIterator runs the AfterLoad hooks of the entities it loads.
+type lifecycleIterator struct {
+	ctx context.Context
+	it  Iterator
+}
+
+func (it *lifecycleIterator) Next(dst interface{}) (*datastore.Key, error) {
+	key, err := it.it.Next(dst)
+	if dst == nil || err == iterator.Done {
+		return key, err
+	}
+	return key, afterLoad(it.ctx, key, dst, err)
+}
+
+func (it *lifecycleIterator) Cursor() (datastore.Cursor, error) {
+	return it.it.Cursor()
+}
+
+func (l *lifecycleDriver) FindIds(ctx context.Context, q *Query) ([]string, error) {
+	return l.d.FindIds(ctx, q)
+}
+
+func (l *lifecycleDriver) FindKeys(ctx context.Context, q *Query) ([]*datastore.Key, error) {
+	return l.d.FindKeys(ctx, q)
+}
+
+// FindPage runs the AfterLoad hooks of the entities the page appended to
+// dst.
+func (l *lifecycleDriver) FindPage(ctx context.Context, q *Query, pageSize int, pageToken string, dst interface{}) (*Page, error) {
+	page, err := l.d.FindPage(ctx, q, pageSize, pageToken, dst)
+	if err != nil || dst == nil {
+		return page, err
+	}
+	slice := reflect.ValueOf(dst).Elem()
+	first := slice.Len() - len(page.Keys)
+	for i, k := range page.Keys {
+		if err := afterLoad(ctx, k, batchElem(slice, first+i), nil); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+func (l *lifecycleDriver) FindIdsPage(ctx context.Context, q *Query, pageSize int, pageToken string) ([]string, string, error) {
+	return l.d.FindIdsPage(ctx, q, pageSize, pageToken)
+}
+
+func (l *lifecycleDriver) Aggregate(ctx context.Context, q *Query, aggs ...Aggregation) (AggregationResult, error) {
+	return l.d.Aggregate(ctx, q, aggs...)
+}
+
+func (l *lifecycleDriver) Count(ctx context.Context, q *Query) (int64, error) {
+	return l.d.Count(ctx, q)
+}
+
+func (l *lifecycleDriver) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	return afterLoad(ctx, key, dst, l.d.Get(ctx, key, dst))
+}
+
+func (l *lifecycleDriver) Create(ctx context.Context, key *datastore.Key, object interface{}) (string, error) {
+	if err := beforeSave(ctx, key, object); err != nil {
+		return "", err
+	}
+	id, err := l.d.Create(ctx, key, object)
+	if err != nil {
+		return "", err
+	}
+	k, err := datastore.DecodeKey(id)
+	if err != nil {
+		return "", err
+	}
+	return id, afterSave(ctx, k, object)
+}
+
+func (l *lifecycleDriver) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	if err := beforeSave(ctx, key, src); err != nil {
+		return nil, err
+	}
+	k, err := l.d.Put(ctx, key, src)
+	if err != nil {
+		return nil, err
+	}
+	return k, afterSave(ctx, k, src)
+}
+
+// Delete reads the entity, runs its BeforeDelete hook and deletes it in one
+// transaction, so the hook vets the entity deleted.
+func (l *lifecycleDriver) Delete(ctx context.Context, key *datastore.Key) error {
+	if !l.hooked(key) {
+		return l.d.Delete(ctx, key)
+	}
+	return l.d.RunInTransaction(ctx, func(tx Tx) error {
+		return (&lifecycleTx{ctx: ctx, l: l, tx: tx}).Delete(key)
+	})
+}
+
+func (l *lifecycleDriver) Update(ctx context.Context, key *datastore.Key, data interface{}) error {
+	if err := beforeSave(ctx, key, data); err != nil {
+		return err
+	}
+	if err := l.d.Update(ctx, key, data); err != nil {
+		return err
+	}
+	return afterSave(ctx, key, data)
+}
+
+// UpdateVersioned runs the hooks in the transaction of the update.
+func (l *lifecycleDriver) UpdateVersioned(ctx context.Context, key *datastore.Key, data Versioned) error {
+	return updateVersioned(ctx, l, key, data)
+}
+
+func (l *lifecycleDriver) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}, opts ...BatchOption) error {
+	err := l.d.GetMulti(ctx, keys, dst, opts...)
+	me, ok := err.(datastore.MultiError)
+	if err != nil && !ok {
+		return err
+	}
+	v := reflect.ValueOf(dst)
+	errs := make(datastore.MultiError, len(keys))
+	failed := false
+	for i, k := range keys {
+		if ok {
+			errs[i] = me[i]
+		}
+		errs[i] = afterLoad(ctx, k, batchElem(v, i), errs[i])
+		failed = failed || errs[i] != nil
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+func (l *lifecycleDriver) CreateMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) ([]string, error) {
+	v, err := batchValues(keys, src)
+	if err != nil {
+		return nil, err
+	}
+	if err := beforeSaveMulti(ctx, keys, v); err != nil {
+		return nil, err
+	}
+	ids, err := l.d.CreateMulti(ctx, keys, src, opts...)
+	if err != nil {
+		return ids, err
+	}
+	created := make([]*datastore.Key, len(ids))
+	for i, id := range ids {
+		if created[i], err = datastore.DecodeKey(id); err != nil {
+			return ids, err
+		}
+	}
+	return ids, afterSaveMulti(ctx, created, v)
+}
+
+func (l *lifecycleDriver) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) ([]*datastore.Key, error) {
+	v, err := batchValues(keys, src)
+	if err != nil {
+		return nil, err
+	}
+	if err := beforeSaveMulti(ctx, keys, v); err != nil {
+		return nil, err
+	}
+	put, err := l.d.PutMulti(ctx, keys, src, opts...)
+	if err != nil {
+		return put, err
+	}
+	return put, afterSaveMulti(ctx, put, v)
+}
+
+func (l *lifecycleDriver) UpdateMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) error {
+	v, err := batchValues(keys, src)
+	if err != nil {
+		return err
+	}
+	if err := beforeSaveMulti(ctx, keys, v); err != nil {
+		return err
+	}
+	if err := l.d.UpdateMulti(ctx, keys, src, opts...); err != nil {
+		return err
+	}
+	return afterSaveMulti(ctx, keys, v)
+}
+
+// DeleteMulti reads the entities of a chunk with hooks, runs their
+// BeforeDelete hooks and deletes the chunk in one transaction, so a chunk is
+// deleted as a whole or not at all. When hooks fail, their errors are
+// returned in a MultiError, the rest of their chunk being ErrBatchSkipped.
+func (l *lifecycleDriver) DeleteMulti(ctx context.Context, keys []*datastore.Key, opts ...BatchOption) error {
+	hooked := false
+	for _, k := range keys {
+		hooked = hooked || l.hooked(k)
+	}
+	if !hooked {
+		return l.d.DeleteMulti(ctx, keys, opts...)
+	}
+	if err := checkBatchKeys(keys, false); err != nil {
+		return err
+	}
+	return runBatch(ctx, len(keys), newBatchOptions(maxBatchMutations, opts), true, func(ctx context.Context, lo, hi int) error {
+		return l.d.RunInTransaction(ctx, func(tx Tx) error {
+			ltx := &lifecycleTx{ctx: ctx, l: l, tx: tx}
+			var errs datastore.MultiError
+			for i, k := range keys[lo:hi] {
+				if err := ltx.Delete(k); err != nil {
+					if errs == nil {
+						errs = make(datastore.MultiError, hi-lo)
+					}
+					errs[i] = err
+				}
+			}
+			if errs != nil {
+				return errs
+			}
+			return nil
+		})
+	})
+}
+
+func (l *lifecycleDriver) AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	return l.d.AllocateIDs(ctx, keys)
+}
+
+func (l *lifecycleDriver) ReserveIDs(ctx context.Context, keys []*datastore.Key) error {
+	return l.d.ReserveIDs(ctx, keys)
+}
+
+// RunInTransaction runs the AfterSave hooks of the entities written by the
+// attempt that committed, once it did.
+func (l *lifecycleDriver) RunInTransaction(ctx context.Context, f func(tx Tx) error, opts ...TxOption) error {
+	var saved []savedEntity
+	err := l.d.RunInTransaction(ctx, func(tx Tx) error {
+		ltx := &lifecycleTx{ctx: ctx, l: l, tx: tx}
+		err := f(ltx)
+		saved = ltx.saved
+		return err
+	}, opts...)
+	if err != nil {
+		return err
+	}
+	for _, s := range saved {
+		if err := afterSave(ctx, s.key, s.src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *lifecycleDriver) Close() error {
+	return l.d.Close()
+}
+
+// savedEntity is an entity written by a transaction.
+type savedEntity struct {
+	key *datastore.Key
+	src interface{}
+}
+
+// lifecycleTx runs the hooks of the entities of a transaction, but for
+// AfterSave which waits for the commit.
+type lifecycleTx struct {
+	ctx   context.Context
+	l     *lifecycleDriver
+	tx    Tx
+	saved []savedEntity
+}
+
+func (t *lifecycleTx) Get(key *datastore.Key, dst interface{}) error {
+	return afterLoad(t.ctx, key, dst, t.tx.Get(key, dst))
+}
+
+func (t *lifecycleTx) Put(key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	if err := beforeSave(t.ctx, key, src); err != nil {
+		return nil, err
+	}
+	key, err := t.tx.Put(key, src)
+	if err != nil {
+		return nil, err
+	}
+	t.saved = append(t.saved, savedEntity{key: key, src: src})
+	return key, nil
+}
+
+func (t *lifecycleTx) Delete(key *datastore.Key) error {
+	if t.l.hooked(key) {
+		var props datastore.PropertyList
+		switch err := t.tx.Get(key, &props); {
+		case errors.Is(err, ErrNotFound):
+		case err != nil:
+			return err
+		default:
+			if err := t.l.beforeDelete(t.ctx, key, props); err != nil {
+				return err
+			}
+		}
+	}
+	return t.tx.Delete(key)
+}
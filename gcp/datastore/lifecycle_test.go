@@ -0,0 +1,291 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type eventsKey struct{}
+
+// beforeDeleteKey holds a function BeforeDelete calls with the key, once it
+// passed.
+type beforeDeleteKey struct{}
+
+// record appends an event to the log of ctx.
+func record(ctx context.Context, event string, key *datastore.Key) {
+	if events, ok := ctx.Value(eventsKey{}).(*[]string); ok {
+		*events = append(*events, event+" "+FormatKey(key))
+	}
+}
+
+var (
+	errRejected = errors.New("rejected")
+	errKept     = errors.New("kept")
+)
+
+// hookedAnimal derives its slug from its name before it is saved, refuses
+// to be saved when rejected, and to be deleted when kept.
+type hookedAnimal struct {
+	Name   string `validate:"required,max=20"`
+	Legs   int    `validate:"max=8"`
+	Slug   string `validate:"regex=^[a-z-]+$"`
+	Kept   bool
+	Loaded bool `datastore:"-"`
+}
+
+func (a *hookedAnimal) BeforeSave(ctx context.Context, key *datastore.Key) error {
+	record(ctx, "before-save", key)
+	if a.Name == "rejected" {
+		return errRejected
+	}
+	a.Slug = strings.ToLower(strings.ReplaceAll(a.Name, " ", "-"))
+	return nil
+}
+
+func (a *hookedAnimal) AfterSave(ctx context.Context, key *datastore.Key) error {
+	record(ctx, "after-save", key)
+	return nil
+}
+
+func (a *hookedAnimal) AfterLoad(ctx context.Context, key *datastore.Key) error {
+	a.Loaded = true
+	return nil
+}
+
+func (a *hookedAnimal) BeforeDelete(ctx context.Context, key *datastore.Key) error {
+	record(ctx, "before-delete", key)
+	if a.Kept {
+		return errKept
+	}
+	if f, ok := ctx.Value(beforeDeleteKey{}).(func(*datastore.Key)); ok {
+		f(key)
+	}
+	return nil
+}
+
+type LifecycleTestSuite struct {
+	suite.Suite
+	newDriver func(t *testing.T) Driver
+	raw       Driver
+	d         Driver
+	ctx       context.Context
+	events    []string
+	cat       *datastore.Key
+	dog       *datastore.Key
+}
+
+func TestLifecycleTestSuite(t *testing.T) {
+	forEachDriver(t, func(newDriver func(*testing.T) Driver) suite.TestingSuite {
+		return &LifecycleTestSuite{newDriver: newDriver}
+	})
+}
+
+func (s *LifecycleTestSuite) SetupTest() {
+	s.raw = s.newDriver(s.T())
+	s.d = NewLifecycleDriver(s.raw, LifecycleKind("Animal", hookedAnimal{}))
+	s.events = nil
+	s.ctx = context.WithValue(context.Background(), eventsKey{}, &s.events)
+	s.cat = datastore.NameKey("Animal", "cat", nil)
+	s.dog = datastore.NameKey("Animal", "dog", nil)
+	_, err := s.d.PutMulti(s.ctx, []*datastore.Key{s.cat, s.dog},
+		[]hookedAnimal{{Name: "Big Cat", Legs: 4}, {Name: "Dog", Legs: 4, Kept: true}})
+	s.Require().NoError(err)
+}
+
+func (s *LifecycleTestSuite) TestSave() {
+	assert.Equal(s.T(), []string{
+		`before-save Animal:"cat"`, `before-save Animal:"dog"`,
+		`after-save Animal:"cat"`, `after-save Animal:"dog"`,
+	}, s.events)
+
+	var a hookedAnimal
+	s.Require().NoError(s.d.Get(s.ctx, s.cat, &a))
+	assert.Equal(s.T(), "big-cat", a.Slug, "BeforeSave changes are saved")
+
+	s.events = nil
+	k, err := s.d.Put(s.ctx, datastore.IncompleteKey("Animal", nil), &hookedAnimal{Name: "bird", Legs: 2})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []string{"before-save Animal", "after-save " + FormatKey(k)}, s.events,
+		"AfterSave sees the complete key")
+
+	s.events = nil
+	_, err = s.d.Put(s.ctx, s.cat, &hookedAnimal{Name: "rejected"})
+	assert.ErrorIs(s.T(), err, errRejected)
+	err = s.d.Update(s.ctx, s.cat, &hookedAnimal{Name: "Cat", Legs: 12})
+	var verr *ValidationError
+	s.Require().ErrorAs(err, &verr)
+	assert.ErrorIs(s.T(), err, ErrInvalidArgument)
+	assert.Equal(s.T(), []FieldError{{Field: "Legs", Rule: "max=8", Message: "must be at most 8"}}, verr.Fields)
+	assert.Equal(s.T(), []string{`before-save Animal:"cat"`, `before-save Animal:"cat"`}, s.events, "nothing was saved")
+	s.Require().NoError(s.d.Get(s.ctx, s.cat, &a))
+	assert.Equal(s.T(), "Big Cat", a.Name)
+}
+
+func (s *LifecycleTestSuite) TestSaveMulti() {
+	bird := datastore.NameKey("Animal", "bird", nil)
+	_, err := s.d.PutMulti(s.ctx, []*datastore.Key{bird, s.cat},
+		[]*hookedAnimal{{Name: "bird", Legs: 2}, {Name: "cat", Legs: 40}})
+	me, ok := err.(datastore.MultiError)
+	s.Require().True(ok, err)
+	assert.ErrorIs(s.T(), me[0], ErrBatchSkipped)
+	assert.ErrorIs(s.T(), me[1], ErrInvalidArgument)
+	var a hookedAnimal
+	assert.ErrorIs(s.T(), s.d.Get(s.ctx, bird, &a), ErrNotFound, "the batch is rejected as a whole")
+
+	s.events = nil
+	ids, err := s.d.CreateMulti(s.ctx, []*datastore.Key{bird}, []*hookedAnimal{{Name: "bird", Legs: 2}})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []string{`before-save Animal:"bird"`, `after-save Animal:"bird"`}, s.events)
+
+	s.events = nil
+	err = s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		_, err := tx.Put(datastore.IncompleteKey("Animal", nil), &hookedAnimal{Name: "Fish"})
+		return err
+	})
+	s.Require().NoError(err)
+	s.Require().Len(s.events, 2)
+	assert.Equal(s.T(), "before-save Animal", s.events[0])
+	assert.Regexp(s.T(), `^after-save Animal:\d+$`, s.events[1], "AfterSave sees the complete key")
+	assert.Len(s.T(), ids, 1)
+}
+
+func (s *LifecycleTestSuite) TestLoad() {
+	var a hookedAnimal
+	s.Require().NoError(s.d.Get(s.ctx, s.cat, &a))
+	assert.True(s.T(), a.Loaded)
+
+	animals := make([]hookedAnimal, 2)
+	s.Require().NoError(s.d.GetMulti(s.ctx, []*datastore.Key{s.cat, s.dog}, animals))
+	assert.True(s.T(), animals[0].Loaded && animals[1].Loaded)
+
+	it, err := s.d.Find(s.ctx, NewQuery("Animal"))
+	s.Require().NoError(err)
+	var found hookedAnimal
+	_, err = it.Next(&found)
+	s.Require().NoError(err)
+	assert.True(s.T(), found.Loaded)
+
+	var page []*hookedAnimal
+	_, err = s.d.FindPage(s.ctx, NewQuery("Animal"), 5, "", &page)
+	s.Require().NoError(err)
+	s.Require().Len(page, 2)
+	assert.True(s.T(), page[0].Loaded && page[1].Loaded)
+
+	_, err = s.d.Put(s.ctx, s.cat, &datastore.PropertyList{{Name: "Name", Value: "cat"}, {Name: "Color", Value: "red"}})
+	s.Require().NoError(err)
+	a = hookedAnimal{}
+	assert.ErrorIs(s.T(), s.d.Get(s.ctx, s.cat, &a), ErrFieldMismatch)
+	assert.True(s.T(), a.Loaded, "AfterLoad runs on mismatched entities")
+}
+
+// txDeleteDriver only deletes in transactions.
+type txDeleteDriver struct {
+	Driver
+}
+
+func (txDeleteDriver) Delete(ctx context.Context, key *datastore.Key) error {
+	return errors.New("delete outside a transaction")
+}
+
+func (txDeleteDriver) DeleteMulti(ctx context.Context, keys []*datastore.Key, opts ...BatchOption) error {
+	return errors.New("delete outside a transaction")
+}
+
+func (s *LifecycleTestSuite) TestDelete() {
+	s.events = nil
+	assert.ErrorIs(s.T(), s.d.Delete(s.ctx, s.dog), errKept)
+	err := s.d.DeleteMulti(s.ctx, []*datastore.Key{s.cat, s.dog})
+	me, ok := err.(datastore.MultiError)
+	s.Require().True(ok, err)
+	assert.ErrorIs(s.T(), me[0], ErrBatchSkipped)
+	assert.ErrorIs(s.T(), me[1], errKept)
+	n, err := s.d.Count(s.ctx, NewQuery("Animal"))
+	s.Require().NoError(err)
+	assert.Equal(s.T(), int64(2), n, "nothing was deleted")
+
+	s.Require().NoError(s.d.Delete(s.ctx, s.cat))
+	s.Require().NoError(s.d.Delete(s.ctx, s.cat), "missing entities have no hook to run")
+	s.Require().NoError(s.d.Delete(s.ctx, datastore.NameKey("Zoo", "north", nil)), "other kinds have no hook")
+	assert.Equal(s.T(), []string{
+		`before-delete Animal:"dog"`, `before-delete Animal:"cat"`, `before-delete Animal:"dog"`, `before-delete Animal:"cat"`,
+	}, s.events)
+
+	err = s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		return tx.Delete(s.dog)
+	})
+	assert.ErrorIs(s.T(), err, errKept)
+
+	d := NewLifecycleDriver(txDeleteDriver{s.raw}, LifecycleKind("Animal", hookedAnimal{}))
+	s.Require().NoError(d.Update(s.ctx, s.cat, &hookedAnimal{Name: "cat"}))
+	assert.NoError(s.T(), d.DeleteMulti(s.ctx, []*datastore.Key{s.cat}), "the hooks and the delete run in a transaction")
+	s.Require().NoError(d.Update(s.ctx, s.cat, &hookedAnimal{Name: "cat"}))
+	assert.NoError(s.T(), d.Delete(s.ctx, s.cat), "the hook and the delete run in a transaction")
+	assert.ErrorIs(s.T(), d.Delete(s.ctx, s.dog), errKept)
+}
+
+func (s *LifecycleTestSuite) TestDeleteChanged() {
+	changed := false
+	ctx := context.WithValue(s.ctx, beforeDeleteKey{}, func(key *datastore.Key) {
+		if !changed {
+			changed = true
+			s.Require().NoError(s.raw.Update(s.ctx, key, &hookedAnimal{Name: "Big Cat", Kept: true}))
+		}
+	})
+	err := s.d.DeleteMulti(ctx, []*datastore.Key{s.cat})
+	me, ok := err.(datastore.MultiError)
+	s.Require().True(ok, err)
+	assert.ErrorIs(s.T(), me[0], errKept, "the hook runs again on the changed entity")
+	var a hookedAnimal
+	s.Require().NoError(s.raw.Get(s.ctx, s.cat, &a))
+	assert.True(s.T(), a.Kept)
+}
+
+func (s *LifecycleTestSuite) TestTransaction() {
+	bird := datastore.NameKey("Animal", "bird", nil)
+	s.events = nil
+	err := s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		var a hookedAnimal
+		if err := tx.Get(s.cat, &a); err != nil {
+			return err
+		}
+		if !a.Loaded {
+			return errors.New("AfterLoad did not run")
+		}
+		if _, err := tx.Put(bird, &hookedAnimal{Name: "Bird"}); err != nil {
+			return err
+		}
+		if len(s.events) != 1 {
+			return errors.New("AfterSave ran before the commit")
+		}
+		return nil
+	})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []string{`before-save Animal:"bird"`, `after-save Animal:"bird"`}, s.events)
+
+	s.events = nil
+	err = s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		_, err := tx.Put(datastore.IncompleteKey("Animal", nil), &hookedAnimal{Name: "Fish"})
+		return err
+	})
+	s.Require().NoError(err)
+	s.Require().Len(s.events, 2)
+	assert.Equal(s.T(), "before-save Animal", s.events[0])
+	assert.Regexp(s.T(), `^after-save Animal:\d+$`, s.events[1], "AfterSave sees the complete key")
+
+	s.events = nil
+	err = s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		if _, err := tx.Put(bird, &hookedAnimal{Name: "Bird", Legs: 2}); err != nil {
+			return err
+		}
+		_, err := tx.Put(s.cat, &hookedAnimal{Name: ""})
+		return err
+	})
+	assert.ErrorIs(s.T(), err, ErrInvalidArgument)
+	assert.Equal(s.T(), []string{`before-save Animal:"bird"`, `before-save Animal:"cat"`}, s.events, "no AfterSave without a commit")
+}
@@ -0,0 +1,20 @@
+package datastore
+
+import "context"
+
+// kindKind is the metadata kind whose entities are named after the kinds
+// of their namespace.
+const kindKind = "__kind__"
+
+// Kinds returns the kinds of the entities stored in namespace, sorted.
+func Kinds(ctx context.Context, d Driver, namespace string) ([]string, error) {
+	keys, err := d.FindKeys(ctx, NewQuery(kindKind).Namespace(namespace))
+	if err != nil {
+		return nil, err
+	}
+	kinds := make([]string, len(keys))
+	for i, k := range keys {
+		kinds[i] = k.Name
+	}
+	return kinds, nil
+}
@@ -0,0 +1,53 @@
+package datastore
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type MetadataTestSuite struct {
+	suite.Suite
+	newDriver func(t *testing.T) Driver
+	d         Driver
+	ctx       context.Context
+}
+
+func TestMetadataTestSuite(t *testing.T) {
+	forEachDriver(t, func(newDriver func(*testing.T) Driver) suite.TestingSuite {
+		return &MetadataTestSuite{newDriver: newDriver}
+	})
+}
+
+func (s *MetadataTestSuite) SetupTest() {
+	s.d = s.newDriver(s.T())
+	s.ctx = context.Background()
+	zoo := datastore.NameKey("Zoo", "north", nil)
+	bird := datastore.NameKey("Bird", "owl", nil)
+	bird.Namespace = "tenant"
+	_, err := s.d.PutMulti(s.ctx,
+		[]*datastore.Key{zoo, datastore.NameKey("Animal", "cat", zoo), datastore.NameKey("Animal", "dog", nil), bird},
+		[]Animal{{Name: "zoo"}, {Name: "cat"}, {Name: "dog"}, {Name: "owl"}})
+	s.Require().NoError(err)
+}
+
+func (s *MetadataTestSuite) TestKinds() {
+	kinds, err := Kinds(s.ctx, s.d, "")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []string{"Animal", "Zoo"}, kinds)
+
+	kinds, err = Kinds(s.ctx, s.d, "tenant")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []string{"Bird"}, kinds)
+
+	kinds, err = Kinds(s.ctx, NewNamespaceDriver(s.d, "tenant"), "")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []string{"Bird"}, kinds, "the view lists the kinds of its namespace")
+
+	kinds, err = Kinds(s.ctx, s.d, "empty")
+	s.Require().NoError(err)
+	assert.Empty(s.T(), kinds)
+}
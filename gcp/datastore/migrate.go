@@ -0,0 +1,390 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// MigrationKind is the kind of the records of the migrations.
+const MigrationKind = "SchemaMigration"
+
+const defaultMigrationBatchSize = 100
+
+// ErrMigrationConflict is returned by Migrator.Run when another run advanced
+// the same migration meanwhile.
+var ErrMigrationConflict error = &Error{Kind: ErrConflict, Err: errors.New("migration advanced by another run")}
+
+// Transform changes the properties of an entity in place and reports whether
+// it changed them. Unchanged entities are not written.
+type Transform func(key *datastore.Key, props *datastore.PropertyList) (bool, error)
+
+// Migration transforms every entity of a kind, once.
+type Migration struct {
+	// Kind is the kind of the entities to transform.
+	Kind string
+	// Version orders the migrations of the kind, the lowest first. It must
+	// be positive and is never reused for another migration of the kind.
+	Version     int64
+	Description string
+	Transform   Transform
+}
+
+// MigrationRecord is the record of a migration stored by Migrator.Run,
+// under the kind MigrationKind. It doubles as the checkpoint of the
+// migration while it runs.
+type MigrationRecord struct {
+	Kind        string
+	Version     int64
+	Description string `datastore:",noindex"`
+	// Checkpoint is the key of the last entity migrated, nil before the
+	// first batch. Entities are migrated in key order.
+	Checkpoint *datastore.Key `datastore:",noindex"`
+	// Processed and Changed count the entities read and those written.
+	Processed int64 `datastore:",noindex"`
+	Changed   int64 `datastore:",noindex"`
+	Started   time.Time
+	// Completed is zero until every entity was migrated.
+	Completed time.Time
+}
+
+// Applied reports whether every entity was migrated.
+func (r MigrationRecord) Applied() bool {
+	return !r.Completed.IsZero()
+}
+
+type migrationOptions struct {
+	batchSize int
+	dryRun    bool
+	progress  func(MigrationRecord)
+}
+
+// MigrationOption configures Migrator.Run.
+type MigrationOption func(*migrationOptions)
+
+// MigrationBatchSize sets the number of entities migrated per transaction,
+// 100 by default. It is capped so the entities and the checkpoint fit in a
+// commit. Values below one are ignored.
+func MigrationBatchSize(size int) MigrationOption {
+	return func(o *migrationOptions) {
+		if size > 0 {
+			o.batchSize = size
+		}
+		if o.batchSize > maxBatchMutations-1 {
+			o.batchSize = maxBatchMutations - 1
+		}
+	}
+}
+
+// MigrationDryRun runs the transforms without writing anything, to report
+// how many entities the pending migrations would change.
+func MigrationDryRun() MigrationOption {
+	return func(o *migrationOptions) {
+		o.dryRun = true
+	}
+}
+
+// MigrationProgress calls f with the record of the running migration after
+// every batch.
+func MigrationProgress(f func(MigrationRecord)) MigrationOption {
+	return func(o *migrationOptions) {
+		o.progress = f
+	}
+}
+
+// Migrator applies migrations to the entities of a driver. To migrate the
+// entities of a namespace, give it a namespace view of the driver.
+type Migrator struct {
+	d          Driver
+	migrations []Migration
+}
+
+// NewMigrator returns a migrator applying migrations in ascending version
+// order. Every migration needs a kind, a positive version unique within its
+// kind and a transform.
+func NewMigrator(d Driver, migrations ...Migration) (*Migrator, error) {
+	seen := map[string]bool{}
+	for _, mig := range migrations {
+		switch {
+		case mig.Kind == "":
+			return nil, invalidArgument(fmt.Errorf("migration %d has no kind", mig.Version))
+		case mig.Version <= 0:
+			return nil, invalidArgument(fmt.Errorf("migration %d of %s: version must be positive", mig.Version, mig.Kind))
+		case mig.Transform == nil:
+			return nil, invalidArgument(fmt.Errorf("migration %d of %s has no transform", mig.Version, mig.Kind))
+		case seen[migrationName(mig)]:
+			return nil, invalidArgument(fmt.Errorf("migration %d of %s is defined twice", mig.Version, mig.Kind))
+		}
+		seen[migrationName(mig)] = true
+	}
+	sorted := append([]Migration(nil), migrations...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return &Migrator{d: d, migrations: sorted}, nil
+}
+
+func migrationName(mig Migration) string {
+	return fmt.Sprintf("%s/v%d", mig.Kind, mig.Version)
+}
+
+func migrationKey(mig Migration) *datastore.Key {
+	return datastore.NameKey(MigrationKind, migrationName(mig), nil)
+}
+
+// Records returns the records of the migrations that started, applied or
+// not.
+func (m *Migrator) Records(ctx context.Context) ([]MigrationRecord, error) {
+	it, err := m.d.Find(ctx, NewQuery(MigrationKind))
+	if err != nil {
+		return nil, err
+	}
+	var records []MigrationRecord
+	for {
+		var r MigrationRecord
+		if _, err := it.Next(&r); err == iterator.Done {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+}
+
+// Run applies the migrations that were not applied yet and returns their
+// records. Each migration walks the entities of its kind in key order, in
+// batches. Every batch is rewritten in a transaction along with the
+// checkpoint of the migration, so a run that failed or was interrupted
+// resumes after the last batch it committed. On error, the records of the
+// migrations before the failing one are returned along with its own.
+//
+// A dry run starts from the checkpoints but stores nothing: the records it
+// returns count the entities that would change, and are not completed.
+func (m *Migrator) Run(ctx context.Context, opts ...MigrationOption) ([]MigrationRecord, error) {
+	o := migrationOptions{batchSize: defaultMigrationBatchSize}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	var records []MigrationRecord
+	for _, mig := range m.migrations {
+		r, err := m.run(ctx, mig, o)
+		records = append(records, r)
+		if err != nil {
+			return records, fmt.Errorf("migration %d of %s: %w", mig.Version, mig.Kind, err)
+		}
+	}
+	return records, nil
+}
+
+func (m *Migrator) run(ctx context.Context, mig Migration, o migrationOptions) (MigrationRecord, error) {
+	key := migrationKey(mig)
+	var r MigrationRecord
+	switch err := m.d.Get(ctx, key, &r); {
+	case errors.Is(err, ErrNotFound):
+		r = MigrationRecord{Kind: mig.Kind, Version: mig.Version, Description: mig.Description, Started: now()}
+	case err != nil:
+		return r, err
+	case r.Applied():
+		return r, nil
+	}
+
+	for {
+		q := NewQuery(mig.Kind).KeysOnly().Order("__key__").Limit(o.batchSize)
+		if r.Checkpoint != nil {
+			q = q.Filter(Gt("__key__", r.Checkpoint))
+		}
+		keys, err := m.d.FindKeys(ctx, q)
+		if err != nil {
+			return r, err
+		}
+		if len(keys) == 0 {
+			break
+		}
+
+		var next MigrationRecord
+		if o.dryRun {
+			next, err = m.dryRun(ctx, mig, r, keys)
+		} else {
+			next, err = m.migrate(ctx, mig, key, r, keys)
+		}
+		if err != nil {
+			return r, err
+		}
+		r = next
+		if o.progress != nil {
+			o.progress(r)
+		}
+	}
+
+	if o.dryRun {
+		return r, nil
+	}
+	done := r
+	done.Completed = now()
+	err := m.d.RunInTransaction(ctx, func(tx Tx) error {
+		if err := checkMigration(tx, key, r); err != nil {
+			return err
+		}
+		_, err := tx.Put(key, &done)
+		return err
+	})
+	if err != nil {
+		return r, err
+	}
+	return done, nil
+}
+
+// migrate transforms the entities of keys and stores the checkpoint after
+// them in one transaction, and returns the new record.
+func (m *Migrator) migrate(ctx context.Context, mig Migration, key *datastore.Key, r MigrationRecord, keys []*datastore.Key) (MigrationRecord, error) {
+	var next MigrationRecord
+	err := m.d.RunInTransaction(ctx, func(tx Tx) error {
+		if err := checkMigration(tx, key, r); err != nil {
+			return err
+		}
+		next = r
+		for _, k := range keys {
+			var props datastore.PropertyList
+			switch err := tx.Get(k, &props); {
+			case errors.Is(err, ErrNotFound):
+				// Deleted since the keys were read.
+				continue
+			case err != nil:
+				return err
+			}
+			changed, err := mig.Transform(k, &props)
+			if err != nil {
+				return fmt.Errorf("transform %v: %w", k, err)
+			}
+			next.Processed++
+			if !changed {
+				continue
+			}
+			next.Changed++
+			if _, err := tx.Put(k, &props); err != nil {
+				return err
+			}
+		}
+		next.Checkpoint = keys[len(keys)-1]
+		_, err := tx.Put(key, &next)
+		return err
+	})
+	return next, err
+}
+
+// dryRun transforms the entities of keys without storing them and returns
+// the record the batch would leave.
+func (m *Migrator) dryRun(ctx context.Context, mig Migration, r MigrationRecord, keys []*datastore.Key) (MigrationRecord, error) {
+	entities := make([]datastore.PropertyList, len(keys))
+	err := m.d.GetMulti(ctx, keys, entities)
+	me, _ := err.(datastore.MultiError)
+	if err != nil && me == nil {
+		return r, err
+	}
+	for i, k := range keys {
+		if me != nil && me[i] != nil {
+			if errors.Is(me[i], ErrNotFound) {
+				continue
+			}
+			return r, me[i]
+		}
+		changed, err := mig.Transform(k, &entities[i])
+		if err != nil {
+			return r, fmt.Errorf("transform %v: %w", k, err)
+		}
+		r.Processed++
+		if changed {
+			r.Changed++
+		}
+	}
+	r.Checkpoint = keys[len(keys)-1]
+	return r, nil
+}
+
+// checkMigration fails with ErrMigrationConflict unless the stored record of
+// the migration, if any, still has the checkpoint of r.
+func checkMigration(tx Tx, key *datastore.Key, r MigrationRecord) error {
+	var stored MigrationRecord
+	switch err := tx.Get(key, &stored); {
+	case errors.Is(err, ErrNotFound):
+		if r.Checkpoint == nil {
+			return nil
+		}
+	case err != nil:
+		return err
+	case stored.Applied():
+	case stored.Checkpoint == nil && r.Checkpoint == nil:
+		return nil
+	case stored.Checkpoint != nil && r.Checkpoint != nil && stored.Checkpoint.Equal(r.Checkpoint):
+		return nil
+	}
+	return ErrMigrationConflict
+}
+
+// now returns the current time at the precision Datastore keeps.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// RenameProperty returns a transform renaming the property from to to. It
+// leaves entities without from unchanged, and fails on entities having both.
+func RenameProperty(from, to string) Transform {
+	return func(_ *datastore.Key, props *datastore.PropertyList) (bool, error) {
+		i := propertyIndex(*props, from)
+		if i < 0 {
+			return false, nil
+		}
+		if propertyIndex(*props, to) >= 0 {
+			return false, fmt.Errorf("both %s and %s are set", from, to)
+		}
+		(*props)[i].Name = to
+		return true, nil
+	}
+}
+
+// ConvertProperty returns a transform replacing the value of the property
+// name by the one convert returns. The value of a multi-valued property is
+// a []interface{}. Entities without the property are left unchanged, as
+// are those whose converted value is equal to the original.
+func ConvertProperty(name string, convert func(v interface{}) (interface{}, error)) Transform {
+	return func(_ *datastore.Key, props *datastore.PropertyList) (bool, error) {
+		i := propertyIndex(*props, name)
+		if i < 0 {
+			return false, nil
+		}
+		v, err := convert((*props)[i].Value)
+		if err != nil {
+			return false, fmt.Errorf("convert %s: %w", name, err)
+		}
+		if reflect.DeepEqual(v, (*props)[i].Value) {
+			return false, nil
+		}
+		(*props)[i].Value = v
+		return true, nil
+	}
+}
+
+// DeleteProperty returns a transform removing the property name.
+func DeleteProperty(name string) Transform {
+	return func(_ *datastore.Key, props *datastore.PropertyList) (bool, error) {
+		i := propertyIndex(*props, name)
+		if i < 0 {
+			return false, nil
+		}
+		*props = append((*props)[:i], (*props)[i+1:]...)
+		return true, nil
+	}
+}
+
+func propertyIndex(props datastore.PropertyList, name string) int {
+	for i, p := range props {
+		if p.Name == name {
+			return i
+		}
+	}
+	return -1
+}
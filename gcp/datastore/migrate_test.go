@@ -0,0 +1,207 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type MigrationTestSuite struct {
+	suite.Suite
+	newDriver func(t *testing.T) Driver
+	d         Driver
+	ctx       context.Context
+	keys      []*datastore.Key
+}
+
+func TestMigrationTestSuite(t *testing.T) {
+	forEachDriver(t, func(newDriver func(*testing.T) Driver) suite.TestingSuite {
+		return &MigrationTestSuite{newDriver: newDriver}
+	})
+}
+
+// SetupTest stores animals the way an older Animal did, with Food instead
+// of FoodType and Legs as a string.
+func (s *MigrationTestSuite) SetupTest() {
+	s.d = s.newDriver(s.T())
+	s.ctx = context.Background()
+	s.keys = nil
+	var entities []datastore.PropertyList
+	for i := 1; i <= 5; i++ {
+		s.keys = append(s.keys, datastore.IDKey("Animal", int64(i), nil))
+		entities = append(entities, datastore.PropertyList{
+			{Name: "Name", Value: fmt.Sprintf("animal %d", i)},
+			{Name: "Legs", Value: strconv.Itoa(i % 2 * 2)},
+			{Name: "Food", Value: "meat"},
+		})
+	}
+	entities[4] = datastore.PropertyList{{Name: "Name", Value: "animal 5"}, {Name: "Legs", Value: int64(2)}}
+	_, err := s.d.PutMulti(s.ctx, s.keys, entities)
+	s.Require().NoError(err)
+}
+
+func (s *MigrationTestSuite) migrations() []Migration {
+	return []Migration{
+		{Kind: "Animal", Version: 2, Description: "Legs as integers", Transform: ConvertProperty("Legs", legsToInt)},
+		{Kind: "Animal", Version: 1, Description: "Food renamed FoodType", Transform: RenameProperty("Food", "FoodType")},
+	}
+}
+
+func legsToInt(v interface{}) (interface{}, error) {
+	s, ok := v.(string)
+	if !ok {
+		return v, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func (s *MigrationTestSuite) TestRun() {
+	var a Animal
+	assert.ErrorIs(s.T(), s.d.Get(s.ctx, s.keys[0], &a), ErrFieldMismatch)
+
+	m, err := NewMigrator(s.d, s.migrations()...)
+	s.Require().NoError(err)
+	var batches int
+	records, err := m.Run(s.ctx, MigrationBatchSize(2), MigrationProgress(func(MigrationRecord) { batches++ }))
+	s.Require().NoError(err)
+	s.Require().Len(records, 2)
+	assert.Equal(s.T(), 6, batches, "3 batches per migration")
+	assert.Equal(s.T(), int64(1), records[0].Version, "migrations run in version order")
+	assert.Equal(s.T(), int64(5), records[0].Processed)
+	assert.Equal(s.T(), int64(4), records[0].Changed)
+	assert.Equal(s.T(), int64(4), records[1].Changed)
+	assert.True(s.T(), records[0].Applied())
+	assert.Equal(s.T(), s.keys[4], records[1].Checkpoint)
+
+	animals := make([]Animal, len(s.keys))
+	s.Require().NoError(s.d.GetMulti(s.ctx, s.keys, animals))
+	assert.Equal(s.T(), Animal{Name: "animal 1", Legs: 2, FoodType: "meat"}, animals[0])
+	assert.Equal(s.T(), Animal{Name: "animal 2", Legs: 0, FoodType: "meat"}, animals[1])
+
+	stored, err := m.Records(s.ctx)
+	s.Require().NoError(err)
+	assert.Len(s.T(), stored, 2)
+	for _, r := range stored {
+		assert.True(s.T(), r.Applied(), r.Version)
+	}
+
+	records, err = m.Run(s.ctx, MigrationProgress(func(MigrationRecord) { s.Fail("applied migrations run again") }))
+	s.Require().NoError(err)
+	assert.Equal(s.T(), stored[0].Completed, records[0].Completed)
+}
+
+func (s *MigrationTestSuite) TestDryRun() {
+	m, err := NewMigrator(s.d, s.migrations()...)
+	s.Require().NoError(err)
+	records, err := m.Run(s.ctx, MigrationDryRun(), MigrationBatchSize(3))
+	s.Require().NoError(err)
+	s.Require().Len(records, 2)
+	assert.Equal(s.T(), int64(5), records[0].Processed)
+	assert.Equal(s.T(), int64(4), records[0].Changed)
+	assert.False(s.T(), records[0].Applied())
+
+	var props datastore.PropertyList
+	s.Require().NoError(s.d.Get(s.ctx, s.keys[0], &props))
+	assert.Equal(s.T(), "Food", props[propertyIndex(props, "Food")].Name, "nothing is written")
+	stored, err := m.Records(s.ctx)
+	s.Require().NoError(err)
+	assert.Empty(s.T(), stored)
+}
+
+func (s *MigrationTestSuite) TestResume() {
+	errBoom := errors.New("boom")
+	var fail bool
+	rename := RenameProperty("Food", "FoodType")
+	migration := Migration{Kind: "Animal", Version: 1, Transform: func(k *datastore.Key, props *datastore.PropertyList) (bool, error) {
+		if fail && k.ID == 4 {
+			return false, errBoom
+		}
+		return rename(k, props)
+	}}
+	m, err := NewMigrator(s.d, migration)
+	s.Require().NoError(err)
+
+	fail = true
+	records, err := m.Run(s.ctx, MigrationBatchSize(2))
+	assert.ErrorIs(s.T(), err, errBoom)
+	s.Require().Len(records, 1)
+	assert.Equal(s.T(), s.keys[1], records[0].Checkpoint, "the first batch is committed")
+	var props datastore.PropertyList
+	s.Require().NoError(s.d.Get(s.ctx, s.keys[2], &props))
+	assert.GreaterOrEqual(s.T(), propertyIndex(props, "Food"), 0, "the failed batch is rolled back")
+
+	fail = false
+	var checkpoints []*datastore.Key
+	records, err = m.Run(s.ctx, MigrationBatchSize(2), MigrationProgress(func(r MigrationRecord) {
+		checkpoints = append(checkpoints, r.Checkpoint)
+	}))
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []*datastore.Key{s.keys[3], s.keys[4]}, checkpoints, "the run resumes after the checkpoint")
+	assert.Equal(s.T(), int64(5), records[0].Processed)
+	assert.Equal(s.T(), int64(4), records[0].Changed)
+	assert.True(s.T(), records[0].Applied())
+}
+
+func (s *MigrationTestSuite) TestConflict() {
+	m, err := NewMigrator(s.d, Migration{Kind: "Animal", Version: 1, Transform: RenameProperty("Food", "FoodType")})
+	s.Require().NoError(err)
+	_, err = m.Run(s.ctx, MigrationBatchSize(2), MigrationProgress(func(r MigrationRecord) {
+		if r.Checkpoint.Equal(s.keys[1]) {
+			r.Checkpoint = s.keys[3]
+			_, err := s.d.Put(s.ctx, migrationKey(Migration{Kind: "Animal", Version: 1}), &r)
+			s.Require().NoError(err)
+		}
+	}))
+	assert.ErrorIs(s.T(), err, ErrMigrationConflict)
+	assert.ErrorIs(s.T(), err, ErrConflict)
+}
+
+func TestNewMigrator(t *testing.T) {
+	rename := RenameProperty("Food", "FoodType")
+	for _, migrations := range [][]Migration{
+		{{Version: 1, Transform: rename}},
+		{{Kind: "Animal", Transform: rename}},
+		{{Kind: "Animal", Version: -1, Transform: rename}},
+		{{Kind: "Animal", Version: 1}},
+		{{Kind: "Animal", Version: 1, Transform: rename}, {Kind: "Animal", Version: 1, Transform: rename}},
+	} {
+		_, err := NewMigrator(NewMemoryDriver(), migrations...)
+		assert.ErrorIs(t, err, ErrInvalidArgument, migrations)
+	}
+	_, err := NewMigrator(NewMemoryDriver(),
+		Migration{Kind: "Animal", Version: 1, Transform: rename}, Migration{Kind: "Zoo", Version: 1, Transform: rename})
+	assert.NoError(t, err, "versions are per kind")
+}
+
+func TestTransforms(t *testing.T) {
+	props := datastore.PropertyList{{Name: "Food", Value: "meat"}, {Name: "Legs", Value: "4"}}
+
+	changed, err := RenameProperty("Food", "FoodType")(nil, &props)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	changed, err = RenameProperty("Food", "FoodType")(nil, &props)
+	assert.NoError(t, err)
+	assert.False(t, changed, "already renamed")
+	_, err = RenameProperty("Legs", "FoodType")(nil, &props)
+	assert.Error(t, err, "both are set")
+
+	changed, err = ConvertProperty("Legs", legsToInt)(nil, &props)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	changed, err = ConvertProperty("Legs", legsToInt)(nil, &props)
+	assert.NoError(t, err)
+	assert.False(t, changed, "already converted")
+	_, err = ConvertProperty("FoodType", legsToInt)(nil, &props)
+	assert.Error(t, err)
+
+	changed, err = DeleteProperty("FoodType")(nil, &props)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, datastore.PropertyList{{Name: "Legs", Value: int64(4)}}, props)
+}
@@ -0,0 +1,352 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/datastore"
+)
+
+// ErrForeignNamespace is returned by a namespace-scoped driver for keys and
+// queries of another namespace.
+var ErrForeignNamespace error = &Error{Kind: ErrInvalidArgument, Err: errors.New("foreign namespace")}
+
+var _ Driver = (*namespaceDriver)(nil)
+
+// namespaceDriver is a view of a Driver confined to one namespace. Every
+// query, key, ancestor and key filter value is placed in the namespace;
+// those of the default namespace are moved to it and those of any other
+// namespace are rejected.
+type namespaceDriver struct {
+	d         Driver
+	namespace string
+}
+
+// NewNamespaceDriver returns a view of d confined to namespace, typically
+// the namespace of a tenant. Closing the view closes d.
+func NewNamespaceDriver(d Driver, namespace string) Driver {
+	return &namespaceDriver{d: d, namespace: namespace}
+}
+
+// scopeKey returns a copy of k, with its parents, in the namespace of the
+// view. A nil key is left for the driver to reject.
+func (n *namespaceDriver) scopeKey(k *datastore.Key) (*datastore.Key, error) {
+	if k == nil {
+		return nil, nil
+	}
+	if k.Namespace != "" && k.Namespace != n.namespace {
+		return nil, fmt.Errorf("%w: key %v is in namespace %q, not %q", ErrForeignNamespace, k, k.Namespace, n.namespace)
+	}
+	parent, err := n.scopeKey(k.Parent)
+	if err != nil {
+		return nil, err
+	}
+	c := *k
+	c.Namespace = n.namespace
+	c.Parent = parent
+	return &c, nil
+}
+
+// scopeKeys scopes the keys of a batch. When one is foreign the whole batch
+// is rejected with a MultiError, as checkBatchKeys does for invalid keys.
+func (n *namespaceDriver) scopeKeys(keys []*datastore.Key) ([]*datastore.Key, error) {
+	scoped := make([]*datastore.Key, len(keys))
+	var errs datastore.MultiError
+	for i, k := range keys {
+		var err error
+		if scoped[i], err = n.scopeKey(k); err != nil {
+			if errs == nil {
+				errs = make(datastore.MultiError, len(keys))
+			}
+			errs[i] = err
+		}
+	}
+	if errs == nil {
+		return scoped, nil
+	}
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = ErrBatchSkipped
+		}
+	}
+	return nil, errs
+}
+
+// scopeValue scopes the keys held by a filter value.
+func (n *namespaceDriver) scopeValue(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case *datastore.Key:
+		return n.scopeKey(x)
+	case []*datastore.Key:
+		return n.scopeKeys(x)
+	case []interface{}:
+		values := make([]interface{}, len(x))
+		for i := range x {
+			var err error
+			if values[i], err = n.scopeValue(x[i]); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return v, nil
+}
+
+func (n *namespaceDriver) scopeFilter(ef datastore.EntityFilter) (datastore.EntityFilter, error) {
+	switch f := ef.(type) {
+	case datastore.PropertyFilter:
+		v, err := n.scopeValue(f.Value)
+		f.Value = v
+		return f, err
+	case datastore.AndFilter:
+		filters, err := n.scopeFilters(f.Filters)
+		return datastore.AndFilter{Filters: filters}, err
+	case datastore.OrFilter:
+		filters, err := n.scopeFilters(f.Filters)
+		return datastore.OrFilter{Filters: filters}, err
+	}
+	// Anything else is left for Validate to reject.
+	return ef, nil
+}
+
+func (n *namespaceDriver) scopeFilters(efs []datastore.EntityFilter) ([]datastore.EntityFilter, error) {
+	scoped := make([]datastore.EntityFilter, len(efs))
+	for i, ef := range efs {
+		var err error
+		if scoped[i], err = n.scopeFilter(ef); err != nil {
+			return nil, err
+		}
+	}
+	return scoped, nil
+}
+
+// scopeQuery returns q running in the namespace of the view.
+func (n *namespaceDriver) scopeQuery(q *Query) (*Query, error) {
+	if q.namespace != "" && q.namespace != n.namespace {
+		return nil, fmt.Errorf("%w: query is in namespace %q, not %q", ErrForeignNamespace, q.namespace, n.namespace)
+	}
+	q = q.Namespace(n.namespace)
+	ancestor, err := n.scopeKey(q.ancestor)
+	if err != nil {
+		return nil, err
+	}
+	q.ancestor = ancestor
+	for i, f := range q.filters {
+		ef, err := n.scopeFilter(f.EntityFilter())
+		if err != nil {
+			return nil, err
+		}
+		q.filters[i] = entityFilter{ef}
+	}
+	return q, nil
+}
+
+// entityFilter is a Filter holding a client filter as is.
+type entityFilter struct {
+	ef datastore.EntityFilter
+}
+
+func (f entityFilter) EntityFilter() datastore.EntityFilter {
+	return f.ef
+}
+
+func (n *namespaceDriver) Find(ctx context.Context, q *Query) (Iterator, error) {
+	q, err := n.scopeQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	return n.d.Find(ctx, q)
+}
+
+func (n *namespaceDriver) FindIds(ctx context.Context, q *Query) ([]string, error) {
+	q, err := n.scopeQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	return n.d.FindIds(ctx, q)
+}
+
+func (n *namespaceDriver) FindKeys(ctx context.Context, q *Query) ([]*datastore.Key, error) {
+	q, err := n.scopeQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	return n.d.FindKeys(ctx, q)
+}
+
+func (n *namespaceDriver) FindPage(ctx context.Context, q *Query, pageSize int, pageToken string, dst interface{}) (*Page, error) {
+	q, err := n.scopeQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	return n.d.FindPage(ctx, q, pageSize, pageToken, dst)
+}
+
+func (n *namespaceDriver) FindIdsPage(ctx context.Context, q *Query, pageSize int, pageToken string) ([]string, string, error) {
+	q, err := n.scopeQuery(q)
+	if err != nil {
+		return nil, "", err
+	}
+	return n.d.FindIdsPage(ctx, q, pageSize, pageToken)
+}
+
+func (n *namespaceDriver) Aggregate(ctx context.Context, q *Query, aggs ...Aggregation) (AggregationResult, error) {
+	q, err := n.scopeQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	return n.d.Aggregate(ctx, q, aggs...)
+}
+
+func (n *namespaceDriver) Count(ctx context.Context, q *Query) (int64, error) {
+	q, err := n.scopeQuery(q)
+	if err != nil {
+		return 0, err
+	}
+	return n.d.Count(ctx, q)
+}
+
+func (n *namespaceDriver) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	key, err := n.scopeKey(key)
+	if err != nil {
+		return err
+	}
+	return n.d.Get(ctx, key, dst)
+}
+
+func (n *namespaceDriver) Create(ctx context.Context, key *datastore.Key, object interface{}) (string, error) {
+	key, err := n.scopeKey(key)
+	if err != nil {
+		return "", err
+	}
+	return n.d.Create(ctx, key, object)
+}
+
+func (n *namespaceDriver) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	key, err := n.scopeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return n.d.Put(ctx, key, src)
+}
+
+func (n *namespaceDriver) Delete(ctx context.Context, key *datastore.Key) error {
+	key, err := n.scopeKey(key)
+	if err != nil {
+		return err
+	}
+	return n.d.Delete(ctx, key)
+}
+
+func (n *namespaceDriver) Update(ctx context.Context, key *datastore.Key, data interface{}) error {
+	key, err := n.scopeKey(key)
+	if err != nil {
+		return err
+	}
+	return n.d.Update(ctx, key, data)
+}
+
+func (n *namespaceDriver) UpdateVersioned(ctx context.Context, key *datastore.Key, data Versioned) error {
+	key, err := n.scopeKey(key)
+	if err != nil {
+		return err
+	}
+	return n.d.UpdateVersioned(ctx, key, data)
+}
+
+func (n *namespaceDriver) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}, opts ...BatchOption) error {
+	keys, err := n.scopeKeys(keys)
+	if err != nil {
+		return err
+	}
+	return n.d.GetMulti(ctx, keys, dst, opts...)
+}
+
+func (n *namespaceDriver) CreateMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) ([]string, error) {
+	keys, err := n.scopeKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	return n.d.CreateMulti(ctx, keys, src, opts...)
+}
+
+func (n *namespaceDriver) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) ([]*datastore.Key, error) {
+	keys, err := n.scopeKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	return n.d.PutMulti(ctx, keys, src, opts...)
+}
+
+func (n *namespaceDriver) UpdateMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) error {
+	keys, err := n.scopeKeys(keys)
+	if err != nil {
+		return err
+	}
+	return n.d.UpdateMulti(ctx, keys, src, opts...)
+}
+
+func (n *namespaceDriver) DeleteMulti(ctx context.Context, keys []*datastore.Key, opts ...BatchOption) error {
+	keys, err := n.scopeKeys(keys)
+	if err != nil {
+		return err
+	}
+	return n.d.DeleteMulti(ctx, keys, opts...)
+}
+
+func (n *namespaceDriver) AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	keys, err := n.scopeKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	return n.d.AllocateIDs(ctx, keys)
+}
+
+func (n *namespaceDriver) ReserveIDs(ctx context.Context, keys []*datastore.Key) error {
+	keys, err := n.scopeKeys(keys)
+	if err != nil {
+		return err
+	}
+	return n.d.ReserveIDs(ctx, keys)
+}
+
+func (n *namespaceDriver) RunInTransaction(ctx context.Context, f func(tx Tx) error, opts ...TxOption) error {
+	return n.d.RunInTransaction(ctx, func(tx Tx) error {
+		return f(&namespaceTx{tx: tx, n: n})
+	}, opts...)
+}
+
+func (n *namespaceDriver) Close() error {
+	return n.d.Close()
+}
+
+// namespaceTx confines a transaction to the namespace of its view.
+type namespaceTx struct {
+	tx Tx
+	n  *namespaceDriver
+}
+
+func (t *namespaceTx) Get(key *datastore.Key, dst interface{}) error {
+	key, err := t.n.scopeKey(key)
+	if err != nil {
+		return err
+	}
+	return t.tx.Get(key, dst)
+}
+
+func (t *namespaceTx) Put(key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	key, err := t.n.scopeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return t.tx.Put(key, src)
+}
+
+func (t *namespaceTx) Delete(key *datastore.Key) error {
+	key, err := t.n.scopeKey(key)
+	if err != nil {
+		return err
+	}
+	return t.tx.Delete(key)
+}
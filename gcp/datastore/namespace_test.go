@@ -0,0 +1,112 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/api/iterator"
+)
+
+type NamespaceTestSuite struct {
+	suite.Suite
+	newDriver func(t *testing.T) Driver
+	acme      Driver
+	globex    Driver
+	ctx       context.Context
+	zoo       *datastore.Key
+	cat       *datastore.Key
+}
+
+func TestNamespaceTestSuite(t *testing.T) {
+	forEachDriver(t, func(newDriver func(*testing.T) Driver) suite.TestingSuite {
+		return &NamespaceTestSuite{newDriver: newDriver}
+	})
+}
+
+func (s *NamespaceTestSuite) SetupTest() {
+	d := s.newDriver(s.T())
+	s.acme = NewNamespaceDriver(d, "acme")
+	s.globex = NewNamespaceDriver(d, "globex")
+	s.ctx = context.Background()
+	s.zoo = datastore.NameKey("Zoo", "north", nil)
+	s.cat = datastore.NameKey("Animal", "cat", s.zoo)
+
+	_, err := s.acme.Create(s.ctx, s.cat, &Animal{Name: "cat", Legs: 4})
+	s.Require().NoError(err)
+}
+
+func (s *NamespaceTestSuite) keys(d Driver, q *Query) []*datastore.Key {
+	it, err := d.Find(s.ctx, q)
+	s.Require().NoError(err)
+	var keys []*datastore.Key
+	for {
+		k, err := it.Next(&Animal{})
+		if err == iterator.Done {
+			return keys
+		}
+		s.Require().NoError(err)
+		keys = append(keys, k)
+	}
+}
+
+func (s *NamespaceTestSuite) TestIsolation() {
+	var a Animal
+	assert.NoError(s.T(), s.acme.Get(s.ctx, s.cat, &a))
+	assert.ErrorIs(s.T(), s.globex.Get(s.ctx, s.cat, &a), datastore.ErrNoSuchEntity)
+
+	keys := s.keys(s.acme, NewQuery("Animal"))
+	s.Require().Len(keys, 1)
+	assert.Equal(s.T(), "acme", keys[0].Namespace)
+	assert.Equal(s.T(), "acme", keys[0].Parent.Namespace)
+	assert.Empty(s.T(), s.keys(s.globex, NewQuery("Animal")))
+}
+
+func (s *NamespaceTestSuite) TestAncestorAndKeyFilters() {
+	assert.Len(s.T(), s.keys(s.acme, NewQuery("Animal").Ancestor(s.zoo)), 1)
+	assert.Len(s.T(), s.keys(s.acme, NewQuery("Animal").Filter(Eq("__key__", s.cat))), 1)
+	assert.Len(s.T(), s.keys(s.acme, NewQuery("Animal").Filter(In("__key__", s.cat))), 1)
+	assert.Empty(s.T(), s.keys(s.globex, NewQuery("Animal").Ancestor(s.zoo)))
+}
+
+func (s *NamespaceTestSuite) TestForeignKeys() {
+	foreign := s.keys(s.acme, NewQuery("Animal"))[0]
+
+	assert.ErrorIs(s.T(), s.globex.Get(s.ctx, foreign, &Animal{}), ErrForeignNamespace)
+	assert.ErrorIs(s.T(), s.globex.Delete(s.ctx, foreign), ErrForeignNamespace)
+	_, err := s.globex.Find(s.ctx, NewQuery("Animal").Ancestor(foreign.Parent))
+	assert.ErrorIs(s.T(), err, ErrForeignNamespace)
+	_, err = s.globex.FindIds(s.ctx, NewQuery("Animal").Filter(Eq("__key__", foreign)))
+	assert.ErrorIs(s.T(), err, ErrForeignNamespace)
+	_, err = s.globex.FindIds(s.ctx, NewQuery("Animal").Namespace("acme"))
+	assert.ErrorIs(s.T(), err, ErrForeignNamespace)
+
+	err = s.globex.GetMulti(s.ctx, []*datastore.Key{s.cat, foreign}, make([]Animal, 2))
+	var me datastore.MultiError
+	s.Require().True(errors.As(err, &me))
+	assert.Equal(s.T(), ErrBatchSkipped, me[0])
+	assert.ErrorIs(s.T(), me[1], ErrForeignNamespace)
+
+	// The entity of the other tenant is untouched.
+	assert.NoError(s.T(), s.acme.Get(s.ctx, foreign, &Animal{}))
+}
+
+func (s *NamespaceTestSuite) TestTransaction() {
+	err := s.globex.RunInTransaction(s.ctx, func(tx Tx) error {
+		if err := tx.Get(s.cat, &Animal{}); !errors.Is(err, datastore.ErrNoSuchEntity) {
+			return err
+		}
+		_, err := tx.Put(s.cat, &Animal{Name: "cat", Legs: 3})
+		return err
+	})
+	s.Require().NoError(err)
+
+	var a Animal
+	s.Require().NoError(s.globex.Get(s.ctx, s.cat, &a))
+	assert.Equal(s.T(), 3, a.Legs)
+	s.Require().NoError(s.acme.Get(s.ctx, s.cat, &a))
+	assert.Equal(s.T(), 4, a.Legs)
+}
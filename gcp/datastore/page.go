@@ -0,0 +1,119 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// Page is a single page of query results.
+type Page struct {
+	// Keys holds the keys of the entities on this page, in query order.
+	Keys []*datastore.Key
+	// NextPageToken is the opaque token of the following page. It is empty
+	// when there are no more results.
+	NextPageToken string
+}
+
+// Ids returns the encoded keys of the page, as FindIds does.
+func (p *Page) Ids() []string {
+	ids := make([]string, 0, len(p.Keys))
+	for _, k := range p.Keys {
+		ids = append(ids, k.Encode())
+	}
+	return ids
+}
+
+// pageRequest validates a page request. It returns the query reading the
+// page, limited to one result past the page size so the next page can be
+// detected, and the cursor the page starts at.
+func pageRequest(query *Query, pageSize int, pageToken string) (*Query, datastore.Cursor, error) {
+	if pageSize <= 0 {
+		return nil, datastore.Cursor{}, invalidArgument(fmt.Errorf("invalid page size %d", pageSize))
+	}
+
+	cursor, err := datastore.DecodeCursor(pageToken)
+	if err != nil {
+		return nil, datastore.Cursor{}, invalidArgument(fmt.Errorf("invalid page token: %w", err))
+	}
+
+	if pageToken != "" {
+		// The cursor already points past any offset of the first page.
+		query = query.Offset(0)
+	}
+
+	query = query.Limit(pageSize + 1)
+	if err := query.Validate(); err != nil {
+		return nil, datastore.Cursor{}, err
+	}
+	return query, cursor, nil
+}
+
+// readPage drains it into dst, which must be nil or a pointer to a slice of
+// structs, struct pointers or PropertyLoadSavers, and returns the page.
+func readPage(it Iterator, pageSize int, dst interface{}) (_ *Page, err error) {
+	var slice reflect.Value
+	if dst != nil {
+		slice = reflect.ValueOf(dst)
+		if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+			return nil, invalidArgument(errors.New("invalid page destination: must be a pointer to a slice"))
+		}
+		slice = slice.Elem()
+		// A failed read leaves dst as it was, so it can be retried.
+		defer func(n int) {
+			if err != nil {
+				slice.SetLen(n)
+			}
+		}(slice.Len())
+	}
+
+	page := &Page{}
+	for len(page.Keys) < pageSize {
+		var elem reflect.Value
+		var target interface{}
+		if slice.IsValid() {
+			elem = newSliceElem(slice.Type().Elem())
+			target = elem.Interface()
+		}
+
+		key, err := it.Next(target)
+		if err == iterator.Done {
+			return page, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		page.Keys = append(page.Keys, key)
+		if slice.IsValid() {
+			if slice.Type().Elem().Kind() != reflect.Ptr {
+				elem = elem.Elem()
+			}
+			slice.Set(reflect.Append(slice, elem))
+		}
+	}
+
+	cursor, err := it.Cursor()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := it.Next(nil); err == iterator.Done {
+		return page, nil
+	} else if err != nil {
+		return nil, err
+	}
+	page.NextPageToken = cursor.String()
+	return page, nil
+}
+
+// newSliceElem allocates a pointer to load the next element of a slice of
+// elemType into.
+func newSliceElem(elemType reflect.Type) reflect.Value {
+	if elemType.Kind() == reflect.Ptr {
+		return reflect.New(elemType.Elem())
+	}
+	return reflect.New(elemType)
+}
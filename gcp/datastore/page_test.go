@@ -0,0 +1,67 @@
+package datastore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type PageTestSuite struct {
+	suite.Suite
+}
+
+func TestPageTestSuite(t *testing.T) {
+	suite.Run(t, new(PageTestSuite))
+}
+
+func (s *PageTestSuite) TestIds() {
+	k := datastore.NameKey("Animal", "cat", nil)
+	p := &Page{Keys: []*datastore.Key{k}}
+	assert.Equal(s.T(), []string{k.Encode()}, p.Ids())
+}
+
+func (s *PageTestSuite) TestPageRequest() {
+	q, cursor, err := pageRequest(NewQuery("Animal").Offset(10), 20, "")
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 21, q.limit)
+	assert.Equal(s.T(), 10, q.offset)
+	assert.Equal(s.T(), "", cursor.String())
+
+	q, cursor, err = pageRequest(NewQuery("Animal").Offset(10), 20, "AQID")
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 0, q.offset)
+	assert.Equal(s.T(), "AQID", cursor.String())
+
+	_, _, err = pageRequest(NewQuery("Animal"), 0, "")
+	assert.Error(s.T(), err)
+
+	_, _, err = pageRequest(NewQuery("Animal"), 10, "not a cursor!")
+	assert.Error(s.T(), err)
+
+	_, _, err = pageRequest(NewQuery("Animal").Order(""), 10, "")
+	assert.Error(s.T(), err)
+}
+
+func (s *PageTestSuite) TestInvalidRequests() {
+	d := &driver{timeout: ctxTimeOut}
+
+	_, err := d.FindPage(context.Background(), NewQuery("Animal"), -1, "", nil)
+	assert.Error(s.T(), err)
+
+	_, _, err = d.FindIdsPage(context.Background(), NewQuery("Animal"), 10, "%%")
+	assert.Error(s.T(), err)
+}
+
+func (s *PageTestSuite) TestNewSliceElem() {
+	var animals []Animal
+	e := newSliceElem(reflect.TypeOf(animals).Elem())
+	assert.IsType(s.T(), &Animal{}, e.Interface())
+
+	var pointers []*Animal
+	e = newSliceElem(reflect.TypeOf(pointers).Elem())
+	assert.IsType(s.T(), &Animal{}, e.Interface())
+}
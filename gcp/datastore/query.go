@@ -0,0 +1,319 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Query describes a read of a single kind. It is built fluently, every
+// builder method returns a derived copy, and it is validated against the
+// combinations the backend rejects before it is run.
+type Query struct {
+	kind       string
+	namespace  string
+	ancestor   *datastore.Key
+	filters    []Filter
+	orders     []order
+	projection []string
+	distinctOn []string
+	keysOnly   bool
+	limit      int
+	offset     int
+	err        error
+
+	// includeDeleted lets a SoftDeleteDriver yield tombstones.
+	includeDeleted bool
+	// start is the cursor a SoftDeleteDriver resumes its queries at.
+	start datastore.Cursor
+}
+
+// order is a single sort order of a query.
+type order struct {
+	field string
+	desc  bool
+}
+
+func (o order) String() string {
+	if o.desc {
+		return "-" + o.field
+	}
+	return o.field
+}
+
+var inequalityConditions = map[string]bool{
+	"<":      true,
+	"<=":     true,
+	">":      true,
+	">=":     true,
+	"!=":     true,
+	"not-in": true,
+}
+
+var equalityConditions = map[string]bool{
+	"=":  true,
+	"in": true,
+}
+
+// NewQuery creates a query over the given kind.
+func NewQuery(kind string) *Query {
+	return &Query{kind: kind, limit: -1}
+}
+
+func (q *Query) clone() *Query {
+	c := *q
+	c.filters = append([]Filter(nil), q.filters...)
+	c.orders = append([]order(nil), q.orders...)
+	c.projection = append([]string(nil), q.projection...)
+	c.distinctOn = append([]string(nil), q.distinctOn...)
+	return &c
+}
+
+// Kind returns the kind the query reads.
+func (q *Query) Kind() string {
+	return q.kind
+}
+
+// Namespace runs the query in the given namespace instead of the default
+// one.
+func (q *Query) Namespace(namespace string) *Query {
+	q = q.clone()
+	q.namespace = namespace
+	return q
+}
+
+// Ancestor restricts the query to the descendants of the given key.
+func (q *Query) Ancestor(ancestor *datastore.Key) *Query {
+	q = q.clone()
+	q.ancestor = ancestor
+	return q
+}
+
+// Filter adds a filter to the query. Filters are combined with AND; use Or
+// for alternatives and Where to adapt a custom DataFilter.
+func (q *Query) Filter(f Filter) *Query {
+	q = q.clone()
+	if f == nil {
+		q.setErr(errors.New("nil filter"))
+		return q
+	}
+	q.filters = append(q.filters, f)
+	return q
+}
+
+// Order adds sort orders to the query, applied in the given sequence.
+// A field prefixed with a minus sign sorts in descending order.
+func (q *Query) Order(fields ...string) *Query {
+	q = q.clone()
+	for _, f := range fields {
+		f = strings.TrimSpace(f)
+		o := order{field: f}
+		if strings.HasPrefix(f, "-") {
+			o = order{field: strings.TrimSpace(f[1:]), desc: true}
+		}
+		if o.field == "" {
+			q.setErr(errors.New("empty sort order"))
+			continue
+		}
+		q.orders = append(q.orders, o)
+	}
+	return q
+}
+
+// Limit caps the number of results. A negative value means unlimited.
+func (q *Query) Limit(limit int) *Query {
+	q = q.clone()
+	q.limit = limit
+	return q
+}
+
+// Offset skips the given number of results.
+func (q *Query) Offset(offset int) *Query {
+	q = q.clone()
+	if offset < 0 {
+		q.setErr(fmt.Errorf("negative offset %d", offset))
+	}
+	q.offset = offset
+	return q
+}
+
+// Project restricts the results to the given properties.
+func (q *Query) Project(fields ...string) *Query {
+	q = q.clone()
+	q.projection = append([]string(nil), fields...)
+	return q
+}
+
+// DistinctOn de-duplicates the results of a projection query with respect to
+// the given properties, which must be a subset of the projection.
+func (q *Query) DistinctOn(fields ...string) *Query {
+	q = q.clone()
+	q.distinctOn = append([]string(nil), fields...)
+	return q
+}
+
+// KeysOnly makes the query yield keys without their entities.
+func (q *Query) KeysOnly() *Query {
+	q = q.clone()
+	q.keysOnly = true
+	return q
+}
+
+// IncludeDeleted makes the query of a SoftDeleteDriver yield the entities
+// that were soft deleted along with the others. Other drivers have none to
+// exclude and ignore it.
+func (q *Query) IncludeDeleted() *Query {
+	q = q.clone()
+	q.includeDeleted = true
+	return q
+}
+
+func (q *Query) setErr(err error) {
+	if q.err == nil {
+		q.err = err
+	}
+}
+
+// Validate reports the first builder error or invalid combination found in
+// the query, as an ErrInvalidArgument.
+func (q *Query) Validate() error {
+	return invalidArgument(q.validate())
+}
+
+func (q *Query) validate() error {
+	if q.err != nil {
+		return fmt.Errorf("invalid query: %w", q.err)
+	}
+
+	if q.ancestor != nil && q.ancestor.Namespace != q.namespace {
+		return fmt.Errorf("invalid query: ancestor namespace %q differs from the query namespace %q", q.ancestor.Namespace, q.namespace)
+	}
+
+	inequality := ""
+	equality := map[string]bool{}
+	for _, f := range q.filters {
+		err := walkFilter(f.EntityFilter(), func(pf datastore.PropertyFilter) error {
+			field, cond := pf.FieldName, strings.TrimSpace(pf.Operator)
+			switch {
+			case field == "":
+				return errors.New("empty filter field")
+			case equalityConditions[cond]:
+				equality[field] = true
+			case inequalityConditions[cond]:
+				if inequality != "" && inequality != field {
+					return fmt.Errorf("inequality filters on %q and %q, only one property is allowed", inequality, field)
+				}
+				inequality = field
+			default:
+				return fmt.Errorf("unknown filter condition %q", pf.Operator)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("invalid query: %w", err)
+		}
+	}
+
+	if inequality != "" && len(q.orders) > 0 && q.orders[0].field != inequality {
+		return fmt.Errorf("invalid query: inequality filter on %q requires it to be the first sort order, got %q", inequality, q.orders[0].field)
+	}
+
+	if q.keysOnly && len(q.projection) > 0 {
+		return errors.New("invalid query: keys-only queries cannot have a projection")
+	}
+
+	projected := map[string]bool{}
+	for _, p := range q.projection {
+		if equality[p] {
+			return fmt.Errorf("invalid query: property %q is used in an equality filter and cannot be projected", p)
+		}
+		projected[p] = true
+	}
+
+	for _, p := range q.distinctOn {
+		if !projected[p] {
+			return fmt.Errorf("invalid query: distinct-on property %q is not projected", p)
+		}
+	}
+
+	return nil
+}
+
+// walkFilter calls visit for every property filter in ef, depth first.
+func walkFilter(ef datastore.EntityFilter, visit func(datastore.PropertyFilter) error) error {
+	var members []datastore.EntityFilter
+	switch f := ef.(type) {
+	case nil:
+		return errors.New("nil filter")
+	case datastore.PropertyFilter:
+		return visit(f)
+	case datastore.AndFilter:
+		members = f.Filters
+	case datastore.OrFilter:
+		members = f.Filters
+	default:
+		return fmt.Errorf("unsupported filter %T", ef)
+	}
+	if len(members) == 0 {
+		return errors.New("empty composite filter")
+	}
+	for _, m := range members {
+		if err := walkFilter(m, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// build validates the query and converts it to a client query.
+func (q *Query) build() (*datastore.Query, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	dq := datastore.NewQuery(q.kind)
+
+	if q.namespace != "" {
+		dq = dq.Namespace(q.namespace)
+	}
+
+	if q.ancestor != nil {
+		dq = dq.Ancestor(q.ancestor)
+	}
+
+	for _, f := range q.filters {
+		dq = dq.FilterEntity(f.EntityFilter())
+	}
+
+	for _, o := range q.orders {
+		dq = dq.Order(o.String())
+	}
+
+	if len(q.projection) > 0 {
+		dq = dq.Project(q.projection...)
+	}
+
+	if len(q.distinctOn) > 0 {
+		dq = dq.DistinctOn(q.distinctOn...)
+	}
+
+	if q.keysOnly {
+		dq = dq.KeysOnly()
+	}
+
+	if q.limit >= 0 {
+		dq = dq.Limit(q.limit)
+	}
+
+	if q.offset > 0 {
+		dq = dq.Offset(q.offset)
+	}
+
+	if q.start.String() != "" {
+		dq = dq.Start(q.start)
+	}
+
+	return dq, nil
+}
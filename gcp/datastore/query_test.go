@@ -0,0 +1,95 @@
+package datastore
+
+import (
+	"testing"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type QueryTestSuite struct {
+	suite.Suite
+}
+
+func TestQueryTestSuite(t *testing.T) {
+	suite.Run(t, new(QueryTestSuite))
+}
+
+func (s *QueryTestSuite) TestBuilderDoesNotMutate() {
+	base := NewQuery("Animal").Filter(Eq("Legs", 4))
+	derived := base.Order("-Name").Limit(10)
+
+	assert.Len(s.T(), base.orders, 0)
+	assert.Equal(s.T(), -1, base.limit)
+	assert.Len(s.T(), derived.orders, 1)
+	assert.Equal(s.T(), "-Name", derived.orders[0].String())
+	assert.Equal(s.T(), 10, derived.limit)
+}
+
+func (s *QueryTestSuite) TestValidate() {
+	cases := []struct {
+		name  string
+		query *Query
+		valid bool
+	}{
+		{"plain", NewQuery("Animal"), true},
+		{"full", NewQuery("Animal").
+			Filter(Gt("Legs", 2)).
+			Order("Legs", "-Name").
+			Project("Legs", "Name").
+			DistinctOn("Legs").
+			Limit(5).Offset(5), true},
+		{"inequality range", NewQuery("Animal").
+			Filter(Gt("Legs", 2)).
+			Filter(Lte("Legs", 8)), true},
+		{"inequality not first order", NewQuery("Animal").
+			Filter(Gt("Legs", 2)).
+			Order("Name", "Legs"), false},
+		{"inequality on two properties", NewQuery("Animal").
+			Filter(Gt("Legs", 2)).
+			Filter(NotEqual("Name", "cat")), false},
+		{"unknown condition", NewQuery("Animal").Filter(Where(testFilter{"Legs", "~", 2})), false},
+		{"empty field", NewQuery("Animal").Filter(Eq("", 2)), false},
+		{"nil filter", NewQuery("Animal").Filter(nil), false},
+		{"empty order", NewQuery("Animal").Order("-"), false},
+		{"negative offset", NewQuery("Animal").Offset(-1), false},
+		{"keys-only projection", NewQuery("Animal").Project("Name").KeysOnly(), false},
+		{"distinct-on not projected", NewQuery("Animal").Project("Name").DistinctOn("Legs"), false},
+		{"or across one inequality", NewQuery("Animal").
+			Filter(Or(Lt("Legs", 2), Gt("Legs", 4))).
+			Order("Legs"), true},
+		{"or across two inequalities", NewQuery("Animal").
+			Filter(Or(Lt("Legs", 2), NotIn("Name", "cat"))), false},
+		{"empty composite", NewQuery("Animal").Filter(And()), false},
+		{"nil composite member", NewQuery("Animal").Filter(Or(Eq("Legs", 2), nil)), false},
+		{"projected equality", NewQuery("Animal").
+			Filter(Eq("Name", "cat")).
+			Project("Name"), false},
+		{"ancestor in namespace", NewQuery("Animal").
+			Namespace("tenant").
+			Ancestor(&datastore.Key{Kind: "Zoo", Name: "north", Namespace: "tenant"}), true},
+		{"ancestor in another namespace", NewQuery("Animal").
+			Ancestor(&datastore.Key{Kind: "Zoo", Name: "north", Namespace: "tenant"}), false},
+	}
+
+	for _, c := range cases {
+		err := c.query.Validate()
+		if c.valid {
+			assert.NoError(s.T(), err, c.name)
+		} else {
+			assert.Error(s.T(), err, c.name)
+		}
+	}
+}
+
+func (s *QueryTestSuite) TestBuild() {
+	q, err := NewQuery("Animal").Order("Name").Limit(3).build()
+	assert.NoError(s.T(), err)
+	assert.NotNil(s.T(), q)
+
+	q, err = NewQuery("Animal").Order("").build()
+	assert.Error(s.T(), err)
+	assert.Nil(s.T(), q)
+}
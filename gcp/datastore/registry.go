@@ -0,0 +1,130 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrRegistryClosed is returned by a Registry once it was closed.
+var ErrRegistryClosed = errors.New("driver registry is closed")
+
+// RegistryKey identifies the drivers of a Registry. An empty DatabaseID is
+// the default database and an empty Namespace the default namespace.
+type RegistryKey struct {
+	ProjectID  string
+	DatabaseID string
+	Namespace  string
+}
+
+// Registry shares one driver per project, database and namespace across a
+// process. The drivers of a project and database share one client, and
+// those of a namespace other than the default one are views confined to
+// it, see NewNamespaceDriver. It is safe for concurrent use.
+type Registry struct {
+	opts []Option
+
+	mu      sync.Mutex
+	clients map[RegistryKey]*registryClient
+	drivers map[RegistryKey]*registryDriver
+	closed  bool
+}
+
+// registryClient is a driver shared by the drivers of a project and
+// database, keyed by them with an empty namespace.
+type registryClient struct {
+	d       Driver
+	drivers int
+}
+
+// registryDriver is a driver of a Registry. Closing it closes the client
+// it shares once no other driver of the registry uses it.
+type registryDriver struct {
+	Driver
+	close func() error
+}
+
+func (d *registryDriver) Close() error {
+	return d.close()
+}
+
+// NewRegistry returns an empty registry whose drivers are created with
+// opts.
+func NewRegistry(opts ...Option) *Registry {
+	return &Registry{
+		opts:    opts,
+		clients: map[RegistryKey]*registryClient{},
+		drivers: map[RegistryKey]*registryDriver{},
+	}
+}
+
+// Driver returns the driver of key, creating it on first use. Closing the
+// returned driver removes it from the registry, so the next call creates a
+// new one.
+func (r *Registry) Driver(ctx context.Context, key RegistryKey) (Driver, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil, ErrRegistryClosed
+	}
+	if d, ok := r.drivers[key]; ok {
+		return d, nil
+	}
+
+	ck := RegistryKey{ProjectID: key.ProjectID, DatabaseID: key.DatabaseID}
+	c, ok := r.clients[ck]
+	if !ok {
+		opts := append(r.opts[:len(r.opts):len(r.opts)], WithDatabase(key.DatabaseID))
+		d, err := newDriver(ctx, key.ProjectID, opts...)
+		if err != nil {
+			return nil, err
+		}
+		c = &registryClient{d: d.intercepted()}
+		r.clients[ck] = c
+	}
+
+	scoped := c.d
+	if key.Namespace != "" {
+		scoped = NewNamespaceDriver(scoped, key.Namespace)
+	}
+	d := &registryDriver{Driver: scoped}
+	d.close = func() error {
+		r.mu.Lock()
+		if r.drivers[key] != d {
+			r.mu.Unlock()
+			return nil
+		}
+		delete(r.drivers, key)
+		c.drivers--
+		if c.drivers > 0 {
+			r.mu.Unlock()
+			return nil
+		}
+		delete(r.clients, ck)
+		r.mu.Unlock()
+		return c.d.Close()
+	}
+	c.drivers++
+	r.drivers[key] = d
+	return d, nil
+}
+
+// Close closes every client of the registry and returns the first error.
+// The registry cannot be used afterwards.
+func (r *Registry) Close() error {
+	r.mu.Lock()
+	clients := r.clients
+	r.clients = map[RegistryKey]*registryClient{}
+	r.drivers = map[RegistryKey]*registryDriver{}
+	r.closed = true
+	r.mu.Unlock()
+
+	var first error
+	for _, c := range clients {
+		if err := c.d.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,118 @@
+package datastore
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/marjau/cloud/gcp/datastore/dstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type RegistryTestSuite struct {
+	suite.Suite
+	srv *dstest.Server
+	r   *Registry
+	ctx context.Context
+}
+
+func TestRegistryTestSuite(t *testing.T) {
+	suite.Run(t, new(RegistryTestSuite))
+}
+
+func (s *RegistryTestSuite) SetupTest() {
+	s.srv = startTestServer(s.T())
+	s.r = NewRegistry()
+	s.ctx = context.Background()
+}
+
+func (s *RegistryTestSuite) TearDownTest() {
+	s.NoError(s.r.Close())
+	s.srv.Close()
+}
+
+func (s *RegistryTestSuite) TestSharedDrivers() {
+	key := RegistryKey{ProjectID: testProjectID}
+	drivers := make([]Driver, 8)
+	var wg sync.WaitGroup
+	for i := range drivers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			d, err := s.r.Driver(s.ctx, key)
+			s.NoError(err)
+			drivers[i] = d
+		}(i)
+	}
+	wg.Wait()
+	for _, d := range drivers {
+		assert.Same(s.T(), drivers[0], d)
+	}
+
+	other, err := s.r.Driver(s.ctx, RegistryKey{ProjectID: "other"})
+	s.Require().NoError(err)
+	assert.NotSame(s.T(), drivers[0], other)
+	tenant, err := s.r.Driver(s.ctx, RegistryKey{ProjectID: testProjectID, Namespace: "tenant"})
+	s.Require().NoError(err)
+	assert.NotSame(s.T(), drivers[0], tenant)
+	assert.Len(s.T(), s.r.clients, 2, "the namespaces of a project share its client")
+}
+
+func (s *RegistryTestSuite) TestSharedClient() {
+	a, err := s.r.Driver(s.ctx, RegistryKey{ProjectID: testProjectID, Namespace: "a"})
+	s.Require().NoError(err)
+	b, err := s.r.Driver(s.ctx, RegistryKey{ProjectID: testProjectID, Namespace: "b"})
+	s.Require().NoError(err)
+	s.Require().Len(s.r.clients, 1)
+
+	s.Require().NoError(a.Close())
+	_, err = b.Create(s.ctx, datastore.NameKey("Animal", "cat", nil), &Animal{Name: "cat"})
+	assert.NoError(s.T(), err, "closing a namespace leaves the client open for the others")
+	s.Require().NoError(b.Close())
+	assert.Empty(s.T(), s.r.clients, "the last driver closes the client")
+}
+
+func (s *RegistryTestSuite) TestCloseDriver() {
+	key := RegistryKey{ProjectID: testProjectID}
+	d, err := s.r.Driver(s.ctx, key)
+	s.Require().NoError(err)
+	s.Require().NoError(d.Close())
+	assert.NoError(s.T(), d.Close(), "closing twice is harmless")
+
+	// A closed driver is replaced by a working one.
+	next, err := s.r.Driver(s.ctx, key)
+	s.Require().NoError(err)
+	assert.NotSame(s.T(), d, next)
+	_, err = next.Create(s.ctx, datastore.NameKey("Animal", "cat", nil), &Animal{Name: "cat"})
+	assert.NoError(s.T(), err)
+}
+
+func (s *RegistryTestSuite) TestNamespace() {
+	tenant, err := s.r.Driver(s.ctx, RegistryKey{ProjectID: testProjectID, Namespace: "tenant"})
+	s.Require().NoError(err)
+	k := datastore.NameKey("Animal", "cat", nil)
+	k.Namespace = "tenant"
+	_, err = tenant.Create(s.ctx, k, &Animal{Name: "cat"})
+	s.Require().NoError(err)
+
+	ids, err := tenant.FindIds(s.ctx, NewQuery("Animal"))
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), []string{k.Encode()}, ids)
+
+	d, err := s.r.Driver(s.ctx, RegistryKey{ProjectID: testProjectID})
+	s.Require().NoError(err)
+	ids, err = d.FindIds(s.ctx, NewQuery("Animal"))
+	assert.NoError(s.T(), err)
+	assert.Empty(s.T(), ids)
+}
+
+func (s *RegistryTestSuite) TestClose() {
+	_, err := s.r.Driver(s.ctx, RegistryKey{ProjectID: testProjectID})
+	s.Require().NoError(err)
+	s.Require().NoError(s.r.Close())
+
+	_, err = s.r.Driver(s.ctx, RegistryKey{ProjectID: testProjectID})
+	assert.Equal(s.T(), ErrRegistryClosed, err)
+}
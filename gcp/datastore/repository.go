@@ -0,0 +1,173 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// Entity is a typed entity together with its key.
+type Entity[T any] struct {
+	Key   *datastore.Key
+	Value T
+}
+
+// Repository gives type-safe access to the entities of one kind through a
+// Driver. T is the struct the entities load into; *T may implement
+// datastore.PropertyLoadSaver.
+type Repository[T any] struct {
+	driver Driver
+	kind   string
+}
+
+// NewRepository binds a repository of T to the given kind.
+func NewRepository[T any](d Driver, kind string) *Repository[T] {
+	return &Repository[T]{driver: d, kind: kind}
+}
+
+// Kind returns the kind the repository is bound to.
+func (r *Repository[T]) Kind() string {
+	return r.kind
+}
+
+// Query starts a query over the repository kind.
+func (r *Repository[T]) Query() *Query {
+	return NewQuery(r.kind)
+}
+
+// NameKey returns a key of the repository kind with a string ID.
+func (r *Repository[T]) NameKey(name string, parent *datastore.Key) *datastore.Key {
+	return datastore.NameKey(r.kind, name, parent)
+}
+
+// IDKey returns a key of the repository kind with a numeric ID.
+func (r *Repository[T]) IDKey(id int64, parent *datastore.Key) *datastore.Key {
+	return datastore.IDKey(r.kind, id, parent)
+}
+
+// IncompleteKey returns a key of the repository kind whose ID is allocated
+// when the entity is saved.
+func (r *Repository[T]) IncompleteKey(parent *datastore.Key) *datastore.Key {
+	return datastore.IncompleteKey(r.kind, parent)
+}
+
+func (r *Repository[T]) checkKey(key *datastore.Key) error {
+	if key == nil {
+		return invalidArgument(fmt.Errorf("repository %s: nil key", r.kind))
+	}
+	if key.Kind != r.kind {
+		return invalidArgument(fmt.Errorf("repository %s: key of kind %q", r.kind, key.Kind))
+	}
+	return nil
+}
+
+func (r *Repository[T]) checkQuery(q *Query) (*Query, error) {
+	if q == nil {
+		return r.Query(), nil
+	}
+	if q.Kind() != r.kind {
+		return nil, invalidArgument(fmt.Errorf("repository %s: query of kind %q", r.kind, q.Kind()))
+	}
+	return q, nil
+}
+
+// Get loads the entity stored under key.
+func (r *Repository[T]) Get(ctx context.Context, key *datastore.Key) (Entity[T], error) {
+	e := Entity[T]{Key: key}
+	if err := r.checkKey(key); err != nil {
+		return e, err
+	}
+	err := r.driver.Get(ctx, key, &e.Value)
+	return e, err
+}
+
+// List loads every entity matched by q, or the whole kind when q is nil.
+func (r *Repository[T]) List(ctx context.Context, q *Query) ([]Entity[T], error) {
+	it, err := r.Iterate(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	var entities []Entity[T]
+	for {
+		e, err := it.Next()
+		if err == iterator.Done {
+			return entities, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, e)
+	}
+}
+
+// ListPage loads one page of the entities matched by q and returns the
+// token of the next page.
+func (r *Repository[T]) ListPage(ctx context.Context, q *Query, pageSize int, pageToken string) ([]Entity[T], string, error) {
+	q, err := r.checkQuery(q)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var values []T
+	page, err := r.driver.FindPage(ctx, q, pageSize, pageToken, &values)
+	if err != nil {
+		return nil, "", err
+	}
+
+	entities := make([]Entity[T], 0, len(values))
+	for i, v := range values {
+		entities = append(entities, Entity[T]{Key: page.Keys[i], Value: v})
+	}
+	return entities, page.NextPageToken, nil
+}
+
+// Save stores value under key and returns the complete key, allocating an
+// ID when key is incomplete.
+func (r *Repository[T]) Save(ctx context.Context, key *datastore.Key, value T) (*datastore.Key, error) {
+	if err := r.checkKey(key); err != nil {
+		return nil, err
+	}
+	return r.driver.Put(ctx, key, &value)
+}
+
+// Delete removes the entity stored under key.
+func (r *Repository[T]) Delete(ctx context.Context, key *datastore.Key) error {
+	if err := r.checkKey(key); err != nil {
+		return err
+	}
+	return r.driver.Delete(ctx, key)
+}
+
+// Iterate runs q, or a query over the whole kind when q is nil, and returns
+// a typed iterator over its results.
+func (r *Repository[T]) Iterate(ctx context.Context, q *Query) (*EntityIterator[T], error) {
+	q, err := r.checkQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	it, err := r.driver.Find(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return &EntityIterator[T]{it: it}, nil
+}
+
+// EntityIterator yields the typed results of a repository query.
+type EntityIterator[T any] struct {
+	it Iterator
+}
+
+// Next returns the next entity. When there are no more results,
+// iterator.Done is returned as the error.
+func (it *EntityIterator[T]) Next() (Entity[T], error) {
+	var e Entity[T]
+	key, err := it.it.Next(&e.Value)
+	if err != nil {
+		return Entity[T]{}, err
+	}
+	e.Key = key
+	return e, nil
+}
@@ -0,0 +1,140 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/api/iterator"
+)
+
+type RepositoryTestSuite struct {
+	suite.Suite
+	r   *Repository[Animal]
+	ctx context.Context
+}
+
+func TestRepositoryTestSuite(t *testing.T) {
+	suite.Run(t, new(RepositoryTestSuite))
+}
+
+func (s *RepositoryTestSuite) SetupTest() {
+	s.r = NewRepository[Animal](NewMemoryDriver(), "Animal")
+	s.ctx = context.Background()
+}
+
+func (s *RepositoryTestSuite) TestKeys() {
+	parent := datastore.NameKey("Zoo", "north", nil)
+
+	k := s.r.NameKey("cat", parent)
+	assert.Equal(s.T(), "Animal", k.Kind)
+	assert.Equal(s.T(), "cat", k.Name)
+	assert.Equal(s.T(), parent, k.Parent)
+
+	assert.Equal(s.T(), int64(7), s.r.IDKey(7, nil).ID)
+	assert.True(s.T(), s.r.IncompleteKey(nil).Incomplete())
+	assert.Equal(s.T(), "Animal", s.r.Query().Kind())
+}
+
+func (s *RepositoryTestSuite) TestRejectsOtherKinds() {
+	ctx := context.Background()
+	other := datastore.NameKey("Plant", "fern", nil)
+
+	_, err := s.r.Get(ctx, other)
+	assert.Error(s.T(), err)
+
+	_, err = s.r.Save(ctx, other, Animal{Name: "fern"})
+	assert.Error(s.T(), err)
+
+	assert.Error(s.T(), s.r.Delete(ctx, other))
+	assert.Error(s.T(), s.r.Delete(ctx, nil))
+
+	_, err = s.r.List(ctx, NewQuery("Plant"))
+	assert.Error(s.T(), err)
+
+	_, _, err = s.r.ListPage(ctx, NewQuery("Plant"), 10, "")
+	assert.Error(s.T(), err)
+}
+
+// saveAnimals stores animals with legs 1 to n under the IDs 1 to n.
+func (s *RepositoryTestSuite) saveAnimals(n int) {
+	for i := 1; i <= n; i++ {
+		_, err := s.r.Save(s.ctx, s.r.IDKey(int64(i), nil), Animal{Name: fmt.Sprintf("animal %d", i), Legs: i})
+		s.Require().NoError(err)
+	}
+}
+
+func (s *RepositoryTestSuite) TestRoundTrip() {
+	k, err := s.r.Save(s.ctx, s.r.IncompleteKey(nil), Animal{Name: "cat", Legs: 4})
+	s.Require().NoError(err)
+	s.Require().False(k.Incomplete())
+
+	e, err := s.r.Get(s.ctx, k)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), Entity[Animal]{Key: k, Value: Animal{Name: "cat", Legs: 4}}, e)
+
+	s.Require().NoError(s.r.Delete(s.ctx, k))
+	_, err = s.r.Get(s.ctx, k)
+	assert.ErrorIs(s.T(), err, ErrNotFound)
+	_, err = s.r.Get(s.ctx, s.r.NameKey("dog", nil))
+	assert.ErrorIs(s.T(), err, ErrNotFound)
+}
+
+func (s *RepositoryTestSuite) TestList() {
+	s.saveAnimals(3)
+
+	all, err := s.r.List(s.ctx, nil)
+	s.Require().NoError(err)
+	s.Require().Len(all, 3)
+	assert.Equal(s.T(), s.r.IDKey(1, nil), all[0].Key)
+	assert.Equal(s.T(), "animal 1", all[0].Value.Name)
+
+	some, err := s.r.List(s.ctx, s.r.Query().Filter(Gte("Legs", 2)).Order("-Legs"))
+	s.Require().NoError(err)
+	s.Require().Len(some, 2)
+	assert.Equal(s.T(), []int{3, 2}, []int{some[0].Value.Legs, some[1].Value.Legs})
+}
+
+func (s *RepositoryTestSuite) TestListPage() {
+	s.saveAnimals(5)
+
+	var legs []int
+	token := ""
+	for pages := 0; ; pages++ {
+		s.Require().Less(pages, 3)
+		page, next, err := s.r.ListPage(s.ctx, s.r.Query().Order("Legs"), 2, token)
+		s.Require().NoError(err)
+		for _, e := range page {
+			s.Require().Equal(e.Value.Legs, int(e.Key.ID))
+			legs = append(legs, e.Value.Legs)
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	assert.Equal(s.T(), []int{1, 2, 3, 4, 5}, legs)
+}
+
+func (s *RepositoryTestSuite) TestIterate() {
+	s.saveAnimals(3)
+
+	it, err := s.r.Iterate(s.ctx, s.r.Query().Order("Legs"))
+	s.Require().NoError(err)
+	e, err := it.Next()
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 1, e.Value.Legs)
+	e, err = it.Next()
+	s.Require().NoError(err)
+	assert.Equal(s.T(), s.r.IDKey(2, nil), e.Key, "the iteration can stop early")
+
+	it, err = s.r.Iterate(s.ctx, s.r.Query().Filter(Gt("Legs", 2)))
+	s.Require().NoError(err)
+	_, err = it.Next()
+	s.Require().NoError(err)
+	_, err = it.Next()
+	assert.Equal(s.T(), iterator.Done, err)
+}
@@ -0,0 +1,170 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy controls how the driver retries operations that fail with a
+// transient error. Idempotent operations are retried on their own; writes
+// that would store a new entity on every attempt, such as a Put of an
+// incomplete key, are only retried as part of a transaction, which is
+// attempted again as a whole.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts, the first one included. One or
+	// less disables retries.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between two attempts.
+	MaxBackoff time.Duration
+	// Multiplier grows the wait after each retry. Values below one are
+	// treated as one.
+	Multiplier float64
+	// Jitter is the fraction of each wait, between 0 and 1, drawn at random
+	// so that clients failing together do not retry together.
+	Jitter float64
+	// OnRetry, when set, is called before each retry with the name of the
+	// operation, the attempt that failed and its error.
+	OnRetry func(op string, attempt int, err error)
+}
+
+// DefaultRetryPolicy is the policy of drivers created without
+// WithRetryPolicy.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    4,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.5,
+}
+
+// WithRetryPolicy replaces the default retry policy of the driver.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(d *driver) {
+		d.retry = p
+	}
+}
+
+// backoff returns the wait after the given failed attempt.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	mult := p.Multiplier
+	if mult < 1 {
+		mult = 1
+	}
+	wait := float64(p.InitialBackoff) * math.Pow(mult, float64(attempt-1))
+	if p.MaxBackoff > 0 && wait > float64(p.MaxBackoff) {
+		wait = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		jitter := p.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		wait -= jitter * rand.Float64() * wait
+	}
+	return time.Duration(wait)
+}
+
+// RetryError is returned by an operation that failed after more than one
+// attempt. It wraps the error of the last attempt.
+type RetryError struct {
+	Op       string
+	Attempts int
+	Err      error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%s failed after %d attempts: %v", e.Op, e.Attempts, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// Attempts returns how many attempts the operation that returned err made:
+// zero for a nil error and one unless err is a RetryError.
+func Attempts(err error) int {
+	var re *RetryError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &re):
+		return re.Attempts
+	}
+	return 1
+}
+
+// IsTransient reports whether err is a failure that may succeed when
+// attempted again: an Unavailable, DeadlineExceeded or Aborted status.
+func IsTransient(err error) bool {
+	var se interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &se) {
+		return false
+	}
+	switch se.GRPCStatus().Code() {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// finalError is returned by an attempt of do to stop the retries, whatever
+// err is. do returns err in its place.
+type finalError struct {
+	err error
+}
+
+func (e finalError) Error() string {
+	return e.err.Error()
+}
+
+// do runs f, each attempt with its own default timeout, until it succeeds,
+// fails with an error that is not transient or exhausts the attempts of the
+// policy. An operation that is not idempotent is attempted once, and one
+// returning a finalError is not attempted again. The error returned is
+// classified under its kind.
+func (d *driver) do(ctx context.Context, op string, idempotent bool, f func(ctx context.Context) error) error {
+	p := d.retry
+	for attempt := 1; ; attempt++ {
+		err := d.attempt(ctx, f)
+		if err == nil {
+			return nil
+		}
+		fe, final := err.(finalError)
+		if final {
+			err = fe.err
+		}
+		if final || !idempotent || attempt >= p.MaxAttempts || !IsTransient(err) || ctx.Err() != nil {
+			if attempt > 1 {
+				return &RetryError{Op: op, Attempts: attempt, Err: wrapError(err)}
+			}
+			return wrapError(err)
+		}
+
+		if p.OnRetry != nil {
+			p.OnRetry(op, attempt, err)
+		}
+		t := time.NewTimer(p.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return &RetryError{Op: op, Attempts: attempt, Err: wrapError(err)}
+		case <-t.C:
+		}
+	}
+}
+
+func (d *driver) attempt(ctx context.Context, f func(ctx context.Context) error) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+
+	return f(ctx)
+}
@@ -0,0 +1,201 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/marjau/cloud/gcp/datastore/dstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type RetryTestSuite struct {
+	suite.Suite
+	srv     *dstest.Server
+	d       Driver
+	ctx     context.Context
+	retries []string
+}
+
+func TestRetryTestSuite(t *testing.T) {
+	suite.Run(t, new(RetryTestSuite))
+}
+
+func (s *RetryTestSuite) SetupTest() {
+	s.srv = startTestServer(s.T())
+	s.ctx = context.Background()
+	s.retries = nil
+	d, err := NewDriver(s.ctx, testProjectID, WithRetryPolicy(RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		Multiplier:     2,
+		OnRetry: func(op string, attempt int, err error) {
+			s.retries = append(s.retries, fmt.Sprintf("%s#%d", op, attempt))
+		},
+	}))
+	s.Require().NoError(err)
+	s.d = d
+	s.T().Cleanup(func() {
+		d.Close()
+		s.srv.Close()
+	})
+
+	s.Require().NoError(s.d.Update(s.ctx, datastore.NameKey("Animal", "cat", nil), &Animal{Name: "cat", Legs: 4}))
+}
+
+func (s *RetryTestSuite) TestBackoff() {
+	p := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 3}
+	assert.Equal(s.T(), 100*time.Millisecond, p.backoff(1))
+	assert.Equal(s.T(), 300*time.Millisecond, p.backoff(2))
+	assert.Equal(s.T(), 900*time.Millisecond, p.backoff(3))
+	assert.Equal(s.T(), time.Second, p.backoff(4))
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		wait := p.backoff(2)
+		assert.GreaterOrEqual(s.T(), wait, 150*time.Millisecond)
+		assert.LessOrEqual(s.T(), wait, 300*time.Millisecond)
+	}
+}
+
+func (s *RetryTestSuite) TestIsTransient() {
+	assert.True(s.T(), IsTransient(status.Error(codes.Unavailable, "")))
+	assert.True(s.T(), IsTransient(fmt.Errorf("wrapped: %w", status.Error(codes.Aborted, ""))))
+	assert.False(s.T(), IsTransient(status.Error(codes.InvalidArgument, "")))
+	assert.False(s.T(), IsTransient(datastore.ErrNoSuchEntity))
+	assert.False(s.T(), IsTransient(nil))
+}
+
+func (s *RetryTestSuite) TestRetryIdempotent() {
+	s.srv.Fail("Lookup", codes.Aborted, 2)
+	var a Animal
+	assert.NoError(s.T(), s.d.Get(s.ctx, datastore.NameKey("Animal", "cat", nil), &a))
+	assert.Equal(s.T(), "cat", a.Name)
+	assert.Equal(s.T(), []string{"Get#1", "Get#2"}, s.retries)
+
+	s.srv.Fail("Commit", codes.DeadlineExceeded, 1)
+	assert.NoError(s.T(), s.d.Update(s.ctx, datastore.NameKey("Animal", "dog", nil), &Animal{Name: "dog"}))
+}
+
+func (s *RetryTestSuite) TestAttemptsExhausted() {
+	s.srv.Fail("Lookup", codes.Aborted, 3)
+	var a Animal
+	err := s.d.Get(s.ctx, datastore.NameKey("Animal", "cat", nil), &a)
+	var re *RetryError
+	s.Require().ErrorAs(err, &re)
+	assert.Equal(s.T(), "Get", re.Op)
+	assert.Equal(s.T(), 3, Attempts(err))
+	assert.Equal(s.T(), codes.Aborted, status.Code(re.Err))
+}
+
+func (s *RetryTestSuite) TestPermanentError() {
+	s.srv.Fail("Lookup", codes.InvalidArgument, 1)
+	var a Animal
+	err := s.d.Get(s.ctx, datastore.NameKey("Animal", "cat", nil), &a)
+	assert.Equal(s.T(), codes.InvalidArgument, status.Code(err))
+	assert.Equal(s.T(), 1, Attempts(err))
+	assert.Empty(s.T(), s.retries)
+
+	err = s.d.Get(s.ctx, datastore.NameKey("Animal", "cow", nil), &a)
+	assert.ErrorIs(s.T(), err, datastore.ErrNoSuchEntity)
+}
+
+func (s *RetryTestSuite) TestNonIdempotentNotRetried() {
+	s.srv.Fail("Commit", codes.Aborted, 1)
+	_, err := s.d.Put(s.ctx, datastore.IncompleteKey("Animal", nil), &Animal{Name: "cow"})
+	assert.Equal(s.T(), codes.Aborted, status.Code(err))
+	assert.Empty(s.T(), s.retries)
+
+	s.srv.Fail("Commit", codes.Aborted, 1)
+	err = s.d.Update(s.ctx, datastore.IncompleteKey("Animal", nil), &Animal{Name: "cow"})
+	assert.Equal(s.T(), codes.Aborted, status.Code(err))
+	assert.Empty(s.T(), s.retries)
+
+	s.srv.Fail("Commit", codes.Aborted, 1)
+	keys := []*datastore.Key{datastore.NameKey("Animal", "cow", nil), datastore.IncompleteKey("Animal", nil)}
+	_, err = s.d.PutMulti(s.ctx, keys, []Animal{{Name: "cow"}, {Name: "pig"}})
+	assert.Error(s.T(), err)
+	assert.Empty(s.T(), s.retries)
+
+	n, err := s.d.Count(s.ctx, NewQuery("Animal"))
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(1), n)
+}
+
+func (s *RetryTestSuite) TestTransactionRetried() {
+	s.srv.Fail("Commit", codes.DeadlineExceeded, 1)
+	calls := 0
+	err := s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		calls++
+		var a Animal
+		if err := tx.Get(datastore.NameKey("Animal", "cat", nil), &a); err != nil {
+			return err
+		}
+		_, err := tx.Put(datastore.IncompleteKey("Animal", nil), &Animal{Name: "kitten"})
+		return err
+	})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 2, calls)
+	assert.Equal(s.T(), []string{"RunInTransaction#1"}, s.retries)
+
+	n, err := s.d.Count(s.ctx, NewQuery("Animal"))
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(2), n, "the failed attempt stored nothing")
+
+	s.srv.Fail("BeginTransaction", codes.DeadlineExceeded, 1)
+	calls = 0
+	err = s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		calls++
+		return nil
+	})
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 1, calls, "f did not run in the attempt that failed to begin")
+	assert.Equal(s.T(), []string{"RunInTransaction#1", "RunInTransaction#1"}, s.retries)
+}
+
+func (s *RetryTestSuite) TestTransactionErrorNotRetried() {
+	s.srv.Fail("Lookup", codes.Aborted, 1)
+	calls := 0
+	err := s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		calls++
+		var a Animal
+		return tx.Get(datastore.NameKey("Animal", "cat", nil), &a)
+	})
+	assert.Equal(s.T(), codes.Aborted, status.Code(err), "errors of f are returned as they are, transient or not")
+	assert.Equal(s.T(), 1, calls)
+	assert.Equal(s.T(), 1, Attempts(err))
+
+	boom := errors.New("boom")
+	calls = 0
+	err = s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		calls++
+		return boom
+	})
+	assert.Equal(s.T(), boom, err)
+	assert.Equal(s.T(), 1, calls)
+	assert.Empty(s.T(), s.retries)
+}
+
+func (s *RetryTestSuite) TestBatchAndPages() {
+	keys := []*datastore.Key{datastore.NameKey("Animal", "dog", nil), datastore.NameKey("Animal", "bird", nil)}
+	s.srv.Fail("Commit", codes.Aborted, 1)
+	s.Require().NoError(s.d.UpdateMulti(s.ctx, keys, []Animal{{Name: "dog"}, {Name: "bird"}}))
+
+	s.srv.Fail("Lookup", codes.Aborted, 1)
+	got := make([]Animal, len(keys))
+	s.Require().NoError(s.d.GetMulti(s.ctx, keys, got))
+	assert.Equal(s.T(), "bird", got[1].Name)
+
+	s.srv.Fail("RunQuery", codes.Aborted, 1)
+	var page []Animal
+	_, err := s.d.FindPage(s.ctx, NewQuery("Animal"), 10, "", &page)
+	s.Require().NoError(err)
+	assert.Len(s.T(), page, 3)
+	assert.Equal(s.T(), []string{"UpdateMulti#1", "GetMulti#1", "FindPage#1"}, s.retries)
+}
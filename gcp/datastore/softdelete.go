@@ -0,0 +1,687 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// DeletedAtProperty is the property a SoftDeleteDriver stamps on the
+// entities it deletes, holding the time of the deletion. Entities carrying
+// it are tombstones, unless it holds the zero time. To read it along with
+// the other properties of a tombstone, give the struct a field tagged
+// `datastore:"_deletedAt"`; live entities save it as the zero time.
+const DeletedAtProperty = "_deletedAt"
+
+var _ Driver = (*SoftDeleteDriver)(nil)
+
+// SoftDeleteDriver is a Driver whose deletes can be undone. Delete and
+// DeleteMulti, in or out of transactions, stamp the entities with
+// DeletedAtProperty instead of removing them. The tombstones left are
+// invisible to lookups, which report them as ErrNotFound, and to queries,
+// unless the query calls IncludeDeleted. Restore brings them back and Purge
+// deletes them for good.
+//
+// Writes replace tombstones like any entity, which brings them back too.
+// Queries skip the tombstones they read, reading on in chunks until their
+// limit is filled, so Purge keeps them cheap. Keys-only queries tell the
+// tombstones apart by the keys of those matching the query, read with a
+// keys-only query of their own; projections look the entities up.
+type SoftDeleteDriver struct {
+	d Driver
+}
+
+// NewSoftDeleteDriver returns d with soft deletes. Closing it closes d.
+func NewSoftDeleteDriver(d Driver) *SoftDeleteDriver {
+	return &SoftDeleteDriver{d: d}
+}
+
+// deletedAt returns the deletion time of a tombstone. A zero time marks a
+// live entity.
+func deletedAt(props []datastore.Property) (time.Time, bool) {
+	for _, p := range props {
+		if t, ok := p.Value.(time.Time); ok && p.Name == DeletedAtProperty && !t.IsZero() {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// withoutDeletedAt returns props without DeletedAtProperty.
+func withoutDeletedAt(props datastore.PropertyList) datastore.PropertyList {
+	live := props[:0]
+	for _, p := range props {
+		if p.Name != DeletedAtProperty {
+			live = append(live, p)
+		}
+	}
+	return live
+}
+
+// liveChunkSize is the most results a SoftDeleteDriver reads at once to
+// skip the tombstones among them.
+const liveChunkSize = 300
+
+func (s *SoftDeleteDriver) Find(ctx context.Context, q *Query) (Iterator, error) {
+	if q.includeDeleted {
+		return s.d.Find(ctx, q)
+	}
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	return s.find(ctx, q, datastore.Cursor{}), nil
+}
+
+// find runs q from start without its tombstones. The offset and the limit
+// of q are applied to the live entities.
+func (s *SoftDeleteDriver) find(ctx context.Context, q *Query, start datastore.Cursor) *liveIterator {
+	it := &liveIterator{
+		ctx:      ctx,
+		d:        s.d,
+		q:        q.Offset(0),
+		keysOnly: q.keysOnly,
+		lookup:   len(q.projection) > 0,
+		skip:     q.offset,
+		limit:    q.limit,
+		start:    start,
+		cursor:   start,
+	}
+	if q.keysOnly {
+		it.tombstoneQuery = tombstoneKeysQuery(q)
+	}
+	// Keys-only queries whose tombstones cannot be queried read the
+	// entities to tell them apart.
+	it.q.keysOnly = it.tombstoneQuery != nil
+	return it
+}
+
+// tombstoneKeysQuery returns the keys-only query of all the tombstones
+// matching the filters of q, or when those cannot be combined with the
+// marker, of all the tombstones of its kind and ancestor. It returns nil if
+// there is none, as for kindless queries, which cannot filter properties.
+func tombstoneKeysQuery(q *Query) *Query {
+	if q.kind == "" {
+		return nil
+	}
+	tq := q.clone()
+	tq.orders, tq.limit, tq.offset, tq.start = nil, -1, 0, datastore.Cursor{}
+	tq = tq.KeysOnly().Filter(Gt(DeletedAtProperty, time.Time{}))
+	if tq.Validate() == nil {
+		return tq
+	}
+	tq = NewQuery(q.kind).Namespace(q.namespace).KeysOnly().Filter(Gt(DeletedAtProperty, time.Time{}))
+	if q.ancestor != nil {
+		tq = tq.Ancestor(q.ancestor)
+	}
+	if tq.Validate() != nil {
+		return nil
+	}
+	return tq
+}
+
+// liveResult is a result read by a liveIterator.
+type liveResult struct {
+	key     *datastore.Key
+	props   datastore.PropertyList
+	cursor  datastore.Cursor
+	deleted bool
+}
+
+// liveIterator skips the tombstones among the results of a query. It reads
+// them in chunks of liveChunkSize at most, and no more than its limit still
+// needs, each resuming at the cursor of the previous one.
+type liveIterator struct {
+	ctx      context.Context
+	d        Driver
+	q        *Query
+	keysOnly bool
+	// lookup is set for projections, whose results lack the marker of
+	// their entity.
+	lookup bool
+	// tombstoneQuery is set for keys-only queries, and tombstones holds
+	// the keys it returned, by memoryKey, once read.
+	tombstoneQuery *Query
+	tombstones     map[string]bool
+
+	skip     int
+	limit    int
+	returned int
+	results  []liveResult
+	start    datastore.Cursor
+	done     bool
+	cursor   datastore.Cursor
+}
+
+func (it *liveIterator) Next(dst interface{}) (*datastore.Key, error) {
+	for {
+		if it.limit >= 0 && it.returned >= it.limit {
+			return nil, iterator.Done
+		}
+		if len(it.results) == 0 {
+			if it.done {
+				return nil, iterator.Done
+			}
+			if err := it.read(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		r := it.results[0]
+		it.results = it.results[1:]
+		it.cursor = r.cursor
+		if r.deleted {
+			continue
+		}
+		if it.skip > 0 {
+			it.skip--
+			continue
+		}
+		it.returned++
+		if dst == nil || it.keysOnly {
+			return r.key, nil
+		}
+		return r.key, loadEntity(dst, r.key, r.props)
+	}
+}
+
+// read reads the next chunk of results.
+func (it *liveIterator) read() error {
+	n := liveChunkSize
+	if left := it.limit - it.returned + it.skip; it.limit >= 0 && left < n {
+		n = left
+	}
+	if it.tombstoneQuery != nil && it.tombstones == nil {
+		keys, err := it.d.FindKeys(it.ctx, it.tombstoneQuery)
+		if err != nil {
+			return err
+		}
+		it.tombstones = make(map[string]bool, len(keys))
+		for _, k := range keys {
+			it.tombstones[memoryKey(k)] = true
+		}
+	}
+
+	q := it.q.Limit(n)
+	q.start = it.start
+	rit, err := it.d.Find(it.ctx, q)
+	if err != nil {
+		return err
+	}
+	var results []liveResult
+	for {
+		var props datastore.PropertyList
+		var dst interface{} = &props
+		if q.keysOnly {
+			dst = nil
+		}
+		key, err := rit.Next(dst)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		cursor, err := rit.Cursor()
+		if err != nil {
+			return err
+		}
+		deleted := hasDeletedAt(props)
+		if q.keysOnly {
+			deleted = it.tombstones[memoryKey(key)]
+		}
+		results = append(results, liveResult{key: key, props: props, cursor: cursor, deleted: deleted})
+	}
+	if it.lookup && len(results) > 0 {
+		if err := it.lookUp(results); err != nil {
+			return err
+		}
+	}
+
+	it.results, it.done = results, len(results) < n
+	if len(results) > 0 {
+		it.start = results[len(results)-1].cursor
+	}
+	return nil
+}
+
+// lookUp marks the results whose entities are tombstones, or are gone.
+func (it *liveIterator) lookUp(results []liveResult) error {
+	keys := make([]*datastore.Key, len(results))
+	for i, r := range results {
+		keys[i] = r.key
+	}
+	loaded := make([]datastore.PropertyList, len(keys))
+	err := it.d.GetMulti(it.ctx, keys, loaded)
+	me, ok := err.(datastore.MultiError)
+	if err != nil && !ok {
+		return err
+	}
+	for i := range results {
+		switch {
+		case ok && errors.Is(me[i], ErrNotFound):
+			results[i].deleted = true
+		case ok && me[i] != nil:
+			return me[i]
+		default:
+			results[i].deleted = hasDeletedAt(loaded[i])
+		}
+	}
+	return nil
+}
+
+// Cursor returns the position after the last result read, which may be a
+// tombstone following the last result returned.
+func (it *liveIterator) Cursor() (datastore.Cursor, error) {
+	return it.cursor, nil
+}
+
+func (s *SoftDeleteDriver) FindIds(ctx context.Context, q *Query) ([]string, error) {
+	keys, err := s.FindKeys(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeKeys(keys), nil
+}
+
+func (s *SoftDeleteDriver) FindKeys(ctx context.Context, q *Query) ([]*datastore.Key, error) {
+	if q.includeDeleted {
+		return s.d.FindKeys(ctx, q)
+	}
+	it, err := s.Find(ctx, q.KeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	var keys []*datastore.Key
+	for {
+		k, err := it.Next(nil)
+		if err == iterator.Done {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+}
+
+func (s *SoftDeleteDriver) FindPage(ctx context.Context, q *Query, pageSize int, pageToken string, dst interface{}) (*Page, error) {
+	if q.includeDeleted {
+		return s.d.FindPage(ctx, q, pageSize, pageToken, dst)
+	}
+	q, start, err := pageRequest(q, pageSize, pageToken)
+	if err != nil {
+		return nil, err
+	}
+	return readPage(s.find(ctx, q, start), pageSize, dst)
+}
+
+func (s *SoftDeleteDriver) FindIdsPage(ctx context.Context, q *Query, pageSize int, pageToken string) ([]string, string, error) {
+	page, err := s.FindPage(ctx, q, pageSize, pageToken, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return page.Ids(), page.NextPageToken, nil
+}
+
+// Aggregate subtracts the counts and sums of the tombstones of q from those
+// of all its results, both computed by the driver. Averages, and the
+// aggregates of queries with a limit, an offset or an inequality filter,
+// are computed from the live entities, read in chunks, or from their keys
+// when only counts are asked for.
+func (s *SoftDeleteDriver) Aggregate(ctx context.Context, q *Query, aggs ...Aggregation) (AggregationResult, error) {
+	if q.includeDeleted {
+		return s.d.Aggregate(ctx, q, aggs...)
+	}
+	if err := validateAggregations(q, aggs); err != nil {
+		return nil, err
+	}
+	if tq := tombstoneQuery(q, aggs); tq != nil {
+		all, err := s.d.Aggregate(ctx, q, aggs...)
+		if err != nil {
+			return nil, err
+		}
+		deleted, err := s.d.Aggregate(ctx, tq, aggs...)
+		if err != nil {
+			return nil, err
+		}
+		return subtractAggregates(all, deleted), nil
+	}
+
+	countsOnly := len(q.projection) == 0
+	for _, agg := range aggs {
+		countsOnly = countsOnly && agg.op == "count"
+	}
+	if countsOnly {
+		q = q.KeysOnly()
+	}
+	a := newAggregator(aggs)
+	it := s.find(ctx, q, datastore.Cursor{})
+	for {
+		var props datastore.PropertyList
+		k, err := it.Next(&props)
+		if err == iterator.Done {
+			return a.result(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		a.add(func(field string) (interface{}, bool) {
+			return indexedValue(k, props, field)
+		})
+	}
+}
+
+// tombstoneQuery returns the query of the tombstones of q whose aggs can be
+// subtracted from those of q, or nil if they cannot.
+func tombstoneQuery(q *Query, aggs []Aggregation) *Query {
+	if q.limit >= 0 || q.offset > 0 {
+		return nil
+	}
+	for _, a := range aggs {
+		if a.op == "avg" {
+			return nil
+		}
+	}
+	tq := q.clone()
+	tq.orders = nil
+	tq = tq.Filter(Gt(DeletedAtProperty, time.Time{}))
+	if tq.Validate() != nil {
+		return nil
+	}
+	return tq
+}
+
+// subtractAggregates returns the counts and sums of all less those of
+// deleted.
+func subtractAggregates(all, deleted AggregationResult) AggregationResult {
+	live := AggregationResult{}
+	for alias, v := range all {
+		x, xInt := v.(int64)
+		y, yInt := deleted[alias].(int64)
+		if xInt && yInt {
+			live[alias] = x - y
+			continue
+		}
+		xf, _ := all.Float(alias)
+		yf, _ := deleted.Float(alias)
+		live[alias] = xf - yf
+	}
+	return live
+}
+
+func (s *SoftDeleteDriver) Count(ctx context.Context, q *Query) (int64, error) {
+	return count(s.Aggregate(ctx, q, Count(countAlias)))
+}
+
+func (s *SoftDeleteDriver) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	var props datastore.PropertyList
+	if err := s.d.Get(ctx, key, &props); err != nil {
+		return err
+	}
+	if hasDeletedAt(props) {
+		return errNoSuchEntity
+	}
+	return loadEntity(dst, key, props)
+}
+
+func (s *SoftDeleteDriver) Create(ctx context.Context, key *datastore.Key, object interface{}) (string, error) {
+	return s.d.Create(ctx, key, object)
+}
+
+func (s *SoftDeleteDriver) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	return s.d.Put(ctx, key, src)
+}
+
+func (s *SoftDeleteDriver) Delete(ctx context.Context, key *datastore.Key) error {
+	stamp := now()
+	return s.d.RunInTransaction(ctx, func(tx Tx) error {
+		return softDelete(tx, key, stamp)
+	})
+}
+
+func (s *SoftDeleteDriver) Update(ctx context.Context, key *datastore.Key, data interface{}) error {
+	return s.d.Update(ctx, key, data)
+}
+
+// UpdateVersioned treats a tombstone as a missing entity.
+func (s *SoftDeleteDriver) UpdateVersioned(ctx context.Context, key *datastore.Key, data Versioned) error {
+	return updateVersioned(ctx, s, key, data)
+}
+
+func (s *SoftDeleteDriver) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}, opts ...BatchOption) error {
+	v, err := batchValues(keys, dst)
+	if err != nil {
+		return err
+	}
+	loaded := make([]datastore.PropertyList, len(keys))
+	err = s.d.GetMulti(ctx, keys, loaded, opts...)
+	me, ok := err.(datastore.MultiError)
+	if err != nil && !ok {
+		return err
+	}
+
+	errs := make(datastore.MultiError, len(keys))
+	failed := false
+	for i, k := range keys {
+		switch {
+		case ok && me[i] != nil:
+			errs[i] = me[i]
+		case hasDeletedAt(loaded[i]):
+			errs[i] = errNoSuchEntity
+		default:
+			errs[i] = loadEntity(batchElem(v, i), k, loaded[i])
+		}
+		failed = failed || errs[i] != nil
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+func hasDeletedAt(props []datastore.Property) bool {
+	_, ok := deletedAt(props)
+	return ok
+}
+
+func (s *SoftDeleteDriver) CreateMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) ([]string, error) {
+	return s.d.CreateMulti(ctx, keys, src, opts...)
+}
+
+func (s *SoftDeleteDriver) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) ([]*datastore.Key, error) {
+	return s.d.PutMulti(ctx, keys, src, opts...)
+}
+
+func (s *SoftDeleteDriver) UpdateMulti(ctx context.Context, keys []*datastore.Key, src interface{}, opts ...BatchOption) error {
+	return s.d.UpdateMulti(ctx, keys, src, opts...)
+}
+
+// DeleteMulti stamps the entities of keys in a transaction per chunk, so a
+// chunk is deleted as a whole or not at all.
+func (s *SoftDeleteDriver) DeleteMulti(ctx context.Context, keys []*datastore.Key, opts ...BatchOption) error {
+	if err := checkBatchKeys(keys, false); err != nil {
+		return err
+	}
+	stamp := now()
+	return runBatch(ctx, len(keys), newBatchOptions(maxBatchMutations, opts), true, func(ctx context.Context, lo, hi int) error {
+		return s.d.RunInTransaction(ctx, func(tx Tx) error {
+			for _, k := range keys[lo:hi] {
+				if err := softDelete(tx, k, stamp); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+func (s *SoftDeleteDriver) AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	return s.d.AllocateIDs(ctx, keys)
+}
+
+func (s *SoftDeleteDriver) ReserveIDs(ctx context.Context, keys []*datastore.Key) error {
+	return s.d.ReserveIDs(ctx, keys)
+}
+
+func (s *SoftDeleteDriver) RunInTransaction(ctx context.Context, f func(tx Tx) error, opts ...TxOption) error {
+	return s.d.RunInTransaction(ctx, func(tx Tx) error {
+		return f(&softDeleteTx{tx: tx})
+	}, opts...)
+}
+
+func (s *SoftDeleteDriver) Close() error {
+	return s.d.Close()
+}
+
+// Restore brings back the soft deleted entities of keys, in a transaction
+// per chunk. Entities that are not deleted are left as they are. Those that
+// were purged, or never existed, are reported as ErrNotFound in the
+// returned MultiError, and the rest of their chunk as ErrBatchSkipped.
+func (s *SoftDeleteDriver) Restore(ctx context.Context, keys ...*datastore.Key) error {
+	if err := checkBatchKeys(keys, false); err != nil {
+		return err
+	}
+	return runBatch(ctx, len(keys), newBatchOptions(maxBatchMutations, nil), true, func(ctx context.Context, lo, hi int) error {
+		return s.d.RunInTransaction(ctx, func(tx Tx) error {
+			var errs datastore.MultiError
+			for i, k := range keys[lo:hi] {
+				var props datastore.PropertyList
+				err := tx.Get(k, &props)
+				if errors.Is(err, ErrNotFound) {
+					if errs == nil {
+						errs = make(datastore.MultiError, hi-lo)
+					}
+					errs[i] = err
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if !hasDeletedAt(props) {
+					continue
+				}
+				props = withoutDeletedAt(props)
+				if _, err := tx.Put(k, &props); err != nil {
+					return err
+				}
+			}
+			if errs != nil {
+				return errs
+			}
+			return nil
+		})
+	})
+}
+
+// purgePageSize is the most keys Purge reads, and deletes, at once.
+const purgePageSize = maxBatchMutations
+
+// Purge deletes for good the entities of kind soft deleted at least age
+// ago, in the namespace of the driver, and returns how many it deleted. It
+// reads their keys a page at a time, deleting each page before reading the
+// next one.
+func (s *SoftDeleteDriver) Purge(ctx context.Context, kind string, age time.Duration) (int, error) {
+	cutoff := now().Add(-age)
+	q := NewQuery(kind).
+		KeysOnly().
+		Filter(Gt(DeletedAtProperty, time.Time{})).
+		Filter(Lte(DeletedAtProperty, cutoff)).
+		Limit(purgePageSize)
+	purged := 0
+	for {
+		// The keys of a page are either deleted or no longer match, so
+		// every page is the first one.
+		keys, err := s.d.FindKeys(ctx, q)
+		if err != nil {
+			return purged, err
+		}
+		n, err := s.purge(ctx, keys, cutoff)
+		purged += n
+		// A page of which nothing was deleted would be read again.
+		if err != nil || len(keys) < purgePageSize || n == 0 {
+			return purged, err
+		}
+	}
+}
+
+// purge deletes the tombstones of keys deleted at cutoff or before, in a
+// transaction per chunk, and returns how many it deleted.
+func (s *SoftDeleteDriver) purge(ctx context.Context, keys []*datastore.Key, cutoff time.Time) (int, error) {
+	var purged int64
+	err := runBatch(ctx, len(keys), newBatchOptions(maxBatchMutations, nil), true, func(ctx context.Context, lo, hi int) error {
+		var n int64
+		err := s.d.RunInTransaction(ctx, func(tx Tx) error {
+			n = 0
+			for _, k := range keys[lo:hi] {
+				var props datastore.PropertyList
+				switch err := tx.Get(k, &props); {
+				case errors.Is(err, ErrNotFound):
+					continue
+				case err != nil:
+					return err
+				}
+				// Restored, or written again, since the query.
+				if t, ok := deletedAt(props); !ok || t.After(cutoff) {
+					continue
+				}
+				if err := tx.Delete(k); err != nil {
+					return err
+				}
+				n++
+			}
+			return nil
+		})
+		if err == nil {
+			atomic.AddInt64(&purged, n)
+		}
+		return err
+	})
+	return int(purged), err
+}
+
+// softDelete stamps the entity of key as deleted at stamp, unless it is
+// missing or already a tombstone.
+func softDelete(tx Tx, key *datastore.Key, stamp time.Time) error {
+	var props datastore.PropertyList
+	switch err := tx.Get(key, &props); {
+	case errors.Is(err, ErrNotFound):
+		return nil
+	case err != nil:
+		return err
+	}
+	if hasDeletedAt(props) {
+		return nil
+	}
+	props = append(withoutDeletedAt(props), datastore.Property{Name: DeletedAtProperty, Value: stamp})
+	_, err := tx.Put(key, &props)
+	return err
+}
+
+// softDeleteTx hides tombstones from the reads of a transaction and soft
+// deletes its deletes.
+type softDeleteTx struct {
+	tx Tx
+}
+
+func (t *softDeleteTx) Get(key *datastore.Key, dst interface{}) error {
+	var props datastore.PropertyList
+	if err := t.tx.Get(key, &props); err != nil {
+		return err
+	}
+	if hasDeletedAt(props) {
+		return errNoSuchEntity
+	}
+	return loadEntity(dst, key, props)
+}
+
+func (t *softDeleteTx) Put(key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	return t.tx.Put(key, src)
+}
+
+func (t *softDeleteTx) Delete(key *datastore.Key) error {
+	return softDelete(t.tx, key, now())
+}
@@ -0,0 +1,322 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/api/iterator"
+)
+
+type SoftDeleteTestSuite struct {
+	suite.Suite
+	newDriver func(t *testing.T) Driver
+	raw       Driver
+	d         *SoftDeleteDriver
+	ctx       context.Context
+	keys      []*datastore.Key
+}
+
+func TestSoftDeleteTestSuite(t *testing.T) {
+	forEachDriver(t, func(newDriver func(*testing.T) Driver) suite.TestingSuite {
+		return &SoftDeleteTestSuite{newDriver: newDriver}
+	})
+}
+
+func (s *SoftDeleteTestSuite) SetupTest() {
+	s.raw = s.newDriver(s.T())
+	s.d = NewSoftDeleteDriver(s.raw)
+	s.ctx = context.Background()
+	s.keys = nil
+	var animals []Animal
+	for i := 1; i <= 5; i++ {
+		s.keys = append(s.keys, datastore.IDKey("Animal", int64(i), nil))
+		animals = append(animals, Animal{Name: fmt.Sprintf("animal %d", i), Legs: i})
+	}
+	_, err := s.d.PutMulti(s.ctx, s.keys, animals)
+	s.Require().NoError(err)
+}
+
+// deleteFirst soft deletes the first three animals.
+func (s *SoftDeleteTestSuite) deleteFirst() {
+	s.Require().NoError(s.d.Delete(s.ctx, s.keys[0]))
+	s.Require().NoError(s.d.DeleteMulti(s.ctx, s.keys[1:3]))
+}
+
+func (s *SoftDeleteTestSuite) TestLookups() {
+	s.deleteFirst()
+
+	var a Animal
+	assert.ErrorIs(s.T(), s.d.Get(s.ctx, s.keys[0], &a), ErrNotFound)
+	s.Require().NoError(s.d.Get(s.ctx, s.keys[3], &a))
+	assert.Equal(s.T(), "animal 4", a.Name)
+
+	animals := make([]Animal, 2)
+	err := s.d.GetMulti(s.ctx, []*datastore.Key{s.keys[1], s.keys[4]}, animals)
+	me, ok := err.(datastore.MultiError)
+	s.Require().True(ok, err)
+	assert.ErrorIs(s.T(), me[0], ErrNotFound)
+	assert.NoError(s.T(), me[1])
+	assert.Equal(s.T(), "animal 5", animals[1].Name)
+
+	var props datastore.PropertyList
+	s.Require().NoError(s.raw.Get(s.ctx, s.keys[0], &props), "the entity is kept")
+	deleted, ok := deletedAt(props)
+	s.Require().True(ok)
+	assert.WithinDuration(s.T(), time.Now(), deleted, time.Minute)
+
+	s.Require().NoError(s.d.Delete(s.ctx, s.keys[0]), "deleting a tombstone is a no-op")
+	s.Require().NoError(s.raw.Get(s.ctx, s.keys[0], &props))
+	again, _ := deletedAt(props)
+	assert.True(s.T(), deleted.Equal(again), "the first deletion time is kept")
+	assert.NoError(s.T(), s.d.Delete(s.ctx, datastore.IDKey("Animal", 42, nil)), "missing entities are ignored")
+}
+
+func (s *SoftDeleteTestSuite) TestQueries() {
+	s.deleteFirst()
+
+	keys, err := s.d.FindKeys(s.ctx, NewQuery("Animal"))
+	s.Require().NoError(err)
+	assert.Equal(s.T(), s.keys[3:], keys)
+	ids, err := s.d.FindIds(s.ctx, NewQuery("Animal"))
+	s.Require().NoError(err)
+	assert.Equal(s.T(), EncodeKeys(s.keys[3:]), ids)
+
+	it, err := s.d.Find(s.ctx, NewQuery("Animal").Order("Legs").Offset(1).Limit(1))
+	s.Require().NoError(err)
+	var a Animal
+	k, err := it.Next(&a)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), s.keys[4], k, "offset and limit apply to the live entities")
+	assert.Equal(s.T(), 5, a.Legs)
+
+	n, err := s.d.Count(s.ctx, NewQuery("Animal"))
+	s.Require().NoError(err)
+	assert.Equal(s.T(), int64(2), n)
+	res, err := s.d.Aggregate(s.ctx, NewQuery("Animal"), Sum("legs", "Legs"), Avg("avg", "Legs"))
+	s.Require().NoError(err)
+	sum, _ := res.Int("legs")
+	assert.Equal(s.T(), int64(9), sum)
+	avg, _ := res.Float("avg")
+	assert.Equal(s.T(), 4.5, avg)
+
+	keys, err = s.d.FindKeys(s.ctx, NewQuery("Animal").IncludeDeleted())
+	s.Require().NoError(err)
+	assert.Equal(s.T(), s.keys, keys)
+	n, err = s.d.Count(s.ctx, NewQuery("Animal").IncludeDeleted())
+	s.Require().NoError(err)
+	assert.Equal(s.T(), int64(5), n)
+	it, err = s.d.Find(s.ctx, NewQuery("Animal").IncludeDeleted().Limit(1))
+	s.Require().NoError(err)
+	var props datastore.PropertyList
+	_, err = it.Next(&props)
+	s.Require().NoError(err)
+	assert.True(s.T(), hasDeletedAt(props), "tombstones carry their deletion time")
+}
+
+// limitsDriver records the limits of the queries it runs, and whether they
+// are keys-only.
+type limitsDriver struct {
+	Driver
+	limits   []int
+	keysOnly []bool
+}
+
+func (l *limitsDriver) Find(ctx context.Context, q *Query) (Iterator, error) {
+	l.limits = append(l.limits, q.limit)
+	l.keysOnly = append(l.keysOnly, q.keysOnly)
+	return l.Driver.Find(ctx, q)
+}
+
+func (l *limitsDriver) FindKeys(ctx context.Context, q *Query) ([]*datastore.Key, error) {
+	l.limits = append(l.limits, q.limit)
+	l.keysOnly = append(l.keysOnly, q.keysOnly)
+	return l.Driver.FindKeys(ctx, q)
+}
+
+func (s *SoftDeleteTestSuite) TestChunks() {
+	s.deleteFirst()
+
+	raw := &limitsDriver{Driver: s.raw}
+	d := NewSoftDeleteDriver(raw)
+	keys, err := d.FindKeys(s.ctx, NewQuery("Animal").Limit(2))
+	s.Require().NoError(err)
+	assert.Equal(s.T(), s.keys[3:], keys)
+	assert.Equal(s.T(), []int{-1, 2, 2, 1}, raw.limits, "the tombstones are read, then chunks read what the limit still needs")
+	assert.Equal(s.T(), []bool{true, true, true, true}, raw.keysOnly, "keys-only queries read no entity")
+
+	it, err := d.Find(s.ctx, NewQuery("Animal").Project("Name"))
+	s.Require().NoError(err)
+	var names []string
+	for {
+		var a Animal
+		_, err := it.Next(&a)
+		if err == iterator.Done {
+			break
+		}
+		s.Require().NoError(err)
+		names = append(names, a.Name)
+	}
+	assert.Equal(s.T(), []string{"animal 4", "animal 5"}, names, "projections skip tombstones too")
+
+	raw.limits = nil
+	n, err := d.Count(s.ctx, NewQuery("Animal"))
+	s.Require().NoError(err)
+	assert.Equal(s.T(), int64(2), n)
+	assert.Empty(s.T(), raw.limits, "counts are left to the driver")
+	res, err := d.Aggregate(s.ctx, NewQuery("Animal").Filter(Gt("Legs", 1)), Count("n"), Sum("legs", "Legs"))
+	s.Require().NoError(err)
+	assert.Equal(s.T(), AggregationResult{"n": int64(2), "legs": int64(9)}, res)
+	assert.Equal(s.T(), []int{liveChunkSize}, raw.limits, "an inequality filter aggregates the live entities")
+
+	raw.limits, raw.keysOnly = nil, nil
+	n, err = d.Count(s.ctx, NewQuery("Animal").Filter(Gt("Legs", 1)))
+	s.Require().NoError(err)
+	assert.Equal(s.T(), int64(2), n)
+	assert.Equal(s.T(), []bool{true, true}, raw.keysOnly, "counts read keys only")
+
+	raw.limits, raw.keysOnly = nil, nil
+	purged, err := d.Purge(s.ctx, "Animal", 0)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 3, purged)
+	assert.Equal(s.T(), []int{purgePageSize}, raw.limits, "purges read their keys a page at a time")
+	assert.Equal(s.T(), []bool{true}, raw.keysOnly)
+}
+
+func (s *SoftDeleteTestSuite) TestPages() {
+	s.Require().NoError(s.d.DeleteMulti(s.ctx, []*datastore.Key{s.keys[1], s.keys[2]}))
+
+	var animals []Animal
+	page, err := s.d.FindPage(s.ctx, NewQuery("Animal"), 2, "", &animals)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []*datastore.Key{s.keys[0], s.keys[3]}, page.Keys)
+	assert.Equal(s.T(), []string{"animal 1", "animal 4"}, []string{animals[0].Name, animals[1].Name})
+	s.Require().NotEmpty(page.NextPageToken)
+
+	ids, token, err := s.d.FindIdsPage(s.ctx, NewQuery("Animal"), 2, page.NextPageToken)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), EncodeKeys(s.keys[4:]), ids)
+	assert.Empty(s.T(), token)
+
+	ids, _, err = s.d.FindIdsPage(s.ctx, NewQuery("Animal").Offset(1), 1, "")
+	s.Require().NoError(err)
+	assert.Equal(s.T(), EncodeKeys(s.keys[3:4]), ids)
+}
+
+func (s *SoftDeleteTestSuite) TestTransaction() {
+	err := s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		return tx.Delete(s.keys[0])
+	})
+	s.Require().NoError(err)
+
+	var props datastore.PropertyList
+	s.Require().NoError(s.raw.Get(s.ctx, s.keys[0], &props))
+	assert.True(s.T(), hasDeletedAt(props))
+
+	err = s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		var a Animal
+		return tx.Get(s.keys[0], &a)
+	})
+	assert.ErrorIs(s.T(), err, ErrNotFound)
+
+	doc := datastore.NameKey("Document", "readme", nil)
+	s.Require().NoError(s.d.UpdateVersioned(s.ctx, doc, &Document{Title: "draft"}))
+	s.Require().NoError(s.d.Delete(s.ctx, doc))
+	assert.NoError(s.T(), s.d.UpdateVersioned(s.ctx, doc, &Document{Title: "again"}), "a tombstone is a missing entity")
+}
+
+func (s *SoftDeleteTestSuite) TestRestore() {
+	s.deleteFirst()
+
+	err := s.d.Restore(s.ctx, s.keys[0], datastore.IDKey("Animal", 42, nil))
+	me, ok := err.(datastore.MultiError)
+	s.Require().True(ok, err)
+	assert.ErrorIs(s.T(), me[0], ErrBatchSkipped)
+	assert.ErrorIs(s.T(), me[1], ErrNotFound)
+
+	s.Require().NoError(s.d.Restore(s.ctx, s.keys[0], s.keys[3]))
+	var a Animal
+	s.Require().NoError(s.d.Get(s.ctx, s.keys[0], &a), "restored entities load without the marker")
+	assert.Equal(s.T(), Animal{Name: "animal 1", Legs: 1}, a)
+	n, err := s.d.Count(s.ctx, NewQuery("Animal"))
+	s.Require().NoError(err)
+	assert.Equal(s.T(), int64(3), n)
+}
+
+func (s *SoftDeleteTestSuite) TestPurge() {
+	s.deleteFirst()
+
+	n, err := s.d.Purge(s.ctx, "Animal", time.Hour)
+	s.Require().NoError(err)
+	assert.Zero(s.T(), n, "the tombstones are too recent")
+
+	s.Require().NoError(s.d.Restore(s.ctx, s.keys[2]))
+	n, err = s.d.Purge(s.ctx, "Animal", 0)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 2, n)
+
+	var props datastore.PropertyList
+	assert.ErrorIs(s.T(), s.raw.Get(s.ctx, s.keys[0], &props), ErrNotFound)
+	assert.NoError(s.T(), s.raw.Get(s.ctx, s.keys[2], &props), "restored entities are kept")
+	err = s.d.Restore(s.ctx, s.keys[0])
+	me, ok := err.(datastore.MultiError)
+	s.Require().True(ok, err)
+	assert.ErrorIs(s.T(), me[0], ErrNotFound)
+	keys, err := s.d.FindKeys(s.ctx, NewQuery("Animal").IncludeDeleted())
+	s.Require().NoError(err)
+	assert.Equal(s.T(), s.keys[2:], keys)
+}
+
+func (s *SoftDeleteTestSuite) TestPurgePages() {
+	keys := IncompleteKeys("Bird", nil, purgePageSize+1)
+	keys, err := s.d.PutMulti(s.ctx, keys, make([]Animal, len(keys)))
+	s.Require().NoError(err)
+	s.Require().NoError(s.d.DeleteMulti(s.ctx, keys))
+
+	n, err := s.d.Purge(s.ctx, "Bird", 0)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), len(keys), n)
+	left, err := s.d.FindKeys(s.ctx, NewQuery("Bird").IncludeDeleted())
+	s.Require().NoError(err)
+	assert.Empty(s.T(), left)
+}
+
+// Toy reads the deletion time of its tombstones.
+type Toy struct {
+	Name      string
+	DeletedAt time.Time `datastore:"_deletedAt"`
+}
+
+func (s *SoftDeleteTestSuite) TestTaggedField() {
+	ball, kite := datastore.NameKey("Toy", "ball", nil), datastore.NameKey("Toy", "kite", nil)
+	_, err := s.d.PutMulti(s.ctx, []*datastore.Key{ball, kite}, []Toy{{Name: "ball"}, {Name: "kite"}})
+	s.Require().NoError(err)
+
+	var p Toy
+	s.Require().NoError(s.d.Get(s.ctx, ball, &p), "a zero deletion time is a live entity")
+	keys, err := s.d.FindKeys(s.ctx, NewQuery("Toy"))
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []*datastore.Key{ball, kite}, keys)
+	n, err := s.d.Purge(s.ctx, "Toy", 0)
+	s.Require().NoError(err)
+	assert.Zero(s.T(), n, "live entities are not purged")
+
+	s.Require().NoError(s.d.Delete(s.ctx, kite))
+	assert.ErrorIs(s.T(), s.d.Get(s.ctx, kite, &p), ErrNotFound)
+	s.Require().NoError(s.raw.Get(s.ctx, kite, &p))
+	assert.WithinDuration(s.T(), time.Now(), p.DeletedAt, time.Minute)
+
+	s.Require().NoError(s.d.Restore(s.ctx, kite))
+	p = Toy{}
+	s.Require().NoError(s.d.Get(s.ctx, kite, &p))
+	assert.Equal(s.T(), Toy{Name: "kite"}, p)
+	s.Require().NoError(s.d.Delete(s.ctx, kite))
+	n, err = s.d.Purge(s.ctx, "Toy", 0)
+	s.Require().NoError(err)
+	assert.Equal(s.T(), 1, n)
+	assert.NoError(s.T(), s.raw.Get(s.ctx, ball, &p))
+}
@@ -0,0 +1,243 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+
+	"cloud.google.com/go/datastore"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/iterator"
+)
+
+// instrumentationName names the tracer and the meter of the telemetry.
+const instrumentationName = "github.com/marjau/cloud/gcp/datastore"
+
+// The attributes of the spans and metrics of the telemetry.
+const (
+	operationAttribute   = attribute.Key("datastore.operation")
+	kindAttribute        = attribute.Key("datastore.kind")
+	namespaceAttribute   = attribute.Key("datastore.namespace")
+	entityCountAttribute = attribute.Key("datastore.entity_count")
+	resultCountAttribute = attribute.Key("datastore.result_count")
+	errorTypeAttribute   = attribute.Key("error.type")
+)
+
+// writes are the operations whose keys are written once they succeed. Those
+// of transactions are only staged, and are counted once RunInTransaction
+// committed them.
+var writes = map[string]bool{
+	"RunInTransaction": true,
+	"Create":           true,
+	"Put":              true,
+	"Update":           true,
+	"UpdateVersioned":  true,
+	"Delete":           true,
+	"CreateMulti":      true,
+	"PutMulti":         true,
+	"UpdateMulti":      true,
+	"DeleteMulti":      true,
+}
+
+type telemetryOptions struct {
+	tracerProvider trace.TracerProvider
+	meterProvider  metric.MeterProvider
+}
+
+// TelemetryOption configures NewTelemetry.
+type TelemetryOption func(*telemetryOptions)
+
+// TelemetryTracerProvider sets the provider of the tracer, the global one by
+// default. Its exporters decide where the spans go.
+func TelemetryTracerProvider(tp trace.TracerProvider) TelemetryOption {
+	return func(o *telemetryOptions) {
+		o.tracerProvider = tp
+	}
+}
+
+// TelemetryMeterProvider sets the provider of the meter, the global one by
+// default. Its readers decide where the metrics go.
+func TelemetryMeterProvider(mp metric.MeterProvider) TelemetryOption {
+	return func(o *telemetryOptions) {
+		o.meterProvider = mp
+	}
+}
+
+var _ IteratorInterceptor = (*telemetry)(nil)
+
+// telemetry is the Interceptor returned by NewTelemetry.
+type telemetry struct {
+	tracer   trace.Tracer
+	duration metric.Float64Histogram
+	errors   metric.Int64Counter
+	read     metric.Int64Counter
+	written  metric.Int64Counter
+}
+
+// NewTelemetry returns an Interceptor tracing and measuring the operations of
+// a driver with OpenTelemetry:
+//
+//	telemetry, err := datastore.NewTelemetry()
+//	...
+//	d, err := datastore.NewDriver(ctx, projectID, datastore.WithInterceptors(telemetry))
+//
+// Every operation runs in a client span named after it, such as
+// "datastore.Get", carrying its operation, kind, namespace, entity count and
+// result count. The operations of a transaction are children of its span.
+// The span of Find ends once its iterator stopped, so that it counts the
+// results; an iterator that is not read to the end leaves it unended.
+//
+// It records these metrics, by operation and kind:
+//   - datastore.operation.duration, a histogram of the latency in seconds;
+//   - datastore.operation.errors, a counter of the failures by error.type,
+//     the kind of the error such as "not_found";
+//   - datastore.entities.read, a counter of the entities and keys read;
+//   - datastore.entities.written, a counter of the entities written or
+//     deleted, those of a transaction once it committed.
+func NewTelemetry(opts ...TelemetryOption) (Interceptor, error) {
+	o := telemetryOptions{
+		tracerProvider: otel.GetTracerProvider(),
+		meterProvider:  otel.GetMeterProvider(),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	meter := o.meterProvider.Meter(instrumentationName)
+	t := &telemetry{tracer: o.tracerProvider.Tracer(instrumentationName)}
+	var err error
+	if t.duration, err = meter.Float64Histogram("datastore.operation.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Duration of the Datastore operations.")); err != nil {
+		return nil, err
+	}
+	if t.errors, err = meter.Int64Counter("datastore.operation.errors",
+		metric.WithUnit("{error}"),
+		metric.WithDescription("Failed Datastore operations.")); err != nil {
+		return nil, err
+	}
+	if t.read, err = meter.Int64Counter("datastore.entities.read",
+		metric.WithUnit("{entity}"),
+		metric.WithDescription("Entities and keys read from Datastore.")); err != nil {
+		return nil, err
+	}
+	if t.written, err = meter.Int64Counter("datastore.entities.written",
+		metric.WithUnit("{entity}"),
+		metric.WithDescription("Entities written to or deleted from Datastore.")); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *telemetry) Before(ctx context.Context, op *Operation) (context.Context, error) {
+	ctx, _ = t.tracer.Start(ctx, "datastore."+op.Name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			operationAttribute.String(op.Name),
+			kindAttribute.String(op.Kind),
+			namespaceAttribute.String(op.Namespace),
+			entityCountAttribute.Int(len(op.Keys)),
+		))
+	return ctx, nil
+}
+
+func (t *telemetry) After(ctx context.Context, op *Operation) {
+	span := trace.SpanFromContext(ctx)
+	if op.Name == "Find" && op.Err == nil {
+		// AfterNext ends it.
+		t.duration.Record(ctx, op.Duration.Seconds(), metric.WithAttributes(metricAttributes(op)...))
+		return
+	}
+	defer span.End()
+	span.SetAttributes(resultCountAttribute.Int(op.Results))
+
+	attrs := metricAttributes(op)
+	if op.Err != nil {
+		t.recordError(ctx, span, attrs, op.Err)
+	}
+	t.duration.Record(ctx, op.Duration.Seconds(), metric.WithAttributes(attrs...))
+	if op.Results > 0 {
+		t.read.Add(ctx, int64(op.Results), metric.WithAttributes(attrs...))
+	}
+	if n := written(op); n > 0 {
+		t.written.Add(ctx, int64(n), metric.WithAttributes(attrs...))
+	}
+}
+
+func (t *telemetry) AfterNext(ctx context.Context, op *Operation, err error) {
+	attrs := metricAttributes(op)
+	if err == nil || errors.Is(err, ErrFieldMismatch) {
+		t.read.Add(ctx, 1, metric.WithAttributes(attrs...))
+		return
+	}
+
+	span := trace.SpanFromContext(ctx)
+	defer span.End()
+	span.SetAttributes(resultCountAttribute.Int(op.Results))
+	if err != iterator.Done {
+		t.recordError(ctx, span, attrs, err)
+	}
+}
+
+// metricAttributes returns the attributes of the metrics of op. The
+// namespace is left out, as there may be one per tenant.
+func metricAttributes(op *Operation) []attribute.KeyValue {
+	return []attribute.KeyValue{operationAttribute.String(op.Name), kindAttribute.String(op.Kind)}
+}
+
+// recordError records err on span and counts it.
+func (t *telemetry) recordError(ctx context.Context, span trace.Span, attrs []attribute.KeyValue, err error) {
+	span.RecordError(err)
+	span.SetStatus(otelcodes.Error, err.Error())
+	errAttr := errorTypeAttribute.String(errorType(err))
+	span.SetAttributes(errAttr)
+	t.errors.Add(ctx, 1, metric.WithAttributes(append(attrs, errAttr)...))
+}
+
+// written returns how many entities op wrote.
+func written(op *Operation) int {
+	if !writes[op.Name] {
+		return 0
+	}
+	if me, ok := op.Err.(datastore.MultiError); ok {
+		n := 0
+		for _, err := range me {
+			if err == nil {
+				n++
+			}
+		}
+		return n
+	}
+	if op.Err != nil {
+		return 0
+	}
+	return len(op.Keys)
+}
+
+// errorType names the kind of err, "batch" for the errors of a batch and
+// "other" for unclassified errors.
+func errorType(err error) string {
+	if _, ok := err.(datastore.MultiError); ok {
+		return "batch"
+	}
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return "not_found"
+	case errors.Is(err, ErrConflict):
+		return "conflict"
+	case errors.Is(err, ErrInvalidArgument):
+		return "invalid_argument"
+	case errors.Is(err, ErrUnavailable):
+		return "unavailable"
+	case errors.Is(err, ErrFieldMismatch):
+		return "field_mismatch"
+	case errors.Is(err, ErrTimeout):
+		return "timeout"
+	case errors.Is(err, ErrInternal):
+		return "internal"
+	}
+	return "other"
+}
@@ -0,0 +1,275 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/iterator"
+)
+
+type TelemetryTestSuite struct {
+	suite.Suite
+	newDriver func(t *testing.T) Driver
+	d         Driver
+	spans     *tracetest.InMemoryExporter
+	reader    *sdkmetric.ManualReader
+	ctx       context.Context
+}
+
+func TestTelemetryTestSuite(t *testing.T) {
+	forEachDriver(t, func(newDriver func(*testing.T) Driver) suite.TestingSuite {
+		return &TelemetryTestSuite{newDriver: newDriver}
+	})
+}
+
+func (s *TelemetryTestSuite) SetupTest() {
+	s.spans = tracetest.NewInMemoryExporter()
+	s.reader = sdkmetric.NewManualReader()
+	telemetry, err := NewTelemetry(
+		TelemetryTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(s.spans))),
+		TelemetryMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(s.reader))),
+	)
+	s.Require().NoError(err)
+	s.d = NewInterceptedDriver(s.newDriver(s.T()), telemetry)
+	s.ctx = context.Background()
+}
+
+// span returns the only span named name.
+func (s *TelemetryTestSuite) span(name string) tracetest.SpanStub {
+	var found []tracetest.SpanStub
+	for _, span := range s.spans.GetSpans() {
+		if span.Name == name {
+			found = append(found, span)
+		}
+	}
+	s.Require().Len(found, 1, name)
+	return found[0]
+}
+
+// sum returns the sum of the data points of the counter name matching attrs.
+func (s *TelemetryTestSuite) sum(name string, attrs ...attribute.KeyValue) int64 {
+	var rm metricdata.ResourceMetrics
+	s.Require().NoError(s.reader.Collect(s.ctx, &rm))
+	var n int64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			data, ok := m.Data.(metricdata.Sum[int64])
+			if m.Name != name || !ok {
+				continue
+			}
+			for _, dp := range data.DataPoints {
+				if hasAttributes(dp.Attributes, attrs) {
+					n += dp.Value
+				}
+			}
+		}
+	}
+	return n
+}
+
+// histogramCount returns the number of values recorded by the histogram name
+// matching attrs.
+func (s *TelemetryTestSuite) histogramCount(name string, attrs ...attribute.KeyValue) uint64 {
+	var rm metricdata.ResourceMetrics
+	s.Require().NoError(s.reader.Collect(s.ctx, &rm))
+	var n uint64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			data, ok := m.Data.(metricdata.Histogram[float64])
+			if m.Name != name || !ok {
+				continue
+			}
+			for _, dp := range data.DataPoints {
+				if hasAttributes(dp.Attributes, attrs) {
+					n += dp.Count
+				}
+			}
+		}
+	}
+	return n
+}
+
+func hasAttributes(set attribute.Set, attrs []attribute.KeyValue) bool {
+	for _, a := range attrs {
+		if v, ok := set.Value(a.Key); !ok || v != a.Value {
+			return false
+		}
+	}
+	return true
+}
+
+func attributes(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	m := make(map[attribute.Key]attribute.Value, len(span.Attributes))
+	for _, a := range span.Attributes {
+		m[a.Key] = a.Value
+	}
+	return m
+}
+
+func (s *TelemetryTestSuite) TestSpans() {
+	zoo := datastore.NameKey("Zoo", "north", nil)
+	_, err := s.d.PutMulti(s.ctx, IncompleteKeys("Animal", zoo, 2), []Animal{{Name: "cat"}, {Name: "dog"}})
+	s.Require().NoError(err)
+	keys, err := s.d.FindKeys(s.ctx, NewQuery("Animal").Ancestor(zoo))
+	s.Require().NoError(err)
+	err = s.d.Get(s.ctx, datastore.NameKey("Animal", "cow", zoo), &Animal{})
+	s.Require().ErrorIs(err, ErrNotFound)
+
+	put := s.span("datastore.PutMulti")
+	assert.Equal(s.T(), trace.SpanKindClient, put.SpanKind)
+	attrs := attributes(put)
+	assert.Equal(s.T(), "PutMulti", attrs[operationAttribute].AsString())
+	assert.Equal(s.T(), "Animal", attrs[kindAttribute].AsString())
+	assert.Equal(s.T(), int64(2), attrs[entityCountAttribute].AsInt64())
+	assert.Equal(s.T(), otelcodes.Unset, put.Status.Code)
+
+	find := attributes(s.span("datastore.FindKeys"))
+	assert.Equal(s.T(), int64(0), find[entityCountAttribute].AsInt64())
+	assert.Equal(s.T(), int64(len(keys)), find[resultCountAttribute].AsInt64())
+	assert.Equal(s.T(), int64(2), find[resultCountAttribute].AsInt64())
+
+	get := s.span("datastore.Get")
+	assert.Equal(s.T(), otelcodes.Error, get.Status.Code)
+	assert.Equal(s.T(), "not_found", attributes(get)[errorTypeAttribute].AsString())
+	assert.Equal(s.T(), int64(0), attributes(get)[resultCountAttribute].AsInt64())
+	if assert.Len(s.T(), get.Events, 1) {
+		assert.Equal(s.T(), "exception", get.Events[0].Name)
+	}
+}
+
+func (s *TelemetryTestSuite) TestTransaction() {
+	k := datastore.NameKey("Animal", "cat", nil)
+	s.Require().NoError(s.d.Update(s.ctx, k, &Animal{Name: "cat"}))
+	err := s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		var a Animal
+		if err := tx.Get(k, &a); err != nil {
+			return err
+		}
+		a.Legs = 4
+		_, err := tx.Put(k, &a)
+		return err
+	})
+	s.Require().NoError(err)
+
+	run := s.span("datastore.RunInTransaction")
+	for _, name := range []string{"datastore.Tx.Get", "datastore.Tx.Put"} {
+		span := s.span(name)
+		assert.Equal(s.T(), run.SpanContext.SpanID(), span.Parent.SpanID(), name)
+		assert.Equal(s.T(), run.SpanContext.TraceID(), span.SpanContext.TraceID(), name)
+	}
+	assert.Equal(s.T(), int64(1), attributes(s.span("datastore.Tx.Get"))[resultCountAttribute].AsInt64())
+	assert.Equal(s.T(), int64(2), s.sum("datastore.entities.written"))
+	assert.Equal(s.T(), int64(1), s.sum("datastore.entities.written", operationAttribute.String("RunInTransaction"), kindAttribute.String("Animal")),
+		"the staged write is counted once committed")
+
+	err = s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		if err := tx.Delete(k); err != nil {
+			return err
+		}
+		return errors.New("rolled back")
+	})
+	s.Require().Error(err)
+	assert.Equal(s.T(), int64(2), s.sum("datastore.entities.written"), "a rolled back write is not counted")
+}
+
+func (s *TelemetryTestSuite) TestFind() {
+	_, err := s.d.PutMulti(s.ctx, IncompleteKeys("Animal", nil, 3), []Animal{{Name: "cat"}, {Name: "dog"}, {Name: "cow"}})
+	s.Require().NoError(err)
+
+	it, err := s.d.Find(s.ctx, NewQuery("Animal"))
+	s.Require().NoError(err)
+	assert.Len(s.T(), s.spans.GetSpans(), 1, "the span of Find ends once its iterator stopped")
+	n := 0
+	for {
+		_, err := it.Next(&Animal{})
+		if err == iterator.Done {
+			break
+		}
+		s.Require().NoError(err)
+		n++
+	}
+	s.Require().Equal(3, n)
+	_, err = it.Next(&Animal{})
+	s.Require().Equal(iterator.Done, err)
+	assert.Equal(s.T(), int64(3), attributes(s.span("datastore.Find"))[resultCountAttribute].AsInt64())
+	assert.Equal(s.T(), int64(3), s.sum("datastore.entities.read", operationAttribute.String("Find"), kindAttribute.String("Animal")))
+
+	page, err := s.d.FindPage(s.ctx, NewQuery("Animal"), 2, "", nil)
+	s.Require().NoError(err)
+	s.Require().Len(page.Keys, 2)
+	assert.Equal(s.T(), int64(2), attributes(s.span("datastore.FindPage"))[resultCountAttribute].AsInt64())
+	assert.Equal(s.T(), int64(2), s.sum("datastore.entities.read", operationAttribute.String("FindPage")))
+}
+
+func (s *TelemetryTestSuite) TestMetrics() {
+	keys := []*datastore.Key{
+		datastore.NameKey("Animal", "cat", nil),
+		datastore.NameKey("Animal", "dog", nil),
+		datastore.NameKey("Animal", "cow", nil),
+	}
+	s.Require().NoError(s.d.UpdateMulti(s.ctx, keys[:2], []Animal{{Name: "cat"}, {Name: "dog"}}))
+	err := s.d.GetMulti(s.ctx, keys, make([]Animal, 3))
+	var me datastore.MultiError
+	s.Require().ErrorAs(err, &me)
+	s.Require().NoError(s.d.Delete(s.ctx, keys[0]))
+	_, err = s.d.PutMulti(s.ctx, keys, []Animal{})
+	s.Require().ErrorIs(err, ErrInvalidArgument)
+	_, err = s.d.Count(s.ctx, NewQuery("Animal"))
+	s.Require().NoError(err)
+
+	operation := operationAttribute.String
+	animal := kindAttribute.String("Animal")
+	assert.Equal(s.T(), int64(2), s.sum("datastore.entities.written", operation("UpdateMulti"), animal))
+	assert.Equal(s.T(), int64(1), s.sum("datastore.entities.written", operation("Delete"), animal))
+	assert.Equal(s.T(), int64(0), s.sum("datastore.entities.written", operation("PutMulti")), "the put failed")
+	assert.Equal(s.T(), int64(2), s.sum("datastore.entities.read", operation("GetMulti"), animal))
+
+	assert.Equal(s.T(), int64(1), s.sum("datastore.operation.errors", operation("GetMulti"), errorTypeAttribute.String("batch")))
+	assert.Equal(s.T(), int64(1), s.sum("datastore.operation.errors", operation("PutMulti"), errorTypeAttribute.String("invalid_argument")))
+	assert.Equal(s.T(), int64(2), s.sum("datastore.operation.errors"))
+
+	assert.Equal(s.T(), uint64(5), s.histogramCount("datastore.operation.duration"))
+	assert.Equal(s.T(), uint64(1), s.histogramCount("datastore.operation.duration", operation("Count"), animal))
+}
+
+func TestErrorType(t *testing.T) {
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{errNoSuchEntity, "not_found"},
+		{ErrVersionConflict, "conflict"},
+		{ErrForeignNamespace, "invalid_argument"},
+		{wrapError(context.DeadlineExceeded), "timeout"},
+		{wrapError(&datastore.ErrFieldMismatch{}), "field_mismatch"},
+		{&Error{Kind: ErrInternal, Err: errors.New("broken")}, "internal"},
+		{datastore.MultiError{nil, errNoSuchEntity}, "batch"},
+		{&RetryError{Op: "Get", Attempts: 2, Err: &Error{Kind: ErrUnavailable, Err: errors.New("down")}}, "unavailable"},
+		{errors.New("boom"), "other"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, errorType(c.err), c.err)
+	}
+}
+
+func TestNewTelemetryDefaults(t *testing.T) {
+	telemetry, err := NewTelemetry()
+	if !assert.NoError(t, err) {
+		return
+	}
+	d := NewInterceptedDriver(NewMemoryDriver(), telemetry)
+	defer d.Close()
+	assert.NoError(t, d.Update(context.Background(), datastore.NameKey("Animal", "cat", nil), &Animal{Name: "cat"}),
+		"the global no-op providers are used by default")
+}
@@ -0,0 +1,170 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+
+	"cloud.google.com/go/datastore"
+)
+
+// defaultTxAttempts matches the number of attempts of the client.
+const defaultTxAttempts = 3
+
+// ErrReadOnlyTransaction is returned by writes in a read-only transaction.
+var ErrReadOnlyTransaction error = &Error{Kind: ErrInvalidArgument, Err: errors.New("write in a read-only transaction")}
+
+// Tx groups reads and writes that commit atomically. Reads observe the
+// state before the transaction began; writes apply when it commits.
+type Tx interface {
+	Get(key *datastore.Key, dst interface{}) error
+	// Put stages src under key and returns the key it is stored under. An
+	// incomplete key gets its ID at once, and keeps it when the transaction
+	// is attempted again.
+	Put(key *datastore.Key, src interface{}) (*datastore.Key, error)
+	Delete(key *datastore.Key) error
+}
+
+// TxOption configures Driver.RunInTransaction.
+type TxOption func(*txOptions)
+
+type txOptions struct {
+	attempts int
+	readOnly bool
+}
+
+func newTxOptions(opts []TxOption) txOptions {
+	o := txOptions{attempts: defaultTxAttempts}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// TxMaxAttempts sets how many times a transaction is attempted when its
+// commit fails on contention. Values below one are ignored.
+func TxMaxAttempts(attempts int) TxOption {
+	return func(o *txOptions) {
+		if attempts > 0 {
+			o.attempts = attempts
+		}
+	}
+}
+
+// TxReadOnly marks the transaction as read-only, which the backend runs
+// without taking locks.
+func TxReadOnly() TxOption {
+	return func(o *txOptions) {
+		o.readOnly = true
+	}
+}
+
+// RunInTransaction runs f in a transaction and commits it when f returns
+// nil. When the commit fails on contention f is retried, up to the
+// configured attempts, and an ErrConflict wrapping
+// datastore.ErrConcurrentTransaction is returned once they are exhausted.
+// An error returned by f rolls back and is returned as is, even when it is
+// transient, as f may have effects outside Datastore. A transient failure
+// to begin or commit the transaction attempts it again as a whole under the
+// retry policy of the driver, running f again. f may therefore run up to
+// the attempts of the policy times those of the transaction.
+func (d *driver) RunInTransaction(ctx context.Context, f func(tx Tx) error, opts ...TxOption) error {
+	o := newTxOptions(opts)
+	dsOpts := []datastore.TransactionOption{datastore.MaxAttempts(o.attempts)}
+	if o.readOnly {
+		dsOpts = append(dsOpts, datastore.ReadOnly)
+	}
+
+	ids := &txIDs{allocate: func(key *datastore.Key) (*datastore.Key, error) {
+		keys, err := d.AllocateIDs(ctx, []*datastore.Key{key})
+		if err != nil {
+			return nil, err
+		}
+		return keys[0], nil
+	}}
+	return d.do(ctx, "RunInTransaction", true, func(ctx context.Context) error {
+		var fErr error
+		_, err := d.client.RunInTransaction(ctx, func(t *datastore.Transaction) error {
+			ids.next = 0
+			fErr = f(&transaction{t: t, readOnly: o.readOnly, ids: ids})
+			return fErr
+		}, dsOpts...)
+		if err != nil && fErr != nil {
+			return finalError{err: err}
+		}
+		return err
+	})
+}
+
+// txIDs allocates the IDs of the incomplete keys put by a transaction. The
+// n-th incomplete key put by an attempt gets the ID of the n-th one of the
+// previous attempt, when it has the same kind and parent, so that retries
+// do not use up IDs.
+type txIDs struct {
+	allocate func(key *datastore.Key) (*datastore.Key, error)
+	keys     []*datastore.Key
+	next     int
+}
+
+// complete returns key with its ID, allocating one when key is incomplete.
+func (ids *txIDs) complete(key *datastore.Key) (*datastore.Key, error) {
+	if !key.Incomplete() {
+		return key, nil
+	}
+	i := ids.next
+	if i < len(ids.keys) && sameParent(ids.keys[i], key) {
+		ids.next++
+		return cloneKey(ids.keys[i]), nil
+	}
+	k, err := ids.allocate(key)
+	if err != nil {
+		return nil, err
+	}
+	if i < len(ids.keys) {
+		ids.keys[i] = k
+	} else {
+		ids.keys = append(ids.keys, k)
+	}
+	ids.next++
+	return cloneKey(k), nil
+}
+
+// sameParent reports whether a and b have the same kind, parent and
+// namespace.
+func sameParent(a, b *datastore.Key) bool {
+	return a.Kind == b.Kind && a.Namespace == b.Namespace && a.Parent.Equal(b.Parent)
+}
+
+// transaction adapts a client transaction to Tx.
+type transaction struct {
+	t        *datastore.Transaction
+	readOnly bool
+	ids      *txIDs
+}
+
+func (t *transaction) Get(key *datastore.Key, dst interface{}) error {
+	return wrapError(t.t.Get(key, dst))
+}
+
+func (t *transaction) Put(key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	if t.readOnly {
+		return nil, ErrReadOnlyTransaction
+	}
+	if !validKey(key) {
+		return nil, errInvalidKey
+	}
+	key, err := t.ids.complete(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := t.t.Put(key, src); err != nil {
+		return nil, wrapError(err)
+	}
+	return key, nil
+}
+
+func (t *transaction) Delete(key *datastore.Key) error {
+	if t.readOnly {
+		return ErrReadOnlyTransaction
+	}
+	return wrapError(t.t.Delete(key))
+}
@@ -0,0 +1,162 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type TransactionTestSuite struct {
+	suite.Suite
+	newDriver func(t *testing.T) Driver
+	d         Driver
+	ctx       context.Context
+	key       *datastore.Key
+}
+
+func TestTransactionTestSuite(t *testing.T) {
+	forEachDriver(t, func(newDriver func(*testing.T) Driver) suite.TestingSuite {
+		return &TransactionTestSuite{newDriver: newDriver}
+	})
+}
+
+func (s *TransactionTestSuite) SetupTest() {
+	s.d = s.newDriver(s.T())
+	s.ctx = context.Background()
+	s.key = datastore.NameKey("Animal", "cat", nil)
+	s.Require().NoError(s.d.Update(s.ctx, s.key, &Animal{Name: "cat", Legs: 4}))
+}
+
+func (s *TransactionTestSuite) legs() int {
+	var a Animal
+	s.Require().NoError(s.d.Get(s.ctx, s.key, &a))
+	return a.Legs
+}
+
+func (s *TransactionTestSuite) TestCommit() {
+	var kitten *datastore.Key
+	err := s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		var a Animal
+		if err := tx.Get(s.key, &a); err != nil {
+			return err
+		}
+		a.Legs++
+		k, err := tx.Put(s.key, &a)
+		if err != nil {
+			return err
+		}
+		if !k.Equal(s.key) {
+			return fmt.Errorf("put %v, got %v", s.key, k)
+		}
+		kitten, err = tx.Put(datastore.IncompleteKey("Animal", nil), &Animal{Name: "kitten"})
+		return err
+	})
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 5, s.legs())
+
+	s.Require().False(kitten.Incomplete(), "Put returns the complete key")
+	var a Animal
+	s.Require().NoError(s.d.Get(s.ctx, kitten, &a))
+	assert.Equal(s.T(), "kitten", a.Name)
+	ids, err := s.d.FindIds(s.ctx, NewQuery("Animal"))
+	assert.NoError(s.T(), err)
+	assert.Len(s.T(), ids, 2)
+}
+
+func (s *TransactionTestSuite) TestRollback() {
+	boom := errors.New("boom")
+	err := s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		if err := tx.Delete(s.key); err != nil {
+			return err
+		}
+		return boom
+	})
+	assert.Equal(s.T(), boom, err)
+	assert.Equal(s.T(), 4, s.legs())
+}
+
+func (s *TransactionTestSuite) TestRetryOnContention() {
+	attempts := 0
+	err := s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		attempts++
+		var a Animal
+		if err := tx.Get(s.key, &a); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			// A concurrent writer changes the entity after it was read.
+			if err := s.d.Update(s.ctx, s.key, &Animal{Name: "cat", Legs: 10}); err != nil {
+				return err
+			}
+		}
+		a.Legs++
+		_, err := tx.Put(s.key, &a)
+		return err
+	})
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 2, attempts)
+	assert.Equal(s.T(), 11, s.legs())
+}
+
+func (s *TransactionTestSuite) TestIncompleteKeyRetried() {
+	var keys []*datastore.Key
+	err := s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		var a Animal
+		if err := tx.Get(s.key, &a); err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			if err := s.d.Update(s.ctx, s.key, &a); err != nil {
+				return err
+			}
+		}
+		k, err := tx.Put(datastore.IncompleteKey("Animal", nil), &Animal{Name: "kitten"})
+		keys = append(keys, k)
+		return err
+	})
+	s.Require().NoError(err)
+	s.Require().Len(keys, 2)
+	assert.Equal(s.T(), keys[0], keys[1], "the retry reuses the allocated ID")
+
+	next, err := s.d.AllocateIDs(s.ctx, []*datastore.Key{datastore.IncompleteKey("Animal", nil)})
+	s.Require().NoError(err)
+	assert.NotEqual(s.T(), keys[0].ID, next[0].ID)
+}
+
+func (s *TransactionTestSuite) TestMaxAttempts() {
+	attempts := 0
+	err := s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		attempts++
+		var a Animal
+		if err := tx.Get(s.key, &a); err != nil {
+			return err
+		}
+		if err := s.d.Update(s.ctx, s.key, &a); err != nil {
+			return err
+		}
+		_, err := tx.Put(s.key, &a)
+		return err
+	}, TxMaxAttempts(2))
+	assert.ErrorIs(s.T(), err, datastore.ErrConcurrentTransaction)
+	assert.ErrorIs(s.T(), err, ErrConflict)
+	assert.Equal(s.T(), 2, attempts)
+}
+
+func (s *TransactionTestSuite) TestReadOnly() {
+	err := s.d.RunInTransaction(s.ctx, func(tx Tx) error {
+		var a Animal
+		if err := tx.Get(s.key, &a); err != nil {
+			return err
+		}
+		_, err := tx.Put(s.key, &a)
+		assert.Equal(s.T(), ErrReadOnlyTransaction, err)
+		assert.Equal(s.T(), ErrReadOnlyTransaction, tx.Delete(s.key))
+		return nil
+	}, TxReadOnly())
+	assert.NoError(s.T(), err)
+}
@@ -0,0 +1,310 @@
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// FieldError reports a field breaking one of its validation rules.
+type FieldError struct {
+	// Field is the path of the field in the entity, such as Diet.Food or
+	// Tags[2].
+	Field string
+	// Rule is the rule as written in the tag, such as required or min=1.
+	Rule    string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Field + " " + e.Message
+}
+
+// ValidationError lists the fields of an entity breaking their rules.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Error()
+	}
+	return "invalid entity: " + strings.Join(msgs, "; ")
+}
+
+// ValidateEntity checks the fields of v, a struct or a struct pointer,
+// against the rules of their validate tags, nested structs and slices of
+// structs included. Rules are separated by commas:
+//
+//	required       the field is not its zero value
+//	min=N, max=N   bounds of a number, or of the length of a string, slice
+//	               or map
+//	enum=A|B|C     the value, or every element of a slice, is one of these
+//	regex=RE       the string, or every string of a slice, matches RE; the
+//	               pattern runs to the end of the tag, so regex comes last
+//
+// Rules other than required pass on empty strings, slices and maps, leaving
+// optional fields free to be empty; numbers are checked even when zero.
+// ValidateEntity returns nil, a *ValidationError listing every field
+// breaking a rule, or an error for a malformed tag, all of them classified
+// as ErrInvalidArgument. Values other than structs have no rules.
+func ValidateEntity(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+	var fields []FieldError
+	if err := validateStruct(rv, "", &fields); err != nil {
+		return invalidArgument(err)
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return invalidArgument(&ValidationError{Fields: fields})
+}
+
+func validateStruct(v reflect.Value, path string, errs *[]FieldError) error {
+	plan := planOf(v.Type())
+	if plan.err != nil {
+		return plan.err
+	}
+	for _, f := range plan.fields {
+		fv := v.Field(f.index)
+		name := path + f.name
+		for _, r := range f.rules {
+			if err := r.check(fv, name, errs); err != nil {
+				return fmt.Errorf("invalid validate tag of %s.%s: %w", v.Type(), f.name, err)
+			}
+		}
+		if f.nested {
+			if err := validateNested(fv, name, errs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateNested(v reflect.Value, path string, errs *[]FieldError) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return validateNested(v.Elem(), path, errs)
+	case reflect.Struct:
+		return validateStruct(v, path+".", errs)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := validateNested(v.Index(i), fmt.Sprintf("%s[%d]", path, i), errs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// typePlan lists the fields of a struct type to validate.
+type typePlan struct {
+	fields []fieldPlan
+	err    error
+}
+
+type fieldPlan struct {
+	index  int
+	name   string
+	rules  []rule
+	nested bool
+}
+
+var typePlans sync.Map // of reflect.Type to *typePlan
+
+func planOf(t reflect.Type) *typePlan {
+	if p, ok := typePlans.Load(t); ok {
+		return p.(*typePlan)
+	}
+	p := &typePlan{}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() || sf.Tag.Get("datastore") == "-" {
+			continue
+		}
+		f := fieldPlan{index: i, name: sf.Name, nested: hasNestedStructs(sf.Type)}
+		if tag := sf.Tag.Get("validate"); tag != "" {
+			var err error
+			if f.rules, err = parseRules(tag); err != nil {
+				p.err = fmt.Errorf("invalid validate tag of %s.%s: %w", t, sf.Name, err)
+				break
+			}
+		}
+		if len(f.rules) > 0 || f.nested {
+			p.fields = append(p.fields, f)
+		}
+	}
+	actual, _ := typePlans.LoadOrStore(t, p)
+	return actual.(*typePlan)
+}
+
+var timeStructType = reflect.TypeOf(time.Time{})
+
+// hasNestedStructs reports whether values of t hold structs to validate.
+func hasNestedStructs(t reflect.Type) bool {
+	for {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Array:
+			t = t.Elem()
+		case reflect.Struct:
+			return t != timeStructType
+		default:
+			return false
+		}
+	}
+}
+
+// rule is a parsed validation rule.
+type rule struct {
+	name  string
+	text  string
+	bound float64
+	enum  []string
+	re    *regexp.Regexp
+}
+
+func parseRules(tag string) ([]rule, error) {
+	var rules []rule
+	for tag != "" {
+		var text string
+		if i := strings.IndexByte(tag, ','); i >= 0 && !strings.HasPrefix(strings.TrimSpace(tag), "regex=") {
+			text, tag = strings.TrimSpace(tag[:i]), tag[i+1:]
+		} else {
+			text, tag = strings.TrimSpace(tag), ""
+		}
+		name, arg, hasArg := strings.Cut(text, "=")
+		r := rule{name: name, text: text}
+		switch {
+		case name == "required" && !hasArg:
+		case (name == "min" || name == "max") && hasArg:
+			bound, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %w", text, err)
+			}
+			r.bound = bound
+		case name == "enum" && hasArg:
+			r.enum = strings.Split(arg, "|")
+		case name == "regex" && hasArg:
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %w", text, err)
+			}
+			r.re = re
+		default:
+			return nil, fmt.Errorf("unknown rule %q", text)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// check appends to errs the ways v, at path, breaks r. It fails when r does
+// not apply to the type of v.
+func (r rule) check(v reflect.Value, path string, errs *[]FieldError) error {
+	if r.name == "required" {
+		if v.IsZero() {
+			*errs = append(*errs, FieldError{Field: path, Rule: r.text, Message: "is required"})
+		}
+		return nil
+	}
+	if isEmpty(v) {
+		return nil
+	}
+
+	switch r.name {
+	case "min", "max":
+		n, what := 0.0, ""
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n = float64(v.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n = float64(v.Uint())
+		case reflect.Float32, reflect.Float64:
+			n = v.Float()
+		case reflect.String:
+			n, what = float64(utf8.RuneCountInString(v.String())), "length "
+		case reflect.Slice, reflect.Array, reflect.Map:
+			n, what = float64(v.Len()), "length "
+		default:
+			return fmt.Errorf("rule %s does not apply to %s", r.text, v.Type())
+		}
+		bound := strconv.FormatFloat(r.bound, 'g', -1, 64)
+		switch {
+		case r.name == "min" && n < r.bound:
+			*errs = append(*errs, FieldError{Field: path, Rule: r.text, Message: what + "must be at least " + bound})
+		case r.name == "max" && n > r.bound:
+			*errs = append(*errs, FieldError{Field: path, Rule: r.text, Message: what + "must be at most " + bound})
+		}
+		return nil
+	}
+
+	if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+		for i := 0; i < v.Len(); i++ {
+			if err := r.checkValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), errs); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return r.checkValue(v, path, errs)
+}
+
+// isEmpty reports whether v is an empty string, slice or map.
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return false
+}
+
+// checkValue checks a single value against an enum or regex rule.
+func (r rule) checkValue(v reflect.Value, path string, errs *[]FieldError) error {
+	if r.name == "regex" {
+		if v.Kind() != reflect.String {
+			return fmt.Errorf("rule %s does not apply to %s", r.text, v.Type())
+		}
+		if !r.re.MatchString(v.String()) {
+			*errs = append(*errs, FieldError{Field: path, Rule: r.text, Message: "must match " + r.re.String()})
+		}
+		return nil
+	}
+
+	var s string
+	switch v.Kind() {
+	case reflect.String:
+		s = v.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		s = strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		s = strconv.FormatUint(v.Uint(), 10)
+	default:
+		return fmt.Errorf("rule %s does not apply to %s", r.text, v.Type())
+	}
+	for _, e := range r.enum {
+		if s == e {
+			return nil
+		}
+	}
+	*errs = append(*errs, FieldError{Field: path, Rule: r.text, Message: "must be one of " + strings.Join(r.enum, ", ")})
+	return nil
+}
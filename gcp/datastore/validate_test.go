@@ -0,0 +1,122 @@
+package datastore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type validatedDiet struct {
+	Food  string `validate:"required"`
+	Meals int    `validate:"min=1,max=5"`
+}
+
+type validatedAnimal struct {
+	Name    string    `validate:"required,min=2,max=10"`
+	Legs    int       `validate:"max=8"`
+	Weight  float64   `validate:"min=0.5"`
+	Color   string    `validate:"enum=red|green|blue"`
+	Code    string    `validate:"regex=^[A-Z]{2},[0-9]+$"`
+	Tags    []string  `validate:"max=2,enum=small|furry|loud"`
+	Born    time.Time `validate:"required"`
+	Diet    validatedDiet
+	Friends []*validatedDiet
+	Ignored string `datastore:"-" validate:"required"`
+	private string
+}
+
+func TestValidateEntity(t *testing.T) {
+	valid := validatedAnimal{
+		Name:    "cat",
+		Legs:    4,
+		Weight:  2.5,
+		Color:   "red",
+		Code:    "AB,12",
+		Tags:    []string{"small"},
+		Born:    time.Now(),
+		Diet:    validatedDiet{Food: "fish", Meals: 3},
+		Friends: []*validatedDiet{nil, {Food: "meat", Meals: 1}},
+	}
+	assert.NoError(t, ValidateEntity(&valid))
+	assert.NoError(t, ValidateEntity(valid), "structs are validated by value too")
+	assert.NoError(t, ValidateEntity(&Animal{}), "no rules")
+	assert.NoError(t, ValidateEntity((*validatedAnimal)(nil)))
+	assert.NoError(t, ValidateEntity(42))
+
+	invalid := validatedAnimal{
+		Name:    "a very long name",
+		Legs:    10,
+		Weight:  0.1,
+		Color:   "pink",
+		Code:    "ab,12",
+		Tags:    []string{"small", "fierce", "loud"},
+		Diet:    validatedDiet{Meals: 6},
+		Friends: []*validatedDiet{{Food: "fish", Meals: -1}},
+	}
+	err := ValidateEntity(&invalid)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+	var verr *ValidationError
+	require.True(t, errors.As(err, &verr))
+	assert.Equal(t, []FieldError{
+		{Field: "Name", Rule: "max=10", Message: "length must be at most 10"},
+		{Field: "Legs", Rule: "max=8", Message: "must be at most 8"},
+		{Field: "Weight", Rule: "min=0.5", Message: "must be at least 0.5"},
+		{Field: "Color", Rule: "enum=red|green|blue", Message: "must be one of red, green, blue"},
+		{Field: "Code", Rule: "regex=^[A-Z]{2},[0-9]+$", Message: "must match ^[A-Z]{2},[0-9]+$"},
+		{Field: "Tags", Rule: "max=2", Message: "length must be at most 2"},
+		{Field: "Tags[1]", Rule: "enum=small|furry|loud", Message: "must be one of small, furry, loud"},
+		{Field: "Born", Rule: "required", Message: "is required"},
+		{Field: "Diet.Food", Rule: "required", Message: "is required"},
+		{Field: "Diet.Meals", Rule: "max=5", Message: "must be at most 5"},
+		{Field: "Friends[0].Meals", Rule: "min=1", Message: "must be at least 1"},
+	}, verr.Fields)
+	assert.Contains(t, err.Error(), "invalid entity: Name length must be at most 10; Legs must be at most 8;")
+}
+
+func TestValidateEntityZeroValues(t *testing.T) {
+	err := ValidateEntity(&struct {
+		Meals  int            `validate:"min=2"`
+		Debt   float64        `validate:"max=-1"`
+		Size   int            `validate:"enum=1|2"`
+		Nick   string         `validate:"min=2,enum=a|b,regex=^x$"`
+		Tags   []string       `validate:"min=1"`
+		Scores map[string]int `validate:"min=1"`
+	}{})
+	var verr *ValidationError
+	require.True(t, errors.As(err, &verr))
+	assert.Equal(t, []FieldError{
+		{Field: "Meals", Rule: "min=2", Message: "must be at least 2"},
+		{Field: "Debt", Rule: "max=-1", Message: "must be at most -1"},
+		{Field: "Size", Rule: "enum=1|2", Message: "must be one of 1, 2"},
+	}, verr.Fields, "zero numbers are checked, empty strings, slices and maps are not")
+}
+
+func TestValidateEntityTags(t *testing.T) {
+	for _, v := range []interface{}{
+		&struct {
+			A string `validate:"bogus"`
+		}{},
+		&struct {
+			A int `validate:"min=x"`
+		}{},
+		&struct {
+			A string `validate:"regex=("`
+		}{},
+		&struct {
+			A string `validate:"required=yes"`
+		}{},
+		&struct {
+			A bool `validate:"max=1"`
+		}{A: true},
+		&struct {
+			A float64 `validate:"enum=1|2"`
+		}{A: 1},
+	} {
+		err := ValidateEntity(v)
+		assert.ErrorIs(t, err, ErrInvalidArgument, "%T", v)
+		assert.ErrorContains(t, err, "invalid validate tag", "%T", v)
+	}
+}
@@ -0,0 +1,65 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"cloud.google.com/go/datastore"
+)
+
+// ErrVersionConflict is returned by UpdateVersioned when the stored entity
+// changed since the caller read it. The caller should reload and retry.
+var ErrVersionConflict error = &Error{Kind: ErrConflict, Err: errors.New("version conflict: the entity was modified concurrently")}
+
+// Versioned is implemented by entities that carry a version, typically a
+// Version field saved with the entity. A new entity has version zero and
+// every versioned update increments it.
+type Versioned interface {
+	GetVersion() int64
+	SetVersion(version int64)
+}
+
+func (d *driver) UpdateVersioned(ctx context.Context, key *datastore.Key, data Versioned) error {
+	return updateVersioned(ctx, d, key, data)
+}
+
+// updateVersioned stores data under key in a transaction, provided the
+// version of the stored entity is still the version of data. A zero version
+// expects no stored entity. On success data holds its new version.
+func updateVersioned(ctx context.Context, d Driver, key *datastore.Key, data Versioned) error {
+	if data == nil {
+		return invalidArgument(fmt.Errorf("%w: versioned entity is nil", datastore.ErrInvalidEntityType))
+	}
+	t := reflect.TypeOf(data)
+	if t.Kind() != reflect.Ptr {
+		return invalidArgument(fmt.Errorf("%w: versioned entity must be a pointer, got %T", datastore.ErrInvalidEntityType, data))
+	}
+	if reflect.ValueOf(data).IsNil() {
+		return invalidArgument(fmt.Errorf("%w: versioned entity is a nil %T", datastore.ErrInvalidEntityType, data))
+	}
+
+	expected := data.GetVersion()
+	err := d.RunInTransaction(ctx, func(tx Tx) error {
+		stored := reflect.New(t.Elem()).Interface().(Versioned)
+		switch err := tx.Get(key, stored); {
+		case errors.Is(err, datastore.ErrNoSuchEntity):
+			if expected != 0 {
+				return ErrVersionConflict
+			}
+		case err != nil:
+			return err
+		case stored.GetVersion() != expected:
+			return ErrVersionConflict
+		}
+
+		data.SetVersion(expected + 1)
+		_, err := tx.Put(key, data)
+		return err
+	})
+	if err != nil {
+		data.SetVersion(expected)
+	}
+	return err
+}
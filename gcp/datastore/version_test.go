@@ -0,0 +1,85 @@
+package datastore
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type Document struct {
+	Title   string
+	Version int64
+}
+
+func (d *Document) GetVersion() int64        { return d.Version }
+func (d *Document) SetVersion(version int64) { d.Version = version }
+
+type VersionTestSuite struct {
+	suite.Suite
+	newDriver func(t *testing.T) Driver
+	d         Driver
+	ctx       context.Context
+	key       *datastore.Key
+}
+
+func TestVersionTestSuite(t *testing.T) {
+	forEachDriver(t, func(newDriver func(*testing.T) Driver) suite.TestingSuite {
+		return &VersionTestSuite{newDriver: newDriver}
+	})
+}
+
+func (s *VersionTestSuite) SetupTest() {
+	s.d = s.newDriver(s.T())
+	s.ctx = context.Background()
+	s.key = datastore.NameKey("Document", "readme", nil)
+}
+
+func (s *VersionTestSuite) stored() Document {
+	var doc Document
+	s.Require().NoError(s.d.Get(s.ctx, s.key, &doc))
+	return doc
+}
+
+func (s *VersionTestSuite) TestUpdate() {
+	doc := &Document{Title: "draft"}
+	s.Require().NoError(s.d.UpdateVersioned(s.ctx, s.key, doc))
+	assert.Equal(s.T(), int64(1), doc.Version)
+
+	doc.Title = "final"
+	s.Require().NoError(s.d.UpdateVersioned(s.ctx, s.key, doc))
+	assert.Equal(s.T(), int64(2), doc.Version)
+	assert.Equal(s.T(), Document{Title: "final", Version: 2}, s.stored())
+}
+
+func (s *VersionTestSuite) TestConflict() {
+	s.Require().NoError(s.d.UpdateVersioned(s.ctx, s.key, &Document{Title: "draft"}))
+
+	// Two writers read version 1; the second one to write loses.
+	first, second := s.stored(), s.stored()
+	first.Title = "first"
+	s.Require().NoError(s.d.UpdateVersioned(s.ctx, s.key, &first))
+
+	second.Title = "second"
+	assert.Equal(s.T(), ErrVersionConflict, s.d.UpdateVersioned(s.ctx, s.key, &second))
+	assert.Equal(s.T(), int64(1), second.Version, "a failed update keeps the version read")
+	assert.Equal(s.T(), Document{Title: "first", Version: 2}, s.stored())
+
+	// A new entity conflicts with a stored one, and a deleted entity with
+	// any version.
+	assert.Equal(s.T(), ErrVersionConflict, s.d.UpdateVersioned(s.ctx, s.key, &Document{Title: "new"}))
+	s.Require().NoError(s.d.Delete(s.ctx, s.key))
+	assert.Equal(s.T(), ErrVersionConflict, s.d.UpdateVersioned(s.ctx, s.key, &first))
+}
+
+func (s *VersionTestSuite) TestInvalidKey() {
+	err := s.d.UpdateVersioned(s.ctx, datastore.IncompleteKey("Document", nil), &Document{})
+	assert.Error(s.T(), err)
+}
+
+func (s *VersionTestSuite) TestNilEntity() {
+	assert.ErrorIs(s.T(), s.d.UpdateVersioned(s.ctx, s.key, nil), ErrInvalidArgument)
+	assert.ErrorIs(s.T(), s.d.UpdateVersioned(s.ctx, s.key, (*Document)(nil)), ErrInvalidArgument)
+}